@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// BlobAttrs is the subset of object attributes the ingest path needs.
+type BlobAttrs struct {
+	Name string
+	Size int64
+}
+
+// BlobStore is the object storage uploads are read from during ingest.
+// Production uses GCS; a local directory tree stands in for it in
+// benchmarks and tools.
+type BlobStore interface {
+	// List returns all objects in bucket whose names start with prefix.
+	List(ctx context.Context, bucket, prefix string) ([]BlobAttrs, error)
+	// ReadRange reads up to length bytes starting at offset. length < 0
+	// reads to the end of the object.
+	ReadRange(ctx context.Context, bucket, name string, offset, length int64) ([]byte, error)
+}
+
+// gcsBlobStore reads objects from Google Cloud Storage.
+type gcsBlobStore struct {
+	client *storage.Client
+}
+
+func (s gcsBlobStore) List(ctx context.Context, bucket, prefix string) ([]BlobAttrs, error) {
+	it := s.client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	var res []BlobAttrs
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, BlobAttrs{Name: attrs.Name, Size: attrs.Size})
+	}
+	return res, nil
+}
+
+func (s gcsBlobStore) ReadRange(ctx context.Context, bucket, name string, offset, length int64) ([]byte, error) {
+	rc, err := s.client.Bucket(bucket).Object(name).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// localBlobStore maps buckets to directories under root and object names to
+// slash-separated paths within them.
+type localBlobStore struct {
+	root string
+}
+
+func (s localBlobStore) List(ctx context.Context, bucket, prefix string) ([]BlobAttrs, error) {
+	dir := filepath.Join(s.root, bucket)
+	var res []BlobAttrs
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		res = append(res, BlobAttrs{Name: name, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s/%s: %w", bucket, prefix, err)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (s localBlobStore) ReadRange(ctx context.Context, bucket, name string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(filepath.Join(s.root, bucket, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	if length >= 0 {
+		r = io.LimitReader(f, length)
+	}
+	return io.ReadAll(r)
+}
+
+// blobStore returns the configured blob store, defaulting to GCS.
+func (h *Handlers) blobStore() BlobStore {
+	if h.Blobs != nil {
+		return h.Blobs
+	}
+	if h.Storage != nil {
+		return gcsBlobStore{client: h.Storage}
+	}
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	secretmanagerpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
@@ -24,6 +26,84 @@ type Config struct {
 	HealthcareLocation  string // e.g. "us-central1"
 	HealthcareDatasetID string // "vv-dataset-1"
 	HealthcareStoreID   string // "vv-dicom"
+
+	// QuarantinePrefix is the object prefix (in ImagingBucket) where uploads
+	// that fail pre-import validation are moved, e.g. "quarantine".
+	QuarantinePrefix string
+
+	// Default upload quotas; 0 means unlimited. Individual accounts and
+	// provider organizations can override these on their usage document.
+	AccountQuota     QuotaLimits
+	ProviderOrgQuota QuotaLimits
+
+	// IngestWorkers is the number of in-process ingest workers (0 disables
+	// them, e.g. when another instance runs the workers). IngestMaxAttempts
+	// caps retries per ingest job.
+	IngestWorkers     int
+	IngestMaxAttempts int
+
+	// IndexWorkers is the number of in-process longitudinal index workers
+	// (0 disables them). IndexMaxAttempts caps retries per index job.
+	IndexWorkers     int
+	IndexMaxAttempts int
+
+	// RegistrationWorkers is the number of in-process registration workers
+	// (0 disables them). RegistrationMaxAttempts caps retries per job.
+	RegistrationWorkers     int
+	RegistrationMaxAttempts int
+
+	// AutoIndexOnIngest queues longitudinal indexing for every study an
+	// ingest creates or adds instances to.
+	AutoIndexOnIngest bool
+
+	// IngestMode selects how validated uploads reach the DICOM store:
+	// "import" (Healthcare bulk import, default) or "stow" (per-instance
+	// STOW-RS with StowConcurrency requests in flight). StowURL points STOW
+	// at a non-Google DICOMweb server; empty uses the Healthcare store.
+	IngestMode      string
+	StowConcurrency int
+	StowURL         string
+	StowBearer      string
+
+	// HeaderScanWorkers bounds concurrent header fetch+parse when building
+	// studies from an upload.
+	HeaderScanWorkers int
+
+	// DeidOnIngest de-identifies validated uploads with DeidProfile before
+	// they reach the DICOM store; the de-identified copies are written under
+	// DeidPrefix/{session_id}/ in the upload bucket and the originals are
+	// left in place. DeidProfile is also the default for exports.
+	DeidOnIngest bool
+	DeidProfile  DeidProfile
+	DeidPrefix   string
+
+	// AdminUserIDs may use the /api/admin endpoints (e.g. to inspect and
+	// re-queue dead-lettered ingests).
+	AdminUserIDs []string
+
+	// Pub/Sub push authentication. Push requests must carry a Google-signed
+	// OIDC token for PubSubPushAudience issued to PubSubPushServiceAccount;
+	// both are required unless PubSubPushInsecure is set for local dev, which
+	// turns push authentication off.
+	PubSubPushAudience       string
+	PubSubPushServiceAccount string
+	PubSubPushInsecure       bool
+
+	// InternalAddr, if set (e.g. ":8081"), serves /internal/ routes on a
+	// separate listener instead of the public one.
+	InternalAddr string
+}
+
+// validatePubSubPush reports a missing push audience or service account,
+// unless push authentication is explicitly turned off.
+func (c Config) validatePubSubPush() error {
+	if c.PubSubPushInsecure {
+		return nil
+	}
+	if c.PubSubPushAudience == "" || c.PubSubPushServiceAccount == "" {
+		return fmt.Errorf("VISIT_VIZOR_PUBSUB_PUSH_AUDIENCE and VISIT_VIZOR_PUBSUB_PUSH_SERVICE_ACCOUNT are required (set VISIT_VIZOR_PUBSUB_PUSH_INSECURE=true to run without push authentication)")
+	}
+	return nil
 }
 
 // serviceAccountCreds is a minimal view of a GCP service account JSON key.
@@ -75,6 +155,33 @@ func loadUploadManagerCreds(ctx context.Context, projectID string) (string, stri
 	return creds.ClientEmail, creds.PrivateKey
 }
 
+// envInt64 reads an integer environment variable, returning def when it is
+// unset or malformed.
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("LoadConfig: invalid %s=%q: %v", name, v, err)
+		return def
+	}
+	return n
+}
+
+// envList reads a comma-separated environment variable, dropping empty
+// entries.
+func envList(name string) []string {
+	var res []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 // LoadConfig reads configuration from environment variables, using
 // the same names as the Python service where it makes sense, so
 // deployment/env setup can be reused.
@@ -95,9 +202,6 @@ func LoadConfig() Config {
 
 	ctx := context.Background()
 	signedEmail, signedKey := loadUploadManagerCreds(ctx, projectID)
-	
-	fmt.Sprintf("DEBUG: signedEmail = %v", signedEmail)
-	fmt.Sprintf("DEBUG: signedKey = %v", signedKey)
 
 	healthLoc := os.Getenv("VISIT_VIZOR_HEALTHCARE_LOCATION")
 	if healthLoc == "" {
@@ -114,6 +218,31 @@ func LoadConfig() Config {
 		store = "vv-dicom"
 	}
 
+	quarantinePrefix := os.Getenv("VISIT_VIZOR_QUARANTINE_PREFIX")
+	if quarantinePrefix == "" {
+		quarantinePrefix = "quarantine"
+	}
+
+	deidPrefix := os.Getenv("VISIT_VIZOR_DEID_PREFIX")
+	if deidPrefix == "" {
+		deidPrefix = "deidentified"
+	}
+	var deidProfile DeidProfile
+	for _, opt := range envList("VISIT_VIZOR_DEID_OPTIONS") {
+		switch opt {
+		case "retain_dates":
+			deidProfile.RetainLongitudinalDates = true
+		case "retain_uids":
+			deidProfile.RetainUIDs = true
+		default:
+			log.Printf("LoadConfig: unknown VISIT_VIZOR_DEID_OPTIONS entry %q", opt)
+		}
+	}
+
+	ingestMode := os.Getenv("VISIT_VIZOR_INGEST_MODE")
+	if ingestMode == "" {
+		ingestMode = IngestModeImport
+	}
 
 	return Config{
 		ProjectID:     projectID,
@@ -126,5 +255,47 @@ func LoadConfig() Config {
 		HealthcareLocation:  healthLoc,    // us-central1
 		HealthcareDatasetID: dataset, // "vv-dataset-1"
 		HealthcareStoreID:   store,   // "vv-dicom"
+
+		QuarantinePrefix: quarantinePrefix,
+
+		AccountQuota: QuotaLimits{
+			MaxBytes:          envInt64("VISIT_VIZOR_QUOTA_ACCOUNT_MAX_BYTES", 50<<30),
+			MaxStudies:        envInt64("VISIT_VIZOR_QUOTA_ACCOUNT_MAX_STUDIES", 500),
+			MaxSessionsPerDay: envInt64("VISIT_VIZOR_QUOTA_ACCOUNT_MAX_SESSIONS_PER_DAY", 20),
+		},
+		ProviderOrgQuota: QuotaLimits{
+			MaxBytes:          envInt64("VISIT_VIZOR_QUOTA_PROVIDER_MAX_BYTES", 0),
+			MaxStudies:        envInt64("VISIT_VIZOR_QUOTA_PROVIDER_MAX_STUDIES", 0),
+			MaxSessionsPerDay: envInt64("VISIT_VIZOR_QUOTA_PROVIDER_MAX_SESSIONS_PER_DAY", 200),
+		},
+
+		IngestWorkers:     int(envInt64("VISIT_VIZOR_INGEST_WORKERS", 2)),
+		IngestMaxAttempts: int(envInt64("VISIT_VIZOR_INGEST_MAX_ATTEMPTS", 5)),
+
+		IndexWorkers:     int(envInt64("VISIT_VIZOR_INDEX_WORKERS", 1)),
+		IndexMaxAttempts: int(envInt64("VISIT_VIZOR_INDEX_MAX_ATTEMPTS", 3)),
+
+		RegistrationWorkers:     int(envInt64("VISIT_VIZOR_REGISTRATION_WORKERS", 1)),
+		RegistrationMaxAttempts: int(envInt64("VISIT_VIZOR_REGISTRATION_MAX_ATTEMPTS", 3)),
+
+		AutoIndexOnIngest: os.Getenv("VISIT_VIZOR_AUTO_INDEX_ON_INGEST") == "true",
+
+		IngestMode:      ingestMode,
+		StowConcurrency: int(envInt64("VISIT_VIZOR_STOW_CONCURRENCY", 8)),
+		StowURL:         os.Getenv("VISIT_VIZOR_STOW_URL"),
+		StowBearer:      os.Getenv("VISIT_VIZOR_STOW_BEARER"),
+
+		HeaderScanWorkers: int(envInt64("VISIT_VIZOR_HEADER_SCAN_WORKERS", 16)),
+
+		DeidOnIngest: os.Getenv("VISIT_VIZOR_DEID_ON_INGEST") == "true",
+		DeidProfile:  deidProfile,
+		DeidPrefix:   deidPrefix,
+
+		AdminUserIDs: envList("VISIT_VIZOR_ADMIN_UIDS"),
+
+		PubSubPushAudience:       os.Getenv("VISIT_VIZOR_PUBSUB_PUSH_AUDIENCE"),
+		PubSubPushServiceAccount: os.Getenv("VISIT_VIZOR_PUBSUB_PUSH_SERVICE_ACCOUNT"),
+		PubSubPushInsecure:       os.Getenv("VISIT_VIZOR_PUBSUB_PUSH_INSECURE") == "true",
+		InternalAddr:             os.Getenv("VISIT_VIZOR_INTERNAL_ADDR"),
 	}
 }
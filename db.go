@@ -13,6 +13,9 @@ import (
 // operations we need for auth/accounts, mirroring htmlery_rest/db.py.
 type FirestoreDB struct {
 	client *firestore.Client
+
+	// sliceIndex caches per-study slice indexes for resolve-point.
+	sliceIndex *sliceIndexCache
 }
 
 // NewFirestoreDB creates a new Firestore client for the given project ID.
@@ -21,7 +24,7 @@ func NewFirestoreDB(ctx context.Context, projectID string) (*FirestoreDB, error)
 	if err != nil {
 		return nil, fmt.Errorf("firestore.NewClient: %w", err)
 	}
-	return &FirestoreDB{client: client}, nil
+	return &FirestoreDB{client: client, sliceIndex: newSliceIndexCache()}, nil
 }
 
 // Close releases underlying Firestore resources.
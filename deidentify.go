@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// DeidProfile selects the PS3.15 Basic Application Level Confidentiality
+// Profile plus the options our research partners ask for.
+type DeidProfile struct {
+	// RetainLongitudinalDates keeps dates and times unmodified (PS3.15
+	// Retain Longitudinal Temporal Information with Full Dates Option), so
+	// studies of the same patient can still be ordered and compared.
+	RetainLongitudinalDates bool `firestore:"retain_longitudinal_dates" json:"retain_longitudinal_dates"`
+	// RetainUIDs keeps the original UIDs (Retain UIDs Option). Without it
+	// every UID is replaced through the per-patient mapping.
+	RetainUIDs bool `firestore:"retain_uids" json:"retain_uids"`
+}
+
+// Deidentification actions from PS3.15 Table E.1-1.
+const (
+	deidRemove = 'X' // remove the attribute
+	deidZero   = 'Z' // replace with a zero-length value
+	deidDummy  = 'D' // replace with a consistent pseudonym
+	deidUID    = 'U' // replace with a remapped UID
+)
+
+// deidAction is the basic-profile action for one attribute. Temporal marks
+// dates and times that the retain-longitudinal-dates option keeps.
+type deidAction struct {
+	action   byte
+	temporal bool
+}
+
+// deidActions holds the PS3.15 Table E.1-1 actions that keep an attribute in
+// some form, plus removals spelled out for attributes that are commonly
+// present. Anything not listed here or in deidRetain is removed, so the
+// table does not need to be complete to be safe. UIDs are handled by VR in
+// deidentifyElements rather than listed.
+var deidActions = map[tag.Tag]deidAction{
+	// Patient identification; name and ID become a per-patient pseudonym.
+	tag.PatientName:                 {action: deidDummy},
+	tag.PatientID:                   {action: deidDummy},
+	tag.IssuerOfPatientID:           {action: deidRemove},
+	tag.PatientBirthDate:            {action: deidZero},
+	tag.PatientBirthTime:            {action: deidRemove},
+	tag.PatientBirthName:            {action: deidRemove},
+	tag.PatientSex:                  {action: deidZero},
+	tag.PatientAge:                  {action: deidRemove},
+	tag.PatientSize:                 {action: deidRemove},
+	tag.PatientWeight:               {action: deidRemove},
+	tag.PatientAddress:              {action: deidRemove},
+	tag.PatientMotherBirthName:      {action: deidRemove},
+	tag.PatientTelephoneNumbers:     {action: deidRemove},
+	tag.OtherPatientIDs:             {action: deidRemove},
+	tag.OtherPatientIDsSequence:     {action: deidRemove},
+	tag.OtherPatientNames:           {action: deidRemove},
+	tag.MilitaryRank:                {action: deidRemove},
+	tag.EthnicGroup:                 {action: deidRemove},
+	tag.Occupation:                  {action: deidRemove},
+	tag.AdditionalPatientHistory:    {action: deidRemove},
+	tag.PatientComments:             {action: deidRemove},
+	tag.PatientState:                {action: deidRemove},
+	tag.MedicalRecordLocator:        {action: deidRemove},
+	tag.CurrentPatientLocation:      {action: deidRemove},
+	tag.PatientInstitutionResidence: {action: deidRemove},
+	tag.ResponsiblePerson:           {action: deidRemove},
+	tag.ResponsibleOrganization:     {action: deidRemove},
+	tag.ReferencedPatientSequence:   {action: deidRemove},
+
+	// Institutions, staff and devices.
+	tag.InstitutionName:                          {action: deidRemove},
+	tag.InstitutionAddress:                       {action: deidRemove},
+	tag.InstitutionCodeSequence:                  {action: deidRemove},
+	tag.InstitutionalDepartmentName:              {action: deidRemove},
+	tag.StationName:                              {action: deidRemove},
+	tag.DeviceSerialNumber:                       {action: deidRemove},
+	tag.ReferringPhysicianName:                   {action: deidZero},
+	tag.ReferringPhysicianAddress:                {action: deidRemove},
+	tag.ReferringPhysicianTelephoneNumbers:       {action: deidRemove},
+	tag.ReferringPhysicianIdentificationSequence: {action: deidRemove},
+	tag.PhysiciansOfRecord:                       {action: deidRemove},
+	tag.PerformingPhysicianName:                  {action: deidRemove},
+	tag.NameOfPhysiciansReadingStudy:             {action: deidRemove},
+	tag.OperatorsName:                            {action: deidRemove},
+	tag.RequestingPhysician:                      {action: deidRemove},
+
+	// Orders and free text.
+	tag.AccessionNumber:                   {action: deidZero},
+	tag.StudyID:                           {action: deidZero},
+	tag.AdmittingDiagnosesDescription:     {action: deidRemove},
+	tag.RequestAttributesSequence:         {action: deidRemove},
+	tag.PerformedProcedureStepID:          {action: deidRemove},
+	tag.PerformedProcedureStepDescription: {action: deidRemove},
+	tag.ImageComments:                     {action: deidRemove},
+	tag.ProtocolName:                      {action: deidRemove},
+	tag.StudyDescription:                  {action: deidRemove},
+	tag.SeriesDescription:                 {action: deidRemove},
+	tag.RequestedProcedureDescription:     {action: deidRemove},
+	tag.ReasonForStudy:                    {action: deidRemove},
+	tag.RequestedProcedureComments:        {action: deidRemove},
+	tag.StudyComments:                     {action: deidRemove},
+	tag.PatientInsurancePlanCodeSequence:  {action: deidRemove},
+	tag.CountryOfResidence:                {action: deidRemove},
+	tag.RegionOfResidence:                 {action: deidRemove},
+	tag.MedicalAlerts:                     {action: deidRemove},
+	tag.Allergies:                         {action: deidRemove},
+	tag.ContentCreatorName:                {action: deidRemove},
+	tag.DerivationDescription:             {action: deidRemove},
+	tag.PersonName:                        {action: deidRemove},
+	tag.TextValue:                         {action: deidRemove},
+
+	// Dates and times.
+	tag.StudyDate:                       {action: deidZero, temporal: true},
+	tag.StudyTime:                       {action: deidZero, temporal: true},
+	tag.SeriesDate:                      {action: deidRemove, temporal: true},
+	tag.SeriesTime:                      {action: deidRemove, temporal: true},
+	tag.AcquisitionDate:                 {action: deidRemove, temporal: true},
+	tag.AcquisitionTime:                 {action: deidRemove, temporal: true},
+	tag.AcquisitionDateTime:             {action: deidRemove, temporal: true},
+	tag.ContentDate:                     {action: deidZero, temporal: true},
+	tag.ContentTime:                     {action: deidZero, temporal: true},
+	tag.InstanceCreationDate:            {action: deidRemove, temporal: true},
+	tag.InstanceCreationTime:            {action: deidRemove, temporal: true},
+	tag.PerformedProcedureStepStartDate: {action: deidRemove, temporal: true},
+	tag.PerformedProcedureStepStartTime: {action: deidRemove, temporal: true},
+}
+
+// deidRetain lists the attributes that carry no identity and that viewing,
+// indexing and registration depend on: file meta, SOP class, image pixel
+// description, geometry and acquisition technique. Sequences listed here are
+// kept and their items de-identified with the same rules.
+var deidRetain = map[tag.Tag]bool{
+	tag.FileMetaInformationGroupLength: true,
+	tag.FileMetaInformationVersion:     true,
+	tag.MediaStorageSOPClassUID:        true,
+	tag.MediaStorageSOPInstanceUID:     true,
+	tag.TransferSyntaxUID:              true,
+	tag.ImplementationClassUID:         true,
+	tag.ImplementationVersionName:      true,
+
+	// SOP common, study and series identity (UIDs are remapped).
+	tag.SpecificCharacterSet:  true,
+	tag.SOPClassUID:           true,
+	tag.SOPInstanceUID:        true,
+	tag.StudyInstanceUID:      true,
+	tag.SeriesInstanceUID:     true,
+	tag.ImageType:             true,
+	tag.Modality:              true,
+	tag.SeriesNumber:          true,
+	tag.InstanceNumber:        true,
+	tag.AcquisitionNumber:     true,
+	tag.BodyPartExamined:      true,
+	tag.PatientPosition:       true,
+	tag.Laterality:            true,
+	tag.ImageLaterality:       true,
+	tag.Manufacturer:          true,
+	tag.ManufacturerModelName: true,
+
+	// Frame of reference and geometry.
+	tag.FrameOfReferenceUID:        true,
+	tag.PositionReferenceIndicator: true,
+	tag.ImagePositionPatient:       true,
+	tag.ImageOrientationPatient:    true,
+	tag.SliceThickness:             true,
+	tag.SliceLocation:              true,
+	tag.SpacingBetweenSlices:       true,
+	tag.PixelSpacing:               true,
+	tag.ImagerPixelSpacing:         true,
+
+	// Image pixel description.
+	tag.SamplesPerPixel:           true,
+	tag.PhotometricInterpretation: true,
+	tag.PlanarConfiguration:       true,
+	tag.NumberOfFrames:            true,
+	tag.Rows:                      true,
+	tag.Columns:                   true,
+	tag.BitsAllocated:             true,
+	tag.BitsStored:                true,
+	tag.HighBit:                   true,
+	tag.PixelRepresentation:       true,
+	tag.LossyImageCompression:     true,
+	tag.RescaleIntercept:          true,
+	tag.RescaleSlope:              true,
+	tag.RescaleType:               true,
+	tag.WindowCenter:              true,
+	tag.WindowWidth:               true,
+	tag.PixelData:                 true,
+
+	// Acquisition technique.
+	tag.ScanningSequence:      true,
+	tag.SequenceVariant:       true,
+	tag.MRAcquisitionType:     true,
+	tag.RepetitionTime:        true,
+	tag.EchoTime:              true,
+	tag.InversionTime:         true,
+	tag.FlipAngle:             true,
+	tag.MagneticFieldStrength: true,
+	tag.KVP:                   true,
+	tag.ConvolutionKernel:     true,
+
+	// Multi-frame functional groups and references.
+	tag.SharedFunctionalGroupsSequence:   true,
+	tag.PerFrameFunctionalGroupsSequence: true,
+	tag.PlanePositionSequence:            true,
+	tag.PlaneOrientationSequence:         true,
+	tag.PixelMeasuresSequence:            true,
+	tag.FrameContentSequence:             true,
+	tag.DimensionIndexValues:             true,
+	tag.InStackPositionNumber:            true,
+	tag.StackID:                          true,
+	tag.ReferencedImageSequence:          true,
+	tag.ReferencedSOPClassUID:            true,
+	tag.ReferencedSOPInstanceUID:         true,
+	tag.ReferencedFrameNumber:            true,
+}
+
+// deidKeepUIDs are UI attributes that name a class or encoding rather than an
+// instance, so remapping them would only break the object.
+var deidKeepUIDs = map[tag.Tag]bool{
+	tag.SOPClassUID:             true,
+	tag.MediaStorageSOPClassUID: true,
+	tag.ReferencedSOPClassUID:   true,
+	tag.TransferSyntaxUID:       true,
+	tag.ImplementationClassUID:  true,
+}
+
+// Pseudonym kinds kept in the deid_mappings collection.
+const (
+	DeidKindUID     = "uid"
+	DeidKindPatient = "patient"
+)
+
+// DeidMapper hands out stable replacements for identifiers. The same
+// (patientKey, kind, original) must always map to the same pseudonym so
+// longitudinal links survive de-identification.
+type DeidMapper interface {
+	Pseudonym(ctx context.Context, patientKey, kind, original string) (string, error)
+}
+
+// cachedDeidMapper memoizes a DeidMapper for one run, since every instance
+// of a study repeats the same study, series and frame-of-reference UIDs.
+type cachedDeidMapper struct {
+	next  DeidMapper
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newCachedDeidMapper(next DeidMapper) *cachedDeidMapper {
+	return &cachedDeidMapper{next: next, cache: make(map[string]string)}
+}
+
+func (m *cachedDeidMapper) Pseudonym(ctx context.Context, patientKey, kind, original string) (string, error) {
+	key := patientKey + "\x00" + kind + "\x00" + original
+	m.mu.Lock()
+	v, ok := m.cache[key]
+	m.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := m.next.Pseudonym(ctx, patientKey, kind, original)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.cache[key] = v
+	m.mu.Unlock()
+	return v, nil
+}
+
+// newDeidUID returns a fresh UUID-derived UID under the 2.25 root (PS3.5
+// B.2), which needs no registered org root and is at most 44 characters.
+func newDeidUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return "2.25." + new(big.Int).SetBytes(b[:]).String(), nil
+}
+
+// newDeidPatientPseudonym returns a random patient pseudonym, used for both
+// PatientID and PatientName.
+func newDeidPatientPseudonym() (string, error) {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ANON-%X", b[:]), nil
+}
+
+// deidPatientKey scopes pseudonyms to one patient of one account, so the
+// same PatientID under two accounts never shares a mapping.
+func deidPatientKey(userID, patientID string) string {
+	return userID + "/" + patientID
+}
+
+// deidentifier applies a DeidProfile to datasets of one patient.
+type deidentifier struct {
+	profile    DeidProfile
+	mapper     DeidMapper
+	patientKey string
+}
+
+// deidentifyDataset applies the profile in place and records what was done
+// in PatientIdentityRemoved, DeidentificationMethod and its code sequence.
+func deidentifyDataset(ctx context.Context, ds *dicom.Dataset, profile DeidProfile, mapper DeidMapper, patientKey string) error {
+	d := &deidentifier{profile: profile, mapper: mapper, patientKey: patientKey}
+	elems, err := d.deidentifyElements(ctx, ds.Elements)
+	if err != nil {
+		return err
+	}
+	ds.Elements = elems
+
+	codes := [][]*dicom.Element{deidMethodCode("113100", "Basic Application Confidentiality Profile")}
+	temporal := "REMOVED"
+	if profile.RetainLongitudinalDates {
+		codes = append(codes, deidMethodCode("113106", "Retain Longitudinal Temporal Information Full Dates Option"))
+		temporal = "UNMODIFIED"
+	}
+	if profile.RetainUIDs {
+		codes = append(codes, deidMethodCode("113110", "Retain UIDs Option"))
+	}
+	method := "PS3.15 Basic Application Level Confidentiality Profile"
+	if profile.RetainLongitudinalDates {
+		method += "; Retain Longitudinal Full Dates"
+	}
+	if profile.RetainUIDs {
+		method += "; Retain UIDs"
+	}
+	for _, set := range []struct {
+		t    tag.Tag
+		data any
+	}{
+		{tag.PatientIdentityRemoved, []string{"YES"}},
+		{tag.DeidentificationMethod, []string{method}},
+		{tag.DeidentificationMethodCodeSequence, codes},
+		{tag.LongitudinalTemporalInformationModified, []string{temporal}},
+	} {
+		if err := setDatasetElement(ds, set.t, set.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deidMethodCode(value, meaning string) []*dicom.Element {
+	elems := make([]*dicom.Element, 0, 3)
+	for _, set := range []struct {
+		t tag.Tag
+		v string
+	}{
+		{tag.CodeValue, value},
+		{tag.CodingSchemeDesignator, "DCM"},
+		{tag.CodeMeaning, meaning},
+	} {
+		el, err := dicom.NewElement(set.t, []string{set.v})
+		if err != nil {
+			panic(err) // standard tags with string values cannot fail
+		}
+		elems = append(elems, el)
+	}
+	return elems
+}
+
+// setDatasetElement replaces or inserts a top-level element, keeping the
+// dataset in tag order.
+func setDatasetElement(ds *dicom.Dataset, t tag.Tag, data any) error {
+	el, err := dicom.NewElement(t, data)
+	if err != nil {
+		return fmt.Errorf("new element %s: %w", tag.DebugString(t), err)
+	}
+	for i, existing := range ds.Elements {
+		if existing.Tag == t {
+			ds.Elements[i] = el
+			return nil
+		}
+		if tagLess(t, existing.Tag) {
+			ds.Elements = append(ds.Elements[:i], append([]*dicom.Element{el}, ds.Elements[i:]...)...)
+			return nil
+		}
+	}
+	ds.Elements = append(ds.Elements, el)
+	return nil
+}
+
+func tagLess(a, b tag.Tag) bool {
+	if a.Group != b.Group {
+		return a.Group < b.Group
+	}
+	return a.Element < b.Element
+}
+
+// deidentifyElements applies the action table to one level of a dataset and
+// recurses into the items of retained sequences. It fails closed: anything
+// that is neither in deidActions nor in deidRetain is dropped.
+func (d *deidentifier) deidentifyElements(ctx context.Context, elems []*dicom.Element) ([]*dicom.Element, error) {
+	out := elems[:0]
+	for _, el := range elems {
+		if tag.IsPrivate(el.Tag.Group) {
+			continue
+		}
+
+		a, listed := deidActions[el.Tag]
+		switch {
+		case deidIsUID(el) && !deidKeepUIDs[el.Tag]:
+			if !d.profile.RetainUIDs {
+				a, listed = deidAction{action: deidUID}, true
+			} else {
+				listed = false
+			}
+		case listed && a.temporal && d.profile.RetainLongitudinalDates:
+			listed = false
+		case !listed && !deidRetain[el.Tag]:
+			continue
+		}
+		if !listed {
+			if el.Value != nil && el.Value.ValueType() == dicom.Sequences {
+				if err := d.deidentifySequence(ctx, el); err != nil {
+					return nil, err
+				}
+			}
+			out = append(out, el)
+			continue
+		}
+
+		switch a.action {
+		case deidRemove:
+			continue
+		case deidZero:
+			el.Value = mustDeidValue([]string{""})
+		case deidDummy:
+			orig := strings.TrimSpace(deidElementString(el))
+			pseudo, err := d.mapper.Pseudonym(ctx, d.patientKey, DeidKindPatient, "")
+			if err != nil {
+				return nil, fmt.Errorf("patient pseudonym: %w", err)
+			}
+			if orig == "" {
+				pseudo = ""
+			}
+			el.Value = mustDeidValue([]string{pseudo})
+		case deidUID:
+			var mapped []string
+			for _, uid := range deidElementStrings(el) {
+				uid = strings.TrimRight(strings.TrimSpace(uid), "\x00")
+				if uid == "" {
+					mapped = append(mapped, "")
+					continue
+				}
+				m, err := d.mapper.Pseudonym(ctx, d.patientKey, DeidKindUID, uid)
+				if err != nil {
+					return nil, fmt.Errorf("uid pseudonym: %w", err)
+				}
+				mapped = append(mapped, m)
+			}
+			if mapped == nil {
+				continue
+			}
+			el.Value = mustDeidValue(mapped)
+		}
+		out = append(out, el)
+	}
+	return out, nil
+}
+
+// deidentifySequence de-identifies every item of a sequence element. Items
+// are rebuilt because the parser does not expose them for in-place edits.
+func (d *deidentifier) deidentifySequence(ctx context.Context, el *dicom.Element) error {
+	items, ok := el.Value.GetValue().([]*dicom.SequenceItemValue)
+	if !ok {
+		return nil
+	}
+	rebuilt := make([][]*dicom.Element, 0, len(items))
+	for _, item := range items {
+		children, _ := item.GetValue().([]*dicom.Element)
+		cleaned, err := d.deidentifyElements(ctx, children)
+		if err != nil {
+			return err
+		}
+		rebuilt = append(rebuilt, cleaned)
+	}
+	el.Value = mustDeidValue(rebuilt)
+	return nil
+}
+
+// deidIsUID reports whether an element has VR UI, falling back to the
+// dictionary when the parser did not record one.
+func deidIsUID(el *dicom.Element) bool {
+	if el.RawValueRepresentation != "" {
+		return el.RawValueRepresentation == "UI"
+	}
+	info, err := tag.Find(el.Tag)
+	return err == nil && len(info.VRs) > 0 && info.VRs[0] == "UI"
+}
+
+func mustDeidValue(data any) dicom.Value {
+	v, err := dicom.NewValue(data)
+	if err != nil {
+		panic(err) // only called with the types NewValue accepts
+	}
+	return v
+}
+
+func deidElementStrings(el *dicom.Element) []string {
+	if el.Value == nil || el.Value.ValueType() != dicom.Strings {
+		return nil
+	}
+	return dicom.MustGetStrings(el.Value)
+}
+
+func deidElementString(el *dicom.Element) string {
+	return strings.Join(deidElementStrings(el), `\`)
+}
+
+// deidParseError marks objects that cannot be parsed or re-encoded, as
+// opposed to mapping failures that are worth retrying.
+type deidParseError struct{ err error }
+
+func (e *deidParseError) Error() string { return e.err.Error() }
+func (e *deidParseError) Unwrap() error { return e.err }
+
+// deidentifyPart10 reads a DICOM Part 10 object, de-identifies it and writes
+// the result to w as it is encoded. It returns the de-identified instance
+// info for cataloging. On error w may hold a partial object.
+func deidentifyPart10(ctx context.Context, r io.Reader, size int64, w io.Writer, profile DeidProfile, mapper DeidMapper, userID string) (dicomInstanceInfo, error) {
+	// Native pixel data is copied through as raw bytes rather than decoded
+	// into frames and re-encoded, which is lossy for some layouts.
+	ds, err := dicom.Parse(r, size, nil, dicom.SkipProcessingPixelDataValue())
+	if err != nil {
+		return dicomInstanceInfo{}, &deidParseError{fmt.Errorf("parse: %w", err)}
+	}
+	patientKey := deidPatientKey(userID, getStringByTag(&ds, tag.PatientID))
+	if err := deidentifyDataset(ctx, &ds, profile, mapper, patientKey); err != nil {
+		return dicomInstanceInfo{}, err
+	}
+	cw := &deidCountingWriter{w: w}
+	if err := dicom.Write(cw, ds, dicom.SkipVRVerification(), dicom.SkipValueTypeVerification()); err != nil {
+		if cw.err != nil {
+			return dicomInstanceInfo{}, cw.err
+		}
+		return dicomInstanceInfo{}, &deidParseError{fmt.Errorf("write: %w", err)}
+	}
+	info := instanceInfoFromDataset(&ds)
+	info.SizeBytes = cw.n
+	return info, nil
+}
+
+// deidCountingWriter counts the bytes written through it and keeps the
+// destination's own error apart from encoding errors.
+type deidCountingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *deidCountingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: deid_mappings
+//
+// DeidMapping is one stored pseudonym. Documents are keyed by patient, kind
+// and original value so a lookup is a single read.
+type DeidMapping struct {
+	PatientKey string    `firestore:"patient_key" json:"patient_key"`
+	Kind       string    `firestore:"kind" json:"kind"` // uid|patient
+	Original   string    `firestore:"original" json:"original"`
+	Pseudonym  string    `firestore:"pseudonym" json:"pseudonym"`
+	CreatedAt  time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// Pseudonym implements DeidMapper, creating the mapping on first use. The
+// transaction makes concurrent ingests of the same patient agree on one value.
+func (db *FirestoreDB) Pseudonym(ctx context.Context, patientKey, kind, original string) (string, error) {
+	ref := db.client.Collection("deid_mappings").Doc(deterministicTokenID("DEID", patientKey, kind, original))
+	var pseudonym string
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err == nil {
+			var m DeidMapping
+			if err := snap.DataTo(&m); err != nil {
+				return err
+			}
+			pseudonym = m.Pseudonym
+			return nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return err
+		}
+		if kind == DeidKindPatient {
+			pseudonym, err = newDeidPatientPseudonym()
+		} else {
+			pseudonym, err = newDeidUID()
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Create(ref, &DeidMapping{
+			PatientKey: patientKey,
+			Kind:       kind,
+			Original:   original,
+			Pseudonym:  pseudonym,
+			CreatedAt:  time.Now().UTC(),
+		})
+	})
+	if err != nil {
+		return "", fmt.Errorf("deid mapping (%s): %w", kind, err)
+	}
+	return pseudonym, nil
+}
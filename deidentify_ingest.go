@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// deidObjectName maps an uploaded object (userId/sessionId/relative) to its
+// de-identified copy under the configured deid prefix. Like quarantine, the
+// prefix lives outside the upload prefix so the originals are never mixed
+// with the copies.
+func (h *Handlers) deidObjectName(objectName string) string {
+	prefix := strings.Trim(h.Cfg.DeidPrefix, "/")
+	if prefix == "" {
+		prefix = "deidentified"
+	}
+	return path.Join(prefix, objectName)
+}
+
+// deidGCSPrefix is the gs:// prefix holding the de-identified copies of an
+// upload prefix; import and study creation run against it.
+func (h *Handlers) deidGCSPrefix(gcsPrefix string) (string, error) {
+	bucketName, objectPrefix, err := splitGCSPrefix(gcsPrefix)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s/", bucketName, h.deidObjectName(strings.TrimSuffix(objectPrefix, "/"))), nil
+}
+
+// deidentifyUploadedFiles writes a de-identified copy of every validated file
+// and points the file records at the copies and their remapped UIDs. Files
+// that cannot be re-encoded are rejected; storage and mapping errors fail the
+// attempt so it can be retried.
+func (h *Handlers) deidentifyUploadedFiles(ctx context.Context, sess *UploadSession, bucketName string, files []*UploadFile) error {
+	const concurrency = 8
+	var (
+		mu       sync.Mutex
+		firstErr error
+		done     int
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, concurrency)
+	)
+	mapper := newCachedDeidMapper(h.DB)
+	bucket := h.Storage.Bucket(bucketName)
+
+	for _, f := range files {
+		if f.Outcome != UploadFilePending && f.Outcome != UploadFileUnknown {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(f *UploadFile) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fail := func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+
+			rc, err := bucket.Object(f.ObjectName).NewReader(ctx)
+			if err != nil {
+				fail(fmt.Errorf("read %s: %w", f.ObjectName, err))
+				return
+			}
+			// The copy is encoded straight into the object writer.
+			// Cancelling wctx on failure abandons the upload, so no
+			// partial object is left behind.
+			dst := h.deidObjectName(f.ObjectName)
+			wctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			w := bucket.Object(dst).NewWriter(wctx)
+			w.ContentType = "application/dicom"
+			info, err := deidentifyPart10(ctx, rc, rc.Attrs.Size, w, h.Cfg.DeidProfile, mapper, sess.UserID)
+			rc.Close()
+			if err != nil {
+				cancel()
+				w.Close()
+				var parseErr *deidParseError
+				if !errors.As(err, &parseErr) {
+					fail(fmt.Errorf("deidentify %s: %w", f.ObjectName, err))
+					return
+				}
+				mu.Lock()
+				f.Outcome = UploadFileRejected
+				f.Reason = err.Error()
+				mu.Unlock()
+				return
+			}
+			if err := w.Close(); err != nil {
+				fail(fmt.Errorf("write %s: %w", dst, err))
+				return
+			}
+
+			mu.Lock()
+			f.DeidObjectName = dst
+			f.StudyInstanceUID = info.StudyInstanceUID
+			f.SeriesInstanceUID = info.SeriesInstanceUID
+			f.SOPInstanceUID = info.SOPInstanceUID
+			done++
+			mu.Unlock()
+		}(f)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	log.Printf("deidentifyUploadedFiles: session=%s deidentified=%d", sess.SessionID, done)
+	if done == 0 && !anyDeidentified(files) {
+		return permanentIngestError("deidentify_failed", fmt.Errorf("no file of session %s could be de-identified", sess.SessionID))
+	}
+	return nil
+}
+
+func anyDeidentified(files []*UploadFile) bool {
+	for _, f := range files {
+		if f.DeidObjectName != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// deidProfileFromQuery overrides the configured profile with the
+// retain_dates and retain_uids query parameters, when present.
+func deidProfileFromQuery(def DeidProfile, r *http.Request) (DeidProfile, error) {
+	p := def
+	q := r.URL.Query()
+	for name, dst := range map[string]*bool{
+		"retain_dates": &p.RetainLongitudinalDates,
+		"retain_uids":  &p.RetainUIDs,
+	} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("%s: %w", name, err)
+		}
+		*dst = b
+	}
+	return p, nil
+}
+
+// readRetrievedInstance returns the Part 10 bytes of a retrieved instance,
+// which arrives either as application/dicom or as the first part of a
+// multipart/related response.
+func readRetrievedInstance(resp *http.Response) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return io.ReadAll(resp.Body)
+	}
+	part, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("read multipart instance: %w", err)
+	}
+	defer part.Close()
+	return io.ReadAll(part)
+}
+
+// handleImagingInstanceDeidentified implements
+// GET /api/imaging/studies/{id}/instances/{sop}/deidentified, which exports
+// one instance of the caller's study de-identified with the configured
+// profile (optionally overridden by retain_dates / retain_uids).
+func (h *Handlers) handleImagingInstanceDeidentified(w http.ResponseWriter, r *http.Request, studyID, sopUID string) {
+	ctx := r.Context()
+	userID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("handleImagingInstanceDeidentified getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthorized",
+		})
+		return
+	}
+
+	profile, err := deidProfileFromQuery(h.Cfg.DeidProfile, r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":   "invalid_profile",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	inst, err := h.DB.GetImagingInstance(ctx, imagingInstanceDocID(studyID, sopUID))
+	if err != nil {
+		log.Printf("handleImagingInstanceDeidentified GetImagingInstance error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if inst == nil || inst.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "instance_not_found",
+		})
+		return
+	}
+	if h.Dicom == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "dicom_client_not_configured",
+		})
+		return
+	}
+
+	resp, err := h.Dicom.RetrieveInstanceRaw(ctx, inst.StudyInstanceUID, inst.SeriesInstanceUID, inst.SOPInstanceUID)
+	if err != nil {
+		log.Printf("handleImagingInstanceDeidentified RetrieveInstanceRaw error: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{
+			"error": "dicom_retrieve_error",
+		})
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("handleImagingInstanceDeidentified upstream status %d %s", resp.StatusCode, resp.Status)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	raw, err := readRetrievedInstance(resp)
+	if err != nil {
+		log.Printf("handleImagingInstanceDeidentified read error: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{
+			"error": "dicom_retrieve_error",
+		})
+		return
+	}
+
+	var out bytes.Buffer
+	info, err := deidentifyPart10(ctx, bytes.NewReader(raw), int64(len(raw)), &out, profile, newCachedDeidMapper(h.DB), userID)
+	if err != nil {
+		log.Printf("handleImagingInstanceDeidentified deidentify error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "deidentify_failed",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dicom")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.SOPInstanceUID+".dcm"))
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(out.Bytes()); err != nil {
+		log.Printf("handleImagingInstanceDeidentified write error: %v", err)
+	}
+}
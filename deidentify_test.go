@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// memDeidMapper is an in-memory DeidMapper that numbers pseudonyms in order.
+type memDeidMapper struct {
+	m     map[string]string
+	calls int
+}
+
+func (f *memDeidMapper) Pseudonym(_ context.Context, patientKey, kind, original string) (string, error) {
+	f.calls++
+	if f.m == nil {
+		f.m = make(map[string]string)
+	}
+	key := patientKey + "|" + kind + "|" + original
+	if v, ok := f.m[key]; ok {
+		return v, nil
+	}
+	v := fmt.Sprintf("2.25.%d", len(f.m)+1)
+	if kind == DeidKindPatient {
+		v = fmt.Sprintf("ANON-%d", len(f.m)+1)
+	}
+	f.m[key] = v
+	return v, nil
+}
+
+// identifiedPart10 writes a small CT instance carrying PHI, a private tag
+// and a reference sequence.
+func identifiedPart10(t *testing.T, patientID, studyUID, sopUID string) []byte {
+	t.Helper()
+	refItem := []*dicom.Element{
+		mustElement(t, tag.ReferencedSOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.2"}),
+		mustElement(t, tag.ReferencedSOPInstanceUID, []string{"1.2.3.9.9"}),
+	}
+	private := &dicom.Element{
+		Tag:                    tag.Tag{Group: 0x0029, Element: 0x1010},
+		RawValueRepresentation: "LO",
+		Value:                  mustDeidValue([]string{"SECRET"}),
+	}
+	ds := dicom.Dataset{Elements: []*dicom.Element{
+		mustElement(t, tag.MediaStorageSOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.2"}),
+		mustElement(t, tag.MediaStorageSOPInstanceUID, []string{sopUID}),
+		mustElement(t, tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.1"}),
+		mustElement(t, tag.SOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.2"}),
+		mustElement(t, tag.SOPInstanceUID, []string{sopUID}),
+		mustElement(t, tag.StudyDate, []string{"20240102"}),
+		mustElement(t, tag.AccessionNumber, []string{"ACC123"}),
+		mustElement(t, tag.Modality, []string{"CT"}),
+		mustElement(t, tag.InstitutionName, []string{"General Hospital"}),
+		mustElement(t, tag.StudyDescription, []string{"CT chest for Jane Doe"}),
+		mustElement(t, tag.SeriesDescription, []string{"Doe^Jane follow-up"}),
+		mustElement(t, tag.ReferencedImageSequence, [][]*dicom.Element{refItem}),
+		mustElement(t, tag.PatientName, []string{"Doe^Jane"}),
+		mustElement(t, tag.PatientID, []string{patientID}),
+		mustElement(t, tag.PatientBirthDate, []string{"19700101"}),
+		private,
+		mustElement(t, tag.StudyInstanceUID, []string{studyUID}),
+		mustElement(t, tag.SeriesInstanceUID, []string{studyUID + ".1"}),
+		mustElement(t, tag.RequestedProcedureID, []string{"RP-" + patientID}),
+		mustElement(t, tag.IrradiationEventUID, []string{studyUID + ".7"}),
+		mustElement(t, tag.Rows, []int{2}),
+		mustElement(t, tag.Columns, []int{2}),
+	}}
+	var buf bytes.Buffer
+	if err := dicom.Write(&buf, ds, dicom.SkipVRVerification()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func deidRoundTrip(t *testing.T, in []byte, profile DeidProfile, mapper DeidMapper, userID string) (dicom.Dataset, dicomInstanceInfo) {
+	t.Helper()
+	var out bytes.Buffer
+	info, err := deidentifyPart10(context.Background(), bytes.NewReader(in), int64(len(in)), &out, profile, mapper, userID)
+	if err != nil {
+		t.Fatalf("deidentifyPart10: %v", err)
+	}
+	ds, err := dicom.Parse(bytes.NewReader(out.Bytes()), int64(out.Len()), nil)
+	if err != nil {
+		t.Fatalf("parse de-identified output: %v", err)
+	}
+	return ds, info
+}
+
+func TestDeidentifyBasicProfile(t *testing.T) {
+	mapper := &memDeidMapper{}
+	ds, info := deidRoundTrip(t, identifiedPart10(t, "MRN-1", "1.2.3", "1.2.3.1.1"), DeidProfile{}, mapper, "u1")
+
+	for _, removed := range []tag.Tag{tag.InstitutionName, tag.Tag{Group: 0x0029, Element: 0x1010}} {
+		if _, err := ds.FindElementByTag(removed); err == nil {
+			t.Errorf("%s not removed", tag.DebugString(removed))
+		}
+	}
+	for _, zeroed := range []tag.Tag{tag.StudyDate, tag.AccessionNumber, tag.PatientBirthDate} {
+		if got := getStringByTag(&ds, zeroed); got != "" {
+			t.Errorf("%s = %q, want empty", tag.DebugString(zeroed), got)
+		}
+	}
+	if got := getStringByTag(&ds, tag.PatientID); !strings.HasPrefix(got, "ANON-") {
+		t.Errorf("PatientID = %q, want pseudonym", got)
+	}
+	if getStringByTag(&ds, tag.PatientName) != getStringByTag(&ds, tag.PatientID) {
+		t.Errorf("PatientName and PatientID pseudonyms differ")
+	}
+	if info.StudyInstanceUID == "1.2.3" || !strings.HasPrefix(info.StudyInstanceUID, "2.25.") {
+		t.Errorf("StudyInstanceUID = %q, want remapped", info.StudyInstanceUID)
+	}
+	if got := getStringByTag(&ds, tag.MediaStorageSOPInstanceUID); got != info.SOPInstanceUID {
+		t.Errorf("MediaStorageSOPInstanceUID = %q, want %q", got, info.SOPInstanceUID)
+	}
+	if getStringByTag(&ds, tag.PatientIdentityRemoved) != "YES" {
+		t.Errorf("PatientIdentityRemoved not set")
+	}
+	if got := getStringByTag(&ds, tag.LongitudinalTemporalInformationModified); got != "REMOVED" {
+		t.Errorf("LongitudinalTemporalInformationModified = %q", got)
+	}
+
+	seq, err := ds.FindElementByTag(tag.ReferencedImageSequence)
+	if err != nil {
+		t.Fatalf("ReferencedImageSequence dropped: %v", err)
+	}
+	items := seq.Value.GetValue().([]*dicom.SequenceItemValue)
+	for _, el := range items[0].GetValue().([]*dicom.Element) {
+		if el.Tag == tag.ReferencedSOPInstanceUID && deidElementString(el) == "1.2.3.9.9" {
+			t.Errorf("ReferencedSOPInstanceUID inside sequence not remapped")
+		}
+	}
+}
+
+func TestDeidentifyFailsClosed(t *testing.T) {
+	ds, _ := deidRoundTrip(t, identifiedPart10(t, "MRN-1", "1.2.3", "1.2.3.1.1"), DeidProfile{}, &memDeidMapper{}, "u1")
+
+	// Descriptions are free text and often carry names; RequestedProcedureID
+	// is on neither list and must be dropped by default.
+	for _, removed := range []tag.Tag{tag.StudyDescription, tag.SeriesDescription, tag.RequestedProcedureID} {
+		if _, err := ds.FindElementByTag(removed); err == nil {
+			t.Errorf("%s survived de-identification", tag.DebugString(removed))
+		}
+	}
+	if got := getStringByTag(&ds, tag.IrradiationEventUID); got == "" || got == "1.2.3.7" {
+		t.Errorf("IrradiationEventUID = %q, want remapped", got)
+	}
+	for _, kept := range []tag.Tag{tag.SOPClassUID, tag.TransferSyntaxUID} {
+		if got := getStringByTag(&ds, kept); !strings.HasPrefix(got, "1.2.840.10008.") {
+			t.Errorf("%s = %q, want unchanged", tag.DebugString(kept), got)
+		}
+	}
+	if getStringByTag(&ds, tag.Modality) != "CT" || intTag(&ds, tag.Rows) != 2 {
+		t.Errorf("retained attributes lost")
+	}
+}
+
+func TestDeidentifyConsistentPerPatient(t *testing.T) {
+	mapper := newCachedDeidMapper(&memDeidMapper{})
+	_, a := deidRoundTrip(t, identifiedPart10(t, "MRN-1", "1.2.3", "1.2.3.1.1"), DeidProfile{}, mapper, "u1")
+	_, b := deidRoundTrip(t, identifiedPart10(t, "MRN-1", "1.2.3", "1.2.3.1.2"), DeidProfile{}, mapper, "u1")
+	_, other := deidRoundTrip(t, identifiedPart10(t, "MRN-2", "1.2.3", "1.2.3.1.1"), DeidProfile{}, mapper, "u1")
+
+	if a.StudyInstanceUID != b.StudyInstanceUID || a.SeriesInstanceUID != b.SeriesInstanceUID {
+		t.Errorf("same patient study/series remapped inconsistently: %+v vs %+v", a, b)
+	}
+	if a.SOPInstanceUID == b.SOPInstanceUID {
+		t.Errorf("distinct instances share a SOPInstanceUID")
+	}
+	if other.StudyInstanceUID == a.StudyInstanceUID {
+		t.Errorf("different patients share a remapped StudyInstanceUID")
+	}
+}
+
+func TestDeidentifyRetainOptions(t *testing.T) {
+	profile := DeidProfile{RetainLongitudinalDates: true, RetainUIDs: true}
+	ds, info := deidRoundTrip(t, identifiedPart10(t, "MRN-1", "1.2.3", "1.2.3.1.1"), profile, &memDeidMapper{}, "u1")
+
+	if got := getStringByTag(&ds, tag.StudyDate); got != "20240102" {
+		t.Errorf("StudyDate = %q, want retained", got)
+	}
+	if info.StudyInstanceUID != "1.2.3" || info.SOPInstanceUID != "1.2.3.1.1" {
+		t.Errorf("UIDs not retained: %+v", info)
+	}
+	if got := getStringByTag(&ds, tag.PatientBirthDate); got != "" {
+		t.Errorf("PatientBirthDate = %q, want empty even with retained dates", got)
+	}
+	if got := getStringByTag(&ds, tag.LongitudinalTemporalInformationModified); got != "UNMODIFIED" {
+		t.Errorf("LongitudinalTemporalInformationModified = %q", got)
+	}
+	codes, err := ds.FindElementByTag(tag.DeidentificationMethodCodeSequence)
+	if err != nil || len(codes.Value.GetValue().([]*dicom.SequenceItemValue)) != 3 {
+		t.Errorf("DeidentificationMethodCodeSequence = %v, %v; want 3 codes", codes, err)
+	}
+}
+
+func TestNewDeidUID(t *testing.T) {
+	uid, err := newDeidUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uid, "2.25.") || !isValidDicomUID(uid) {
+		t.Errorf("newDeidUID() = %q, not a valid 2.25 UID", uid)
+	}
+}
+
+func TestDeidentifyKeepsPixelData(t *testing.T) {
+	raw := []byte{1, 0, 2, 0, 3, 0, 4, 0} // 2x2, 16 bits allocated
+	ds := dicom.Dataset{Elements: []*dicom.Element{
+		mustElement(t, tag.MediaStorageSOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.2"}),
+		mustElement(t, tag.MediaStorageSOPInstanceUID, []string{"1.2.3.1.1"}),
+		mustElement(t, tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.1"}),
+		mustElement(t, tag.SOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.2"}),
+		mustElement(t, tag.SOPInstanceUID, []string{"1.2.3.1.1"}),
+		mustElement(t, tag.StudyInstanceUID, []string{"1.2.3"}),
+		mustElement(t, tag.PatientID, []string{"MRN-1"}),
+		mustElement(t, tag.SamplesPerPixel, []int{1}),
+		mustElement(t, tag.Rows, []int{2}),
+		mustElement(t, tag.Columns, []int{2}),
+		mustElement(t, tag.BitsAllocated, []int{16}),
+		mustElement(t, tag.BitsStored, []int{12}),
+		mustElement(t, tag.PixelRepresentation, []int{0}),
+		mustElement(t, tag.PixelData, dicom.PixelDataInfo{IntentionallyUnprocessed: true, UnprocessedValueData: raw}),
+	}}
+	var in bytes.Buffer
+	if err := dicom.Write(&in, ds, dicom.SkipVRVerification()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := deidentifyPart10(context.Background(), bytes.NewReader(in.Bytes()), int64(in.Len()), &out, DeidProfile{}, &memDeidMapper{}, "u1"); err != nil {
+		t.Fatalf("deidentifyPart10: %v", err)
+	}
+	got, err := dicom.Parse(bytes.NewReader(out.Bytes()), int64(out.Len()), nil, dicom.SkipProcessingPixelDataValue())
+	if err != nil {
+		t.Fatalf("parse de-identified output: %v", err)
+	}
+	el, err := got.FindElementByTag(tag.PixelData)
+	if err != nil {
+		t.Fatalf("PixelData dropped: %v", err)
+	}
+	if info := dicom.MustGetPixelDataInfo(el.Value); !bytes.Equal(info.UnprocessedValueData, raw) {
+		t.Errorf("PixelData = %v, want %v", info.UnprocessedValueData, raw)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// dicomSniffLen is how many leading bytes we need to classify an object:
+// 128-byte preamble + "DICM" magic, plus some room for http.DetectContentType
+// which looks at up to 512 bytes.
+const dicomSniffLen = 512
+
+// NonDicomFile records an uploaded object that was skipped during ingest
+// because its content did not look like DICOM.
+type NonDicomFile struct {
+	ObjectName   string `firestore:"object_name" json:"object_name"`
+	SizeBytes    int64  `firestore:"size_bytes" json:"size_bytes"`
+	DetectedType string `firestore:"detected_type" json:"detected_type"`
+}
+
+// detectDicomContent classifies the leading bytes of a file.
+//
+// It returns true for Part 10 files (128-byte preamble followed by "DICM")
+// and for preamble-less files whose first bytes decode as a plausible group
+// 0002/0008 data element (common for old implicit VR little endian exports).
+// The second return value is the detected MIME type, which for non-DICOM
+// content comes from http.DetectContentType.
+func detectDicomContent(head []byte) (bool, string) {
+	if len(head) >= 132 && string(head[128:132]) == "DICM" {
+		return true, "application/dicom"
+	}
+	if looksLikePreamblelessDicom(head) {
+		return true, "application/dicom"
+	}
+	if len(head) == 0 {
+		return false, "application/x-empty"
+	}
+	ct := http.DetectContentType(head)
+	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		return false, mt
+	}
+	return false, ct
+}
+
+// looksLikePreamblelessDicom checks whether head starts directly with a data
+// element (no preamble). We accept either implicit VR little endian, where
+// the tag is followed by a 4-byte length, or explicit VR little endian, where
+// the tag is followed by a two-letter VR.
+func looksLikePreamblelessDicom(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	group := binary.LittleEndian.Uint16(head[0:2])
+	element := binary.LittleEndian.Uint16(head[2:4])
+
+	// Files without a preamble start with either file meta (0002) or the
+	// identifying group (0008). Anything else is far more likely to be a
+	// random binary blob than DICOM.
+	if group != 0x0002 && group != 0x0008 {
+		return false
+	}
+	// Elements in these groups are small numbers; the first element is
+	// typically a group length (0000) or something like SpecificCharacterSet
+	// (0005) / ImageType (0008).
+	if element > 0x1200 {
+		return false
+	}
+
+	if isDicomVR(head[4:6]) {
+		return true
+	}
+
+	// Implicit VR: 32-bit little endian value length. Header elements are
+	// short, so anything huge (other than undefined length) is not DICOM.
+	length := binary.LittleEndian.Uint32(head[4:8])
+	return length == 0xFFFFFFFF || length < 0x10000
+}
+
+// isDicomVR reports whether b is one of the two-letter DICOM value
+// representations.
+func isDicomVR(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+	switch string(b[:2]) {
+	case "AE", "AS", "AT", "CS", "DA", "DS", "DT", "FL", "FD", "IS",
+		"LO", "LT", "OB", "OD", "OF", "OL", "OV", "OW", "PN", "SH",
+		"SL", "SQ", "SS", "ST", "SV", "TM", "UC", "UI", "UL", "UN",
+		"UR", "US", "UT", "UV":
+		return true
+	}
+	return false
+}
+
+// isDeclaredDicomContentType reports whether a client-declared content type
+// could plausibly carry DICOM. Browsers frequently send an empty type or
+// application/octet-stream for .dcm files (or files without an extension),
+// so we only reject types that are clearly something else.
+func isDeclaredDicomContentType(contentType string) bool {
+	ct := strings.TrimSpace(contentType)
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	switch mt {
+	case "application/dicom", "application/octet-stream", "binary/octet-stream",
+		"application/x-dicom", "image/dicom", "image/x-dicom":
+		return true
+	}
+	return false
+}
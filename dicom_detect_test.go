@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDetectDicomContent(t *testing.T) {
+	part10 := make([]byte, 200)
+	copy(part10[128:], "DICM")
+
+	// (0008,0005) SpecificCharacterSet, implicit VR little endian, length 10.
+	implicitVR := []byte{0x08, 0x00, 0x05, 0x00, 0x0A, 0x00, 0x00, 0x00, 'I', 'S', 'O', '_', 'I', 'R', ' ', '1', '0', '0'}
+
+	// (0008,0016) SOPClassUID, explicit VR little endian.
+	explicitVR := []byte{0x08, 0x00, 0x16, 0x00, 'U', 'I', 0x02, 0x00, '1', 0x00}
+
+	tests := []struct {
+		name      string
+		head      []byte
+		wantDicom bool
+		wantType  string
+	}{
+		{"part10", part10, true, "application/dicom"},
+		{"implicit vr no preamble", implicitVR, true, "application/dicom"},
+		{"explicit vr no preamble", explicitVR, true, "application/dicom"},
+		{"pdf", []byte("%PDF-1.7\n%âãÏÓ\n"), false, "application/pdf"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), false, "image/png"},
+		{"text", []byte("DICOMDIR index for CD viewer\n"), false, "text/plain"},
+		{"empty", nil, false, "application/x-empty"},
+		{"random group", []byte{0x10, 0x00, 0x10, 0x00, 0x04, 0x00, 0x00, 0x00}, false, "application/octet-stream"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gotDicom, gotType := detectDicomContent(tc.head)
+			if gotDicom != tc.wantDicom || gotType != tc.wantType {
+				t.Fatalf("detectDicomContent = (%v, %q), want (%v, %q)", gotDicom, gotType, tc.wantDicom, tc.wantType)
+			}
+		})
+	}
+}
+
+func TestIsDeclaredDicomContentType(t *testing.T) {
+	accept := []string{"", "application/dicom", "application/octet-stream", "application/dicom; transfer-syntax=*"}
+	reject := []string{"application/pdf", "image/jpeg", "text/html; charset=utf-8", "not a type"}
+
+	for _, ct := range accept {
+		if !isDeclaredDicomContentType(ct) {
+			t.Errorf("isDeclaredDicomContentType(%q) = false, want true", ct)
+		}
+	}
+	for _, ct := range reject {
+		if isDeclaredDicomContentType(ct) {
+			t.Errorf("isDeclaredDicomContentType(%q) = true, want false", ct)
+		}
+	}
+}
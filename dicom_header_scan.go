@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/dicomio"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// headerRangeStart is the first ranged read per object; most headers fit.
+// The range doubles until the top-level PixelData element is reached.
+const headerRangeStart = 64 << 10
+
+// errHeaderTruncated means the bytes read so far end before PixelData.
+var errHeaderTruncated = errors.New("dicom header extends past the bytes read")
+
+// parseDicomHeaderPrefix parses the header from the first bytes of an
+// object of the given total size. Only prefix is parsed, with its own length
+// as the parser's limit, so nothing past it is made up. The header is only
+// trusted once the top-level PixelData element is reached; when the prefix
+// ends inside PixelData the parser fails to skip its value with
+// dicomio.ErrorInsufficientBytesLeft, which only happens there. Any other
+// element that reaches past the prefix returns errHeaderTruncated, asking
+// the caller to read more.
+func parseDicomHeaderPrefix(prefix []byte, size int64) (*dicom.Dataset, error) {
+	complete := int64(len(prefix)) >= size
+
+	p, err := dicom.NewParser(bytes.NewReader(prefix), int64(len(prefix)), nil, dicom.SkipPixelData())
+	if err != nil {
+		if !complete {
+			return nil, errHeaderTruncated
+		}
+		return nil, err
+	}
+	ds := &dicom.Dataset{}
+	for {
+		el, err := p.Next()
+		if err != nil {
+			if errors.Is(err, dicomio.ErrorInsufficientBytesLeft) {
+				// PixelData header read; its value lies past the prefix.
+				return ds, nil
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, dicom.ErrorEndOfDICOM) {
+				if complete {
+					// Whole object parsed without PixelData (e.g. SR).
+					return ds, nil
+				}
+				return nil, errHeaderTruncated
+			}
+			if !complete {
+				return nil, errHeaderTruncated
+			}
+			return nil, err
+		}
+		ds.Elements = append(ds.Elements, el)
+		if el.Tag == tag.PixelData {
+			return ds, nil
+		}
+	}
+}
+
+// scanDicomHeader reads an object's header with ranged reads, doubling the
+// range until the header is complete. It returns either the instance info or
+// a non-DICOM report entry.
+func scanDicomHeader(ctx context.Context, store BlobStore, bucket string, obj BlobAttrs) (*dicomInstanceInfo, *NonDicomFile, error) {
+	n := int64(headerRangeStart)
+	if n > obj.Size {
+		n = obj.Size
+	}
+	buf, err := store.ReadRange(ctx, bucket, obj.Name, 0, n)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s: %w", obj.Name, err)
+	}
+
+	if isDicom, detectedType := detectDicomContent(buf); !isDicom {
+		return nil, &NonDicomFile{ObjectName: obj.Name, SizeBytes: obj.Size, DetectedType: detectedType}, nil
+	}
+
+	for {
+		ds, err := parseDicomHeaderPrefix(buf, obj.Size)
+		if err == nil {
+			info := instanceInfoFromDataset(ds)
+			info.ObjectName = obj.Name
+			info.SizeBytes = obj.Size
+			return &info, nil, nil
+		}
+		if !errors.Is(err, errHeaderTruncated) {
+			return nil, nil, fmt.Errorf("parse %s: %w", obj.Name, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		// Fetch the next range, the same size as what we have.
+		more, err := store.ReadRange(ctx, bucket, obj.Name, int64(len(buf)), int64(len(buf)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %w", obj.Name, err)
+		}
+		if len(more) == 0 {
+			// Object shorter than its listed size; parse what we have.
+			obj.Size = int64(len(buf))
+			continue
+		}
+		buf = append(buf, more...)
+	}
+}
+
+// headerScanResult aggregates scanDicomHeaders output.
+type headerScanResult struct {
+	Studies     map[string][]dicomInstanceInfo
+	NonDicom    []NonDicomFile
+	Total       int
+	Parsed      int
+	ParseErrors int
+}
+
+// scanDicomHeaders scans objects with up to workers concurrent fetch+parse
+// calls. Per-object failures are logged and skipped; cancelling ctx stops
+// the scan and returns ctx.Err().
+func scanDicomHeaders(ctx context.Context, store BlobStore, bucket string, objects []BlobAttrs, workers int) (*headerScanResult, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	res := &headerScanResult{Studies: make(map[string][]dicomInstanceInfo), Total: len(objects)}
+	var (
+		mu          sync.Mutex
+		parseErrors atomic.Int64
+		wg          sync.WaitGroup
+		jobs        = make(chan BlobAttrs)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range jobs {
+				info, nonDicom, err := scanDicomHeader(ctx, store, bucket, obj)
+				if err != nil {
+					if ctx.Err() == nil {
+						parseErrors.Add(1)
+						log.Printf("collectDicomInstances: %v", err)
+					}
+					continue
+				}
+				mu.Lock()
+				switch {
+				case nonDicom != nil:
+					res.NonDicom = append(res.NonDicom, *nonDicom)
+				case info.StudyInstanceUID != "" && info.SOPInstanceUID != "":
+					res.Parsed++
+					res.Studies[info.StudyInstanceUID] = append(res.Studies[info.StudyInstanceUID], *info)
+				default:
+					// Not a valid DICOM instance for our purposes.
+					res.Parsed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, obj := range objects {
+		select {
+		case jobs <- obj:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res.ParseErrors = int(parseErrors.Load())
+
+	// Workers finish in any order; keep the output stable.
+	for uid := range res.Studies {
+		insts := res.Studies[uid]
+		sort.Slice(insts, func(i, j int) bool { return insts[i].ObjectName < insts[j].ObjectName })
+	}
+	sort.Slice(res.NonDicom, func(i, j int) bool { return res.NonDicom[i].ObjectName < res.NonDicom[j].ObjectName })
+	return res, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dicomTestElement appends one explicit VR little endian element.
+func dicomTestElement(buf *bytes.Buffer, group, elem uint16, vr string, value []byte) {
+	if len(value)%2 == 1 {
+		pad := byte(' ')
+		if vr == "UI" || vr == "OB" {
+			pad = 0
+		}
+		value = append(value, pad)
+	}
+	binary.Write(buf, binary.LittleEndian, group)
+	binary.Write(buf, binary.LittleEndian, elem)
+	buf.WriteString(vr)
+	switch vr {
+	case "OB", "OW", "SQ", "UN", "UT":
+		buf.Write([]byte{0, 0})
+		binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+	default:
+		binary.Write(buf, binary.LittleEndian, uint16(len(value)))
+	}
+	buf.Write(value)
+}
+
+// syntheticDicom builds a minimal Part 10 CT instance. headerPad adds a
+// private OB element of that size before PixelData to make the header large.
+func syntheticDicom(studyUID, seriesUID, sopUID string, z float64, pixelBytes, headerPad int) []byte {
+	var meta bytes.Buffer
+	dicomTestElement(&meta, 0x0002, 0x0002, "UI", []byte("1.2.840.10008.5.1.4.1.1.2"))
+	dicomTestElement(&meta, 0x0002, 0x0003, "UI", []byte(sopUID))
+	dicomTestElement(&meta, 0x0002, 0x0010, "UI", []byte("1.2.840.10008.1.2.1"))
+
+	var out bytes.Buffer
+	out.Write(make([]byte, 128))
+	out.WriteString("DICM")
+	groupLen := make([]byte, 4)
+	binary.LittleEndian.PutUint32(groupLen, uint32(meta.Len()))
+	dicomTestElement(&out, 0x0002, 0x0000, "UL", groupLen)
+	out.Write(meta.Bytes())
+
+	us := func(v uint16) []byte { b := make([]byte, 2); binary.LittleEndian.PutUint16(b, v); return b }
+	dicomTestElement(&out, 0x0008, 0x0016, "UI", []byte("1.2.840.10008.5.1.4.1.1.2"))
+	dicomTestElement(&out, 0x0008, 0x0018, "UI", []byte(sopUID))
+	dicomTestElement(&out, 0x0008, 0x0020, "DA", []byte("20260101"))
+	dicomTestElement(&out, 0x0008, 0x0060, "CS", []byte("CT"))
+	dicomTestElement(&out, 0x0019, 0x0010, "LO", []byte("SYNTHETIC"))
+	if headerPad > 0 {
+		dicomTestElement(&out, 0x0019, 0x1001, "OB", make([]byte, headerPad))
+	}
+	dicomTestElement(&out, 0x0020, 0x000D, "UI", []byte(studyUID))
+	dicomTestElement(&out, 0x0020, 0x000E, "UI", []byte(seriesUID))
+	dicomTestElement(&out, 0x0020, 0x0032, "DS", []byte(fmt.Sprintf(`0\0\%g`, z)))
+	dicomTestElement(&out, 0x0020, 0x0037, "DS", []byte(`1\0\0\0\1\0`))
+	side := uint16(1)
+	for int(side)*int(side)*2 < pixelBytes {
+		side++
+	}
+	dicomTestElement(&out, 0x0028, 0x0002, "US", us(1))
+	dicomTestElement(&out, 0x0028, 0x0010, "US", us(side))
+	dicomTestElement(&out, 0x0028, 0x0011, "US", us(side))
+	dicomTestElement(&out, 0x0028, 0x0100, "US", us(16))
+	dicomTestElement(&out, 0x0028, 0x0101, "US", us(16))
+	dicomTestElement(&out, 0x0028, 0x0102, "US", us(15))
+	dicomTestElement(&out, 0x0028, 0x0103, "US", us(0))
+	dicomTestElement(&out, 0x7FE0, 0x0010, "OW", make([]byte, int(side)*int(side)*2))
+	return out.Bytes()
+}
+
+func writeTestBlob(t testing.TB, root, bucket, name string, data []byte) {
+	t.Helper()
+	path := filepath.Join(root, bucket, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDicomHeaderPrefix(t *testing.T) {
+	file := syntheticDicom("1.2.3", "1.2.3.4", "1.2.3.4.5", 0, 128<<10, 0)
+	size := int64(len(file))
+
+	ds, err := parseDicomHeaderPrefix(file[:4096], size)
+	if err != nil {
+		t.Fatalf("header prefix: %v", err)
+	}
+	if info := instanceInfoFromDataset(ds); info.SOPInstanceUID != "1.2.3.4.5" || info.Rows == 0 {
+		t.Errorf("info = %+v", info)
+	}
+
+	if _, err := parseDicomHeaderPrefix(file[:300], size); !errors.Is(err, errHeaderTruncated) {
+		t.Errorf("cut inside header: err = %v, want errHeaderTruncated", err)
+	}
+
+	if _, err := parseDicomHeaderPrefix(file, size); err != nil {
+		t.Errorf("whole file: %v", err)
+	}
+
+	// A 200 KiB header seen through a 64 KiB prefix of an object listed as
+	// 300 MB must ask for more rather than parse past the prefix.
+	large := syntheticDicom("1.2.3", "1.2.3.4", "1.2.3.4.6", 0, 4096, 200<<10)
+	const listed = 300 << 20
+	start := time.Now()
+	if _, err := parseDicomHeaderPrefix(large[:64<<10], listed); !errors.Is(err, errHeaderTruncated) {
+		t.Errorf("large header, short prefix: err = %v, want errHeaderTruncated", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("truncated parse took %v", d)
+	}
+	// Once the prefix covers the PixelData header, the rest is not needed.
+	ds, err = parseDicomHeaderPrefix(large[:len(large)-1000], listed)
+	if err != nil {
+		t.Fatalf("large header, prefix into PixelData: %v", err)
+	}
+	if info := instanceInfoFromDataset(ds); info.SOPInstanceUID != "1.2.3.4.6" {
+		t.Errorf("info = %+v", info)
+	}
+}
+
+func TestScanDicomHeaders(t *testing.T) {
+	root := t.TempDir()
+	const bucket, prefix = "vault", "u1/SESS-1/"
+	writeTestBlob(t, root, bucket, prefix+"a.dcm", syntheticDicom("1.2.3", "1.2.3.4", "1.2.3.4.1", 0, 4096, 0))
+	writeTestBlob(t, root, bucket, prefix+"b.dcm", syntheticDicom("1.2.3", "1.2.3.4", "1.2.3.4.2", 2.5, 4096, 200<<10))
+	writeTestBlob(t, root, bucket, prefix+"c.dcm", syntheticDicom("1.2.9", "1.2.9.4", "1.2.9.4.1", 0, 4096, 0))
+	writeTestBlob(t, root, bucket, prefix+"notes.txt", bytes.Repeat([]byte("hello world\n"), 100))
+	writeTestBlob(t, root, bucket, "u1/OTHER/d.dcm", syntheticDicom("1.2.8", "1.2.8.4", "1.2.8.4.1", 0, 4096, 0))
+
+	store := localBlobStore{root: root}
+	objects, err := store.List(context.Background(), bucket, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := scanDicomHeaders(context.Background(), store, bucket, objects, 3)
+	if err != nil {
+		t.Fatalf("scanDicomHeaders: %v", err)
+	}
+	if res.Total != 4 || res.Parsed != 3 || res.ParseErrors != 0 {
+		t.Errorf("counts total=%d parsed=%d errors=%d", res.Total, res.Parsed, res.ParseErrors)
+	}
+	if got := res.Studies["1.2.3"]; len(got) != 2 || got[0].SOPInstanceUID != "1.2.3.4.1" || got[1].SOPInstanceUID != "1.2.3.4.2" {
+		t.Errorf("study 1.2.3 = %+v", got)
+	} else if got[1].ImagePositionPatient == nil || got[1].ImagePositionPatient[2] != 2.5 {
+		t.Errorf("large-header instance IPP = %v", got[1].ImagePositionPatient)
+	}
+	if len(res.Studies["1.2.9"]) != 1 || len(res.Studies) != 2 {
+		t.Errorf("studies = %v", res.Studies)
+	}
+	if len(res.NonDicom) != 1 || res.NonDicom[0].ObjectName != prefix+"notes.txt" {
+		t.Errorf("non-DICOM = %+v", res.NonDicom)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := scanDicomHeaders(ctx, store, bucket, objects, 3); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled scan: err = %v, want context.Canceled", err)
+	}
+}
+
+// BenchmarkScanDicomHeaders scans a local blob store of synthetic 512 KiB CT
+// slices with a single worker versus a pool.
+func BenchmarkScanDicomHeaders(b *testing.B) {
+	root := b.TempDir()
+	const bucket, prefix, n = "vault", "u1/SESS-BENCH/", 300
+	for i := 0; i < n; i++ {
+		data := syntheticDicom("1.2.3", "1.2.3.4", fmt.Sprintf("1.2.3.4.%d", i+1), float64(i), 512<<10, 0)
+		writeTestBlob(b, root, bucket, fmt.Sprintf("%sslice%04d.dcm", prefix, i), data)
+	}
+	store := localBlobStore{root: root}
+	objects, err := store.List(context.Background(), bucket, prefix)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res, err := scanDicomHeaders(context.Background(), store, bucket, objects, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if res.Parsed != n {
+					b.Fatalf("parsed %d of %d", res.Parsed, n)
+				}
+			}
+		})
+	}
+}
@@ -11,9 +11,6 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
-	"google.golang.org/api/iterator"
-
 	"github.com/suyashkumar/dicom"
 	_ "github.com/suyashkumar/dicom/pkg/frame" // not used
 	"github.com/suyashkumar/dicom/pkg/tag"
@@ -55,8 +52,9 @@ type pubsubPushEnvelope struct {
 
 // DicomIngester wraps the Cloud Healthcare API client for DICOM operations.
 type DicomIngester struct {
-	cfg     Config
-	service *healthcare.Service
+	cfg      Config
+	service  *healthcare.Service
+	progress func(ImportProgress)
 }
 
 // NewDicomIngester creates a Healthcare API client using ADC.
@@ -71,6 +69,29 @@ func NewDicomIngester(ctx context.Context, cfg Config) (*DicomIngester, error) {
 	}, nil
 }
 
+// OnProgress registers a callback invoked with the operation's progress
+// counters each time WaitForOperation polls.
+func (di *DicomIngester) OnProgress(fn func(ImportProgress)) {
+	di.progress = fn
+}
+
+// reportProgress decodes the LRO metadata counters and passes them to the
+// progress callback, if any.
+func (di *DicomIngester) reportProgress(metadata googleapi.RawMessage) {
+	if di.progress == nil || len(metadata) == 0 {
+		return
+	}
+	var meta healthcare.OperationMetadata
+	if err := json.Unmarshal(metadata, &meta); err != nil || meta.Counter == nil {
+		return
+	}
+	di.progress(ImportProgress{
+		Success: meta.Counter.Success,
+		Failure: meta.Counter.Failure,
+		Pending: meta.Counter.Pending,
+	})
+}
+
 func (di *DicomIngester) dicomStoreName() string {
 	return fmt.Sprintf(
 		"projects/%s/locations/%s/datasets/%s/dicomStores/%s",
@@ -188,8 +209,19 @@ func indentJSON(raw json.RawMessage) string {
 	return buf.String()
 }
 
+// ImportOperationResult carries the classified error details of a finished
+// import LRO so callers can attribute failures to individual files.
+type ImportOperationResult struct {
+	Code              int64
+	Message           string
+	DuplicateMessages []string // ALREADY_EXISTS style details
+	ErrorMessages     []string // every other failure detail
+}
+
 // WaitForOperation polls the given long-running operation until completion or context cancel.
-func (di *DicomIngester) WaitForOperation(ctx context.Context, opName string) error {
+// The returned result is non-nil whenever the operation finished, even if it
+// failed, so per-file outcomes can be derived from its details.
+func (di *DicomIngester) WaitForOperation(ctx context.Context, opName string) (*ImportOperationResult, error) {
 	ops := di.service.Projects.Locations.Datasets.Operations
 
 	log.Printf("WaitForOperation: starting poll for %s", opName)
@@ -201,21 +233,28 @@ func (di *DicomIngester) WaitForOperation(ctx context.Context, opName string) er
 		select {
 		case <-ctx.Done():
 			log.Printf("WaitForOperation: context cancelled for %s: %v", opName, ctx.Err())
-			return ctx.Err()
+			return nil, ctx.Err()
 		case <-ticker.C:
 			op, err := ops.Get(opName).Context(ctx).Do()
 			if err != nil {
 				log.Printf("WaitForOperation: operations.Get(%s) error: %v", opName, err)
-				return fmt.Errorf("operations.Get(%s): %w", opName, err)
+				return nil, fmt.Errorf("operations.Get(%s): %w", opName, err)
 			}
 
 			log.Printf("WaitForOperation: op=%s done=%v", op.Name, op.Done)
+			di.reportProgress(op.Metadata)
 
 			if op.Done {
 				if op.Error != nil {
 					dupMsgs, otherMsgs := summarizeStatusDetails(op.Error.Details)
 					code := op.Error.Code
 					msg := op.Error.Message
+					result := &ImportOperationResult{
+						Code:              code,
+						Message:           msg,
+						DuplicateMessages: dupMsgs,
+						ErrorMessages:     otherMsgs,
+					}
 
 					if meta := indentJSON(json.RawMessage(op.Metadata)); meta != "" {
 						log.Printf("WaitForOperation: op %s metadata: %s", opName, meta)
@@ -236,15 +275,15 @@ func (di *DicomIngester) WaitForOperation(ctx context.Context, opName string) er
 							preview = preview[:300] + "..."
 						}
 						log.Printf("WaitForOperation: op %s had duplicate/exists errors only (code=%d), treating as success. First duplicate: %s", opName, code, preview)
-						return nil
+						return result, nil
 					}
 
 					log.Printf("WaitForOperation: op %s failed: %s (code=%d duplicates=%d other_errors=%d)", opName, msg, code, len(dupMsgs), len(otherMsgs))
-					return fmt.Errorf("dicom import failed: %s (code=%d duplicates=%d other_errors=%d)", msg, code, len(dupMsgs), len(otherMsgs))
+					return result, fmt.Errorf("dicom import failed: %s (code=%d duplicates=%d other_errors=%d)", msg, code, len(dupMsgs), len(otherMsgs))
 				}
 
 				log.Printf("WaitForOperation: op %s completed successfully", opName)
-				return nil
+				return &ImportOperationResult{}, nil
 			}
 		}
 	}
@@ -312,8 +351,8 @@ func (di *DicomIngester) WaitForOperation(ctx context.Context, opName string) er
 //	}
 //}
 
-// dicomInstanceInfo captures the minimal DICOM header info we care about
-// for grouping logical studies.
+// dicomInstanceInfo captures the DICOM header info we care about for
+// grouping logical studies and for the imaging_instances catalog.
 type dicomInstanceInfo struct {
 	StudyInstanceUID  string
 	SeriesInstanceUID string
@@ -321,6 +360,30 @@ type dicomInstanceInfo struct {
 	Modality          string
 	StudyDate         string
 	StudyDescription  string
+
+	SeriesNumber      int
+	SeriesDescription string
+	InstanceNumber    int
+	SOPClassUID       string
+	TransferSyntaxUID string
+
+	Rows                    int
+	Columns                 int
+	NumberOfFrames          int
+	SliceThickness          float64
+	PixelSpacing            []float64
+	ImagePositionPatient    []float64
+	ImageOrientationPatient []float64
+	FrameOfReferenceUID     string
+
+	BodyPartExamined      string
+	AcquisitionDate       string
+	AcquisitionTime       string
+	Manufacturer          string
+	ManufacturerModelName string
+
+	ObjectName string
+	SizeBytes  int64
 }
 
 // getStringByTag extracts the first string value for the given tag from
@@ -332,7 +395,12 @@ func getStringByTag(ds *dicom.Dataset, t tag.Tag) string {
 		return ""
 	}
 	el, err := ds.FindElementByTag(t)
-	if err != nil || el == nil {
+	if err != nil || el == nil || el.Value == nil {
+		return ""
+	}
+	// MustGetStrings panics on non-string values, which malformed uploads
+	// (wrong VR for a UID tag, for example) can produce.
+	if el.Value.ValueType() != dicom.Strings {
 		return ""
 	}
 	vals := dicom.MustGetStrings(el.Value)
@@ -372,30 +440,6 @@ func getStringByTag(ds *dicom.Dataset, t tag.Tag) string {
 //	return strings.TrimSpace(el.String())
 //}
 
-// looksLikeDicomObjectName is a conservative filter to skip obviously-non-DICOM files.
-func looksLikeDicomObjectName(name string) bool {
-	name = strings.ToLower(name)
-	if strings.HasSuffix(name, "/") {
-		return false
-	}
-	if strings.HasSuffix(name, ".dcm") || strings.HasSuffix(name, ".dicom") {
-		return true
-	}
-	// Skip obvious non-DICOM extensions.
-	if strings.HasSuffix(name, ".txt") || strings.HasSuffix(name, ".pdf") ||
-		strings.HasSuffix(name, ".csv") || strings.HasSuffix(name, ".json") ||
-		strings.HasSuffix(name, ".xml") || strings.HasSuffix(name, ".zip") ||
-		strings.HasSuffix(name, ".md") || strings.HasSuffix(name, ".html") ||
-		strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".png") ||
-		strings.HasSuffix(name, ".jpg") || strings.HasSuffix(name, ".jpeg") ||
-		strings.HasSuffix(name, ".gif") || strings.HasSuffix(name, ".mp4") ||
-		strings.HasSuffix(name, ".mov") {
-		return false
-	}
-	// Allow names with dots (SOP Instance UIDs) even without extensions.
-	return true
-}
-
 // ////////////////////////////////////////////////////////////////
 //
 //	  SCAN DICOM INSTANCES in GCS bucket that were just uploaded
@@ -415,120 +459,42 @@ func looksLikeDicomObjectName(name string) bool {
 //
 // collectDicomInstances scans all objects under the given GCS prefix and
 // returns a map keyed by StudyInstanceUID with the per-instance header info.
-func (h *Handlers) collectDicomInstances(ctx context.Context, gcsPrefix string) (map[string][]dicomInstanceInfo, error) {
-	if !strings.HasPrefix(gcsPrefix, "gs://") {
-		return nil, fmt.Errorf("gcsPrefix must start with gs://, got %q", gcsPrefix)
+// Objects are classified by content (preamble + DICM magic, or a plausible
+// preamble-less data element) rather than by name; anything that does not
+// look like DICOM is returned in the non-DICOM report with its detected type.
+func (h *Handlers) collectDicomInstances(ctx context.Context, gcsPrefix string) (map[string][]dicomInstanceInfo, []NonDicomFile, error) {
+	bucketName, objectPrefix, err := splitGCSPrefix(gcsPrefix)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Split gs://bucket/prefix...
-	trimmed := strings.TrimPrefix(gcsPrefix, "gs://")
-	parts := strings.SplitN(trimmed, "/", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid gcsPrefix %q", gcsPrefix)
+	store := h.blobStore()
+	if store == nil {
+		return nil, nil, fmt.Errorf("storage client not initialized on Handlers")
 	}
-	bucketName := parts[0]
-	objectPrefix := parts[1]
 
-	if h.Storage == nil {
-		return nil, fmt.Errorf("storage client not initialized on Handlers")
+	listed, err := store.List(ctx, bucketName, objectPrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("iterate GCS objects under %s: %w", gcsPrefix, err)
 	}
-
-	studies := make(map[string][]dicomInstanceInfo)
-
-	it := h.Storage.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: objectPrefix})
-
-	var totalObjects, candidateObjects, parsedObjects, parseErrors int
-	var skippedSamples []string
-
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("iterate GCS objects under %s: %w", gcsPrefix, err)
-		}
-		totalObjects++
-
-		if !looksLikeDicomObjectName(attrs.Name) {
-			if len(skippedSamples) < 5 {
-				skippedSamples = append(skippedSamples, attrs.Name)
-			}
+	objects := make([]BlobAttrs, 0, len(listed))
+	for _, obj := range listed {
+		if strings.HasSuffix(obj.Name, "/") {
+			// Folder placeholder objects created by some upload tools.
 			continue
 		}
-		candidateObjects++
-
-		rc, err := h.Storage.Bucket(bucketName).Object(attrs.Name).NewReader(ctx)
-		if err != nil {
-			log.Printf("collectDicomInstances: open %s: %v", attrs.Name, err)
-			continue
-		}
-
-		ds, err := dicom.Parse(rc, attrs.Size, nil, dicom.SkipPixelData())
-		closeErr := rc.Close()
-		if err != nil {
-			parseErrors++
-			log.Printf("collectDicomInstances: Parse(%s): %v", attrs.Name, err)
-			continue
-		}
-		if closeErr != nil {
-			log.Printf("collectDicomInstances: close(%s): %v", attrs.Name, closeErr)
-		}
-		parsedObjects++
-
-		// ds is a dicom.Dataset value; pass pointer into your helper:
-		studyUID := getStringByTag(&ds, tag.StudyInstanceUID)
-		seriesUID := getStringByTag(&ds, tag.SeriesInstanceUID)
-		sopUID := getStringByTag(&ds, tag.SOPInstanceUID)
-		modality := getStringByTag(&ds, tag.Modality)
-		studyDate := getStringByTag(&ds, tag.StudyDate)
-		desc := getStringByTag(&ds, tag.StudyDescription)
-
-		//// Open the object and parse just the header (drop pixel data).
-		//rc, err := h.Storage.Bucket(bucketName).Object(attrs.Name).NewReader(ctx)
-		//if err != nil {
-		//	log.Printf("collectDicomInstances: open %s: %v", attrs.Name, err)
-		//	continue
-		//}
-		//
-		//// Parse with DropPixelData to only read headers
-		//ds, err := dicom.ParseFile(rc, rc.Size(), dicom.SkipPixelData())
-		//_ = rc.Close()
-		//if err != nil {
-		//	log.Printf("collectDicomInstances: ParseFile(%s): %v", attrs.Name, err)
-		//	continue
-		//}
-		//
-		//studyUID := getStringByTag(&ds, tag.StudyInstanceUID)
-		//seriesUID := getStringByTag(&ds, tag.SeriesInstanceUID)
-		//sopUID := getStringByTag(&ds, tag.SOPInstanceUID)
-		//modality := getStringByTag(&ds, tag.Modality)
-		//studyDate := getStringByTag(&ds, tag.StudyDate)
-		//desc := getStringByTag(&ds, tag.StudyDescription)
-
-		if studyUID == "" || sopUID == "" {
-			// Not a valid DICOM instance for our purposes.
-			continue
-		}
-
-		info := dicomInstanceInfo{
-			StudyInstanceUID:  studyUID,
-			SeriesInstanceUID: seriesUID,
-			SOPInstanceUID:    sopUID,
-			Modality:          modality,
-			StudyDate:         studyDate,
-			StudyDescription:  desc,
-		}
-
-		studies[studyUID] = append(studies[studyUID], info)
+		objects = append(objects, obj)
 	}
 
-	log.Printf("collectDicomInstances: scanned bucket=%s prefix=%s total=%d candidates=%d parsed=%d parseErrors=%d studies=%d", bucketName, objectPrefix, totalObjects, candidateObjects, parsedObjects, parseErrors, len(studies))
-	if candidateObjects == 0 && len(skippedSamples) > 0 {
-		log.Printf("collectDicomInstances: sample skipped objects (treated as non-DICOM): %v", skippedSamples)
+	// Headers are fetched with ranged reads and parsed concurrently.
+	scan, err := scanDicomHeaders(ctx, store, bucketName, objects, h.Cfg.HeaderScanWorkers)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return studies, nil
+	log.Printf("collectDicomInstances: scanned bucket=%s prefix=%s total=%d parsed=%d parseErrors=%d nonDicom=%d studies=%d", bucketName, objectPrefix, scan.Total, scan.Parsed, scan.ParseErrors, len(scan.NonDicom), len(scan.Studies))
+
+	return scan.Studies, scan.NonDicom, nil
 }
 
 // //////////////////////////////////////////////////////////////////////
@@ -555,10 +521,12 @@ func (h *Handlers) collectDicomInstances(ctx context.Context, gcsPrefix string)
 //			}
 //
 // createImagingStudiesFromInstances groups instances by StudyInstanceUID and
-// writes one ImagingStudy document per study.
-func (h *Handlers) createImagingStudiesFromInstances(ctx context.Context, sess *UploadSession, gcsPrefix string, studies map[string][]dicomInstanceInfo) error {
+// upserts one ImagingStudy document per (user, study). files carry the
+// per-file import outcomes; imported bytes are charged to the session's
+// quotas, and only imported or duplicate instances are rolled up.
+func (h *Handlers) createImagingStudiesFromInstances(ctx context.Context, sess *UploadSession, gcsPrefix string, studies map[string][]dicomInstanceInfo, files []*UploadFile) error {
 	if len(studies) == 0 {
-		return fmt.Errorf("no DICOM studies detected under %s", gcsPrefix)
+		return permanentIngestError("no_studies", fmt.Errorf("no DICOM studies detected under %s", gcsPrefix))
 	}
 
 	dicomStorePath := fmt.Sprintf(
@@ -569,7 +537,16 @@ func (h *Handlers) createImagingStudiesFromInstances(ctx context.Context, sess *
 		h.Cfg.HealthcareStoreID,
 	)
 
-	for studyUID, instances := range studies {
+	studyBytes := importedBytesByStudy(files)
+	for studyUID, scanned := range studies {
+		// The prefix may hold objects the import rejected or that arrived
+		// after it ran; only what is in the DICOM store is rolled up and
+		// cataloged.
+		instances := ingestedInstances(scanned, files)
+		if len(instances) == 0 {
+			log.Printf("createImagingStudiesFromInstances: no imported instances for study %s under %s", studyUID, gcsPrefix)
+			continue
+		}
 		seriesSet := make(map[string]struct{})
 		modalitySet := make(map[string]struct{})
 
@@ -600,10 +577,16 @@ func (h *Handlers) createImagingStudiesFromInstances(ctx context.Context, sess *
 			modalities = append(modalities, m)
 		}
 
-		studyID, err := randomTokenID("STUDY", 10)
-		if err != nil {
-			return fmt.Errorf("randomTokenID for study: %w", err)
+		// One document per (user, StudyInstanceUID): redelivered messages and
+		// later sessions for the same study land on the same document. Older
+		// studies with random IDs are merged into rather than duplicated.
+		studyID := deterministicTokenID("STUDY", sess.UserID, studyUID)
+		if existing, err := h.DB.GetImagingStudyForUser(ctx, sess.UserID, studyUID); err != nil {
+			return err
+		} else if existing != nil {
+			studyID = existing.StudyID
 		}
+		now := time.Now().UTC()
 
 		study := &ImagingStudy{
 			StudyID:            studyID,
@@ -615,14 +598,55 @@ func (h *Handlers) createImagingStudiesFromInstances(ctx context.Context, sess *
 			StudyDate:          studyDate,
 			StudyDescription:   studyDescription,
 			NumInstances:       len(instances),
+			SizeBytes:          studyBytes[studyUID],
+			ProviderOrgID:      sess.ProviderOrgID,
 			GCSPrefix:          gcsPrefix,
 			DicomStorePath:     dicomStorePath,
-			CreatedAt:          time.Now().UTC(),
+			CreatedAt:          now,
+			UpdatedAt:          now,
 		}
 
-		if err := h.DB.CreateImagingStudy(ctx, study); err != nil {
+		created, deltaBytes, err := h.DB.UpsertImagingStudy(ctx, study)
+		if err != nil {
 			return err
 		}
+		deltaStudies := int64(0)
+		if created {
+			deltaStudies = 1
+		}
+		if deltaBytes != 0 || deltaStudies != 0 {
+			if err := h.DB.AddUsage(ctx, quotaScopesForSession(sess.UserID, sess.ProviderOrgID), deltaBytes, deltaStudies); err != nil {
+				log.Printf("createImagingStudiesFromInstances: AddUsage(%s): %v", study.StudyID, err)
+			}
+		}
+		if err := h.DB.UpsertImagingInstances(ctx, newImagingInstances(study.StudyID, sess, instances)); err != nil {
+			return err
+		}
+		if err := h.DB.SyncImagingStudyInstanceCount(ctx, study.StudyID, sess.SessionID); err != nil {
+			return err
+		}
+		if err := h.refreshImagingSeries(ctx, study.StudyID, sess.UserID); err != nil {
+			return err
+		}
+		if h.Cfg.AutoIndexOnIngest {
+			// New instances make any existing index stale, so updated
+			// studies are re-queued as well. Indexing can always be
+			// requested again, so a failure here does not fail the ingest.
+			if _, _, err := h.enqueueStudyIndex(ctx, study); err != nil {
+				log.Printf("createImagingStudiesFromInstances: enqueueStudyIndex(%s): %v", study.StudyID, err)
+			}
+		}
+
+		evType := UploadEventStudyUpdated
+		if created {
+			evType = UploadEventStudyCreated
+		}
+		h.Events.Publish(UploadEvent{
+			Type:             evType,
+			SessionID:        sess.SessionID,
+			StudyID:          study.StudyID,
+			StudyInstanceUID: studyUID,
+		})
 	}
 
 	return nil
@@ -630,16 +654,24 @@ func (h *Handlers) createImagingStudiesFromInstances(ctx context.Context, sess *
 
 // handleIngestMessage performs the full ingest flow for a single message:
 // - validate and load the UploadSession
+// - validate uploaded objects, quarantining failures
 // - mark it as importing
 // - start DICOM import from GCS prefix
 // - wait for completion
 // - group instances into ImagingStudy docs
-// - set status to ready or error accordingly.
+// - set status to ready, or record the error message on failure.
+//
+// A failed attempt leaves the session status alone: the worker pool sets it
+// to retrying or error once it knows whether the job is retried.
+//
+// When job is non-nil each completed step is checkpointed on the job record,
+// and steps the job already completed on a previous attempt are skipped so a
+// crashed or expired run resumes where it left off.
 //
 //	THIS IS THE MAIN INGESTION POINT INTO GOOGLE DICOM STORE
-func (h *Handlers) handleIngestMessage(ctx context.Context, msg IngestMessage) error {
+func (h *Handlers) handleIngestMessage(ctx context.Context, msg IngestMessage, job *IngestJob) error {
 	if strings.TrimSpace(msg.SessionID) == "" || strings.TrimSpace(msg.GCSPrefix) == "" {
-		return fmt.Errorf("missing session_id or gcs_prefix in message")
+		return permanentIngestError("bad_message", fmt.Errorf("missing session_id or gcs_prefix in message"))
 	}
 
 	// Load the upload session.
@@ -648,117 +680,248 @@ func (h *Handlers) handleIngestMessage(ctx context.Context, msg IngestMessage) e
 		return fmt.Errorf("GetUploadSession(%s): %w", msg.SessionID, err)
 	}
 	if sess == nil {
-		return fmt.Errorf("upload session %s not found", msg.SessionID)
+		return permanentIngestError("session_not_found", fmt.Errorf("upload session %s not found", msg.SessionID))
+	}
+
+	// Validate every uploaded object before import. Non-DICOM files and
+	// malformed instances are moved to the quarantine prefix so the bulk
+	// import only sees importable files.
+	var files []*UploadFile
+	var nonDicom []NonDicomFile
+	if job.completed(IngestStepValidated) {
+		// Validation results were persisted by the previous attempt.
+		if files, err = h.DB.ListUploadFiles(ctx, msg.SessionID); err != nil {
+			return fmt.Errorf("ListUploadFiles: %w", err)
+		}
+		nonDicom = sess.NonDicomFiles
+	} else {
+		if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+			"status":        "validating",
+			"error_message": "",
+		}); err != nil {
+			return fmt.Errorf("UpdateUploadSessionStatus(validating): %w", err)
+		}
+		validation, err := h.validateUploadedObjects(ctx, msg.GCSPrefix, func(scanned int) {
+			h.Events.Publish(UploadEvent{Type: UploadEventFilesScanned, SessionID: msg.SessionID, FilesScanned: scanned})
+		})
+		if err != nil {
+			_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"error_message": fmt.Sprintf("validateUploadedObjects: %v", err),
+			})
+			return err
+		}
+		report := validation.Report
+		files, nonDicom = validation.Files, validation.NonDicom
+		if err := h.DB.UpsertUploadFiles(ctx, msg.SessionID, files); err != nil {
+			return fmt.Errorf("UpsertUploadFiles(validated): %w", err)
+		}
+		if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+			"validation_report": report,
+			"non_dicom_files":   nonDicom,
+		}); err != nil {
+			return fmt.Errorf("UpdateUploadSessionStatus(validation_report): %w", err)
+		}
+		if report.Passed == 0 {
+			errMsg := fmt.Sprintf("no valid DICOM files under %s (failed=%d non_dicom=%d)", msg.GCSPrefix, report.Failed, len(nonDicom))
+			_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"error_message": errMsg,
+			})
+			return permanentIngestError("no_valid_dicom", fmt.Errorf("%s", errMsg))
+		}
+		if err := h.DB.CheckpointIngestJob(ctx, job, IngestStepValidated, nil); err != nil {
+			return err
+		}
 	}
 
-	// Mark as importing and store GCS prefix (and clear any previous error).
-	if err := h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
-		"status":                 "importing",
-		"error_message":          "",
-		"gcs_prefix":             msg.GCSPrefix,
-		"dicom_import_operation": "",
-	}); err != nil {
-		return fmt.Errorf("UpdateUploadSessionStatus(importing): %w", err)
+	// With ingest-time de-identification, only the de-identified copies
+	// under the deid prefix are imported and cataloged.
+	ingestPrefix := msg.GCSPrefix
+	if h.Cfg.DeidOnIngest {
+		if ingestPrefix, err = h.deidGCSPrefix(msg.GCSPrefix); err != nil {
+			return permanentIngestError("bad_message", err)
+		}
 	}
-
-	// Create a DICOM ingester for this request.
-	ingester, err := NewDicomIngester(ctx, h.Cfg)
-	if err != nil {
-		// Mark error and return.
-		_ = h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
-			"status":        "error",
-			"error_message": fmt.Sprintf("NewDicomIngester: %v", err),
-		})
-		return err
+	if h.Cfg.DeidOnIngest && !job.completed(IngestStepDeidentified) {
+		if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+			"status":        "deidentifying",
+			"error_message": "",
+		}); err != nil {
+			return fmt.Errorf("UpdateUploadSessionStatus(deidentifying): %w", err)
+		}
+		bucketName, _, _ := splitGCSPrefix(msg.GCSPrefix)
+		derr := h.deidentifyUploadedFiles(ctx, sess, bucketName, files)
+		if uerr := h.DB.UpsertUploadFiles(ctx, msg.SessionID, files); uerr != nil {
+			log.Printf("handleIngestMessage: UpsertUploadFiles(deidentified) error: %v", uerr)
+		}
+		if derr != nil {
+			_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"error_message": fmt.Sprintf("deidentifyUploadedFiles: %v", derr),
+			})
+			return derr
+		}
+		if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+			"deid_prefix": ingestPrefix,
+		}); err != nil {
+			return fmt.Errorf("UpdateUploadSessionStatus(deid_prefix): %w", err)
+		}
+		if err := h.DB.CheckpointIngestJob(ctx, job, IngestStepDeidentified, nil); err != nil {
+			return err
+		}
 	}
 
-	opName, err := ingester.ImportAllFromPrefix(ctx, msg.GCSPrefix)
-	if err != nil {
-		_ = h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
-			"status":        "error",
-			"error_message": fmt.Sprintf("ImportAllFromPrefix: %v", err),
+	if !job.completed(IngestStepImported) && h.Cfg.IngestMode == IngestModeStow {
+		if err := h.ingestViaStow(ctx, msg, files); err != nil {
+			return err
+		}
+		if err := h.DB.CheckpointIngestJob(ctx, job, IngestStepImported, nil); err != nil {
+			return err
+		}
+	} else if !job.completed(IngestStepImported) {
+		// Create a DICOM ingester for this request.
+		ingester, err := NewDicomIngester(ctx, h.Cfg)
+		if err != nil {
+			// Record the error and return.
+			_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"error_message": fmt.Sprintf("NewDicomIngester: %v", err),
+			})
+			return err
+		}
+		ingester.OnProgress(func(p ImportProgress) {
+			h.Events.Publish(UploadEvent{Type: UploadEventImportProgress, SessionID: msg.SessionID, Import: &p})
 		})
-		return err
-	}
-	log.Printf("handleIngestMessage: started import op %s for session %s", opName, msg.SessionID)
 
-	// Persist operation name for debugging / later re-checks.
-	if err := h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
-		"dicom_import_operation": opName,
-	}); err != nil {
-		return fmt.Errorf("UpdateUploadSessionStatus(set opName): %w", err)
+		var opName string
+		if job.completed(IngestStepImportStarted) {
+			// The import LRO outlives our process; pick it up again.
+			opName = job.ImportOperation
+			log.Printf("handleIngestMessage: resuming wait on import op %s for session %s", opName, msg.SessionID)
+		} else {
+			// Mark as importing and store GCS prefix (and clear any previous error).
+			if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"status":                 "importing",
+				"error_message":          "",
+				"gcs_prefix":             msg.GCSPrefix,
+				"dicom_import_operation": "",
+			}); err != nil {
+				return fmt.Errorf("UpdateUploadSessionStatus(importing): %w", err)
+			}
+
+			opName, err = ingester.ImportAllFromPrefix(ctx, ingestPrefix)
+			if err != nil {
+				_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+					"error_message": fmt.Sprintf("ImportAllFromPrefix: %v", err),
+				})
+				return err
+			}
+			log.Printf("handleIngestMessage: started import op %s for session %s", opName, msg.SessionID)
+
+			// Persist operation name for debugging / later re-checks.
+			if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"dicom_import_operation": opName,
+			}); err != nil {
+				return fmt.Errorf("UpdateUploadSessionStatus(set opName): %w", err)
+			}
+			if err := h.DB.CheckpointIngestJob(ctx, job, IngestStepImportStarted, map[string]interface{}{
+				"import_operation": opName,
+			}); err != nil {
+				return err
+			}
+		}
+
+		// Block until import is done. Cycles around while polling until it
+		// throws err; 'done' =  err
+		importResult, err := ingester.WaitForOperation(ctx, opName)
+		if importResult != nil {
+			bucketName, _, _ := splitGCSPrefix(msg.GCSPrefix)
+			applyImportResult(files, bucketName, importResult, err)
+			if uerr := h.DB.UpsertUploadFiles(ctx, msg.SessionID, files); uerr != nil {
+				log.Printf("handleIngestMessage: UpsertUploadFiles(import outcome) error: %v", uerr)
+			}
+		}
+		if err != nil {
+			_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"error_message": err.Error(),
+			})
+			return classifyImportFailure(importResult, err)
+		}
+		if err := h.DB.CheckpointIngestJob(ctx, job, IngestStepImported, nil); err != nil {
+			return err
+		}
 	}
 
-	// Block until import is done (for now). This assumes imports are reasonably small.
-	// Cycles around while polling until it throws err; 'done' =  err
-	if err := ingester.WaitForOperation(ctx, opName); err != nil {
-		_ = h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
-			"status":        "error",
-			"error_message": err.Error(),
-		})
-		return err
-	}
-
-	// At this point import succeeded; scan headers under the same prefix and
-	// create one ImagingStudy per StudyInstanceUID.
-	//     studyInstances = a map of [string /* always studyId */][]dicomInstanceInfo
-	//
-	//			type dicomInstanceInfo struct {
-	//				StudyInstanceUID  string
-	//				SeriesInstanceUID string
-	//				SOPInstanceUID    string
-	//				Modality          string
-	//				StudyDate         string
-	//				StudyDescription  string
-	//			}
-	//
-	//
-	studyInstances, err := h.collectDicomInstances(ctx, msg.GCSPrefix)
-	if err != nil {
-		_ = h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
-			"status":        "error",
-			"error_message": fmt.Sprintf("collectDicomInstances: %v", err),
-		})
-		return err
-	}
-
-	////////////////////////////////////////////////////////////////////////
-	//
-	//     Takes a flat header scan result from all the files
-	//
-	//       a map of [string /* always studyId */][]dicomInstanceInfo
-	//
-	//       and rolls up the data by StudyID, with multiple Series and Modalities
-	//
-	//        (This is the data that feeds our Image Viewer summaries for a single study)
-	//               /imaging/studies or detail /imaging/studies/{studyID}
-	//
-	//       study := &ImagingStudy{
-	//			StudyID:            studyID,
-	//			UserID:             sess.UserID,
-	//			SessionID:          sess.SessionID,
-	//			StudyInstanceUID:   studyUID,
-	//			SeriesInstanceUIDs: seriesUIDs,
-	//			ModalitiesInStudy:  modalities,
-	//			StudyDate:          studyDate,
-	//			StudyDescription:   studyDescription,
-	//			NumInstances:       len(instances),
-	//			GCSPrefix:          gcsPrefix,
-	//			DicomStorePath:     dicomStorePath,
-	//			CreatedAt:          time.Now().UTC(),
-	//		}
-	//
-	//
-	if err := h.createImagingStudiesFromInstances(ctx, sess, msg.GCSPrefix, studyInstances); err != nil {
-		_ = h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
-			"status":        "error",
-			"error_message": fmt.Sprintf("createImagingStudies: %v", err),
-		})
-		return err
+	if !job.completed(IngestStepStudiesCreated) {
+		// At this point import succeeded; scan headers under the same prefix and
+		// create one ImagingStudy per StudyInstanceUID.
+		//     studyInstances = a map of [string /* always studyId */][]dicomInstanceInfo
+		//
+		//			type dicomInstanceInfo struct {
+		//				StudyInstanceUID  string
+		//				SeriesInstanceUID string
+		//				SOPInstanceUID    string
+		//				Modality          string
+		//				StudyDate         string
+		//				StudyDescription  string
+		//			}
+		//
+		//
+		studyInstances, lateNonDicom, err := h.collectDicomInstances(ctx, ingestPrefix)
+		if err != nil {
+			_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"error_message": fmt.Sprintf("collectDicomInstances: %v", err),
+			})
+			return err
+		}
+
+		// Validation already moved non-DICOM files out of the prefix; anything
+		// found here was uploaded after validation ran, so add it to the report.
+		if len(lateNonDicom) > 0 {
+			if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"non_dicom_files": append(nonDicom, lateNonDicom...),
+			}); err != nil {
+				log.Printf("handleIngestMessage: UpdateUploadSessionStatus(non_dicom_files) error: %v", err)
+			}
+		}
+
+		////////////////////////////////////////////////////////////////////////
+		//
+		//     Takes a flat header scan result from all the files
+		//
+		//       a map of [string /* always studyId */][]dicomInstanceInfo
+		//
+		//       and rolls up the data by StudyID, with multiple Series and Modalities
+		//
+		//        (This is the data that feeds our Image Viewer summaries for a single study)
+		//               /imaging/studies or detail /imaging/studies/{studyID}
+		//
+		//       study := &ImagingStudy{
+		//			StudyID:            studyID,
+		//			UserID:             sess.UserID,
+		//			SessionID:          sess.SessionID,
+		//			StudyInstanceUID:   studyUID,
+		//			SeriesInstanceUIDs: seriesUIDs,
+		//			ModalitiesInStudy:  modalities,
+		//			StudyDate:          studyDate,
+		//			StudyDescription:   studyDescription,
+		//			NumInstances:       len(instances),
+		//			GCSPrefix:          gcsPrefix,
+		//			DicomStorePath:     dicomStorePath,
+		//			CreatedAt:          time.Now().UTC(),
+		//		}
+		//
+		//
+		if err := h.createImagingStudiesFromInstances(ctx, sess, ingestPrefix, studyInstances, files); err != nil {
+			_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+				"error_message": fmt.Sprintf("createImagingStudies: %v", err),
+			})
+			return err
+		}
+		if err := h.DB.CheckpointIngestJob(ctx, job, IngestStepStudiesCreated, nil); err != nil {
+			return err
+		}
 	}
 
 	// Success: mark session as ready.
-	if err := h.DB.UpdateUploadSessionStatus(ctx, msg.SessionID, map[string]interface{}{
+	if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
 		"status": "ready",
 	}); err != nil {
 		return fmt.Errorf("UpdateUploadSessionStatus(ready): %w", err)
@@ -804,14 +967,29 @@ func (h *Handlers) PubSubDicomIngestHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	log.Printf("PubSubDicomIngest: processing session_id=%s gcs_prefix=%s", msg.SessionID, msg.GCSPrefix)
+	if strings.TrimSpace(msg.SessionID) == "" || strings.TrimSpace(msg.GCSPrefix) == "" {
+		log.Printf("PubSubDicomIngest: missing session_id or gcs_prefix")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	if err := h.handleIngestMessage(ctx, msg); err != nil {
-		log.Printf("PubSubDicomIngest: handleIngestMessage error: %v", err)
+	// Record a durable job and acknowledge right away; the worker pool does
+	// the import, which can run far longer than the push deadline.
+	job, created, err := h.DB.EnqueueIngestJob(ctx, msg, env.Message.MessageID)
+	if err != nil {
+		log.Printf("PubSubDicomIngest: EnqueueIngestJob error: %v", err)
 		// Non-2xx tells Pub/Sub to retry the message.
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !created {
+		// Redelivery of a message we already have a job for; just ack it.
+		log.Printf("PubSubDicomIngest: duplicate delivery of message %s, job %s is %s", env.Message.MessageID, job.JobID, job.Status)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	log.Printf("PubSubDicomIngest: queued job %s for session_id=%s gcs_prefix=%s", job.JobID, msg.SessionID, msg.GCSPrefix)
+	h.Ingest.Notify()
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"visitvizor-rest/dicomweb"
+)
+
+// Ingest modes, selected per deployment with VISIT_VIZOR_INGEST_MODE.
+const (
+	IngestModeImport = "import" // Healthcare bulk import LRO from the GCS prefix
+	IngestModeStow   = "stow"   // one STOW-RS request per validated object
+)
+
+// stowOutcome maps a STOW-RS response to a file outcome. Retryable results
+// leave the file unknown so a later attempt stores it again.
+func stowOutcome(res *dicomweb.StowResult) (outcome string, retryable bool) {
+	switch {
+	case res.StatusCode == http.StatusOK, res.StatusCode == http.StatusAccepted:
+		// 202 means stored with warnings (e.g. coerced attributes).
+		return UploadFileImported, false
+	case res.StatusCode == http.StatusConflict:
+		return UploadFileDuplicate, false
+	case res.StatusCode == http.StatusRequestTimeout,
+		res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode >= 500:
+		return UploadFileUnknown, true
+	default:
+		return UploadFileRejected, false
+	}
+}
+
+// stowSummary counts per-instance STOW results for one attempt.
+type stowSummary struct {
+	Stored    int
+	Duplicate int
+	Rejected  int
+	Retryable int
+}
+
+// stowUploadedFiles stores every pending (or previously unknown) file in
+// bucketName through storer, with at most concurrency requests in flight.
+// File outcomes are updated in place; onProgress is called after each file.
+func (h *Handlers) stowUploadedFiles(
+	ctx context.Context,
+	storer dicomweb.InstanceStorer,
+	bucketName string,
+	files []*UploadFile,
+	concurrency int,
+	onProgress func(ImportProgress),
+) (stowSummary, error) {
+	var todo []*UploadFile
+	for _, f := range files {
+		if f.Outcome == UploadFilePending || f.Outcome == UploadFileUnknown {
+			todo = append(todo, f)
+		}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		sum      stowSummary
+		progress = ImportProgress{Pending: int64(len(todo))}
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, concurrency)
+	)
+	bucket := h.Storage.Bucket(bucketName)
+
+	for _, f := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(f *UploadFile) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			outcome, retryable, reason := UploadFileUnknown, true, ""
+			rc, err := bucket.Object(f.storedObjectName()).NewReader(ctx)
+			if err != nil {
+				reason = fmt.Sprintf("read object: %v", err)
+			} else {
+				res, err := storer.StoreInstance(ctx, rc)
+				rc.Close()
+				if err != nil {
+					reason = err.Error()
+				} else {
+					outcome, retryable = stowOutcome(res)
+					if outcome != UploadFileImported || res.StatusCode != http.StatusOK {
+						reason = fmt.Sprintf("STOW status %d: %s", res.StatusCode, res.Body)
+					}
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			f.Outcome = outcome
+			f.Reason = reason
+			progress.Pending--
+			switch {
+			case retryable:
+				sum.Retryable++
+				progress.Failure++
+			case outcome == UploadFileRejected:
+				sum.Rejected++
+				progress.Failure++
+			case outcome == UploadFileDuplicate:
+				sum.Duplicate++
+				progress.Success++
+			default:
+				sum.Stored++
+				progress.Success++
+			}
+			if onProgress != nil {
+				onProgress(progress)
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return sum, err
+	}
+	log.Printf("stowUploadedFiles: bucket=%s stored=%d duplicate=%d rejected=%d retryable=%d",
+		bucketName, sum.Stored, sum.Duplicate, sum.Rejected, sum.Retryable)
+
+	if sum.Retryable > 0 {
+		return sum, fmt.Errorf("STOW: %d of %d instances failed transiently", sum.Retryable, len(todo))
+	}
+	if sum.Rejected > 0 && !anyStored(files) {
+		return sum, permanentIngestError("stow_rejected", fmt.Errorf("STOW: all %d instances were rejected", sum.Rejected))
+	}
+	return sum, nil
+}
+
+// anyStored reports whether any file has reached the DICOM store, e.g. on an
+// earlier attempt.
+func anyStored(files []*UploadFile) bool {
+	for _, f := range files {
+		if f.Outcome == UploadFileImported || f.Outcome == UploadFileDuplicate {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestViaStow is the STOW counterpart of the bulk import step in
+// handleIngestMessage: it stores the session's validated files one by one
+// and records each file's outcome.
+func (h *Handlers) ingestViaStow(ctx context.Context, msg IngestMessage, files []*UploadFile) error {
+	if h.Stow == nil {
+		return fmt.Errorf("ingest mode %q but no STOW client configured", IngestModeStow)
+	}
+	bucketName, _, err := splitGCSPrefix(msg.GCSPrefix)
+	if err != nil {
+		return permanentIngestError("bad_message", err)
+	}
+
+	if err := h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+		"status":        "importing",
+		"error_message": "",
+		"gcs_prefix":    msg.GCSPrefix,
+		"ingest_mode":   IngestModeStow,
+	}); err != nil {
+		return fmt.Errorf("UpdateUploadSessionStatus(importing): %w", err)
+	}
+
+	_, err = h.stowUploadedFiles(ctx, h.Stow, bucketName, files, h.Cfg.StowConcurrency, func(p ImportProgress) {
+		h.Events.Publish(UploadEvent{Type: UploadEventImportProgress, SessionID: msg.SessionID, Import: &p})
+	})
+	// Persist per-instance results even when the attempt failed, so a retry
+	// only re-sends the instances that did not make it.
+	if uerr := h.DB.UpsertUploadFiles(ctx, msg.SessionID, files); uerr != nil {
+		log.Printf("ingestViaStow: UpsertUploadFiles(stow outcome) error: %v", uerr)
+	}
+	if err != nil {
+		_ = h.updateUploadSession(ctx, msg.SessionID, map[string]interface{}{
+			"error_message": err.Error(),
+		})
+		return err
+	}
+	return nil
+}
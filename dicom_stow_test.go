@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"visitvizor-rest/dicomweb"
+)
+
+func TestStowOutcome(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantOutcome   string
+		wantRetryable bool
+	}{
+		{http.StatusOK, UploadFileImported, false},
+		{http.StatusAccepted, UploadFileImported, false},
+		{http.StatusConflict, UploadFileDuplicate, false},
+		{http.StatusBadRequest, UploadFileRejected, false},
+		{http.StatusUnsupportedMediaType, UploadFileRejected, false},
+		{http.StatusTooManyRequests, UploadFileUnknown, true},
+		{http.StatusServiceUnavailable, UploadFileUnknown, true},
+	}
+	for _, tt := range tests {
+		outcome, retryable := stowOutcome(&dicomweb.StowResult{StatusCode: tt.status})
+		if outcome != tt.wantOutcome || retryable != tt.wantRetryable {
+			t.Errorf("stowOutcome(%d) = (%q, %v), want (%q, %v)", tt.status, outcome, retryable, tt.wantOutcome, tt.wantRetryable)
+		}
+	}
+}
+
+func TestHTTPStowClientStoreInstance(t *testing.T) {
+	var gotPart, gotAuth, gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/related" || params["type"] != "application/dicom" {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(part)
+		gotPart = string(b)
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, `{"00081198":{}}`)
+	}))
+	defer srv.Close()
+
+	c := dicomweb.NewHTTPStowClient(srv.URL+"/dicom-web/", "tok", srv.Client())
+	res, err := c.StoreInstance(context.Background(), strings.NewReader("DICM-bytes"))
+	if err != nil {
+		t.Fatalf("StoreInstance: %v", err)
+	}
+	if gotPath != "/dicom-web/studies" || gotAuth != "Bearer tok" || gotPart != "DICM-bytes" {
+		t.Errorf("request path=%q auth=%q part=%q", gotPath, gotAuth, gotPart)
+	}
+	if res.StatusCode != http.StatusConflict || res.Body != `{"00081198":{}}` {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestHTTPStowClientStreamsBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// A source that fails part way must fail the request rather than
+	// send a truncated instance.
+	body := io.MultiReader(strings.NewReader("DICM"), iotest.ErrReader(errors.New("disk gone")))
+	c := dicomweb.NewHTTPStowClient(srv.URL, "", srv.Client())
+	if _, err := c.StoreInstance(context.Background(), body); err == nil || !strings.Contains(err.Error(), "disk gone") {
+		t.Fatalf("StoreInstance err = %v, want source read error", err)
+	}
+}
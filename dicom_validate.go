@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// FileValidation is the validation outcome for a single uploaded object.
+type FileValidation struct {
+	ObjectName        string   `firestore:"object_name" json:"object_name"`
+	SizeBytes         int64    `firestore:"size_bytes" json:"size_bytes"`
+	Valid             bool     `firestore:"valid" json:"valid"`
+	Issues            []string `firestore:"issues" json:"issues"` // e.g. "missing_tag:SOPInstanceUID"
+	TransferSyntaxUID string   `firestore:"transfer_syntax_uid" json:"transfer_syntax_uid"`
+	QuarantinedTo     string   `firestore:"quarantined_to" json:"quarantined_to"` // gs:// path when moved
+}
+
+// ValidationReport summarizes the pre-import validation stage for an upload
+// session. Only failing files are listed individually; passing files are
+// counted so the session document stays small for large series.
+type ValidationReport struct {
+	Checked     int              `firestore:"checked" json:"checked"`
+	Passed      int              `firestore:"passed" json:"passed"`
+	Failed      int              `firestore:"failed" json:"failed"`
+	Failures    []FileValidation `firestore:"failures" json:"failures"`
+	ValidatedAt time.Time        `firestore:"validated_at" json:"validated_at"`
+}
+
+// supportedTransferSyntaxes lists the transfer syntaxes we accept for import.
+// These are the ones the Healthcare DICOM store can store and transcode.
+var supportedTransferSyntaxes = map[string]string{
+	"1.2.840.10008.1.2":       "Implicit VR Little Endian",
+	"1.2.840.10008.1.2.1":     "Explicit VR Little Endian",
+	"1.2.840.10008.1.2.1.99":  "Deflated Explicit VR Little Endian",
+	"1.2.840.10008.1.2.2":     "Explicit VR Big Endian",
+	"1.2.840.10008.1.2.4.50":  "JPEG Baseline",
+	"1.2.840.10008.1.2.4.51":  "JPEG Extended",
+	"1.2.840.10008.1.2.4.57":  "JPEG Lossless",
+	"1.2.840.10008.1.2.4.70":  "JPEG Lossless SV1",
+	"1.2.840.10008.1.2.4.80":  "JPEG-LS Lossless",
+	"1.2.840.10008.1.2.4.81":  "JPEG-LS Near Lossless",
+	"1.2.840.10008.1.2.4.90":  "JPEG 2000 Lossless",
+	"1.2.840.10008.1.2.4.91":  "JPEG 2000",
+	"1.2.840.10008.1.2.5":     "RLE Lossless",
+	"1.2.840.10008.1.2.4.201": "HTJ2K Lossless",
+	"1.2.840.10008.1.2.4.202": "HTJ2K Lossless RPCL",
+	"1.2.840.10008.1.2.4.203": "HTJ2K",
+	"1.2.840.10008.1.2.1.98":  "Encapsulated Uncompressed Explicit VR Little Endian",
+	"1.2.840.10008.1.2.4.100": "MPEG2 Main Profile",
+	"1.2.840.10008.1.2.4.102": "MPEG-4 AVC/H.264",
+	"1.2.840.10008.1.2.4.103": "MPEG-4 AVC/H.264 BD",
+}
+
+// nativeTransferSyntaxes are the uncompressed syntaxes where the PixelData
+// length must match Rows*Columns*SamplesPerPixel*BitsAllocated*Frames.
+var nativeTransferSyntaxes = map[string]bool{
+	"1.2.840.10008.1.2":      true,
+	"1.2.840.10008.1.2.1":    true,
+	"1.2.840.10008.1.2.1.99": true,
+	"1.2.840.10008.1.2.2":    true,
+}
+
+// isValidDicomUID checks UID syntax per PS3.5 9.1: at most 64 characters,
+// dot-separated numeric components, no empty components and no leading zeros
+// (other than a component that is exactly "0").
+func isValidDicomUID(uid string) bool {
+	if uid == "" || len(uid) > 64 {
+		return false
+	}
+	for _, comp := range strings.Split(uid, ".") {
+		if comp == "" {
+			return false
+		}
+		if len(comp) > 1 && comp[0] == '0' {
+			return false
+		}
+		for _, c := range comp {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// getIntByTag extracts the first integer value for the given tag, handling
+// both binary (US/UL) and string (IS) encodings. ok is false if the tag is
+// missing or unparseable.
+func getIntByTag(ds *dicom.Dataset, t tag.Tag) (int, bool) {
+	if ds == nil {
+		return 0, false
+	}
+	el, err := ds.FindElementByTag(t)
+	if err != nil || el == nil || el.Value == nil {
+		return 0, false
+	}
+	switch el.Value.ValueType() {
+	case dicom.Ints:
+		vals := dicom.MustGetInts(el.Value)
+		if len(vals) == 0 {
+			return 0, false
+		}
+		return vals[0], true
+	case dicom.Strings:
+		vals := dicom.MustGetStrings(el.Value)
+		if len(vals) == 0 {
+			return 0, false
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(vals[0]))
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// validateDicomDataset runs our structural checks against a parsed header
+// (parsed with dicom.SkipPixelData, which keeps the PixelData value length)
+// and returns the transfer syntax plus a list of issue codes. An empty issue
+// list means the instance is importable.
+func validateDicomDataset(ds *dicom.Dataset) (string, []string) {
+	var issues []string
+
+	required := []struct {
+		name string
+		t    tag.Tag
+	}{
+		{"SOPClassUID", tag.SOPClassUID},
+		{"SOPInstanceUID", tag.SOPInstanceUID},
+		{"StudyInstanceUID", tag.StudyInstanceUID},
+		{"SeriesInstanceUID", tag.SeriesInstanceUID},
+	}
+	for _, r := range required {
+		v := getStringByTag(ds, r.t)
+		if v == "" {
+			issues = append(issues, "missing_tag:"+r.name)
+			continue
+		}
+		if !isValidDicomUID(v) {
+			issues = append(issues, "invalid_uid:"+r.name)
+		}
+	}
+
+	// Files without file meta (preamble-less) have no transfer syntax element;
+	// the parser falls back to implicit VR little endian for those.
+	tsUID := getStringByTag(ds, tag.TransferSyntaxUID)
+	if tsUID == "" {
+		tsUID = "1.2.840.10008.1.2"
+	}
+	tsUID = strings.TrimRight(tsUID, "\x00 ")
+	if _, ok := supportedTransferSyntaxes[tsUID]; !ok {
+		issues = append(issues, "unsupported_transfer_syntax:"+tsUID)
+	}
+
+	if issue := checkPixelDataLength(ds, tsUID); issue != "" {
+		issues = append(issues, issue)
+	}
+
+	return tsUID, issues
+}
+
+// checkPixelDataLength verifies that native (uncompressed) PixelData has the
+// length implied by the image pixel module. Encapsulated pixel data uses an
+// undefined length and is not checked here.
+func checkPixelDataLength(ds *dicom.Dataset, tsUID string) string {
+	el, err := ds.FindElementByTag(tag.PixelData)
+	if err != nil || el == nil {
+		// No pixel data (e.g. structured reports); nothing to check.
+		return ""
+	}
+	if el.ValueLength == 0xFFFFFFFF || !nativeTransferSyntaxes[tsUID] {
+		return ""
+	}
+
+	rows, okR := getIntByTag(ds, tag.Rows)
+	cols, okC := getIntByTag(ds, tag.Columns)
+	bits, okB := getIntByTag(ds, tag.BitsAllocated)
+	if !okR || !okC || !okB || rows <= 0 || cols <= 0 || bits <= 0 {
+		return "pixel_module_incomplete"
+	}
+	samples, ok := getIntByTag(ds, tag.SamplesPerPixel)
+	if !ok || samples <= 0 {
+		samples = 1
+	}
+	frames, ok := getIntByTag(ds, tag.NumberOfFrames)
+	if !ok || frames <= 0 {
+		frames = 1
+	}
+
+	var expected int64
+	if bits == 1 {
+		// Bit-packed (e.g. segmentation masks).
+		expected = (int64(rows)*int64(cols)*int64(samples)*int64(frames) + 7) / 8
+	} else {
+		expected = int64(rows) * int64(cols) * int64(samples) * int64(frames) * int64((bits+7)/8)
+	}
+	actual := int64(el.ValueLength)
+
+	// Values are padded to an even length.
+	if actual == expected || (expected%2 == 1 && actual == expected+1) {
+		return ""
+	}
+	return fmt.Sprintf("pixel_data_length_mismatch:expected=%d,actual=%d", expected, actual)
+}
+
+// quarantineObjectName maps an uploaded object (userId/sessionId/relative)
+// to its location under the configured quarantine prefix. The quarantine
+// prefix lives outside the session's upload prefix so the Healthcare import
+// glob never picks quarantined files up.
+func (h *Handlers) quarantineObjectName(objectName string) string {
+	prefix := strings.Trim(h.Cfg.QuarantinePrefix, "/")
+	if prefix == "" {
+		prefix = "quarantine"
+	}
+	return path.Join(prefix, objectName)
+}
+
+// moveObject copies src to dst within the same bucket and deletes src.
+func (h *Handlers) moveObject(ctx context.Context, bucketName, src, dst string) error {
+	bkt := h.Storage.Bucket(bucketName)
+	if _, err := bkt.Object(dst).CopierFrom(bkt.Object(src)).Run(ctx); err != nil {
+		return fmt.Errorf("copy %s -> %s: %w", src, dst, err)
+	}
+	if err := bkt.Object(src).Delete(ctx); err != nil {
+		return fmt.Errorf("delete %s: %w", src, err)
+	}
+	return nil
+}
+
+// scanProgressEvery is how many objects are validated between progress
+// callbacks.
+const scanProgressEvery = 25
+
+// uploadValidation is everything the validation stage learns about the
+// objects under a session prefix.
+type uploadValidation struct {
+	Report   *ValidationReport
+	NonDicom []NonDicomFile
+	Files    []*UploadFile // one record per object, for the upload_files collection
+}
+
+// ////////////////////////////////////////////////////////////////
+//
+//	VALIDATE uploaded objects before the Healthcare import
+//
+// validateUploadedObjects checks every object under gcsPrefix before import.
+// Non-DICOM content and DICOM instances that fail validation are moved to the
+// quarantine prefix so the bulk import only sees clean files. It returns the
+// validation report, the list of non-DICOM files found and a per-file record
+// (checksums, UIDs, preliminary outcome) for every object. onScanned, if
+// non-nil, is called periodically with the number of objects examined so far.
+func (h *Handlers) validateUploadedObjects(ctx context.Context, gcsPrefix string, onScanned func(scanned int)) (*uploadValidation, error) {
+	bucketName, objectPrefix, err := splitGCSPrefix(gcsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if h.Storage == nil {
+		return nil, fmt.Errorf("storage client not initialized on Handlers")
+	}
+
+	res := &uploadValidation{
+		Report:   &ValidationReport{Failures: []FileValidation{}},
+		NonDicom: []NonDicomFile{},
+	}
+	report := res.Report
+
+	it := h.Storage.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: objectPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterate GCS objects under %s: %w", gcsPrefix, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue
+		}
+
+		file := newUploadFile(attrs)
+		res.Files = append(res.Files, file)
+		if onScanned != nil && len(res.Files)%scanProgressEvery == 0 {
+			onScanned(len(res.Files))
+		}
+
+		fv := h.validateObject(ctx, bucketName, attrs, file)
+		if fv == nil {
+			// Read error; leave the object in place, the import will report it.
+			continue
+		}
+		if fv.Valid {
+			report.Checked++
+			report.Passed++
+			continue
+		}
+
+		file.Outcome = UploadFileRejected
+		file.Reason = strings.Join(fv.Issues, "; ")
+
+		dst := h.quarantineObjectName(attrs.Name)
+		if err := h.moveObject(ctx, bucketName, attrs.Name, dst); err != nil {
+			log.Printf("validateUploadedObjects: quarantine %s: %v", attrs.Name, err)
+		} else {
+			fv.QuarantinedTo = fmt.Sprintf("gs://%s/%s", bucketName, dst)
+			file.QuarantinedTo = fv.QuarantinedTo
+		}
+
+		// Non-DICOM files are reported separately and do not count as
+		// validation failures of DICOM instances.
+		if file.DetectedType != "application/dicom" {
+			res.NonDicom = append(res.NonDicom, NonDicomFile{
+				ObjectName:   attrs.Name,
+				SizeBytes:    attrs.Size,
+				DetectedType: file.DetectedType,
+			})
+			continue
+		}
+		report.Checked++
+		report.Failed++
+		report.Failures = append(report.Failures, *fv)
+	}
+
+	if onScanned != nil {
+		onScanned(len(res.Files))
+	}
+	report.ValidatedAt = time.Now().UTC()
+	log.Printf("validateUploadedObjects: prefix=%s checked=%d passed=%d failed=%d nonDicom=%d", gcsPrefix, report.Checked, report.Passed, report.Failed, len(res.NonDicom))
+	return res, nil
+}
+
+// validateObject reads and validates a single object header, filling in the
+// detected type and UIDs on file as it goes. It returns nil when the object
+// could not be read at all.
+func (h *Handlers) validateObject(ctx context.Context, bucketName string, attrs *storage.ObjectAttrs, file *UploadFile) *FileValidation {
+	fv := &FileValidation{ObjectName: attrs.Name, SizeBytes: attrs.Size, Issues: []string{}}
+
+	rc, err := h.Storage.Bucket(bucketName).Object(attrs.Name).NewReader(ctx)
+	if err != nil {
+		log.Printf("validateObject: open %s: %v", attrs.Name, err)
+		return nil
+	}
+	defer rc.Close()
+
+	br := bufio.NewReaderSize(rc, dicomSniffLen)
+	head, _ := br.Peek(dicomSniffLen)
+	isDicom, detectedType := detectDicomContent(head)
+	file.DetectedType = detectedType
+	if !isDicom {
+		fv.Issues = append(fv.Issues, "not_dicom:"+detectedType)
+		return fv
+	}
+
+	ds, err := dicom.Parse(br, attrs.Size, nil, dicom.SkipPixelData())
+	if err != nil {
+		fv.Issues = append(fv.Issues, "parse_error:"+err.Error())
+		return fv
+	}
+
+	file.StudyInstanceUID = getStringByTag(&ds, tag.StudyInstanceUID)
+	file.SeriesInstanceUID = getStringByTag(&ds, tag.SeriesInstanceUID)
+	file.SOPInstanceUID = getStringByTag(&ds, tag.SOPInstanceUID)
+
+	fv.TransferSyntaxUID, fv.Issues = validateDicomDataset(&ds)
+	if fv.Issues == nil {
+		fv.Issues = []string{}
+	}
+	fv.Valid = len(fv.Issues) == 0
+	return fv
+}
+
+// splitGCSPrefix splits gs://bucket/prefix into its bucket and object prefix.
+func splitGCSPrefix(gcsPrefix string) (string, string, error) {
+	if !strings.HasPrefix(gcsPrefix, "gs://") {
+		return "", "", fmt.Errorf("gcsPrefix must start with gs://, got %q", gcsPrefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(gcsPrefix, "gs://"), "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid gcsPrefix %q", gcsPrefix)
+	}
+	return parts[0], parts[1], nil
+}
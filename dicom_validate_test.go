@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestIsValidDicomUID(t *testing.T) {
+	valid := []string{"1.2.840.10008.1.2", "0.1", "2.25.329800735698586629295641978511506172918"}
+	invalid := []string{"", "1..2", "1.02.3", "1.2.abc", ".1.2", strings.Repeat("1.", 33) + "1"}
+
+	for _, uid := range valid {
+		if !isValidDicomUID(uid) {
+			t.Errorf("isValidDicomUID(%q) = false, want true", uid)
+		}
+	}
+	for _, uid := range invalid {
+		if isValidDicomUID(uid) {
+			t.Errorf("isValidDicomUID(%q) = true, want false", uid)
+		}
+	}
+}
+
+func mustElement(t *testing.T, tg tag.Tag, data any) *dicom.Element {
+	t.Helper()
+	el, err := dicom.NewElement(tg, data)
+	if err != nil {
+		t.Fatalf("NewElement(%v): %v", tg, err)
+	}
+	return el
+}
+
+func TestValidateDicomDataset(t *testing.T) {
+	base := func(pixelLen uint32) *dicom.Dataset {
+		pixel := mustElement(t, tag.PixelData, dicom.PixelDataInfo{IntentionallySkipped: true})
+		pixel.ValueLength = pixelLen
+		return &dicom.Dataset{Elements: []*dicom.Element{
+			mustElement(t, tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.1"}),
+			mustElement(t, tag.SOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.2"}),
+			mustElement(t, tag.SOPInstanceUID, []string{"1.2.3.4.5"}),
+			mustElement(t, tag.StudyInstanceUID, []string{"1.2.3"}),
+			mustElement(t, tag.SeriesInstanceUID, []string{"1.2.3.4"}),
+			mustElement(t, tag.Rows, []int{4}),
+			mustElement(t, tag.Columns, []int{4}),
+			mustElement(t, tag.BitsAllocated, []int{16}),
+			pixel,
+		}}
+	}
+
+	if ts, issues := validateDicomDataset(base(32)); len(issues) != 0 || ts != "1.2.840.10008.1.2.1" {
+		t.Fatalf("valid dataset: ts=%q issues=%v", ts, issues)
+	}
+
+	_, issues := validateDicomDataset(base(30))
+	if len(issues) != 1 || !strings.HasPrefix(issues[0], "pixel_data_length_mismatch") {
+		t.Fatalf("short pixel data: issues=%v", issues)
+	}
+
+	ds := base(32)
+	ds.Elements = append(ds.Elements[:2], ds.Elements[3:]...) // drop SOPInstanceUID
+	ds.Elements[0] = mustElement(t, tag.TransferSyntaxUID, []string{"1.2.3.999"})
+	_, issues = validateDicomDataset(ds)
+	want := []string{"missing_tag:SOPInstanceUID", "unsupported_transfer_syntax:1.2.3.999"}
+	if strings.Join(issues, ",") != strings.Join(want, ",") {
+		t.Fatalf("issues = %v, want %v", issues, want)
+	}
+}
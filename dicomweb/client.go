@@ -198,6 +198,33 @@ func (c *Client) RetrieveInstanceRaw(
 	return resp, nil
 }
 
+// RetrieveInstanceTranscoded retrieves a single DICOM instance as Part 10,
+// asking the store to transcode it to transferSyntax (for example
+// 1.2.840.10008.1.2.1 to get uncompressed pixel data).
+// The caller is responsible for closing resp.Body.
+func (c *Client) RetrieveInstanceTranscoded(
+	ctx context.Context,
+	studyUID, seriesUID, instanceUID, transferSyntax string,
+) (*http.Response, error) {
+	if studyUID == "" || seriesUID == "" || instanceUID == "" {
+		return nil, fmt.Errorf("studyUID, seriesUID, and instanceUID are required")
+	}
+
+	parent := c.dicomStoreParent()
+	dicomWebPath := fmt.Sprintf("studies/%s/series/%s/instances/%s", studyUID, seriesUID, instanceUID)
+
+	instancesSvc := c.svc.Projects.Locations.Datasets.DicomStores.Studies.Series.Instances
+	call := instancesSvc.RetrieveInstance(parent, dicomWebPath)
+	if transferSyntax != "" {
+		call.Header().Set("Accept", fmt.Sprintf("application/dicom; transfer-syntax=%s", transferSyntax))
+	}
+	resp, err := call.Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveInstance: %w", err)
+	}
+	return resp, nil
+}
+
 // RetrieveFramesRaw retrieves one or more frames' pixel data for a given
 // study/series/instance/frame list via the DICOMweb frames endpoint.
 //
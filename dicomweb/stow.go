@@ -0,0 +1,108 @@
+package dicomweb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// StowResult is the DICOM store's answer to storing one instance.
+type StowResult struct {
+	StatusCode int
+	Body       string // response body (truncated), for diagnostics
+}
+
+// InstanceStorer stores DICOM instances one at a time via STOW-RS.
+// Transport failures are returned as errors; any HTTP response, including
+// 4xx/5xx, is returned as a StowResult for the caller to classify.
+type InstanceStorer interface {
+	StoreInstance(ctx context.Context, body io.Reader) (*StowResult, error)
+}
+
+const maxStowResultBody = 2048
+
+func readStowResult(resp *http.Response) *StowResult {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxStowResultBody))
+	return &StowResult{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+}
+
+// StoreInstance stores a single Part 10 instance in the Healthcare DICOM store.
+func (c *Client) StoreInstance(ctx context.Context, body io.Reader) (*StowResult, error) {
+	call := c.svc.Projects.Locations.Datasets.DicomStores.StoreInstances(c.dicomStoreParent(), "studies", body)
+	call.Header().Set("Content-Type", "application/dicom")
+	call.Header().Set("Accept", "application/dicom+json")
+	resp, err := call.Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("StoreInstances: %w", err)
+	}
+	return readStowResult(resp), nil
+}
+
+// HTTPStowClient stores instances on any DICOMweb server that implements
+// STOW-RS, e.g. Orthanc or dcm4chee.
+type HTTPStowClient struct {
+	baseURL     string // DICOMweb root, e.g. "https://pacs.example.com/dicom-web"
+	bearerToken string
+	httpClient  *http.Client
+}
+
+// NewHTTPStowClient returns a STOW-RS client for baseURL. bearerToken is
+// optional; a nil httpClient uses http.DefaultClient.
+func NewHTTPStowClient(baseURL, bearerToken string, httpClient *http.Client) *HTTPStowClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPStowClient{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		bearerToken: bearerToken,
+		httpClient:  httpClient,
+	}
+}
+
+// StoreInstance POSTs one instance as a multipart/related STOW-RS request.
+// The multipart body is streamed from body as the request is sent, so an
+// instance is never held in memory.
+func (c *HTTPStowClient) StoreInstance(ctx context.Context, body io.Reader) (*StowResult, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/dicom"}})
+		if err == nil {
+			if _, err = io.Copy(part, body); err != nil {
+				err = fmt.Errorf("read instance: %w", err)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	// Stop the writer and wait for it, so body is not read after we return.
+	defer func() {
+		pr.Close()
+		<-done
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/studies", pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf(`multipart/related; type="application/dicom"; boundary=%s`, mw.Boundary()))
+	req.Header.Set("Accept", "application/dicom+json")
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("STOW-RS %s: %w", c.baseURL, err)
+	}
+	return readStowResult(resp), nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Transform kinds.
+const (
+	FrameTransformRigid  = "rigid"
+	FrameTransformAffine = "affine"
+)
+
+// CanonicalFrameUID names a patient's canonical frame. A transform whose
+// target is the canonical frame registers its source frame with it, so any
+// two registered frames can be related through it without a direct transform.
+const CanonicalFrameUID = "canonical"
+
+// FrameTransform is a 4x4 homogeneous matrix (row-major) mapping patient
+// coordinates in SourceFoRUID to TargetFoRUID, stored in frame_transforms.
+type FrameTransform struct {
+	TransformID   string    `firestore:"transform_id" json:"transform_id"`
+	PatientUserID string    `firestore:"patient_user_id" json:"patient_user_id"`
+	SourceFoRUID  string    `firestore:"source_frame_of_reference_uid" json:"source_frame_of_reference_uid"`
+	TargetFoRUID  string    `firestore:"target_frame_of_reference_uid" json:"target_frame_of_reference_uid"`
+	Kind          string    `firestore:"kind" json:"kind"` // rigid|affine
+	Matrix        []float64 `firestore:"matrix" json:"matrix"`
+	Description   string    `firestore:"description" json:"description"`
+
+	// How the matrix was obtained, and for registrations the studies and
+	// landmarks it was fitted from and the fit error. Intensity-based
+	// registrations carry a similarity score instead of a residual.
+	Method        string                `firestore:"method" json:"method"` // manual|landmarks|mutual_information
+	SourceStudyID string                `firestore:"source_study_id" json:"source_study_id"`
+	TargetStudyID string                `firestore:"target_study_id" json:"target_study_id"`
+	Landmarks     []LandmarkPair        `firestore:"landmarks" json:"landmarks"`
+	Residual      *RegistrationResidual `firestore:"residual" json:"residual"`
+	Quality       *RegistrationQuality  `firestore:"quality" json:"quality"`
+
+	CreatedBy string    `firestore:"created_by" json:"created_by"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// Transform methods.
+const (
+	FrameTransformMethodManual            = "manual"
+	FrameTransformMethodLandmarks         = "landmarks"
+	FrameTransformMethodMutualInformation = "mutual_information"
+)
+
+// mat4 is a row-major 4x4 homogeneous transform.
+type mat4 [16]float64
+
+func identityMat4() mat4 {
+	return mat4{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+}
+
+func mat4FromSlice(v []float64) (mat4, error) {
+	var m mat4
+	if len(v) != 16 {
+		return m, fmt.Errorf("matrix must have 16 values, got %d", len(v))
+	}
+	copy(m[:], v)
+	return m, nil
+}
+
+// mul returns a·b, i.e. apply b first and then a.
+func (a mat4) mul(b mat4) mat4 {
+	var r mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			var s float64
+			for k := 0; k < 4; k++ {
+				s += a[i*4+k] * b[k*4+j]
+			}
+			r[i*4+j] = s
+		}
+	}
+	return r
+}
+
+// apply maps a point through the transform.
+func (a mat4) apply(x, y, z float64) (float64, float64, float64) {
+	return a[0]*x + a[1]*y + a[2]*z + a[3],
+		a[4]*x + a[5]*y + a[6]*z + a[7],
+		a[8]*x + a[9]*y + a[10]*z + a[11]
+}
+
+// det3 is the determinant of the linear (upper-left 3x3) part.
+func (a mat4) det3() float64 {
+	return a[0]*(a[5]*a[10]-a[6]*a[9]) -
+		a[1]*(a[4]*a[10]-a[6]*a[8]) +
+		a[2]*(a[4]*a[9]-a[5]*a[8])
+}
+
+// inverse inverts an affine transform (last row 0 0 0 1).
+func (a mat4) inverse() (mat4, bool) {
+	det := a.det3()
+	if math.Abs(det) < 1e-12 {
+		return mat4{}, false
+	}
+	var r mat4
+	r[0] = (a[5]*a[10] - a[6]*a[9]) / det
+	r[1] = (a[2]*a[9] - a[1]*a[10]) / det
+	r[2] = (a[1]*a[6] - a[2]*a[5]) / det
+	r[4] = (a[6]*a[8] - a[4]*a[10]) / det
+	r[5] = (a[0]*a[10] - a[2]*a[8]) / det
+	r[6] = (a[2]*a[4] - a[0]*a[6]) / det
+	r[8] = (a[4]*a[9] - a[5]*a[8]) / det
+	r[9] = (a[1]*a[8] - a[0]*a[9]) / det
+	r[10] = (a[0]*a[5] - a[1]*a[4]) / det
+	// Translation: -R⁻¹·t
+	r[3] = -(r[0]*a[3] + r[1]*a[7] + r[2]*a[11])
+	r[7] = -(r[4]*a[3] + r[5]*a[7] + r[6]*a[11])
+	r[11] = -(r[8]*a[3] + r[9]*a[7] + r[10]*a[11])
+	r[15] = 1
+	return r, true
+}
+
+// validateFrameTransform checks the matrix shape and, for rigid transforms,
+// that the linear part is a proper rotation.
+func validateFrameTransform(t *FrameTransform) error {
+	if strings.TrimSpace(t.SourceFoRUID) == "" || strings.TrimSpace(t.TargetFoRUID) == "" {
+		return fmt.Errorf("source and target frame of reference are required")
+	}
+	if t.SourceFoRUID == t.TargetFoRUID {
+		return fmt.Errorf("source and target frame of reference must differ")
+	}
+	if t.SourceFoRUID == CanonicalFrameUID {
+		return fmt.Errorf("the canonical frame can only be a target")
+	}
+	m, err := mat4FromSlice(t.Matrix)
+	if err != nil {
+		return err
+	}
+	for _, v := range m {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("matrix has non-finite values")
+		}
+	}
+	const eps = 1e-6
+	if math.Abs(m[12]) > eps || math.Abs(m[13]) > eps || math.Abs(m[14]) > eps || math.Abs(m[15]-1) > eps {
+		return fmt.Errorf("last matrix row must be 0 0 0 1")
+	}
+	switch t.Kind {
+	case FrameTransformAffine:
+		if math.Abs(m.det3()) < 1e-9 {
+			return fmt.Errorf("affine matrix is singular")
+		}
+	case FrameTransformRigid:
+		// RᵀR = I and det R = +1, with tolerance for registration round-off.
+		const tol = 1e-3
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				var dot float64
+				for k := 0; k < 3; k++ {
+					dot += m[k*4+i] * m[k*4+j]
+				}
+				want := 0.0
+				if i == j {
+					want = 1
+				}
+				if math.Abs(dot-want) > tol {
+					return fmt.Errorf("rigid matrix rotation part is not orthonormal")
+				}
+			}
+		}
+		if math.Abs(m.det3()-1) > tol {
+			return fmt.Errorf("rigid matrix rotation part must have determinant +1")
+		}
+	default:
+		return fmt.Errorf("kind must be %q or %q", FrameTransformRigid, FrameTransformAffine)
+	}
+	return nil
+}
+
+// Ways resolve-point can relate two frames of reference.
+const (
+	FrameMapIdentity  = "identity"  // same frame
+	FrameMapDirect    = "direct"    // one stored transform
+	FrameMapInverse   = "inverse"   // one stored transform, inverted
+	FrameMapCanonical = "canonical" // through the patient's canonical frame
+)
+
+// FrameMapping reports which transform resolve-point applied.
+type FrameMapping struct {
+	Kind         string   `json:"kind"` // identity|direct|inverse|canonical
+	TransformIDs []string `json:"transformIds"`
+}
+
+// resolveFrameTransform finds a transform mapping points in from to points
+// in to, preferring a direct transform over its inverse over a chain
+// through the canonical frame.
+func resolveFrameTransform(transforms []*FrameTransform, from, to string) (mat4, *FrameMapping, bool) {
+	if from == to {
+		return identityMat4(), &FrameMapping{Kind: FrameMapIdentity, TransformIDs: []string{}}, true
+	}
+
+	// toFrame returns the transform src→dst, inverting a stored dst→src if
+	// needed.
+	toFrame := func(src, dst string) (mat4, string, bool, bool) {
+		for _, t := range transforms {
+			if t.SourceFoRUID == src && t.TargetFoRUID == dst {
+				if m, err := mat4FromSlice(t.Matrix); err == nil {
+					return m, t.TransformID, false, true
+				}
+			}
+		}
+		for _, t := range transforms {
+			if t.SourceFoRUID == dst && t.TargetFoRUID == src {
+				m, err := mat4FromSlice(t.Matrix)
+				if err != nil {
+					continue
+				}
+				if inv, ok := m.inverse(); ok {
+					return inv, t.TransformID, true, true
+				}
+			}
+		}
+		return mat4{}, "", false, false
+	}
+
+	if m, id, inverted, ok := toFrame(from, to); ok {
+		kind := FrameMapDirect
+		if inverted {
+			kind = FrameMapInverse
+		}
+		return m, &FrameMapping{Kind: kind, TransformIDs: []string{id}}, true
+	}
+
+	// from → canonical → to, where to → canonical is inverted.
+	fromCanon, fromID, _, ok := toFrame(from, CanonicalFrameUID)
+	if !ok {
+		return mat4{}, nil, false
+	}
+	toCanon, toID, _, ok := toFrame(to, CanonicalFrameUID)
+	if !ok {
+		return mat4{}, nil, false
+	}
+	canonTo, ok := toCanon.inverse()
+	if !ok {
+		return mat4{}, nil, false
+	}
+	return canonTo.mul(fromCanon), &FrameMapping{Kind: FrameMapCanonical, TransformIDs: []string{fromID, toID}}, true
+}
+
+// pickSliceFrame chooses which of a study's frames of reference to search
+// for a point given in from: the same frame if the study has it, else the
+// frame reachable with the fewest transforms (ties broken by UID).
+func pickSliceFrame(slices []*IndexedSlice, transforms []*FrameTransform, from string) (string, mat4, *FrameMapping, bool) {
+	frames := make(map[string]bool)
+	for _, s := range slices {
+		if s.FrameOfReferenceUID != "" {
+			frames[s.FrameOfReferenceUID] = true
+		}
+	}
+	uids := make([]string, 0, len(frames))
+	for uid := range frames {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	var (
+		bestUID     string
+		bestM       mat4
+		bestMapping *FrameMapping
+	)
+	for _, uid := range uids {
+		m, mapping, ok := resolveFrameTransform(transforms, from, uid)
+		if !ok {
+			continue
+		}
+		if bestMapping == nil || len(mapping.TransformIDs) < len(bestMapping.TransformIDs) {
+			bestUID, bestM, bestMapping = uid, m, mapping
+		}
+	}
+	return bestUID, bestM, bestMapping, bestMapping != nil
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: frame_transforms
+//
+// CreateFrameTransform stores a new transform with a generated ID.
+func (db *FirestoreDB) CreateFrameTransform(ctx context.Context, t *FrameTransform) error {
+	id, err := randomTokenID("FXT", 10)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	t.TransformID = id
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	if _, err := db.client.Collection("frame_transforms").Doc(id).Create(ctx, t); err != nil {
+		return fmt.Errorf("create frame transform: %w", err)
+	}
+	return nil
+}
+
+// GetFrameTransform returns a transform, or nil if it does not exist.
+func (db *FirestoreDB) GetFrameTransform(ctx context.Context, transformID string) (*FrameTransform, error) {
+	doc, err := db.client.Collection("frame_transforms").Doc(transformID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get frame transform (%s): %w", transformID, err)
+	}
+	var t FrameTransform
+	if err := doc.DataTo(&t); err != nil {
+		return nil, fmt.Errorf("decode frame transform (%s): %w", transformID, err)
+	}
+	return &t, nil
+}
+
+// SaveFrameTransform overwrites an existing transform.
+func (db *FirestoreDB) SaveFrameTransform(ctx context.Context, t *FrameTransform) error {
+	t.UpdatedAt = time.Now().UTC()
+	if _, err := db.client.Collection("frame_transforms").Doc(t.TransformID).Set(ctx, t); err != nil {
+		return fmt.Errorf("save frame transform (%s): %w", t.TransformID, err)
+	}
+	return nil
+}
+
+// DeleteFrameTransform removes a transform.
+func (db *FirestoreDB) DeleteFrameTransform(ctx context.Context, transformID string) error {
+	if _, err := db.client.Collection("frame_transforms").Doc(transformID).Delete(ctx); err != nil {
+		return fmt.Errorf("delete frame transform (%s): %w", transformID, err)
+	}
+	return nil
+}
+
+// ListFrameTransformsForPatient returns a patient's transforms, newest first
+// so the most recent registration wins when several relate the same frames.
+func (db *FirestoreDB) ListFrameTransformsForPatient(ctx context.Context, patientUserID string) ([]*FrameTransform, error) {
+	docs, err := db.client.Collection("frame_transforms").
+		Where("patient_user_id", "==", patientUserID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("list frame transforms (%s): %w", patientUserID, err)
+	}
+	res := make([]*FrameTransform, 0, len(docs))
+	for _, d := range docs {
+		var t FrameTransform
+		if err := d.DataTo(&t); err != nil {
+			return nil, fmt.Errorf("decode frame transform (%s): %w", d.Ref.ID, err)
+		}
+		res = append(res, &t)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].UpdatedAt.After(res[j].UpdatedAt) })
+	return res, nil
+}
+
+// frameTransformBody is the create/update request body.
+type frameTransformBody struct {
+	SourceFoRUID string    `json:"source_frame_of_reference_uid"`
+	TargetFoRUID string    `json:"target_frame_of_reference_uid"`
+	Kind         string    `json:"kind"`
+	Matrix       []float64 `json:"matrix"`
+	Description  string    `json:"description"`
+}
+
+// ////////////////////////////////////////////////////
+//
+//	ENDPOINT: /api/imaging/frame-transforms[/{id}]
+//
+// FrameTransformsHandler implements CRUD on the caller's frame transforms:
+//
+//	GET    /api/imaging/frame-transforms        list
+//	POST   /api/imaging/frame-transforms        create
+//	GET    /api/imaging/frame-transforms/{id}   fetch
+//	PUT    /api/imaging/frame-transforms/{id}   replace
+//	DELETE /api/imaging/frame-transforms/{id}   delete
+func (h *Handlers) FrameTransformsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	callerID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("FrameTransformsHandler getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+		return
+	}
+
+	const prefix = "/api/imaging/frame-transforms"
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			transforms, err := h.DB.ListFrameTransformsForPatient(ctx, callerID)
+			if err != nil {
+				log.Printf("FrameTransformsHandler ListFrameTransformsForPatient error: %v", err)
+				writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "transforms": transforms})
+		case http.MethodPost:
+			var body frameTransformBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_json"})
+				return
+			}
+			t := &FrameTransform{
+				PatientUserID: callerID,
+				SourceFoRUID:  strings.TrimSpace(body.SourceFoRUID),
+				TargetFoRUID:  strings.TrimSpace(body.TargetFoRUID),
+				Kind:          body.Kind,
+				Matrix:        body.Matrix,
+				Description:   body.Description,
+				Method:        FrameTransformMethodManual,
+				CreatedBy:     callerID,
+			}
+			if err := validateFrameTransform(t); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_transform", "details": err.Error()})
+				return
+			}
+			if err := h.DB.CreateFrameTransform(ctx, t); err != nil {
+				log.Printf("FrameTransformsHandler CreateFrameTransform error: %v", err)
+				writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+				return
+			}
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "transform": t})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	t, err := h.DB.GetFrameTransform(ctx, id)
+	if err != nil {
+		log.Printf("FrameTransformsHandler GetFrameTransform error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+		return
+	}
+	if t == nil || t.PatientUserID != callerID {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "transform_not_found"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "transform": t})
+	case http.MethodPut:
+		var body frameTransformBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_json"})
+			return
+		}
+		t.SourceFoRUID = strings.TrimSpace(body.SourceFoRUID)
+		t.TargetFoRUID = strings.TrimSpace(body.TargetFoRUID)
+		t.Kind = body.Kind
+		t.Matrix = body.Matrix
+		t.Description = body.Description
+		t.Method = FrameTransformMethodManual
+		t.Landmarks, t.Residual, t.Quality = nil, nil, nil
+		if err := validateFrameTransform(t); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_transform", "details": err.Error()})
+			return
+		}
+		if err := h.DB.SaveFrameTransform(ctx, t); err != nil {
+			log.Printf("FrameTransformsHandler SaveFrameTransform error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "transform": t})
+	case http.MethodDelete:
+		if err := h.DB.DeleteFrameTransform(ctx, id); err != nil {
+			log.Printf("FrameTransformsHandler DeleteFrameTransform error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
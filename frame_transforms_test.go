@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// rigidZ returns a rotation of deg degrees about z followed by a translation.
+func rigidZ(deg, tx, ty, tz float64) []float64 {
+	c, s := math.Cos(deg*math.Pi/180), math.Sin(deg*math.Pi/180)
+	return []float64{
+		c, -s, 0, tx,
+		s, c, 0, ty,
+		0, 0, 1, tz,
+		0, 0, 0, 1,
+	}
+}
+
+func nearPoint(t *testing.T, gotX, gotY, gotZ float64, want [3]float64) {
+	t.Helper()
+	if math.Abs(gotX-want[0]) > 1e-9 || math.Abs(gotY-want[1]) > 1e-9 || math.Abs(gotZ-want[2]) > 1e-9 {
+		t.Errorf("point = (%g, %g, %g), want %v", gotX, gotY, gotZ, want)
+	}
+}
+
+func TestMat4Inverse(t *testing.T) {
+	m, _ := mat4FromSlice([]float64{2, 0, 0, 1, 0, 3, 0, -2, 0, 0, 4, 5, 0, 0, 0, 1})
+	inv, ok := m.inverse()
+	if !ok {
+		t.Fatal("inverse failed")
+	}
+	x, y, z := inv.apply(m.apply(1, 2, 3))
+	nearPoint(t, x, y, z, [3]float64{1, 2, 3})
+
+	if _, ok := (mat4{}).inverse(); ok {
+		t.Error("singular matrix inverted")
+	}
+}
+
+func TestValidateFrameTransform(t *testing.T) {
+	ok := &FrameTransform{SourceFoRUID: "1.1", TargetFoRUID: "1.2", Kind: FrameTransformRigid, Matrix: rigidZ(30, 1, 2, 3)}
+	if err := validateFrameTransform(ok); err != nil {
+		t.Errorf("valid rigid rejected: %v", err)
+	}
+
+	scaled := rigidZ(0, 0, 0, 0)
+	scaled[0] = 2
+	cases := map[string]*FrameTransform{
+		"scaled rigid":     {SourceFoRUID: "1.1", TargetFoRUID: "1.2", Kind: FrameTransformRigid, Matrix: scaled},
+		"short matrix":     {SourceFoRUID: "1.1", TargetFoRUID: "1.2", Kind: FrameTransformAffine, Matrix: []float64{1, 0, 0}},
+		"same frame":       {SourceFoRUID: "1.1", TargetFoRUID: "1.1", Kind: FrameTransformRigid, Matrix: rigidZ(0, 0, 0, 0)},
+		"canonical source": {SourceFoRUID: CanonicalFrameUID, TargetFoRUID: "1.1", Kind: FrameTransformRigid, Matrix: rigidZ(0, 0, 0, 0)},
+		"bad last row":     {SourceFoRUID: "1.1", TargetFoRUID: "1.2", Kind: FrameTransformAffine, Matrix: []float64{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 1, 0, 0, 1}},
+		"unknown kind":     {SourceFoRUID: "1.1", TargetFoRUID: "1.2", Kind: "warp", Matrix: rigidZ(0, 0, 0, 0)},
+		"reflection":       {SourceFoRUID: "1.1", TargetFoRUID: "1.2", Kind: FrameTransformRigid, Matrix: []float64{-1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}},
+		"singular affine":  {SourceFoRUID: "1.1", TargetFoRUID: "1.2", Kind: FrameTransformAffine, Matrix: []float64{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}},
+	}
+	scaledAffine := *cases["scaled rigid"]
+	scaledAffine.Kind = FrameTransformAffine
+	if err := validateFrameTransform(&scaledAffine); err != nil {
+		t.Errorf("scaled affine rejected: %v", err)
+	}
+	for name, tr := range cases {
+		if err := validateFrameTransform(tr); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestResolveFrameTransform(t *testing.T) {
+	transforms := []*FrameTransform{
+		{TransformID: "FXT-AB", SourceFoRUID: "A", TargetFoRUID: "B", Matrix: rigidZ(0, 10, 0, 0)},
+		{TransformID: "FXT-AC", SourceFoRUID: "A", TargetFoRUID: CanonicalFrameUID, Matrix: rigidZ(90, 0, 0, 0)},
+		{TransformID: "FXT-DC", SourceFoRUID: "D", TargetFoRUID: CanonicalFrameUID, Matrix: rigidZ(0, 0, 0, 5)},
+	}
+
+	cases := []struct {
+		from, to string
+		kind     string
+		ids      []string
+		want     [3]float64 // image of (1, 2, 3)
+	}{
+		{"A", "A", FrameMapIdentity, nil, [3]float64{1, 2, 3}},
+		{"A", "B", FrameMapDirect, []string{"FXT-AB"}, [3]float64{11, 2, 3}},
+		{"B", "A", FrameMapInverse, []string{"FXT-AB"}, [3]float64{-9, 2, 3}},
+		// A→canonical rotates 90° about z; canonical→D subtracts 5 in z.
+		{"A", "D", FrameMapCanonical, []string{"FXT-AC", "FXT-DC"}, [3]float64{-2, 1, -2}},
+	}
+	for _, c := range cases {
+		m, mapping, ok := resolveFrameTransform(transforms, c.from, c.to)
+		if !ok {
+			t.Errorf("%s→%s: not resolved", c.from, c.to)
+			continue
+		}
+		if mapping.Kind != c.kind || len(mapping.TransformIDs) != len(c.ids) {
+			t.Errorf("%s→%s: mapping = %+v, want %s %v", c.from, c.to, mapping, c.kind, c.ids)
+		}
+		x, y, z := m.apply(1, 2, 3)
+		nearPoint(t, x, y, z, c.want)
+	}
+
+	if _, _, ok := resolveFrameTransform(transforms, "B", "D"); ok {
+		t.Error("B→D resolved without a path")
+	}
+}
+
+func TestPickSliceFrame(t *testing.T) {
+	transforms := []*FrameTransform{
+		{TransformID: "FXT-AB", SourceFoRUID: "A", TargetFoRUID: "B", Matrix: rigidZ(0, 10, 0, 0)},
+		{TransformID: "FXT-AC", SourceFoRUID: "A", TargetFoRUID: CanonicalFrameUID, Matrix: rigidZ(0, 0, 0, 0)},
+		{TransformID: "FXT-CC", SourceFoRUID: "C", TargetFoRUID: CanonicalFrameUID, Matrix: rigidZ(0, 0, 0, 0)},
+	}
+	slices := []*IndexedSlice{{FrameOfReferenceUID: "C"}, {FrameOfReferenceUID: "B"}}
+
+	uid, _, mapping, ok := pickSliceFrame(slices, transforms, "A")
+	if !ok || uid != "B" || mapping.Kind != FrameMapDirect {
+		t.Errorf("pickSliceFrame = %q %+v %v, want B via direct", uid, mapping, ok)
+	}
+
+	slices = append(slices, &IndexedSlice{FrameOfReferenceUID: "A"})
+	if uid, _, mapping, _ := pickSliceFrame(slices, transforms, "A"); uid != "A" || mapping.Kind != FrameMapIdentity {
+		t.Errorf("same frame not preferred: %q %+v", uid, mapping)
+	}
+
+	if _, _, _, ok := pickSliceFrame([]*IndexedSlice{{FrameOfReferenceUID: "Z"}}, transforms, "A"); ok {
+		t.Error("unreachable frame picked")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -69,7 +70,13 @@ func (h *Handlers) GetUserIDFromRequest(ctx context.Context, r *http.Request) (s
 	if userID := strings.TrimSpace(r.Header.Get("X-User-Id")); userID != "" {
 		return userID, nil
 	}
+	return h.verifiedUserIDFromRequest(ctx, r)
+}
 
+// verifiedUserIDFromRequest returns the user ID from the request's Firebase
+// ID token, ignoring X-User-Id. Endpoints that grant elevated access use it
+// instead of GetUserIDFromRequest.
+func (h *Handlers) verifiedUserIDFromRequest(ctx context.Context, r *http.Request) (string, error) {
 	authz := r.Header.Get("Authorization")
 	if !strings.HasPrefix(authz, "Bearer ") {
 		return "", fmt.Errorf("missing Authorization bearer token")
@@ -372,6 +379,7 @@ func (h *Handlers) CreateProviderUploadTokenHandler(w http.ResponseWriter, r *ht
 		PatientPhone  string `json:"patient_phone"`
 		ExpiresInDays int    `json:"expires_in_days"`
 		MaxUses       int    `json:"max_uses"`
+		ProviderOrgID string `json:"provider_org_id"` // optional
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
@@ -397,6 +405,26 @@ func (h *Handlers) CreateProviderUploadTokenHandler(w http.ResponseWriter, r *ht
 		maxUses = 3
 	}
 
+	// The org becomes a quota scope for every session opened with this token,
+	// so only registered, active orgs may be named.
+	providerOrgID := strings.TrimSpace(body.ProviderOrgID)
+	if providerOrgID != "" {
+		org, err := h.DB.GetProviderOrg(ctx, providerOrgID)
+		if err != nil {
+			log.Printf("CreateProviderUploadToken GetProviderOrg error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"error": "server_error",
+			})
+			return
+		}
+		if org == nil || !org.Active {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error": "unknown_provider_org",
+			})
+			return
+		}
+	}
+
 	id, err := randomTokenID("UPL", 6)
 	if err != nil {
 		log.Printf("CreateProviderUploadToken randomTokenID error: %v", err)
@@ -410,6 +438,7 @@ func (h *Handlers) CreateProviderUploadTokenHandler(w http.ResponseWriter, r *ht
 	t := &ProviderUploadToken{
 		TokenID:       id,
 		UserID:        userID,
+		ProviderOrgID: providerOrgID,
 		PhoneHash:     hashPhone(phoneNorm),
 		ExpiresAt:     now.Add(time.Duration(expiresDays) * 24 * time.Hour),
 		RemainingUses: maxUses,
@@ -486,6 +515,24 @@ func (h *Handlers) ProviderCreateUploadSessionHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	// Provider quotas are charged only to the org bound to the token by the
+	// account that issued it; the uploader cannot pick whose quota it uses.
+	providerOrgID := t.ProviderOrgID
+
+	// Enforce session quotas before consuming a token use.
+	violation, err := h.reserveUploadSession(ctx, t.UserID, providerOrgID)
+	if err != nil {
+		log.Printf("ProviderCreateUploadSession reserveUploadSession error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if violation != nil {
+		writeQuotaExceeded(w, violation)
+		return
+	}
+
 	// Decrement RemainingUses (simple non-transactional update for now).
 	if err := h.DB.UpdateProviderUploadToken(ctx, t.TokenID, map[string]interface{}{
 		"remaining_uses": t.RemainingUses - 1,
@@ -515,6 +562,9 @@ func (h *Handlers) ProviderCreateUploadSessionHandler(w http.ResponseWriter, r *
 		CreatedBy: "provider",
 		Status:    "pending",
 		GCSURI:    "", // to be filled when GCS integration is added
+
+		ProviderOrgID: providerOrgID,
+
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -666,7 +716,7 @@ func (h *Handlers) ProviderUploadFilesHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// Mark session as uploaded; GCS/DICOM integration can refine this later.
-	if err := h.DB.UpdateUploadSessionStatus(ctx, sessionID, map[string]interface{}{
+	if err := h.updateUploadSession(ctx, sessionID, map[string]interface{}{
 		"status": "uploaded",
 	}); err != nil {
 		log.Printf("ProviderUploadFiles UpdateUploadSessionStatus error: %v", err)
@@ -760,6 +810,26 @@ func (h *Handlers) ProviderUploadURLHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Reject uploads whose declared type is clearly not DICOM (PDF reports,
+	// JPEG screenshots, viewer HTML from CDs, ...). Content is sniffed again
+	// at ingest time since the declared type is only a hint.
+	if !isDeclaredDicomContentType(body.ContentType) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":        "non_dicom_content_type",
+			"content_type": body.ContentType,
+			"file_name":    body.FileName,
+		})
+		return
+	}
+
+	// The declared size is charged against the quota and enforced by GCS via
+	// the signed content-length range, so it must be given up front.
+	if body.SizeBytes <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid_size_bytes",
+		})
+		return
+	}
 	safeName := sanitizeObjectName(body.FileName)
 
 	// Object path: user_id/session_id/relative-path
@@ -773,6 +843,7 @@ func (h *Handlers) ProviderUploadURLHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	contentLengthRange := fmt.Sprintf("0,%d", body.SizeBytes)
 	signedURL, err := storage.SignedURL(
 		h.Cfg.ImagingBucket,
 		objectPath,
@@ -781,6 +852,7 @@ func (h *Handlers) ProviderUploadURLHandler(w http.ResponseWriter, r *http.Reque
 			Method:         "PUT",
 			Expires:        time.Now().Add(30 * time.Minute),
 			ContentType:    body.ContentType,
+			Headers:        []string{"x-goog-content-length-range:" + contentLengthRange},
 			GoogleAccessID: h.Cfg.SignedURLServiceAccountEmail,
 			PrivateKey:     []byte(h.Cfg.SignedURLPrivateKey),
 		},
@@ -796,9 +868,24 @@ func (h *Handlers) ProviderUploadURLHandler(w http.ResponseWriter, r *http.Reque
 	// gs:// path for later DICOM import / viewing.
 	gsPath := fmt.Sprintf("gs://%s/%s", h.Cfg.ImagingBucket, objectPath)
 
+	// Check the byte quota and count the declared bytes against the session
+	// in one step, so a session cannot slip past the quota one URL at a time.
+	violation, err := h.reserveUploadBytes(ctx, sess, body.SizeBytes)
+	if err != nil {
+		log.Printf("ProviderUploadURL reserveUploadBytes error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if violation != nil {
+		writeQuotaExceeded(w, violation)
+		return
+	}
+
 	// Optional: mark session as "uploading" if it was "pending".
 	if sess.Status == "pending" {
-		if err := h.DB.UpdateUploadSessionStatus(ctx, sess.SessionID, map[string]interface{}{
+		if err := h.updateUploadSession(ctx, sess.SessionID, map[string]interface{}{
 			"status": "uploading",
 		}); err != nil {
 			log.Printf("ProviderUploadURL UpdateUploadSessionStatus error: %v", err)
@@ -810,6 +897,10 @@ func (h *Handlers) ProviderUploadURLHandler(w http.ResponseWriter, r *http.Reque
 		"uploadUrl": signedURL,
 		"gsPath":    gsPath,
 		"uploadId":  objectPath, // can serve as a per-file ID
+		// The PUT must send this header; GCS rejects bodies outside the range.
+		"uploadHeaders": map[string]string{
+			"x-goog-content-length-range": contentLengthRange,
+		},
 	})
 }
 
@@ -844,6 +935,19 @@ func (h *Handlers) UserCreateUploadSessionHandler(w http.ResponseWriter, r *http
 	}
 	_ = json.NewDecoder(r.Body).Decode(&body) // ignore errors, all fields optional
 
+	violation, err := h.reserveUploadSession(ctx, userID, "")
+	if err != nil {
+		log.Printf("UserCreateUploadSession reserveUploadSession error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if violation != nil {
+		writeQuotaExceeded(w, violation)
+		return
+	}
+
 	sessionID, err := randomTokenID("SESS", 10)
 	if err != nil {
 		log.Printf("UserCreateUploadSession randomTokenID error: %v", err)
@@ -883,8 +987,10 @@ func (h *Handlers) UserCreateUploadSessionHandler(w http.ResponseWriter, r *http
 
 // ProviderGetUploadSessionHandler implements
 // GET /api/imaging/provider/upload-sessions/<session_id>
+// GET /api/imaging/provider/upload-sessions/<session_id>/files
 //
-//	Returns a upload session object for front end consumption
+//	Returns a upload session object for front end consumption, or the
+//	per-file ingest outcomes for the session.
 func (h *Handlers) ProviderGetUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -900,7 +1006,12 @@ func (h *Handlers) ProviderGetUploadSessionHandler(w http.ResponseWriter, r *htt
 
 	// Get the {id} from the end of the url
 	sessionID := strings.TrimSpace(strings.TrimPrefix(path, prefix))
-	if sessionID == "" {
+	wantFiles := false
+	if strings.HasSuffix(sessionID, "/files") {
+		sessionID = strings.TrimSuffix(sessionID, "/files")
+		wantFiles = true
+	}
+	if sessionID == "" || strings.Contains(sessionID, "/") {
 		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
 			"error": "session_id required",
 		})
@@ -925,6 +1036,25 @@ func (h *Handlers) ProviderGetUploadSessionHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
+	if wantFiles {
+		files, err := h.DB.ListUploadFiles(ctx, sessionID)
+		if err != nil {
+			log.Printf("ProviderGetUploadSession ListUploadFiles error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"error": "server_error",
+			})
+			return
+		}
+		if files == nil {
+			files = []*UploadFile{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok":    true,
+			"files": files,
+		})
+		return
+	}
+
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"ok":      true,
 		"session": sess,
@@ -966,13 +1096,15 @@ func (h *Handlers) ListImagingStudiesHandler(w http.ResponseWriter, r *http.Requ
 
 // ImagingStudyByIDHandler implements:
 //   - GET /api/imaging/studies/<study_id>
+//   - DELETE /api/imaging/studies/<study_id>
+//   - GET /api/imaging/studies/<study_id>/changes
 //   - GET /api/imaging/studies/<study_id>/dicom/metadata
 //   - GET /api/imaging/studies/<study_id>/dicom/series/<seriesUID>/instances/<sopUID>/frames/<frame>
 //
 // It routes to the appropriate sub-handler based on the URL path. All
 // variants require an authenticated user who owns the ImagingStudy record.
 func (h *Handlers) ImagingStudyByIDHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -997,10 +1129,37 @@ func (h *Handlers) ImagingStudyByIDHandler(w http.ResponseWriter, r *http.Reques
 	// /api/imaging/studies/{studyID}
 	if len(parts) == 1 {
 		studyID := parts[0]
+		if r.Method == http.MethodDelete {
+			h.handleImagingStudyDelete(w, r, studyID)
+			return
+		}
 		h.handleImagingStudyJSON(w, r, studyID)
 		return
 	}
 
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /api/imaging/studies/{studyID}/changes
+	if len(parts) == 2 && parts[1] == "changes" {
+		h.handleImagingStudyChanges(w, r, parts[0])
+		return
+	}
+
+	// /api/imaging/studies/{studyID}/series
+	if len(parts) == 2 && parts[1] == "series" {
+		h.handleImagingStudySeries(w, r, parts[0])
+		return
+	}
+
+	// /api/imaging/studies/{studyID}/instances/{sopUID}/deidentified
+	if len(parts) == 4 && parts[1] == "instances" && parts[3] == "deidentified" {
+		h.handleImagingInstanceDeidentified(w, r, parts[0], parts[2])
+		return
+	}
+
 	// /api/imaging/studies/{studyID}/dicom/metadata
 	if len(parts) == 3 && parts[1] == "dicom" && parts[2] == "metadata" {
 		studyID := parts[0]
@@ -1065,6 +1224,112 @@ func (h *Handlers) handleImagingStudyJSON(w http.ResponseWriter, r *http.Request
 	})
 }
 
+// handleImagingStudyChanges returns the change log of a study owned by the
+// authenticated user: which upload sessions contributed which series.
+func (h *Handlers) handleImagingStudyChanges(w http.ResponseWriter, r *http.Request, studyID string) {
+	ctx := r.Context()
+	userID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("handleImagingStudyChanges getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthorized",
+		})
+		return
+	}
+
+	study, err := h.DB.GetImagingStudy(ctx, studyID)
+	if err != nil {
+		log.Printf("handleImagingStudyChanges GetImagingStudy error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if study == nil || study.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "study_not_found",
+		})
+		return
+	}
+
+	changes, err := h.DB.ListStudyChanges(ctx, studyID)
+	if err != nil {
+		log.Printf("handleImagingStudyChanges ListStudyChanges error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":      true,
+		"changes": changes,
+	})
+}
+
+// handleImagingStudyDelete deletes an ImagingStudy owned by the authenticated
+// user, removes it from the DICOM store when no other study document still
+// references the same StudyInstanceUID, and releases its quota usage.
+func (h *Handlers) handleImagingStudyDelete(w http.ResponseWriter, r *http.Request, studyID string) {
+	ctx := r.Context()
+	userID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("handleImagingStudyDelete getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthorized",
+		})
+		return
+	}
+
+	study, err := h.DB.GetImagingStudy(ctx, studyID)
+	if err != nil {
+		log.Printf("handleImagingStudyDelete GetImagingStudy error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if study == nil || study.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "study_not_found",
+		})
+		return
+	}
+
+	if err := h.DB.DeleteImagingStudy(ctx, studyID); err != nil {
+		log.Printf("handleImagingStudyDelete DeleteImagingStudy error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	h.releaseStudyUsage(ctx, study)
+	if err := h.DB.DeleteImagingInstancesForStudy(ctx, studyID); err != nil {
+		log.Printf("handleImagingStudyDelete DeleteImagingInstancesForStudy error: %v", err)
+	}
+	if err := h.DB.DeleteImagingSeriesForStudy(ctx, studyID); err != nil {
+		log.Printf("handleImagingStudyDelete DeleteImagingSeriesForStudy error: %v", err)
+	}
+
+	// The DICOM store is shared; only drop the instances when this was the
+	// last study document pointing at them.
+	if h.Dicom != nil && study.StudyInstanceUID != "" {
+		other, err := h.DB.GetImagingStudyByStudyInstanceUID(ctx, study.StudyInstanceUID)
+		if err != nil {
+			log.Printf("handleImagingStudyDelete GetImagingStudyByStudyInstanceUID error: %v", err)
+		} else if other == nil {
+			if err := h.Dicom.DeleteStudy(ctx, study.StudyInstanceUID); err != nil {
+				log.Printf("handleImagingStudyDelete DeleteStudy(%s) error: %v", study.StudyInstanceUID, err)
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":       true,
+		"study_id": studyID,
+	})
+}
+
 // handleImagingStudyDicomMetadata proxies DICOMweb /studies/{StudyInstanceUID}/metadata
 // through the backend after verifying ownership of the ImagingStudy.
 func (h *Handlers) handleImagingStudyDicomMetadata(w http.ResponseWriter, r *http.Request, studyID string) {
@@ -1311,9 +1576,9 @@ func (h *Handlers) DicomWebStudiesHandler(w http.ResponseWriter, r *http.Request
 
 	// Ensure the requested StudyInstanceUID corresponds to a study owned by
 	// this user. We use Firestore as the source of truth for ownership.
-	studyRec, err := h.DB.GetImagingStudyByStudyInstanceUID(ctx, studyUID)
+	studyRec, err := h.DB.GetImagingStudyForUser(ctx, userID, studyUID)
 	if err != nil {
-		log.Printf("DicomWebStudiesHandler GetImagingStudyByStudyInstanceUID error: %v", err)
+		log.Printf("DicomWebStudiesHandler GetImagingStudyForUser error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"error": "server_error",
 		})
@@ -1329,7 +1594,7 @@ func (h *Handlers) DicomWebStudiesHandler(w http.ResponseWriter, r *http.Request
 	// Decide which sub-route we are handling.
 	if len(parts) == 2 {
 		// /api/dicomweb/studies/{StudyInstanceUID}/series
-		h.handleDicomWebListSeries(w, r, studyUID)
+		h.handleDicomWebListSeries(w, r, studyRec)
 		return
 	}
 	if len(parts) == 4 && parts[1] == "series" && parts[3] == "metadata" {
@@ -1341,7 +1606,7 @@ func (h *Handlers) DicomWebStudiesHandler(w http.ResponseWriter, r *http.Request
 	if len(parts) == 4 && parts[2] != "" && parts[3] == "instances" {
 		// /api/dicomweb/studies/{StudyInstanceUID}/series/{SeriesInstanceUID}/instances
 		seriesUID := parts[2]
-		h.handleDicomWebListInstances(w, r, studyUID, seriesUID)
+		h.handleDicomWebListInstances(w, r, studyRec, seriesUID)
 		return
 	}
 	if len(parts) == 5 && parts[2] != "" && parts[3] == "instances" {
@@ -1403,27 +1668,20 @@ func (h *Handlers) DicomWebStudiesHandler(w http.ResponseWriter, r *http.Request
 }
 
 // handleDicomWebListSeries returns a DICOM JSON array describing the series
-// within the given StudyInstanceUID, derived from the study-level metadata.
-func (h *Handlers) handleDicomWebListSeries(w http.ResponseWriter, r *http.Request, studyUID string) {
+// within the given study, derived from its instance catalog (or the
+// study-level metadata for studies without one).
+func (h *Handlers) handleDicomWebListSeries(w http.ResponseWriter, r *http.Request, study *ImagingStudy) {
 	ctx := r.Context()
-	bytes, err := h.Dicom.StudyMetadataJSON(ctx, studyUID)
+	studyUID := study.StudyInstanceUID
+	datasets, err := h.studyInstanceDatasets(ctx, study, false)
 	if err != nil {
-		log.Printf("handleDicomWebListSeries StudyMetadataJSON error: %v", err)
+		log.Printf("handleDicomWebListSeries studyInstanceDatasets error: %v", err)
 		writeJSON(w, http.StatusBadGateway, map[string]interface{}{
 			"error": "dicom_metadata_error",
 		})
 		return
 	}
 
-	var datasets []map[string]interface{}
-	if err := json.Unmarshal(bytes, &datasets); err != nil {
-		log.Printf("handleDicomWebListSeries unmarshal error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-			"error": "invalid_dicom_metadata",
-		})
-		return
-	}
-
 	seriesMap := make(map[string]map[string]interface{})
 
 	for _, ds := range datasets {
@@ -1506,9 +1764,9 @@ func (h *Handlers) handleDicomWebSearchStudies(w http.ResponseWriter, r *http.Re
 	//}
 
 	// Enforce ownership via Firestore ImagingStudy
-	studyRec, err := h.DB.GetImagingStudyByStudyInstanceUID(ctx, studyUID)
+	studyRec, err := h.DB.GetImagingStudyForUser(ctx, userID, studyUID)
 	if err != nil {
-		log.Printf("handleDicomWebSearchStudies GetImagingStudyByStudyInstanceUID error: %v", err)
+		log.Printf("handleDicomWebSearchStudies GetImagingStudyForUser error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"error": "server_error",
 		})
@@ -1564,28 +1822,20 @@ func (h *Handlers) handleDicomWebSearchStudies(w http.ResponseWriter, r *http.Re
 }
 
 // handleDicomWebListInstances returns a DICOM JSON array describing the
-// instances within the given StudyInstanceUID/SeriesInstanceUID, derived from
-// the study-level metadata.
-func (h *Handlers) handleDicomWebListInstances(w http.ResponseWriter, r *http.Request, studyUID, seriesUID string) {
+// instances within the given study and SeriesInstanceUID, derived from its
+// instance catalog (or the study-level metadata for studies without one).
+func (h *Handlers) handleDicomWebListInstances(w http.ResponseWriter, r *http.Request, study *ImagingStudy, seriesUID string) {
 	ctx := r.Context()
-	bytes, err := h.Dicom.StudyMetadataJSON(ctx, studyUID)
+	studyUID := study.StudyInstanceUID
+	datasets, err := h.studyInstanceDatasets(ctx, study, false)
 	if err != nil {
-		log.Printf("handleDicomWebListInstances StudyMetadataJSON error: %v", err)
+		log.Printf("handleDicomWebListInstances studyInstanceDatasets error: %v", err)
 		writeJSON(w, http.StatusBadGateway, map[string]interface{}{
 			"error": "dicom_metadata_error",
 		})
 		return
 	}
 
-	var datasets []map[string]interface{}
-	if err := json.Unmarshal(bytes, &datasets); err != nil {
-		log.Printf("handleDicomWebListInstances unmarshal error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-			"error": "invalid_dicom_metadata",
-		})
-		return
-	}
-
 	/////////////////////////////////////////
 	//
 	// 1) Determine dominant orientation for this SeriesInstanceUID.
@@ -1648,8 +1898,11 @@ func (h *Handlers) handleDicomWebListInstances(w http.ResponseWriter, r *http.Re
 		if sopInstanceUID == "" {
 			continue
 		}
-		instanceNumber := dicomwebTagString(ds, "00200013") // InstanceNumber
-		modality := dicomwebTagString(ds, "00080060")       // Modality
+		instanceNumber := ""
+		if v, ok := parseDICOMFloatSlice(ds, "00200013", 1); ok { // InstanceNumber
+			instanceNumber = strconv.Itoa(int(v[0]))
+		}
+		modality := dicomwebTagString(ds, "00080060") // Modality
 
 		obj := map[string]interface{}{}
 		obj["0020000D"] = map[string]interface{}{"vr": "UI", "Value": []string{studyVal}}
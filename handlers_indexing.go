@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -41,6 +42,14 @@ func (h *Handlers) LongitudinalIndexHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	type studyJob struct {
+		StudyID  string `json:"studyId"`
+		JobID    string `json:"jobId,omitempty"`
+		Status   string `json:"status"`
+		Enqueued bool   `json:"enqueued"`
+		Error    string `json:"error,omitempty"`
+	}
+	results := make([]studyJob, 0, len(body.StudyIDs))
 	for _, studyID := range body.StudyIDs {
 		studyID = strings.TrimSpace(studyID)
 		if studyID == "" {
@@ -50,60 +59,112 @@ func (h *Handlers) LongitudinalIndexHandler(w http.ResponseWriter, r *http.Reque
 		study, err := h.DB.GetImagingStudy(ctx, studyID)
 		if err != nil {
 			log.Printf("LongitudinalIndexHandler GetImagingStudy(%s) error: %v", studyID, err)
+			results = append(results, studyJob{StudyID: studyID, Status: "error", Error: "server_error"})
 			continue
 		}
-		if study == nil {
-			log.Printf("LongitudinalIndexHandler study %s not found", studyID)
+		// ACCESS CHECK v1: caller must be the patient/user who owns the study.
+		// Later you can relax this to allow doctor access via an approval list.
+		if study == nil || study.UserID != callerID {
+			log.Printf("LongitudinalIndexHandler: study %s not found for caller %s", studyID, callerID)
+			results = append(results, studyJob{StudyID: studyID, Status: "error", Error: "not_found"})
 			continue
 		}
 
-		// ACCESS CHECK v1: caller must be the patient/user who owns the study.
-		// Later you can relax this to allow doctor access via an approval list.
-		if study.UserID != callerID {
-			log.Printf("LongitudinalIndexHandler: caller %s not owner of study %s", callerID, studyID)
+		job, enqueued, err := h.enqueueStudyIndex(ctx, study)
+		if err != nil {
+			log.Printf("LongitudinalIndexHandler enqueueStudyIndex(%s) error: %v", studyID, err)
+			results = append(results, studyJob{StudyID: studyID, Status: "error", Error: "enqueue_failed"})
 			continue
 		}
+		results = append(results, studyJob{StudyID: studyID, JobID: job.JobID, Status: job.Status, Enqueued: enqueued})
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"ok": true, "jobs": results})
+}
 
-		// Mark status = indexing
-		_ = h.DB.SetLongitudinalIndexStatus(ctx, &LongitudinalIndexStatus{
-			StudyID:       study.StudyID,
-			PatientUserID: study.UserID,
-			Status:        "indexing",
-			LastError:     "",
-		})
+// ////////////////////////////////////////////////////
+//
+//	ENDPOINT: /api/imaging/longitudinal/index/cancel
+//
+//	Cancel queued or running indexing on a set of studies
+//
+// LongitudinalIndexCancelHandler implements
+// POST /api/imaging/longitudinal/index/cancel.
+// Body: { "studyIds": ["STUDY-ID-1", ...] }
+//
+// Queued jobs are cancelled at once; running jobs stop at their next
+// heartbeat, after which the study status reads "cancelled".
+func (h *Handlers) LongitudinalIndexCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 
-		slices, err := h.buildIndexedSlicesForStudy(ctx, study)
+	ctx := r.Context()
+	callerID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("LongitudinalIndexCancelHandler getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+		return
+	}
+
+	var body struct {
+		StudyIDs []string `json:"studyIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_json"})
+		return
+	}
+	if len(body.StudyIDs) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "studyIds required"})
+		return
+	}
+
+	type studyCancel struct {
+		StudyID   string `json:"studyId"`
+		Cancelled bool   `json:"cancelled"`
+		Status    string `json:"status,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+	results := make([]studyCancel, 0, len(body.StudyIDs))
+	for _, studyID := range body.StudyIDs {
+		studyID = strings.TrimSpace(studyID)
+		if studyID == "" {
+			continue
+		}
+		study, err := h.DB.GetImagingStudy(ctx, studyID)
 		if err != nil {
-			log.Printf("buildIndexedSlicesForStudy(%s) error: %v", studyID, err)
-			_ = h.DB.SetLongitudinalIndexStatus(ctx, &LongitudinalIndexStatus{
-				StudyID:       study.StudyID,
-				PatientUserID: study.UserID,
-				Status:        "error",
-				LastError:     err.Error(),
-			})
+			log.Printf("LongitudinalIndexCancelHandler GetImagingStudy(%s) error: %v", studyID, err)
+			results = append(results, studyCancel{StudyID: studyID, Error: "server_error"})
 			continue
 		}
-
-		if err := h.DB.SaveIndexedSlicesForStudy(ctx, study.StudyID, slices); err != nil {
-			log.Printf("SaveIndexedSlicesForStudy(%s) error: %v", studyID, err)
-			_ = h.DB.SetLongitudinalIndexStatus(ctx, &LongitudinalIndexStatus{
-				StudyID:       study.StudyID,
-				PatientUserID: study.UserID,
-				Status:        "error",
-				LastError:     err.Error(),
-			})
+		if study == nil || study.UserID != callerID {
+			results = append(results, studyCancel{StudyID: studyID, Error: "not_found"})
 			continue
 		}
 
-		_ = h.DB.SetLongitudinalIndexStatus(ctx, &LongitudinalIndexStatus{
-			StudyID:       study.StudyID,
-			PatientUserID: study.UserID,
-			Status:        "indexed",
-			LastError:     "",
-		})
+		job, cancelled, err := h.DB.CancelIndexJob(ctx, studyID)
+		if err != nil {
+			log.Printf("LongitudinalIndexCancelHandler CancelIndexJob(%s) error: %v", studyID, err)
+			results = append(results, studyCancel{StudyID: studyID, Error: "server_error"})
+			continue
+		}
+		res := studyCancel{StudyID: studyID, Cancelled: cancelled}
+		if job != nil {
+			res.Status = job.Status
+		}
+		if cancelled && job.Status == IndexJobCancelled {
+			// A queued job never reached a worker, so record it here.
+			if _, err := h.DB.UpdateLongitudinalIndexStatus(ctx, study.StudyID, study.UserID, func(s *LongitudinalIndexStatus) {
+				s.Status, s.LastError = "cancelled", ""
+			}); err != nil {
+				log.Printf("LongitudinalIndexCancelHandler UpdateLongitudinalIndexStatus(%s) error: %v", studyID, err)
+			}
+		}
+		results = append(results, res)
 	}
 
-	writeJSON(w, http.StatusAccepted, map[string]interface{}{"ok": true})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "results": results})
 }
 
 // LongitudinalIndexHandler implements POST /api/imaging/longitudinal/index.
@@ -273,13 +334,33 @@ func (h *Handlers) LongitudinalIndexStatusHandler(w http.ResponseWriter, r *http
 //	  "x": 12.3,
 //	  "y": -45.6,
 //	  "z": 78.9,
-//	  "studyIds": ["STUDY-ID-1", ...]
+//	  "studyIds": ["STUDY-ID-1", ...],
+//	  "toleranceMm": 2.0,            // optional, default half the slice thickness
+//	  "includeOutOfBounds": false,   // optional, see below
+//	  "modality": "MR",              // optional filters
+//	  "orientation": "axial",        // axial|sagittal|coronal|oblique
+//	  "seriesInstanceUids": ["1.2.3", ...]
 //	}
 //
-// Response: array of matches, one per study (when available), each with
+// Response: array of matches, one per series (when available), ordered by
+// study date, then series number, each with
+//
+//	studyId, studyDate, studyInstanceUid, seriesInstanceUid, seriesNumber,
+//	seriesDescription, modality, orientation, sopInstanceUid,
+//	instanceNumber, frameNumber, framesUrl, row, col, plus the
+//	frameOfReferenceUid searched, the point mapped into it and the transform
+//	used to get there.
 //
-//	studyId, studyInstanceUid, seriesInstanceUid, sopInstanceUid,
-//	instanceNumber, row, col.
+// frameNumber is the 1-based frame of the instance (always 1 unless it is a
+// multi-frame object) and framesUrl the frames endpoint that renders it.
+//
+// A series matches only if the point lies within the tolerance of a slice
+// plane and inside that image; each match reports distanceMm, the in-bounds
+// flags and a confidence in [0, 1]. With includeOutOfBounds, series with no
+// such slice return their nearest slice with confidence 0 instead.
+//
+// Studies in another frame of reference are matched through the caller's
+// frame_transforms (directly or via the canonical frame).
 func (h *Handlers) LongitudinalResolvePointHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -301,11 +382,38 @@ func (h *Handlers) LongitudinalResolvePointHandler(w http.ResponseWriter, r *htt
 		Y                   float64  `json:"y"`
 		Z                   float64  `json:"z"`
 		StudyIDs            []string `json:"studyIds"`
+		ToleranceMM         float64  `json:"toleranceMm"`
+		IncludeOutOfBounds  bool     `json:"includeOutOfBounds"`
+		Modality            string   `json:"modality"`
+		Orientation         string   `json:"orientation"`
+		SeriesInstanceUIDs  []string `json:"seriesInstanceUids"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_json"})
 		return
 	}
+	if body.ToleranceMM < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "toleranceMm must not be negative"})
+		return
+	}
+	filter := seriesFilter{
+		Modality:    strings.TrimSpace(body.Modality),
+		Orientation: strings.ToLower(strings.TrimSpace(body.Orientation)),
+	}
+	switch filter.Orientation {
+	case "", OrientationAxial, OrientationSagittal, OrientationCoronal, OrientationOblique:
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid orientation"})
+		return
+	}
+	for _, uid := range body.SeriesInstanceUIDs {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			if filter.SeriesUIDs == nil {
+				filter.SeriesUIDs = make(map[string]bool)
+			}
+			filter.SeriesUIDs[uid] = true
+		}
+	}
 
 	if len(body.StudyIDs) == 0 || strings.TrimSpace(body.FrameOfReferenceUID) == "" {
 		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "frameOfReferenceUid and studyIds required"})
@@ -336,14 +444,37 @@ func (h *Handlers) LongitudinalResolvePointHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
+	transforms, err := h.DB.ListFrameTransformsForPatient(ctx, callerID)
+	if err != nil {
+		log.Printf("LongitudinalResolvePointHandler ListFrameTransformsForPatient error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+		return
+	}
+
 	type match struct {
-		StudyID           string  `json:"studyId"`
-		StudyInstanceUID  string  `json:"studyInstanceUid"`
-		SeriesInstanceUID string  `json:"seriesInstanceUid"`
-		SOPInstanceUID    string  `json:"sopInstanceUid"`
-		InstanceNumber    int     `json:"instanceNumber"`
-		Row               float64 `json:"row"`
-		Col               float64 `json:"col"`
+		StudyID             string        `json:"studyId"`
+		StudyDate           string        `json:"studyDate"`
+		StudyInstanceUID    string        `json:"studyInstanceUid"`
+		SeriesInstanceUID   string        `json:"seriesInstanceUid"`
+		SeriesNumber        int           `json:"seriesNumber"`
+		SeriesDescription   string        `json:"seriesDescription"`
+		Modality            string        `json:"modality"`
+		Orientation         string        `json:"orientation"`
+		SOPInstanceUID      string        `json:"sopInstanceUid"`
+		InstanceNumber      int           `json:"instanceNumber"`
+		FrameNumber         int           `json:"frameNumber"`
+		FramesURL           string        `json:"framesUrl"`
+		Row                 float64       `json:"row"`
+		Col                 float64       `json:"col"`
+		FrameOfReferenceUID string        `json:"frameOfReferenceUid"`
+		Point               [3]float64    `json:"point"` // caller's point in frameOfReferenceUid
+		Transform           *FrameMapping `json:"transform"`
+		DistanceMM          float64       `json:"distanceMm"`
+		ToleranceMM         float64       `json:"toleranceMm"`
+		InBounds            bool          `json:"inBounds"`
+		RowInBounds         bool          `json:"rowInBounds"`
+		ColInBounds         bool          `json:"colInBounds"`
+		Confidence          float64       `json:"confidence"`
 	}
 
 	results := make([]match, 0, len(validStudyIDs))
@@ -354,42 +485,58 @@ func (h *Handlers) LongitudinalResolvePointHandler(w http.ResponseWriter, r *htt
 			continue
 		}
 
-		slices, err := h.DB.ListIndexedSlicesForStudyAndFoR(ctx, studyID, body.FrameOfReferenceUID)
+		index, err := h.DB.StudySliceIndex(ctx, studyID)
 		if err != nil {
-			log.Printf("LongitudinalResolvePointHandler ListIndexedSlicesForStudyAndFoR(%s) error: %v", studyID, err)
+			log.Printf("LongitudinalResolvePointHandler StudySliceIndex(%s) error: %v", studyID, err)
 			continue
 		}
-		if len(slices) == 0 {
+		forUID, m, mapping, ok := pickSliceFrame(index.frames, transforms, body.FrameOfReferenceUID)
+		if !ok {
 			continue
 		}
-
-		// Find slice with minimal distance to plane.
-		var best *IndexedSlice
-		bestDist := 0.0
-		for i, s := range slices {
-			d := distanceToSlicePlane(s, body.X, body.Y, body.Z)
-			if i == 0 || d < bestDist {
-				bestDist = d
-				best = s
-			}
-		}
-		if best == nil {
-			continue
+		x, y, z := m.apply(body.X, body.Y, body.Z)
+
+		// Closest slice the point actually lies on, per series.
+		for _, res := range resolvePointPerSeries(index, forUID, x, y, z, body.ToleranceMM, body.IncludeOutOfBounds, filter) {
+			best := res.Slice
+			results = append(results, match{
+				StudyID:             study.StudyID,
+				StudyDate:           study.StudyDate,
+				StudyInstanceUID:    study.StudyInstanceUID,
+				SeriesInstanceUID:   best.SeriesInstanceUID,
+				SeriesNumber:        best.SeriesNumber,
+				SeriesDescription:   best.SeriesDescription,
+				Modality:            best.Modality,
+				Orientation:         sliceOrientation(best),
+				SOPInstanceUID:      best.SOPInstanceUID,
+				InstanceNumber:      best.InstanceNumber,
+				FrameNumber:         sliceFrameNumber(best),
+				FramesURL:           sliceFramesURL(study.StudyID, best),
+				Row:                 res.Row,
+				Col:                 res.Col,
+				FrameOfReferenceUID: forUID,
+				Point:               [3]float64{x, y, z},
+				Transform:           mapping,
+				DistanceMM:          res.Distance,
+				ToleranceMM:         res.Tolerance,
+				InBounds:            res.RowInBounds && res.ColInBounds,
+				RowInBounds:         res.RowInBounds,
+				ColInBounds:         res.ColInBounds,
+				Confidence:          res.Confidence,
+			})
 		}
-
-		row, col := projectPointToSlice(best, body.X, body.Y, body.Z)
-
-		results = append(results, match{
-			StudyID:           study.StudyID,
-			StudyInstanceUID:  study.StudyInstanceUID,
-			SeriesInstanceUID: best.SeriesInstanceUID,
-			SOPInstanceUID:    best.SOPInstanceUID,
-			InstanceNumber:    best.InstanceNumber,
-			Row:               row,
-			Col:               col,
-		})
 	}
 
+	// Time-ordered strip: per study the series stay in series-number order.
+	sort.SliceStable(results, func(a, b int) bool {
+		da, db := results[a].StudyDate, results[b].StudyDate
+		if da != db {
+			// Studies without a date go last.
+			return db == "" || (da != "" && da < db)
+		}
+		return results[a].StudyID < results[b].StudyID
+	})
+
 	writeJSON(w, http.StatusOK, results)
 }
 
@@ -7,10 +7,12 @@ import (
 	"encoding/base32"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -21,6 +23,7 @@ import (
 type ProviderUploadToken struct {
 	TokenID       string    `firestore:"token_id" json:"token_id"`
 	UserID        string    `firestore:"user_id" json:"user_id"`
+	ProviderOrgID string    `firestore:"provider_org_id" json:"provider_org_id"` // optional; scopes provider quotas
 	PhoneHash     string    `firestore:"phone_hash" json:"phone_hash"`
 	ExpiresAt     time.Time `firestore:"expires_at" json:"expires_at"`
 	RemainingUses int       `firestore:"remaining_uses" json:"remaining_uses"`
@@ -28,17 +31,45 @@ type ProviderUploadToken struct {
 	CreatedAt     time.Time `firestore:"created_at" json:"created_at"`
 }
 
+// ProviderOrg is a registered provider organization, stored in provider_orgs
+// keyed by org ID. Only registered, active orgs can be named on upload tokens
+// and so become quota scopes.
+type ProviderOrg struct {
+	OrgID     string    `firestore:"org_id" json:"org_id"`
+	Name      string    `firestore:"name" json:"name"`
+	Active    bool      `firestore:"active" json:"active"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+}
+
 // UploadSession tracks a single imaging upload session (for GCS/DICOM).
 type UploadSession struct {
 	SessionID string    `firestore:"session_id" json:"session_id"`
 	UserID    string    `firestore:"user_id" json:"user_id"`
 	CreatedBy string    `firestore:"created_by" json:"created_by"` // "patient" or "provider"
-	Status    string    `firestore:"status" json:"status"`         // pending|uploading|uploaded|importing|ready|error
+	Status    string    `firestore:"status" json:"status"`         // pending|uploading|uploaded|validating|importing|retrying|ready|error
 	GCSURI    string    `firestore:"gcs_uri" json:"gcs_uri"`
 	GCSPrefix string    `firestore:"gcs_prefix" json:"gcs_prefix"` // e.g. "gs://bucket/userId/sessionId/"
 
+	// ProviderOrgID is the uploading provider organization, if any; usage is
+	// charged to it as well as to UserID.
+	ProviderOrgID string `firestore:"provider_org_id" json:"provider_org_id"`
+	// DeclaredBytes sums the sizes declared when upload URLs were issued.
+	DeclaredBytes int64 `firestore:"declared_bytes" json:"declared_bytes"`
+	// PendingBytes is the part of DeclaredBytes still charged to the quota
+	// scopes' pending_bytes; it drops to zero when ingest ends.
+	PendingBytes int64 `firestore:"pending_bytes" json:"pending_bytes"`
+
 	DicomImportOpName string    `firestore:"dicom_import_operation" json:"dicom_import_operation"` // LRO name from Healthcare
 	ErrorMsg          string    `firestore:"error_message" json:"error_message"`
+
+	// NonDicomFiles lists uploaded objects skipped during ingest because their
+	// content was not DICOM, with the detected MIME type of each.
+	NonDicomFiles []NonDicomFile `firestore:"non_dicom_files" json:"non_dicom_files"`
+
+	// ValidationReport is the outcome of the pre-import validation stage;
+	// failing files are moved under Config.QuarantinePrefix.
+	ValidationReport *ValidationReport `firestore:"validation_report" json:"validation_report"`
+
 	CreatedAt         time.Time `firestore:"created_at" json:"created_at"`
 	UpdatedAt         time.Time `firestore:"updated_at" json:"updated_at"`
 }
@@ -68,6 +99,14 @@ func hashPhone(normalized string) string {
 	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h[:])
 }
 
+// deterministicTokenID derives a stable ID like STUDY-XXXXXXXXXXXXXXXX from
+// the given parts, so the same inputs always map to the same document.
+func deterministicTokenID(prefix string, parts ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	id := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h[:])
+	return fmt.Sprintf("%s-%s", prefix, id[:16])
+}
+
 // randomTokenID generates a short, human-friendly token like UPL-XXXXX.
 func randomTokenID(prefix string, nBytes int) (string, error) {
 	b := make([]byte, nBytes)
@@ -98,6 +137,23 @@ func (db *FirestoreDB) CreateProviderUploadToken(ctx context.Context, t *Provide
 	return nil
 }
 
+// GetProviderOrg fetches a registered provider organization, or nil if the
+// ID is unknown.
+func (db *FirestoreDB) GetProviderOrg(ctx context.Context, orgID string) (*ProviderOrg, error) {
+	snap, err := db.client.Collection("provider_orgs").Doc(orgID).Get(ctx)
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get provider org (%s): %w", orgID, err)
+	}
+	var org ProviderOrg
+	if err := snap.DataTo(&org); err != nil {
+		return nil, fmt.Errorf("decode provider org (%s): %w", orgID, err)
+	}
+	return &org, nil
+}
+
 // GetProviderUploadToken fetches a ProviderUploadToken by its ID.
 func (db *FirestoreDB) GetProviderUploadToken(ctx context.Context, tokenID string) (*ProviderUploadToken, error) {
 	snap, err := db.client.Collection("provider_upload_tokens").Doc(tokenID).Get(ctx)
@@ -186,9 +242,174 @@ type ImagingStudy struct {
 	StudyDescription string `firestore:"study_description" json:"study_description"`
 	NumInstances     int    `firestore:"num_instances" json:"num_instances"`
 
+	// SizeBytes is the stored size charged to the owner's (and provider
+	// organization's) quota; released again when the study is deleted.
+	SizeBytes     int64  `firestore:"size_bytes" json:"size_bytes"`
+	ProviderOrgID string `firestore:"provider_org_id" json:"provider_org_id"`
+
+	// Per-session contributions, keyed by session ID. Re-ingesting a session
+	// overwrites its entry, so SizeBytes (their sum) stays correct when
+	// messages are redelivered. NumInstances counts distinct instances; see
+	// SyncImagingStudyInstanceCount.
+	SessionInstances map[string]int   `firestore:"session_instances" json:"session_instances"`
+	SessionBytes     map[string]int64 `firestore:"session_bytes" json:"session_bytes"`
+
+	// Every upload session (and its GCS prefix) that contributed instances,
+	// in arrival order. SessionID/GCSPrefix above are the first ones.
+	SessionIDs  []string `firestore:"session_ids" json:"session_ids"`
+	GCSPrefixes []string `firestore:"gcs_prefixes" json:"gcs_prefixes"`
+	// CatalogedSessionIDs are the sessions whose instances are in
+	// imaging_instances; the others were ingested before the catalog.
+	CatalogedSessionIDs []string `firestore:"cataloged_session_ids" json:"cataloged_session_ids"`
+
 	GCSPrefix      string    `firestore:"gcs_prefix" json:"gcs_prefix"`
 	DicomStorePath string    `firestore:"dicom_store_path" json:"dicom_store_path"`
 	CreatedAt      time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// StudyChange is one entry in a study's change log
+// (imaging_studies/{id}/changes), recording what a session contributed.
+type StudyChange struct {
+	ChangeID  string `firestore:"change_id" json:"change_id"`
+	StudyID   string `firestore:"study_id" json:"study_id"`
+	SessionID string `firestore:"session_id" json:"session_id"`
+	GCSPrefix string `firestore:"gcs_prefix" json:"gcs_prefix"`
+	Action    string `firestore:"action" json:"action"` // created|merged|reingested
+
+	AddedSeries     []string `firestore:"added_series" json:"added_series"`
+	AddedModalities []string `firestore:"added_modalities" json:"added_modalities"`
+	InstancesBefore int      `firestore:"instances_before" json:"instances_before"`
+	InstancesAfter  int      `firestore:"instances_after" json:"instances_after"`
+
+	At time.Time `firestore:"at" json:"at"`
+}
+
+// newStudy prepares the first contribution to a study for writing.
+func newStudy(contrib *ImagingStudy) (*ImagingStudy, *StudyChange) {
+	study := *contrib
+	study.SessionInstances = map[string]int{contrib.SessionID: contrib.NumInstances}
+	study.SessionBytes = map[string]int64{contrib.SessionID: contrib.SizeBytes}
+	study.SessionIDs = []string{contrib.SessionID}
+	study.GCSPrefixes = appendUnique(nil, contrib.GCSPrefix)
+	change := &StudyChange{
+		StudyID:         study.StudyID,
+		SessionID:       contrib.SessionID,
+		GCSPrefix:       contrib.GCSPrefix,
+		Action:          "created",
+		AddedSeries:     append([]string{}, contrib.SeriesInstanceUIDs...),
+		AddedModalities: append([]string{}, contrib.ModalitiesInStudy...),
+		InstancesAfter:  study.NumInstances,
+		At:              contrib.UpdatedAt,
+	}
+	return &study, change
+}
+
+// mergeImagingStudy folds one session's contribution into an existing study
+// and returns the change in stored bytes caused by it along with a change
+// log entry. existing is updated in place.
+func mergeImagingStudy(existing, contrib *ImagingStudy) (int64, *StudyChange) {
+	change := &StudyChange{
+		StudyID:         existing.StudyID,
+		SessionID:       contrib.SessionID,
+		GCSPrefix:       contrib.GCSPrefix,
+		Action:          "merged",
+		AddedSeries:     setDifference(contrib.SeriesInstanceUIDs, existing.SeriesInstanceUIDs),
+		AddedModalities: setDifference(contrib.ModalitiesInStudy, existing.ModalitiesInStudy),
+		InstancesBefore: existing.NumInstances,
+		At:              contrib.UpdatedAt,
+	}
+
+	existing.SeriesInstanceUIDs = mergeStringSets(existing.SeriesInstanceUIDs, contrib.SeriesInstanceUIDs)
+	existing.ModalitiesInStudy = mergeStringSets(existing.ModalitiesInStudy, contrib.ModalitiesInStudy)
+	if existing.StudyDate == "" {
+		existing.StudyDate = contrib.StudyDate
+	}
+	if existing.StudyDescription == "" {
+		existing.StudyDescription = contrib.StudyDescription
+	}
+	if existing.ProviderOrgID == "" {
+		existing.ProviderOrgID = contrib.ProviderOrgID
+	}
+
+	if existing.SessionInstances == nil {
+		// Study written before per-session tracking; attribute what it has
+		// to the session that created it.
+		existing.SessionInstances = map[string]int{existing.SessionID: existing.NumInstances}
+		existing.SessionBytes = map[string]int64{existing.SessionID: existing.SizeBytes}
+	}
+	if existing.SessionBytes == nil {
+		existing.SessionBytes = map[string]int64{}
+	}
+	if len(existing.SessionIDs) == 0 {
+		existing.SessionIDs = appendUnique(nil, existing.SessionID)
+		existing.GCSPrefixes = appendUnique(nil, existing.GCSPrefix)
+	}
+	if _, seen := existing.SessionInstances[contrib.SessionID]; seen {
+		change.Action = "reingested"
+	}
+	existing.SessionIDs = appendUnique(existing.SessionIDs, contrib.SessionID)
+	existing.GCSPrefixes = appendUnique(existing.GCSPrefixes, contrib.GCSPrefix)
+
+	delta := contrib.SizeBytes - existing.SessionBytes[contrib.SessionID]
+	existing.SessionInstances[contrib.SessionID] = contrib.NumInstances
+	existing.SessionBytes[contrib.SessionID] = contrib.SizeBytes
+
+	existing.NumInstances = 0
+	for _, n := range existing.SessionInstances {
+		existing.NumInstances += n
+	}
+	existing.SizeBytes = 0
+	for _, b := range existing.SessionBytes {
+		existing.SizeBytes += b
+	}
+	existing.UpdatedAt = contrib.UpdatedAt
+	change.InstancesAfter = existing.NumInstances
+	return delta, change
+}
+
+// appendUnique appends v to list unless it is empty or already present.
+func appendUnique(list []string, v string) []string {
+	if v == "" {
+		return list
+	}
+	for _, x := range list {
+		if x == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
+
+// setDifference returns the values of a (non-empty) that are not in b.
+func setDifference(a, b []string) []string {
+	in := make(map[string]struct{}, len(b))
+	for _, v := range b {
+		in[v] = struct{}{}
+	}
+	out := []string{}
+	for _, v := range a {
+		if _, ok := in[v]; !ok && v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// mergeStringSets returns the sorted union of a and b without empties.
+func mergeStringSets(a, b []string) []string {
+	set := make(map[string]struct{}, len(a)+len(b))
+	for _, v := range append(append([]string{}, a...), b...) {
+		if v != "" {
+			set[v] = struct{}{}
+		}
+	}
+	out := make([]string, 0, len(set))
+	for v := range set {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
 }
 
 // CreateImagingStudy stores a new ImagingStudy document.
@@ -206,6 +427,175 @@ func (db *FirestoreDB) CreateImagingStudy(ctx context.Context, s *ImagingStudy)
 	return nil
 }
 
+// UpsertImagingStudy creates the study document for contrib.StudyID or
+// merges contrib into it if it already exists, and records the contribution
+// in the study's change log. It reports whether the study was created and by
+// how many bytes its stored size changed.
+func (db *FirestoreDB) UpsertImagingStudy(ctx context.Context, contrib *ImagingStudy) (bool, int64, error) {
+	if contrib == nil || contrib.StudyID == "" {
+		return false, 0, fmt.Errorf("missing study_id")
+	}
+	ref := db.client.Collection("imaging_studies").Doc(contrib.StudyID)
+	// One change entry per (study, session) so redelivery overwrites it.
+	changeRef := ref.Collection("changes").Doc(deterministicTokenID("CHG", contrib.StudyID, contrib.SessionID))
+
+	var created bool
+	var delta int64
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var study *ImagingStudy
+		var change *StudyChange
+
+		snap, err := tx.Get(ref)
+		switch {
+		case err == nil:
+			created = false
+			var existing ImagingStudy
+			if err := snap.DataTo(&existing); err != nil {
+				return fmt.Errorf("decode imaging study (%s): %w", contrib.StudyID, err)
+			}
+			delta, change = mergeImagingStudy(&existing, contrib)
+			study = &existing
+		case status.Code(err) == codes.NotFound:
+			created = true
+			delta = contrib.SizeBytes
+			study, change = newStudy(contrib)
+		default:
+			return err
+		}
+
+		change.ChangeID = changeRef.ID
+		if err := tx.Set(ref, study); err != nil {
+			return err
+		}
+		return tx.Set(changeRef, change)
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("upsert imaging study (%s): %w", contrib.StudyID, err)
+	}
+	return created, delta, nil
+}
+
+// SyncImagingStudyInstanceCount marks sessionID as cataloged on the study
+// and recomputes NumInstances as the number of distinct instances in the
+// imaging_instances catalog plus what pre-catalog sessions contributed, so
+// an instance sent by several sessions is counted once. The session's change
+// log entry is updated to match.
+func (db *FirestoreDB) SyncImagingStudyInstanceCount(ctx context.Context, studyID, sessionID string) error {
+	ref := db.client.Collection("imaging_studies").Doc(studyID)
+	changeRef := ref.Collection("changes").Doc(deterministicTokenID("CHG", studyID, sessionID))
+	instancesQuery := db.client.Collection("imaging_instances").Where("study_id", "==", studyID)
+	countQuery := instancesQuery.NewAggregationQuery().WithCount("n")
+
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var study ImagingStudy
+		if err := snap.DataTo(&study); err != nil {
+			return fmt.Errorf("decode imaging study (%s): %w", studyID, err)
+		}
+		res, err := countQuery.Transaction(tx).Get(ctx)
+		if err != nil {
+			return err
+		}
+		cataloged, err := aggregationCount(res, "n")
+		if err != nil {
+			return err
+		}
+
+		study.CatalogedSessionIDs = appendUnique(study.CatalogedSessionIDs, sessionID)
+		numInstances := int(cataloged)
+		for _, sid := range precatalogSessionIDs(&study) {
+			numInstances += study.SessionInstances[sid]
+		}
+
+		if err := tx.Update(ref, []firestore.Update{
+			{Path: "num_instances", Value: numInstances},
+			{Path: "cataloged_session_ids", Value: study.CatalogedSessionIDs},
+		}); err != nil {
+			return err
+		}
+		return tx.Set(changeRef, map[string]interface{}{
+			"instances_after": numInstances,
+		}, firestore.MergeAll)
+	})
+	if err != nil {
+		return fmt.Errorf("sync imaging study instance count (%s): %w", studyID, err)
+	}
+	return nil
+}
+
+// precatalogSessionIDs returns the study's sessions whose instances are not
+// in the imaging_instances catalog.
+func precatalogSessionIDs(study *ImagingStudy) []string {
+	sessions := study.SessionIDs
+	if len(sessions) == 0 {
+		sessions = appendUnique(nil, study.SessionID)
+	}
+	return setDifference(sessions, study.CatalogedSessionIDs)
+}
+
+// aggregationCount reads a count aggregation result by alias.
+func aggregationCount(res firestore.AggregationResult, alias string) (int64, error) {
+	v, ok := res[alias].(*firestorepb.Value)
+	if !ok {
+		return 0, fmt.Errorf("aggregation result %q missing or %T", alias, res[alias])
+	}
+	return v.GetIntegerValue(), nil
+}
+
+// ListStudyChanges returns a study's change log, oldest first.
+func (db *FirestoreDB) ListStudyChanges(ctx context.Context, studyID string) ([]*StudyChange, error) {
+	docs, err := db.client.Collection("imaging_studies").Doc(studyID).Collection("changes").
+		OrderBy("at", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("list study changes (%s): %w", studyID, err)
+	}
+	changes := make([]*StudyChange, 0, len(docs))
+	for _, d := range docs {
+		var c StudyChange
+		if err := d.DataTo(&c); err != nil {
+			return nil, fmt.Errorf("decode study change (%s): %w", d.Ref.ID, err)
+		}
+		changes = append(changes, &c)
+	}
+	return changes, nil
+}
+
+// DeleteImagingStudy removes an ImagingStudy document.
+func (db *FirestoreDB) DeleteImagingStudy(ctx context.Context, studyID string) error {
+	if strings.TrimSpace(studyID) == "" {
+		return fmt.Errorf("empty study_id")
+	}
+	ref := db.client.Collection("imaging_studies").Doc(studyID)
+
+	// Sub-collections are not removed with their parent document.
+	changes, err := ref.Collection("changes").Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("list study changes (%s): %w", studyID, err)
+	}
+	const batchSize = 400
+	for i := 0; i < len(changes); i += batchSize {
+		end := i + batchSize
+		if end > len(changes) {
+			end = len(changes)
+		}
+		b := db.client.Batch()
+		for _, d := range changes[i:end] {
+			b.Delete(d.Ref)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("delete study changes (%s): %w", studyID, err)
+		}
+	}
+
+	if _, err := ref.Delete(ctx); err != nil {
+		return fmt.Errorf("delete imaging study (%s): %w", studyID, err)
+	}
+	return nil
+}
+
 // GetImagingStudy fetches a single ImagingStudy by its StudyID.
 func (db *FirestoreDB) GetImagingStudy(ctx context.Context, studyID string) (*ImagingStudy, error) {
 	if strings.TrimSpace(studyID) == "" {
@@ -253,6 +643,40 @@ func (db *FirestoreDB) ListImagingStudiesByUser(ctx context.Context, userID stri
 	return studies, nil
 }
 
+// GetImagingStudyForUser returns the user's ImagingStudy for a DICOM
+// StudyInstanceUID, or nil if the user has none.
+func (db *FirestoreDB) GetImagingStudyForUser(ctx context.Context, userID, studyInstanceUID string) (*ImagingStudy, error) {
+	userID = strings.TrimSpace(userID)
+	studyInstanceUID = strings.TrimSpace(studyInstanceUID)
+	if userID == "" || studyInstanceUID == "" {
+		return nil, fmt.Errorf("empty user_id or study_instance_uid")
+	}
+
+	// Current documents have a deterministic ID; fall back to a query for
+	// studies created before that.
+	s, err := db.GetImagingStudy(ctx, deterministicTokenID("STUDY", userID, studyInstanceUID))
+	if err != nil || s != nil {
+		return s, err
+	}
+
+	q := db.client.Collection("imaging_studies").
+		Where("user_id", "==", userID).
+		Where("study_instance_uid", "==", studyInstanceUID).
+		Limit(1)
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query imaging study for user %s, StudyInstanceUID %s: %w", userID, studyInstanceUID, err)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	var study ImagingStudy
+	if err := docs[0].DataTo(&study); err != nil {
+		return nil, fmt.Errorf("decode imaging study (%s): %w", docs[0].Ref.ID, err)
+	}
+	return &study, nil
+}
+
 // GetImagingStudyByStudyInstanceUID returns the first ImagingStudy whose
 // study_instance_uid matches the provided DICOM StudyInstanceUID.
 func (db *FirestoreDB) GetImagingStudyByStudyInstanceUID(ctx context.Context, studyInstanceUID string) (*ImagingStudy, error) {
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// ImagingInstance is the per-instance catalog entry in imaging_instances,
+// written at ingest so series listing, search and longitudinal indexing can
+// run from Firestore instead of DICOMweb metadata.
+type ImagingInstance struct {
+	InstanceID string `firestore:"instance_id" json:"instance_id"`
+	StudyID    string `firestore:"study_id" json:"study_id"`
+	UserID     string `firestore:"user_id" json:"user_id"`
+	SessionID  string `firestore:"session_id" json:"session_id"`
+
+	StudyInstanceUID  string `firestore:"study_instance_uid" json:"study_instance_uid"`
+	SeriesInstanceUID string `firestore:"series_instance_uid" json:"series_instance_uid"`
+	SOPInstanceUID    string `firestore:"sop_instance_uid" json:"sop_instance_uid"`
+	SOPClassUID       string `firestore:"sop_class_uid" json:"sop_class_uid"`
+	TransferSyntaxUID string `firestore:"transfer_syntax_uid" json:"transfer_syntax_uid"`
+
+	Modality          string `firestore:"modality" json:"modality"`
+	StudyDate         string `firestore:"study_date" json:"study_date"`
+	SeriesNumber      int    `firestore:"series_number" json:"series_number"`
+	SeriesDescription string `firestore:"series_description" json:"series_description"`
+	InstanceNumber    int    `firestore:"instance_number" json:"instance_number"`
+
+	Rows                    int       `firestore:"rows" json:"rows"`
+	Columns                 int       `firestore:"columns" json:"columns"`
+	NumberOfFrames          int       `firestore:"number_of_frames" json:"number_of_frames"` // 0 for entries cataloged before it was recorded
+	SliceThickness          float64   `firestore:"slice_thickness" json:"slice_thickness"`
+	PixelSpacing            []float64 `firestore:"pixel_spacing" json:"pixel_spacing"`
+	ImagePositionPatient    []float64 `firestore:"image_position_patient" json:"image_position_patient"`
+	ImageOrientationPatient []float64 `firestore:"image_orientation_patient" json:"image_orientation_patient"`
+	FrameOfReferenceUID     string    `firestore:"frame_of_reference_uid" json:"frame_of_reference_uid"`
+
+	BodyPartExamined      string `firestore:"body_part_examined" json:"body_part_examined"`
+	AcquisitionDate       string `firestore:"acquisition_date" json:"acquisition_date"`
+	AcquisitionTime       string `firestore:"acquisition_time" json:"acquisition_time"`
+	Manufacturer          string `firestore:"manufacturer" json:"manufacturer"`
+	ManufacturerModelName string `firestore:"manufacturer_model_name" json:"manufacturer_model_name"`
+
+	ObjectName string `firestore:"object_name" json:"object_name"`
+	SizeBytes  int64  `firestore:"size_bytes" json:"size_bytes"`
+
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// instanceInfoFromDataset extracts the header fields we catalog from a
+// parsed dataset (pixel data is not needed).
+func instanceInfoFromDataset(ds *dicom.Dataset) dicomInstanceInfo {
+	return dicomInstanceInfo{
+		StudyInstanceUID:  getStringByTag(ds, tag.StudyInstanceUID),
+		SeriesInstanceUID: getStringByTag(ds, tag.SeriesInstanceUID),
+		SOPInstanceUID:    getStringByTag(ds, tag.SOPInstanceUID),
+		Modality:          getStringByTag(ds, tag.Modality),
+		StudyDate:         getStringByTag(ds, tag.StudyDate),
+		StudyDescription:  getStringByTag(ds, tag.StudyDescription),
+
+		SeriesNumber:      intTag(ds, tag.SeriesNumber),
+		SeriesDescription: getStringByTag(ds, tag.SeriesDescription),
+		InstanceNumber:    intTag(ds, tag.InstanceNumber),
+		SOPClassUID:       getStringByTag(ds, tag.SOPClassUID),
+		TransferSyntaxUID: getStringByTag(ds, tag.TransferSyntaxUID),
+
+		Rows:                    intTag(ds, tag.Rows),
+		Columns:                 intTag(ds, tag.Columns),
+		NumberOfFrames:          max(intTag(ds, tag.NumberOfFrames), 1),
+		SliceThickness:          firstFloat(getFloatsByTag(ds, tag.SliceThickness)),
+		PixelSpacing:            getFloatsByTagN(ds, tag.PixelSpacing, 2),
+		ImagePositionPatient:    getFloatsByTagN(ds, tag.ImagePositionPatient, 3),
+		ImageOrientationPatient: getFloatsByTagN(ds, tag.ImageOrientationPatient, 6),
+		FrameOfReferenceUID:     getStringByTag(ds, tag.FrameOfReferenceUID),
+
+		BodyPartExamined:      getStringByTag(ds, tag.BodyPartExamined),
+		AcquisitionDate:       getStringByTag(ds, tag.AcquisitionDate),
+		AcquisitionTime:       getStringByTag(ds, tag.AcquisitionTime),
+		Manufacturer:          getStringByTag(ds, tag.Manufacturer),
+		ManufacturerModelName: getStringByTag(ds, tag.ManufacturerModelName),
+	}
+}
+
+// getFloatsByTag returns the numeric values of a tag. DS/IS values are
+// stored as strings by the parser; binary VRs (FD, FL, US, ...) are
+// converted directly. Unparseable values yield nil.
+func getFloatsByTag(ds *dicom.Dataset, t tag.Tag) []float64 {
+	if ds == nil {
+		return nil
+	}
+	el, err := ds.FindElementByTag(t)
+	if err != nil || el == nil || el.Value == nil {
+		return nil
+	}
+	switch el.Value.ValueType() {
+	case dicom.Floats:
+		return dicom.MustGetFloats(el.Value)
+	case dicom.Ints:
+		ints := dicom.MustGetInts(el.Value)
+		res := make([]float64, len(ints))
+		for i, v := range ints {
+			res[i] = float64(v)
+		}
+		return res
+	case dicom.Strings:
+		var res []float64
+		for _, s := range dicom.MustGetStrings(el.Value) {
+			for _, part := range strings.Split(s, `\`) {
+				part = strings.TrimSpace(part)
+				if part == "" {
+					continue
+				}
+				f, err := strconv.ParseFloat(part, 64)
+				if err != nil {
+					return nil
+				}
+				res = append(res, f)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// getFloatsByTagN returns the tag's values only if there are exactly n.
+func getFloatsByTagN(ds *dicom.Dataset, t tag.Tag, n int) []float64 {
+	vals := getFloatsByTag(ds, t)
+	if len(vals) != n {
+		return nil
+	}
+	return vals
+}
+
+// intTag returns the first value of an integer tag, or 0.
+func intTag(ds *dicom.Dataset, t tag.Tag) int {
+	n, _ := getIntByTag(ds, t)
+	return n
+}
+
+func firstFloat(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	return vals[0]
+}
+
+// imagingInstanceDocID is one catalog document per (study document, SOP
+// instance), so re-ingesting the same instance overwrites its entry.
+func imagingInstanceDocID(studyID, sopInstanceUID string) string {
+	return deterministicTokenID("INST", studyID, sopInstanceUID)
+}
+
+// newImagingInstances builds catalog entries for the instances of one study.
+func newImagingInstances(studyID string, sess *UploadSession, instances []dicomInstanceInfo) []*ImagingInstance {
+	res := make([]*ImagingInstance, 0, len(instances))
+	for _, in := range instances {
+		res = append(res, &ImagingInstance{
+			InstanceID: imagingInstanceDocID(studyID, in.SOPInstanceUID),
+			StudyID:    studyID,
+			UserID:     sess.UserID,
+			SessionID:  sess.SessionID,
+
+			StudyInstanceUID:  in.StudyInstanceUID,
+			SeriesInstanceUID: in.SeriesInstanceUID,
+			SOPInstanceUID:    in.SOPInstanceUID,
+			SOPClassUID:       in.SOPClassUID,
+			TransferSyntaxUID: in.TransferSyntaxUID,
+
+			Modality:          in.Modality,
+			StudyDate:         in.StudyDate,
+			SeriesNumber:      in.SeriesNumber,
+			SeriesDescription: in.SeriesDescription,
+			InstanceNumber:    in.InstanceNumber,
+
+			Rows:                    in.Rows,
+			Columns:                 in.Columns,
+			NumberOfFrames:          in.NumberOfFrames,
+			SliceThickness:          in.SliceThickness,
+			PixelSpacing:            in.PixelSpacing,
+			ImagePositionPatient:    in.ImagePositionPatient,
+			ImageOrientationPatient: in.ImageOrientationPatient,
+			FrameOfReferenceUID:     in.FrameOfReferenceUID,
+
+			BodyPartExamined:      in.BodyPartExamined,
+			AcquisitionDate:       in.AcquisitionDate,
+			AcquisitionTime:       in.AcquisitionTime,
+			Manufacturer:          in.Manufacturer,
+			ManufacturerModelName: in.ManufacturerModelName,
+
+			ObjectName: in.ObjectName,
+			SizeBytes:  in.SizeBytes,
+		})
+	}
+	return res
+}
+
+// imagingInstanceDicomJSON renders a catalog entry as a DICOM JSON dataset
+// holding the attributes the DICOMweb list endpoints and the longitudinal
+// index read, so catalog entries and study metadata share one code path.
+func imagingInstanceDicomJSON(in *ImagingInstance) map[string]interface{} {
+	ds := make(map[string]interface{})
+	str := func(t, vr, v string) {
+		if v != "" {
+			ds[t] = map[string]interface{}{"vr": vr, "Value": []interface{}{v}}
+		}
+	}
+	num := func(t, vr string, vals ...float64) {
+		if len(vals) == 0 {
+			return
+		}
+		value := make([]interface{}, len(vals))
+		for i, v := range vals {
+			value[i] = v
+		}
+		ds[t] = map[string]interface{}{"vr": vr, "Value": value}
+	}
+
+	str("0020000D", "UI", in.StudyInstanceUID)
+	str("0020000E", "UI", in.SeriesInstanceUID)
+	str("00080018", "UI", in.SOPInstanceUID)
+	str("00080016", "UI", in.SOPClassUID)
+	str("00080060", "CS", in.Modality)
+	str("0008103E", "LO", in.SeriesDescription)
+	str("00200052", "UI", in.FrameOfReferenceUID)
+	num("00200011", "IS", float64(in.SeriesNumber))
+	num("00200013", "IS", float64(in.InstanceNumber))
+	if in.Rows > 0 && in.Columns > 0 {
+		num("00280010", "US", float64(in.Rows))
+		num("00280011", "US", float64(in.Columns))
+	}
+	if in.NumberOfFrames > 0 {
+		num("00280008", "IS", float64(in.NumberOfFrames))
+	}
+	if in.SliceThickness > 0 {
+		num("00180050", "DS", in.SliceThickness)
+	}
+	num("00280030", "DS", in.PixelSpacing...)
+	num("00200032", "DS", in.ImagePositionPatient...)
+	num("00200037", "DS", in.ImageOrientationPatient...)
+	return ds
+}
+
+// imagingInstanceFromDicomJSON is the reverse of imagingInstanceDicomJSON:
+// it reads the cataloged attributes from a DICOM JSON dataset, such as an
+// entry of DICOMweb study metadata.
+func imagingInstanceFromDicomJSON(study *ImagingStudy, ds map[string]interface{}) *ImagingInstance {
+	floats := func(t string, n int) []float64 {
+		v, _ := parseDICOMFloatSlice(ds, t, n)
+		return v
+	}
+	first := func(t string) float64 {
+		if v, ok := parseDICOMFloatSlice(ds, t, 1); ok {
+			return v[0]
+		}
+		return 0
+	}
+	sopUID := dicomwebTagString(ds, "00080018")
+	studyUID := dicomwebTagString(ds, "0020000D")
+	if studyUID == "" {
+		studyUID = study.StudyInstanceUID
+	}
+	return &ImagingInstance{
+		InstanceID: imagingInstanceDocID(study.StudyID, sopUID),
+		StudyID:    study.StudyID,
+		UserID:     study.UserID,
+
+		StudyInstanceUID:  studyUID,
+		SeriesInstanceUID: dicomwebTagString(ds, "0020000E"),
+		SOPInstanceUID:    sopUID,
+		SOPClassUID:       dicomwebTagString(ds, "00080016"),
+
+		Modality:          dicomwebTagString(ds, "00080060"),
+		SeriesNumber:      int(first("00200011")),
+		SeriesDescription: dicomwebTagString(ds, "0008103E"),
+		InstanceNumber:    int(first("00200013")),
+
+		Rows:                    int(first("00280010")),
+		Columns:                 int(first("00280011")),
+		NumberOfFrames:          max(int(first("00280008")), 1),
+		SliceThickness:          first("00180050"),
+		PixelSpacing:            floats("00280030", 2),
+		ImagePositionPatient:    floats("00200032", 3),
+		ImageOrientationPatient: floats("00200037", 6),
+		FrameOfReferenceUID:     dicomwebTagString(ds, "00200052"),
+	}
+}
+
+// catalogHasFrameGeometry reports whether the catalog describes the plane of
+// every frame of a study. It does not for enhanced multi-frame objects, whose
+// per-frame geometry is only in the metadata, nor for entries cataloged
+// before the frame count and pixel spacing were recorded.
+func catalogHasFrameGeometry(instances []*ImagingInstance) bool {
+	for _, in := range instances {
+		if in.NumberOfFrames != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// catalogCoversStudy reports whether the catalog holds every instance of a
+// study: none of its sessions predates the catalog and there are at least
+// as many entries as the study counts.
+func catalogCoversStudy(study *ImagingStudy, instances []*ImagingInstance) bool {
+	return len(instances) > 0 &&
+		len(instances) >= study.NumInstances &&
+		len(precatalogSessionIDs(study)) == 0
+}
+
+// studyInstanceDatasets returns one DICOM JSON dataset per instance of a
+// study. They come from the imaging_instances catalog when it covers the
+// study, and from DICOMweb study metadata for studies with sessions ingested
+// before the catalog existed. needGeometry also falls back to the metadata
+// when the catalog cannot describe every frame (see catalogHasFrameGeometry).
+func (h *Handlers) studyInstanceDatasets(ctx context.Context, study *ImagingStudy, needGeometry bool) ([]map[string]interface{}, error) {
+	instances, err := h.DB.ListImagingInstancesForStudy(ctx, study.StudyID)
+	if err != nil {
+		return nil, err
+	}
+	if catalogCoversStudy(study, instances) && (!needGeometry || catalogHasFrameGeometry(instances)) {
+		datasets := make([]map[string]interface{}, 0, len(instances))
+		for _, in := range instances {
+			datasets = append(datasets, imagingInstanceDicomJSON(in))
+		}
+		return datasets, nil
+	}
+	return h.studyMetadataDatasets(ctx, study)
+}
+
+// studyMetadataDatasets returns a study's DICOMweb study metadata, one DICOM
+// JSON dataset per instance.
+func (h *Handlers) studyMetadataDatasets(ctx context.Context, study *ImagingStudy) ([]map[string]interface{}, error) {
+	if h.Dicom == nil {
+		return nil, fmt.Errorf("dicom client not configured")
+	}
+	raw, err := h.Dicom.StudyMetadataJSON(ctx, study.StudyInstanceUID)
+	if err != nil {
+		return nil, fmt.Errorf("StudyMetadataJSON: %w", err)
+	}
+	var datasets []map[string]interface{}
+	if err := json.Unmarshal(raw, &datasets); err != nil {
+		return nil, fmt.Errorf("unmarshal study metadata: %w", err)
+	}
+	return datasets, nil
+}
+
+// studyImagingInstances returns a study's instances as catalog entries. Like
+// studyInstanceDatasets, it reads DICOMweb study metadata instead for studies
+// the catalog does not cover (see catalogCoversStudy).
+func (h *Handlers) studyImagingInstances(ctx context.Context, study *ImagingStudy) ([]*ImagingInstance, error) {
+	instances, err := h.DB.ListImagingInstancesForStudy(ctx, study.StudyID)
+	if err != nil {
+		return nil, err
+	}
+	if catalogCoversStudy(study, instances) {
+		return instances, nil
+	}
+	datasets, err := h.studyMetadataDatasets(ctx, study)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*ImagingInstance, 0, len(datasets))
+	for _, ds := range datasets {
+		res = append(res, imagingInstanceFromDicomJSON(study, ds))
+	}
+	return res, nil
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: imaging_instances
+//
+// UpsertImagingInstances writes catalog entries in batches.
+func (db *FirestoreDB) UpsertImagingInstances(ctx context.Context, instances []*ImagingInstance) error {
+	col := db.client.Collection("imaging_instances")
+	now := time.Now().UTC()
+
+	const batchSize = 400
+	for i := 0; i < len(instances); i += batchSize {
+		end := i + batchSize
+		if end > len(instances) {
+			end = len(instances)
+		}
+		b := db.client.Batch()
+		for _, in := range instances[i:end] {
+			in.UpdatedAt = now
+			b.Set(col.Doc(in.InstanceID), in)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("write imaging instances batch: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetImagingInstance returns one catalog entry, or nil if it does not exist.
+func (db *FirestoreDB) GetImagingInstance(ctx context.Context, instanceID string) (*ImagingInstance, error) {
+	doc, err := db.client.Collection("imaging_instances").Doc(instanceID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get imaging instance (%s): %w", instanceID, err)
+	}
+	var in ImagingInstance
+	if err := doc.DataTo(&in); err != nil {
+		return nil, fmt.Errorf("decode imaging instance (%s): %w", instanceID, err)
+	}
+	return &in, nil
+}
+
+// ListImagingInstancesForStudy returns a study's catalog entries ordered by
+// series number, series UID and instance number.
+func (db *FirestoreDB) ListImagingInstancesForStudy(ctx context.Context, studyID string) ([]*ImagingInstance, error) {
+	docs, err := db.client.Collection("imaging_instances").
+		Where("study_id", "==", studyID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("list imaging instances (%s): %w", studyID, err)
+	}
+	res := make([]*ImagingInstance, 0, len(docs))
+	for _, d := range docs {
+		var in ImagingInstance
+		if err := d.DataTo(&in); err != nil {
+			return nil, fmt.Errorf("decode imaging instance (%s): %w", d.Ref.ID, err)
+		}
+		res = append(res, &in)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.SeriesNumber != b.SeriesNumber {
+			return a.SeriesNumber < b.SeriesNumber
+		}
+		if a.SeriesInstanceUID != b.SeriesInstanceUID {
+			return a.SeriesInstanceUID < b.SeriesInstanceUID
+		}
+		return a.InstanceNumber < b.InstanceNumber
+	})
+	return res, nil
+}
+
+// DeleteImagingInstancesForStudy removes a study's catalog entries.
+func (db *FirestoreDB) DeleteImagingInstancesForStudy(ctx context.Context, studyID string) error {
+	docs, err := db.client.Collection("imaging_instances").
+		Where("study_id", "==", studyID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("list imaging instances (%s): %w", studyID, err)
+	}
+	const batchSize = 400
+	for i := 0; i < len(docs); i += batchSize {
+		end := i + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		b := db.client.Batch()
+		for _, d := range docs[i:end] {
+			b.Delete(d.Ref)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("delete imaging instances (%s): %w", studyID, err)
+		}
+	}
+	return nil
+}
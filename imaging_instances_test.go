@@ -0,0 +1,183 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestInstanceInfoFromDataset(t *testing.T) {
+	ds := &dicom.Dataset{Elements: []*dicom.Element{
+		mustElement(t, tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.1"}),
+		mustElement(t, tag.SOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.4"}),
+		mustElement(t, tag.SOPInstanceUID, []string{"1.2.3.4.5"}),
+		mustElement(t, tag.StudyInstanceUID, []string{"1.2.3"}),
+		mustElement(t, tag.SeriesInstanceUID, []string{"1.2.3.4"}),
+		mustElement(t, tag.Modality, []string{"MR"}),
+		mustElement(t, tag.SeriesNumber, []string{"7"}),
+		mustElement(t, tag.SeriesDescription, []string{"T1 AX"}),
+		mustElement(t, tag.InstanceNumber, []string{" 12"}),
+		mustElement(t, tag.Rows, []int{256}),
+		mustElement(t, tag.Columns, []int{192}),
+		mustElement(t, tag.SliceThickness, []string{"3.5"}),
+		mustElement(t, tag.PixelSpacing, []string{"0.5", "0.75"}),
+		mustElement(t, tag.ImagePositionPatient, []string{"-120.5", "-98", "42.25"}),
+		mustElement(t, tag.ImageOrientationPatient, []string{"1", "0", "0", "0", "1", "0"}),
+		mustElement(t, tag.FrameOfReferenceUID, []string{"1.2.3.9"}),
+		mustElement(t, tag.BodyPartExamined, []string{"HEAD"}),
+		mustElement(t, tag.Manufacturer, []string{"ACME"}),
+	}}
+
+	info := instanceInfoFromDataset(ds)
+	if info.SOPInstanceUID != "1.2.3.4.5" || info.Modality != "MR" || info.TransferSyntaxUID != "1.2.840.10008.1.2.1" {
+		t.Errorf("uids/modality = %+v", info)
+	}
+	if info.SeriesNumber != 7 || info.InstanceNumber != 12 || info.SeriesDescription != "T1 AX" {
+		t.Errorf("series/instance = %d/%d %q", info.SeriesNumber, info.InstanceNumber, info.SeriesDescription)
+	}
+	if info.Rows != 256 || info.Columns != 192 || info.SliceThickness != 3.5 {
+		t.Errorf("geometry = %dx%d thickness %v", info.Rows, info.Columns, info.SliceThickness)
+	}
+	if want := []float64{0.5, 0.75}; info.NumberOfFrames != 1 || !reflect.DeepEqual(info.PixelSpacing, want) {
+		t.Errorf("frames/spacing = %d %v, want 1 %v", info.NumberOfFrames, info.PixelSpacing, want)
+	}
+	if want := []float64{-120.5, -98, 42.25}; !reflect.DeepEqual(info.ImagePositionPatient, want) {
+		t.Errorf("IPP = %v, want %v", info.ImagePositionPatient, want)
+	}
+	if want := []float64{1, 0, 0, 0, 1, 0}; !reflect.DeepEqual(info.ImageOrientationPatient, want) {
+		t.Errorf("IOP = %v, want %v", info.ImageOrientationPatient, want)
+	}
+	if info.FrameOfReferenceUID != "1.2.3.9" || info.BodyPartExamined != "HEAD" || info.Manufacturer != "ACME" {
+		t.Errorf("misc = %+v", info)
+	}
+}
+
+func TestImagingInstanceDicomJSON(t *testing.T) {
+	in := &ImagingInstance{
+		StudyInstanceUID:        "1.2.3",
+		SeriesInstanceUID:       "1.2.3.4",
+		SOPInstanceUID:          "1.2.3.4.5",
+		Modality:                "CT",
+		SeriesDescription:       "AX",
+		SeriesNumber:            2,
+		InstanceNumber:          9,
+		Rows:                    512,
+		Columns:                 512,
+		NumberOfFrames:          1,
+		SliceThickness:          1.25,
+		PixelSpacing:            []float64{0.7, 0.7},
+		ImagePositionPatient:    []float64{-10, -20, 30},
+		ImageOrientationPatient: []float64{1, 0, 0, 0, 1, 0},
+		FrameOfReferenceUID:     "1.2.3.9",
+	}
+	ds := imagingInstanceDicomJSON(in)
+
+	if dicomwebTagString(ds, "0020000E") != "1.2.3.4" || dicomwebTagString(ds, "00080018") != "1.2.3.4.5" {
+		t.Errorf("uids not rendered: %v", ds)
+	}
+	if dicomwebOrientationKey(ds) == "" {
+		t.Errorf("orientation not rendered")
+	}
+	for tagHex, want := range map[string]float64{"00200011": 2, "00200013": 9} {
+		if v, ok := parseDICOMFloatSlice(ds, tagHex, 1); !ok || v[0] != want {
+			t.Errorf("%s = %v (ok=%v), want %v", tagHex, v, ok, want)
+		}
+	}
+	frames := frameGeometries(ds)
+	if len(frames) != 1 {
+		t.Fatalf("frameGeometries = %d frames, want 1", len(frames))
+	}
+	if g := frames[0]; !reflect.DeepEqual(g.ipp, in.ImagePositionPatient) || !reflect.DeepEqual(g.spacing, in.PixelSpacing) || g.thickness != 1.25 {
+		t.Errorf("frame geometry = %+v", g)
+	}
+
+	if !catalogHasFrameGeometry([]*ImagingInstance{in}) {
+		t.Errorf("single-frame catalog should describe its geometry")
+	}
+	for _, n := range []int{0, 40} {
+		if catalogHasFrameGeometry([]*ImagingInstance{in, {NumberOfFrames: n}}) {
+			t.Errorf("catalog with a %d-frame entry should fall back to metadata", n)
+		}
+	}
+}
+
+func TestGetFloatsByTagMalformed(t *testing.T) {
+	ds := &dicom.Dataset{Elements: []*dicom.Element{
+		mustElement(t, tag.ImagePositionPatient, []string{"1", "abc", "3"}),
+		mustElement(t, tag.ImageOrientationPatient, []string{"1", "0", "0"}),
+	}}
+	if v := getFloatsByTagN(ds, tag.ImagePositionPatient, 3); v != nil {
+		t.Errorf("unparseable IPP = %v, want nil", v)
+	}
+	if v := getFloatsByTagN(ds, tag.ImageOrientationPatient, 6); v != nil {
+		t.Errorf("short IOP = %v, want nil", v)
+	}
+	if v := getFloatsByTag(ds, tag.SliceThickness); v != nil {
+		t.Errorf("missing tag = %v, want nil", v)
+	}
+}
+
+func TestCatalogCoversStudy(t *testing.T) {
+	two := []*ImagingInstance{{SOPInstanceUID: "1.1"}, {SOPInstanceUID: "1.2"}}
+	cataloged := func(n int, sessions ...string) *ImagingStudy {
+		return &ImagingStudy{SessionID: sessions[0], SessionIDs: sessions, CatalogedSessionIDs: sessions, NumInstances: n}
+	}
+
+	if !catalogCoversStudy(cataloged(2, "S1", "S2"), two) {
+		t.Error("fully cataloged study should use the catalog")
+	}
+	if catalogCoversStudy(cataloged(3, "S1"), two) {
+		t.Error("catalog with fewer entries than the study should fall back")
+	}
+	if catalogCoversStudy(cataloged(0, "S1"), nil) {
+		t.Error("empty catalog should fall back")
+	}
+	older := cataloged(2, "S2")
+	older.SessionIDs = []string{"S1", "S2"}
+	if catalogCoversStudy(older, two) {
+		t.Error("study with a pre-catalog session should fall back")
+	}
+	if catalogCoversStudy(&ImagingStudy{SessionID: "S1", NumInstances: 2}, two) {
+		t.Error("study never marked as cataloged should fall back")
+	}
+}
+
+func TestImagingInstanceFromDicomJSON(t *testing.T) {
+	study := &ImagingStudy{StudyID: "STUDY-1", UserID: "u1", StudyInstanceUID: "1.2.3"}
+	want := &ImagingInstance{
+		InstanceID:              imagingInstanceDocID("STUDY-1", "1.2.3.4.5"),
+		StudyID:                 "STUDY-1",
+		UserID:                  "u1",
+		StudyInstanceUID:        "1.2.3",
+		SeriesInstanceUID:       "1.2.3.4",
+		SOPInstanceUID:          "1.2.3.4.5",
+		Modality:                "CT",
+		SeriesNumber:            2,
+		InstanceNumber:          9,
+		Rows:                    512,
+		Columns:                 512,
+		NumberOfFrames:          1,
+		SliceThickness:          1.25,
+		PixelSpacing:            []float64{0.7, 0.7},
+		ImagePositionPatient:    []float64{-10, -20, 30},
+		ImageOrientationPatient: []float64{1, 0, 0, 0, 1, 0},
+		FrameOfReferenceUID:     "1.2.3.9",
+	}
+	got := imagingInstanceFromDicomJSON(study, imagingInstanceDicomJSON(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v\nwant %+v", got, want)
+	}
+
+	// Study metadata sends IS/DS values as strings.
+	ds := map[string]interface{}{
+		"00080018": map[string]interface{}{"vr": "UI", "Value": []interface{}{"1.2.3.4.6"}},
+		"00200013": map[string]interface{}{"vr": "IS", "Value": []interface{}{"12"}},
+		"00200032": map[string]interface{}{"vr": "DS", "Value": []interface{}{"1", "2", "3.5"}},
+	}
+	got = imagingInstanceFromDicomJSON(study, ds)
+	if got.StudyInstanceUID != "1.2.3" || got.InstanceNumber != 12 || !reflect.DeepEqual(got.ImagePositionPatient, []float64{1, 2, 3.5}) {
+		t.Errorf("string values = %+v", got)
+	}
+}
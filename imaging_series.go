@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Orientation classes of a series, from its ImageOrientationPatient.
+const (
+	OrientationAxial    = "axial"
+	OrientationSagittal = "sagittal"
+	OrientationCoronal  = "coronal"
+	OrientationOblique  = "oblique"
+	OrientationUnknown  = "unknown"
+)
+
+// ImagingSeries is the per-series display document in imaging_series,
+// rolled up from the study's imaging_instances catalog at ingest.
+type ImagingSeries struct {
+	SeriesID          string `firestore:"series_id" json:"series_id"`
+	StudyID           string `firestore:"study_id" json:"study_id"`
+	UserID            string `firestore:"user_id" json:"user_id"`
+	StudyInstanceUID  string `firestore:"study_instance_uid" json:"study_instance_uid"`
+	SeriesInstanceUID string `firestore:"series_instance_uid" json:"series_instance_uid"`
+
+	Modality          string `firestore:"modality" json:"modality"`
+	SeriesDescription string `firestore:"series_description" json:"series_description"`
+	SeriesNumber      int    `firestore:"series_number" json:"series_number"`
+	NumInstances      int    `firestore:"num_instances" json:"num_instances"`
+	BodyPartExamined  string `firestore:"body_part_examined" json:"body_part_examined"`
+
+	OrientationClass string  `firestore:"orientation_class" json:"orientation_class"` // axial|sagittal|coronal|oblique|unknown
+	SliceSpacing     float64 `firestore:"slice_spacing" json:"slice_spacing"`         // mm between adjacent slices, 0 if unknown
+	SliceThickness   float64 `firestore:"slice_thickness" json:"slice_thickness"`
+	Rows             int     `firestore:"rows" json:"rows"`
+	Columns          int     `firestore:"columns" json:"columns"`
+
+	// ThumbnailKey is the DICOMweb path of the middle instance, used by the
+	// frontend to fetch a rendered preview.
+	ThumbnailKey string `firestore:"thumbnail_key" json:"thumbnail_key"`
+
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// sliceNormal returns the unit normal (row × col) of an orientation, or nil
+// if the orientation is missing or degenerate.
+func sliceNormal(iop []float64) []float64 {
+	if len(iop) != 6 {
+		return nil
+	}
+	nx := iop[1]*iop[5] - iop[2]*iop[4]
+	ny := iop[2]*iop[3] - iop[0]*iop[5]
+	nz := iop[0]*iop[4] - iop[1]*iop[3]
+	norm := math.Sqrt(nx*nx + ny*ny + nz*nz)
+	if norm < 1e-6 {
+		return nil
+	}
+	return []float64{nx / norm, ny / norm, nz / norm}
+}
+
+// orientationClass classifies a slice orientation by the patient axis its
+// normal is closest to. Normals more than ~30° off every axis are oblique.
+func orientationClass(iop []float64) string {
+	n := sliceNormal(iop)
+	if n == nil {
+		return OrientationUnknown
+	}
+	x, y, z := math.Abs(n[0]), math.Abs(n[1]), math.Abs(n[2])
+	const minCos = 0.866 // cos(30°)
+	switch {
+	case z >= x && z >= y && z >= minCos:
+		return OrientationAxial
+	case x >= y && x >= z && x >= minCos:
+		return OrientationSagittal
+	case y >= x && y >= z && y >= minCos:
+		return OrientationCoronal
+	}
+	return OrientationOblique
+}
+
+// sliceSpacing estimates the distance between adjacent slices as the median
+// gap between distinct slice positions along the normal.
+func sliceSpacing(normal []float64, instances []*ImagingInstance) float64 {
+	if normal == nil {
+		return 0
+	}
+	var pos []float64
+	for _, in := range instances {
+		if len(in.ImagePositionPatient) != 3 {
+			continue
+		}
+		p := in.ImagePositionPatient
+		pos = append(pos, normal[0]*p[0]+normal[1]*p[1]+normal[2]*p[2])
+	}
+	sort.Float64s(pos)
+	var gaps []float64
+	for i := 1; i < len(pos); i++ {
+		if d := pos[i] - pos[i-1]; d > 1e-3 {
+			gaps = append(gaps, d)
+		}
+	}
+	if len(gaps) == 0 {
+		return 0
+	}
+	sort.Float64s(gaps)
+	return gaps[len(gaps)/2]
+}
+
+// buildImagingSeries rolls catalog entries up into one document per series.
+// Orientation is taken from the most common ImageOrientationPatient so a
+// stray localizer does not change the class of the whole series.
+func buildImagingSeries(studyID, userID string, instances []*ImagingInstance) []*ImagingSeries {
+	bySeries := make(map[string][]*ImagingInstance)
+	var order []string
+	for _, in := range instances {
+		if in.SeriesInstanceUID == "" {
+			continue
+		}
+		if _, ok := bySeries[in.SeriesInstanceUID]; !ok {
+			order = append(order, in.SeriesInstanceUID)
+		}
+		bySeries[in.SeriesInstanceUID] = append(bySeries[in.SeriesInstanceUID], in)
+	}
+
+	res := make([]*ImagingSeries, 0, len(order))
+	for _, uid := range order {
+		insts := bySeries[uid]
+		sort.Slice(insts, func(i, j int) bool { return insts[i].InstanceNumber < insts[j].InstanceNumber })
+
+		s := &ImagingSeries{
+			SeriesID:          imagingSeriesDocID(studyID, uid),
+			StudyID:           studyID,
+			UserID:            userID,
+			SeriesInstanceUID: uid,
+			NumInstances:      len(insts),
+		}
+
+		iopCounts := make(map[string]int)
+		iopByKey := make(map[string][]float64)
+		for _, in := range insts {
+			if s.StudyInstanceUID == "" {
+				s.StudyInstanceUID = in.StudyInstanceUID
+			}
+			if s.Modality == "" {
+				s.Modality = in.Modality
+			}
+			if s.SeriesDescription == "" {
+				s.SeriesDescription = in.SeriesDescription
+			}
+			if s.SeriesNumber == 0 {
+				s.SeriesNumber = in.SeriesNumber
+			}
+			if s.BodyPartExamined == "" {
+				s.BodyPartExamined = in.BodyPartExamined
+			}
+			if s.SliceThickness == 0 {
+				s.SliceThickness = in.SliceThickness
+			}
+			if s.Rows == 0 {
+				s.Rows, s.Columns = in.Rows, in.Columns
+			}
+			if len(in.ImageOrientationPatient) == 6 {
+				key := fmt.Sprintf("%.3f", in.ImageOrientationPatient)
+				iopCounts[key]++
+				iopByKey[key] = in.ImageOrientationPatient
+			}
+		}
+
+		var dominant []float64
+		best := 0
+		for key, n := range iopCounts {
+			if n > best {
+				best, dominant = n, iopByKey[key]
+			}
+		}
+		s.OrientationClass = orientationClass(dominant)
+		s.SliceSpacing = sliceSpacing(sliceNormal(dominant), insts)
+
+		mid := insts[len(insts)/2]
+		s.ThumbnailKey = fmt.Sprintf("studies/%s/series/%s/instances/%s", mid.StudyInstanceUID, uid, mid.SOPInstanceUID)
+
+		res = append(res, s)
+	}
+	return res
+}
+
+func imagingSeriesDocID(studyID, seriesInstanceUID string) string {
+	return deterministicTokenID("SER", studyID, seriesInstanceUID)
+}
+
+// refreshImagingSeries rebuilds a study's series documents from its full
+// instance catalog, so series merged from several uploads stay accurate.
+func (h *Handlers) refreshImagingSeries(ctx context.Context, studyID, userID string) error {
+	instances, err := h.DB.ListImagingInstancesForStudy(ctx, studyID)
+	if err != nil {
+		return err
+	}
+	return h.DB.UpsertImagingSeries(ctx, buildImagingSeries(studyID, userID, instances))
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: imaging_series
+//
+// UpsertImagingSeries writes series documents in one batch per 400.
+func (db *FirestoreDB) UpsertImagingSeries(ctx context.Context, series []*ImagingSeries) error {
+	col := db.client.Collection("imaging_series")
+	now := time.Now().UTC()
+
+	const batchSize = 400
+	for i := 0; i < len(series); i += batchSize {
+		end := i + batchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		b := db.client.Batch()
+		for _, s := range series[i:end] {
+			s.UpdatedAt = now
+			b.Set(col.Doc(s.SeriesID), s)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("write imaging series batch: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListImagingSeriesForStudy returns a study's series ordered by series number.
+func (db *FirestoreDB) ListImagingSeriesForStudy(ctx context.Context, studyID string) ([]*ImagingSeries, error) {
+	docs, err := db.client.Collection("imaging_series").
+		Where("study_id", "==", studyID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("list imaging series (%s): %w", studyID, err)
+	}
+	res := make([]*ImagingSeries, 0, len(docs))
+	for _, d := range docs {
+		var s ImagingSeries
+		if err := d.DataTo(&s); err != nil {
+			return nil, fmt.Errorf("decode imaging series (%s): %w", d.Ref.ID, err)
+		}
+		res = append(res, &s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].SeriesNumber != res[j].SeriesNumber {
+			return res[i].SeriesNumber < res[j].SeriesNumber
+		}
+		return res[i].SeriesInstanceUID < res[j].SeriesInstanceUID
+	})
+	return res, nil
+}
+
+// DeleteImagingSeriesForStudy removes a study's series documents.
+func (db *FirestoreDB) DeleteImagingSeriesForStudy(ctx context.Context, studyID string) error {
+	docs, err := db.client.Collection("imaging_series").
+		Where("study_id", "==", studyID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("list imaging series (%s): %w", studyID, err)
+	}
+	const batchSize = 400
+	for i := 0; i < len(docs); i += batchSize {
+		end := i + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		b := db.client.Batch()
+		for _, d := range docs[i:end] {
+			b.Delete(d.Ref)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("delete imaging series (%s): %w", studyID, err)
+		}
+	}
+	return nil
+}
+
+// handleImagingStudySeries implements GET /api/imaging/studies/{id}/series.
+func (h *Handlers) handleImagingStudySeries(w http.ResponseWriter, r *http.Request, studyID string) {
+	ctx := r.Context()
+	userID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("handleImagingStudySeries getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthorized",
+		})
+		return
+	}
+
+	study, err := h.DB.GetImagingStudy(ctx, studyID)
+	if err != nil {
+		log.Printf("handleImagingStudySeries GetImagingStudy error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if study == nil || study.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "study_not_found",
+		})
+		return
+	}
+
+	series, err := h.DB.ListImagingSeriesForStudy(ctx, studyID)
+	if err != nil {
+		log.Printf("handleImagingStudySeries ListImagingSeriesForStudy error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":       true,
+		"study_id": studyID,
+		"series":   series,
+	})
+}
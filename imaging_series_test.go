@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOrientationClass(t *testing.T) {
+	tests := []struct {
+		iop  []float64
+		want string
+	}{
+		{[]float64{1, 0, 0, 0, 1, 0}, OrientationAxial},
+		{[]float64{0, 1, 0, 0, 0, -1}, OrientationSagittal},
+		{[]float64{1, 0, 0, 0, 0, -1}, OrientationCoronal},
+		{[]float64{1, 0, 0, 0, 0.7071, 0.7071}, OrientationOblique},
+		{[]float64{1, 0, 0, 0, 0.966, 0.259}, OrientationAxial}, // 15° tilt
+		{nil, OrientationUnknown},
+		{[]float64{1, 0, 0, 1, 0, 0}, OrientationUnknown},
+	}
+	for _, tt := range tests {
+		if got := orientationClass(tt.iop); got != tt.want {
+			t.Errorf("orientationClass(%v) = %q, want %q", tt.iop, got, tt.want)
+		}
+	}
+}
+
+func TestBuildImagingSeries(t *testing.T) {
+	axial := []float64{1, 0, 0, 0, 1, 0}
+	inst := func(series string, n int, z float64, iop []float64) *ImagingInstance {
+		return &ImagingInstance{
+			StudyInstanceUID:        "1.2.3",
+			SeriesInstanceUID:       series,
+			SOPInstanceUID:          series + "." + string(rune('0'+n)),
+			Modality:                "CT",
+			SeriesNumber:            2,
+			SeriesDescription:       "CHEST",
+			InstanceNumber:          n,
+			ImagePositionPatient:    []float64{0, 0, z},
+			ImageOrientationPatient: iop,
+		}
+	}
+	instances := []*ImagingInstance{
+		inst("1.2.3.1", 3, 5, axial),
+		inst("1.2.3.1", 1, 0, axial),
+		inst("1.2.3.1", 2, 2.5, axial),
+		inst("1.2.3.1", 4, 7.5, axial),
+		// Localizer in the same series must not change the orientation class.
+		inst("1.2.3.1", 5, 0, []float64{0, 1, 0, 0, 0, -1}),
+		inst("1.2.3.2", 1, 0, nil),
+	}
+
+	series := buildImagingSeries("STUDY-1", "u1", instances)
+	if len(series) != 2 {
+		t.Fatalf("got %d series, want 2", len(series))
+	}
+	s := series[0]
+	if s.SeriesInstanceUID != "1.2.3.1" || s.NumInstances != 5 || s.Modality != "CT" || s.SeriesDescription != "CHEST" {
+		t.Errorf("series = %+v", s)
+	}
+	if s.OrientationClass != OrientationAxial {
+		t.Errorf("orientation = %q, want axial", s.OrientationClass)
+	}
+	if math.Abs(s.SliceSpacing-2.5) > 1e-9 {
+		t.Errorf("slice spacing = %v, want 2.5", s.SliceSpacing)
+	}
+	if want := "studies/1.2.3/series/1.2.3.1/instances/1.2.3.1.3"; s.ThumbnailKey != want {
+		t.Errorf("thumbnail key = %q, want %q", s.ThumbnailKey, want)
+	}
+	if s.SeriesID != imagingSeriesDocID("STUDY-1", "1.2.3.1") {
+		t.Errorf("series id = %q", s.SeriesID)
+	}
+	if series[1].OrientationClass != OrientationUnknown || series[1].SliceSpacing != 0 {
+		t.Errorf("series without geometry = %+v", series[1])
+	}
+}
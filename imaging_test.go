@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeterministicTokenID(t *testing.T) {
+	a := deterministicTokenID("STUDY", "user-1", "1.2.3")
+	if a != deterministicTokenID("STUDY", "user-1", "1.2.3") {
+		t.Fatal("same inputs produced different IDs")
+	}
+	if a == deterministicTokenID("STUDY", "user-2", "1.2.3") {
+		t.Fatal("different users produced the same ID")
+	}
+	if a == deterministicTokenID("STUDY", "user-11", ".2.3") {
+		t.Fatal("part boundaries are not separated")
+	}
+	if !strings.HasPrefix(a, "STUDY-") || len(a) != len("STUDY-")+16 {
+		t.Fatalf("unexpected ID format %q", a)
+	}
+}
+
+func TestMergeImagingStudy(t *testing.T) {
+	existing := &ImagingStudy{
+		SessionID:          "SESS-A",
+		SeriesInstanceUIDs: []string{"1.1"},
+		ModalitiesInStudy:  []string{"CT"},
+		NumInstances:       10,
+		SizeBytes:          1000,
+	}
+
+	// A second session adds a new series.
+	delta, change := mergeImagingStudy(existing, &ImagingStudy{
+		SessionID:          "SESS-B",
+		GCSPrefix:          "gs://b/u/SESS-B/",
+		SeriesInstanceUIDs: []string{"1.2", "1.1"},
+		ModalitiesInStudy:  []string{"PT"},
+		StudyDescription:   "PET/CT",
+		NumInstances:       5,
+		SizeBytes:          500,
+	})
+	if delta != 500 || existing.NumInstances != 15 || existing.SizeBytes != 1500 {
+		t.Fatalf("after merge: delta=%d instances=%d bytes=%d", delta, existing.NumInstances, existing.SizeBytes)
+	}
+	if !reflect.DeepEqual(existing.SeriesInstanceUIDs, []string{"1.1", "1.2"}) ||
+		!reflect.DeepEqual(existing.ModalitiesInStudy, []string{"CT", "PT"}) {
+		t.Fatalf("sets not merged: %v %v", existing.SeriesInstanceUIDs, existing.ModalitiesInStudy)
+	}
+	if existing.StudyDescription != "PET/CT" {
+		t.Fatalf("description not filled: %q", existing.StudyDescription)
+	}
+	if !reflect.DeepEqual(existing.SessionIDs, []string{"SESS-A", "SESS-B"}) ||
+		!reflect.DeepEqual(existing.GCSPrefixes, []string{"gs://b/u/SESS-B/"}) {
+		t.Fatalf("contributors: %v %v", existing.SessionIDs, existing.GCSPrefixes)
+	}
+	if change.Action != "merged" || !reflect.DeepEqual(change.AddedSeries, []string{"1.2"}) ||
+		!reflect.DeepEqual(change.AddedModalities, []string{"PT"}) ||
+		change.InstancesBefore != 10 || change.InstancesAfter != 15 {
+		t.Fatalf("unexpected change entry %+v", change)
+	}
+
+	// Redelivery of the same session must not double count.
+	delta, change = mergeImagingStudy(existing, &ImagingStudy{SessionID: "SESS-B", NumInstances: 5, SizeBytes: 500})
+	if change.Action != "reingested" || len(existing.SessionIDs) != 2 {
+		t.Fatalf("redelivery: action=%q sessions=%v", change.Action, existing.SessionIDs)
+	}
+	if delta != 0 || existing.NumInstances != 15 || existing.SizeBytes != 1500 {
+		t.Fatalf("after redelivery: delta=%d instances=%d bytes=%d", delta, existing.NumInstances, existing.SizeBytes)
+	}
+}
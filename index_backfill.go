@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+)
+
+// indexBackfillPageSize is how many studies the backfill reads per page.
+const indexBackfillPageSize = 200
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: imaging_studies (paged scan)
+//
+// ListImagingStudiesPage returns up to limit studies ordered by document ID,
+// starting after the study afterID ("" for the first page).
+func (db *FirestoreDB) ListImagingStudiesPage(ctx context.Context, afterID string, limit int) ([]*ImagingStudy, error) {
+	q := db.client.Collection("imaging_studies").OrderBy(firestore.DocumentID, firestore.Asc).Limit(limit)
+	if afterID != "" {
+		q = q.StartAfter(afterID)
+	}
+	snaps, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("list imaging studies after %q: %w", afterID, err)
+	}
+	studies := make([]*ImagingStudy, 0, len(snaps))
+	for _, snap := range snaps {
+		var s ImagingStudy
+		if err := snap.DataTo(&s); err != nil {
+			return nil, fmt.Errorf("decode imaging study %s: %w", snap.Ref.ID, err)
+		}
+		if s.StudyID == "" {
+			s.StudyID = snap.Ref.ID
+		}
+		studies = append(studies, &s)
+	}
+	return studies, nil
+}
+
+// studiesMissingIndexStatus returns the studies that have no
+// imaging_longitudinal_status document in statuses.
+func studiesMissingIndexStatus(studies []*ImagingStudy, statuses map[string]*LongitudinalIndexStatus) []*ImagingStudy {
+	var missing []*ImagingStudy
+	for _, s := range studies {
+		if _, ok := statuses[s.StudyID]; !ok {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// backfillLongitudinalIndex enqueues an index job for every study that has
+// never been indexed, i.e. has no imaging_longitudinal_status document.
+// Enqueueing creates that document, so the backfill can be re-run after an
+// interruption and only picks up what is left.
+func (h *Handlers) backfillLongitudinalIndex(ctx context.Context) (scanned, enqueued int, err error) {
+	afterID := ""
+	for {
+		studies, err := h.DB.ListImagingStudiesPage(ctx, afterID, indexBackfillPageSize)
+		if err != nil {
+			return scanned, enqueued, err
+		}
+		if len(studies) == 0 {
+			return scanned, enqueued, nil
+		}
+		scanned += len(studies)
+		afterID = studies[len(studies)-1].StudyID
+
+		ids := make([]string, len(studies))
+		for i, s := range studies {
+			ids[i] = s.StudyID
+		}
+		statuses, err := h.DB.GetLongitudinalIndexStatuses(ctx, ids)
+		if err != nil {
+			return scanned, enqueued, err
+		}
+		for _, study := range studiesMissingIndexStatus(studies, statuses) {
+			if _, ok, err := h.enqueueStudyIndex(ctx, study); err != nil {
+				log.Printf("backfillLongitudinalIndex enqueueStudyIndex(%s) error: %v", study.StudyID, err)
+			} else if ok {
+				enqueued++
+			}
+		}
+		log.Printf("backfillLongitudinalIndex: scanned %d studies, enqueued %d", scanned, enqueued)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestStudiesMissingIndexStatus(t *testing.T) {
+	studies := []*ImagingStudy{{StudyID: "A"}, {StudyID: "B"}, {StudyID: "C"}}
+	statuses := map[string]*LongitudinalIndexStatus{
+		"B": {StudyID: "B", Status: "indexed"},
+		"C": {StudyID: "C", Status: "error"},
+	}
+	missing := studiesMissingIndexStatus(studies, statuses)
+	if len(missing) != 1 || missing[0].StudyID != "A" {
+		t.Fatalf("missing = %v", missing)
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Longitudinal index job statuses.
+const (
+	IndexJobQueued    = "queued"
+	IndexJobRunning   = "running"
+	IndexJobSucceeded = "succeeded"
+	IndexJobFailed    = "failed"
+	IndexJobCancelled = "cancelled"
+)
+
+// IndexJob is a queued or running longitudinal index build for one study,
+// stored in index_jobs. There is one job document per study; re-indexing a
+// study re-queues it. Progress is reported on the study's
+// imaging_longitudinal_status document.
+type IndexJob struct {
+	JobID         string `firestore:"job_id" json:"job_id"`
+	StudyID       string `firestore:"study_id" json:"study_id"`
+	PatientUserID string `firestore:"patient_user_id" json:"patient_user_id"`
+
+	Status          string `firestore:"status" json:"status"` // queued|running|succeeded|failed|cancelled
+	Attempts        int    `firestore:"attempts" json:"attempts"`
+	CancelRequested bool   `firestore:"cancel_requested" json:"cancel_requested"`
+	// RerunRequested is set when a build is requested while one is running,
+	// e.g. because a new session merged instances into the study; the job
+	// is re-queued once the running build finishes.
+	RerunRequested bool `firestore:"rerun_requested" json:"rerun_requested"`
+
+	LeaseOwner     string    `firestore:"lease_owner" json:"lease_owner"`
+	LeaseExpiresAt time.Time `firestore:"lease_expires_at" json:"lease_expires_at"`
+	HeartbeatAt    time.Time `firestore:"heartbeat_at" json:"heartbeat_at"`
+	AvailableAt    time.Time `firestore:"available_at" json:"available_at"`
+
+	LastError string    `firestore:"last_error" json:"last_error"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// active reports whether the job is waiting for or holding a worker.
+func (j *IndexJob) active() bool {
+	return j.Status == IndexJobQueued || j.Status == IndexJobRunning
+}
+
+// claimable reports whether a worker may take the job at now: it is queued
+// and due, or running under a lease that has expired. A job whose worker
+// died after a cancel request is not resumed.
+func (j *IndexJob) claimable(now time.Time) bool {
+	switch j.Status {
+	case IndexJobQueued:
+		return !j.AvailableAt.After(now)
+	case IndexJobRunning:
+		return !j.CancelRequested && j.LeaseExpiresAt.Before(now)
+	}
+	return false
+}
+
+// replaceable reports whether EnqueueIndexJob may start a new build over
+// the job: it is finished, or was cancelled and its worker has let go.
+func (j *IndexJob) replaceable(now time.Time) bool {
+	if !j.active() {
+		return true
+	}
+	return j.Status == IndexJobRunning && j.CancelRequested && j.LeaseExpiresAt.Before(now)
+}
+
+// finishStatus returns the status a job moves to when the attempt that
+// holds it ends, and whether that is a fresh run requested meanwhile. A
+// requested rerun takes precedence over any outcome except cancellation.
+func (j *IndexJob) finishStatus(runErr error, cancelled bool, maxAttempts int) (string, bool) {
+	switch {
+	case cancelled:
+		return IndexJobCancelled, false
+	case j.RerunRequested:
+		return IndexJobQueued, true
+	case runErr == nil:
+		return IndexJobSucceeded, false
+	}
+	if permanent, _ := classifyIngestError(runErr); !permanent && j.Attempts < maxAttempts {
+		return IndexJobQueued, false
+	}
+	return IndexJobFailed, false
+}
+
+func indexJobID(studyID string) string {
+	return deterministicTokenID("IDX", studyID)
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: index_jobs
+//
+// EnqueueIndexJob queues an index build for study. A job that is already
+// queued is returned as is, with enqueued false; a running one is flagged
+// to run again when it finishes, since it may have read the study before
+// the change that prompted this request.
+func (db *FirestoreDB) EnqueueIndexJob(ctx context.Context, study *ImagingStudy) (job *IndexJob, enqueued bool, err error) {
+	ref := db.client.Collection("index_jobs").Doc(indexJobID(study.StudyID))
+	err = db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		job, enqueued = nil, false
+		now := time.Now().UTC()
+		snap, err := tx.Get(ref)
+		if err == nil {
+			var existing IndexJob
+			if err := snap.DataTo(&existing); err != nil {
+				return err
+			}
+			if !existing.replaceable(now) {
+				// Already queued or running; a running job that is winding
+				// down after a cancel is left to release its lease first.
+				job = &existing
+				if existing.Status != IndexJobRunning || existing.CancelRequested || existing.RerunRequested {
+					return nil
+				}
+				job.RerunRequested = true
+				return tx.Update(ref, []firestore.Update{
+					{Path: "rerun_requested", Value: true},
+					{Path: "updated_at", Value: now},
+				})
+			}
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		job = &IndexJob{
+			JobID:         ref.ID,
+			StudyID:       study.StudyID,
+			PatientUserID: study.UserID,
+			Status:        IndexJobQueued,
+			AvailableAt:   now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		enqueued = true
+		return tx.Set(ref, job)
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("enqueue index job (%s): %w", study.StudyID, err)
+	}
+	return job, enqueued, nil
+}
+
+// GetIndexJob fetches the index job of a study, or nil if it has none.
+func (db *FirestoreDB) GetIndexJob(ctx context.Context, studyID string) (*IndexJob, error) {
+	snap, err := db.client.Collection("index_jobs").Doc(indexJobID(studyID)).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get index job (%s): %w", studyID, err)
+	}
+	var job IndexJob
+	if err := snap.DataTo(&job); err != nil {
+		return nil, fmt.Errorf("decode index job (%s): %w", studyID, err)
+	}
+	return &job, nil
+}
+
+// ClaimIndexJob takes the oldest claimable job under a lease for owner.
+// It returns nil when nothing is due.
+//
+// Requires composite indexes on (status, available_at) and
+// (status, lease_expires_at).
+func (db *FirestoreDB) ClaimIndexJob(ctx context.Context, owner string, lease time.Duration) (*IndexJob, error) {
+	col := db.client.Collection("index_jobs")
+	now := time.Now().UTC()
+
+	queued, err := col.Where("status", "==", IndexJobQueued).
+		Where("available_at", "<=", now).
+		OrderBy("available_at", firestore.Asc).
+		Limit(10).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query queued index jobs: %w", err)
+	}
+	expired, err := col.Where("status", "==", IndexJobRunning).
+		Where("lease_expires_at", "<", now).
+		Limit(10).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query expired index jobs: %w", err)
+	}
+
+	for _, cand := range append(expired, queued...) {
+		var claimed *IndexJob
+		err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			claimed = nil
+			snap, err := tx.Get(cand.Ref)
+			if err != nil {
+				return err
+			}
+			var job IndexJob
+			if err := snap.DataTo(&job); err != nil {
+				return err
+			}
+			now := time.Now().UTC()
+			if !job.claimable(now) {
+				return nil
+			}
+			job.Status = IndexJobRunning
+			job.Attempts++
+			job.LeaseOwner = owner
+			job.LeaseExpiresAt = now.Add(lease)
+			job.HeartbeatAt = now
+			job.UpdatedAt = now
+			claimed = &job
+			return tx.Set(cand.Ref, &job)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("claim index job (%s): %w", cand.Ref.ID, err)
+		}
+		if claimed != nil {
+			return claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+// RenewIndexJobLease extends the lease while owner still holds it. held is
+// false if another worker has taken the job over; cancelRequested reports a
+// pending cancellation.
+func (db *FirestoreDB) RenewIndexJobLease(ctx context.Context, jobID, owner string, lease time.Duration) (held, cancelRequested bool, err error) {
+	ref := db.client.Collection("index_jobs").Doc(jobID)
+	err = db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		held, cancelRequested = false, false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var job IndexJob
+		if err := snap.DataTo(&job); err != nil {
+			return err
+		}
+		if job.Status != IndexJobRunning || job.LeaseOwner != owner {
+			return nil
+		}
+		held, cancelRequested = true, job.CancelRequested
+		now := time.Now().UTC()
+		return tx.Update(ref, []firestore.Update{
+			{Path: "lease_expires_at", Value: now.Add(lease)},
+			{Path: "heartbeat_at", Value: now},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return false, false, fmt.Errorf("renew index job lease (%s): %w", jobID, err)
+	}
+	return held, cancelRequested, nil
+}
+
+// FinishIndexJob releases the lease and records the outcome of an attempt:
+// cancelled, succeeded, re-queued with backoff, or failed once the error is
+// permanent or the job has used maxAttempts. A job flagged for a rerun is
+// re-queued at once with its attempts reset instead. It returns the job
+// status, or errIndexSuperseded without changing anything if job no longer
+// holds its lease.
+func (db *FirestoreDB) FinishIndexJob(ctx context.Context, job *IndexJob, runErr error, cancelled bool, maxAttempts int) (string, error) {
+	ref := db.client.Collection("index_jobs").Doc(job.JobID)
+	var jobStatus string
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var current IndexJob
+		if err := snap.DataTo(&current); err != nil {
+			return err
+		}
+		if current.Status != IndexJobRunning || current.LeaseOwner != job.LeaseOwner {
+			return errIndexSuperseded
+		}
+		now := time.Now().UTC()
+		updates := map[string]interface{}{
+			"lease_owner":      "",
+			"lease_expires_at": time.Time{},
+			"cancel_requested": false,
+			"rerun_requested":  false,
+			"updated_at":       now,
+			"last_error":       "",
+		}
+		var rerun bool
+		jobStatus, rerun = current.finishStatus(runErr, cancelled, maxAttempts)
+		updates["status"] = jobStatus
+		switch {
+		case rerun:
+			updates["attempts"] = 0
+			updates["available_at"] = now
+		case jobStatus == IndexJobQueued:
+			updates["available_at"] = now.Add(ingestRetryBackoff(current.Attempts))
+		}
+		if runErr != nil {
+			updates["last_error"] = runErr.Error()
+		}
+		return tx.Set(ref, updates, firestore.MergeAll)
+	})
+	if errors.Is(err, errIndexSuperseded) {
+		return "", errIndexSuperseded
+	}
+	if err != nil {
+		return "", fmt.Errorf("finish index job (%s): %w", job.JobID, err)
+	}
+	return jobStatus, nil
+}
+
+// CancelIndexJob cancels a study's index job: a queued job is cancelled at
+// once, a running one is flagged and stopped by its worker at the next
+// heartbeat. It returns the job (nil if the study has none) and whether
+// anything was cancelled.
+func (db *FirestoreDB) CancelIndexJob(ctx context.Context, studyID string) (*IndexJob, bool, error) {
+	ref := db.client.Collection("index_jobs").Doc(indexJobID(studyID))
+	var (
+		job       *IndexJob
+		cancelled bool
+	)
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		job, cancelled = nil, false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+		var j IndexJob
+		if err := snap.DataTo(&j); err != nil {
+			return err
+		}
+		job = &j
+		now := time.Now().UTC()
+		switch j.Status {
+		case IndexJobQueued:
+			j.Status = IndexJobCancelled
+		case IndexJobRunning:
+			j.CancelRequested = true
+		default:
+			return nil
+		}
+		j.UpdatedAt = now
+		cancelled = true
+		return tx.Set(ref, &j)
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("cancel index job (%s): %w", studyID, err)
+	}
+	return job, cancelled, nil
+}
+
+// errIndexSuperseded reports that a build lost its lease or was overtaken by
+// another build before it could publish or finish. The job belongs to
+// whoever holds it now, so the worker leaves it alone.
+var errIndexSuperseded = errors.New("index build superseded")
+
+// PublishLongitudinalIndexVersion applies fn to the study's status to make
+// version the live index, but only while job still holds its lease and the
+// status still shows this job building on version-1. Otherwise it returns
+// errIndexSuperseded and changes nothing.
+func (db *FirestoreDB) PublishLongitudinalIndexVersion(ctx context.Context, job *IndexJob, version int64, fn func(s *LongitudinalIndexStatus)) error {
+	statusRef := db.client.Collection("imaging_longitudinal_status").Doc(job.StudyID)
+	jobRef := db.client.Collection("index_jobs").Doc(job.JobID)
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		jobSnap, err := tx.Get(jobRef)
+		if err != nil {
+			return err
+		}
+		var current IndexJob
+		if err := jobSnap.DataTo(&current); err != nil {
+			return err
+		}
+		if current.Status != IndexJobRunning || current.LeaseOwner != job.LeaseOwner {
+			return errIndexSuperseded
+		}
+
+		snap, err := tx.Get(statusRef)
+		if err != nil {
+			return err
+		}
+		var s LongitudinalIndexStatus
+		if err := snap.DataTo(&s); err != nil {
+			return err
+		}
+		if s.IndexVersion != version-1 || s.JobID != job.JobID {
+			return errIndexSuperseded
+		}
+		fn(&s)
+		s.UpdatedAt = time.Now().UTC()
+		return tx.Set(statusRef, &s)
+	})
+	if errors.Is(err, errIndexSuperseded) {
+		return errIndexSuperseded
+	}
+	if err != nil {
+		return fmt.Errorf("publish longitudinal index (%s v%d): %w", job.StudyID, version, err)
+	}
+	return nil
+}
+
+// ////////////////////////////////////////////////////////////////
+//
+//	Longitudinal index worker pool
+//
+// IndexWorkerPool builds longitudinal indexes for queued index jobs. Like
+// the ingest pool it can run in several processes over the same
+// index_jobs collection.
+type IndexWorkerPool struct {
+	h           *Handlers
+	workers     int
+	maxAttempts int
+	owner       string
+	lease       time.Duration
+	poll        time.Duration
+	wake        chan struct{}
+}
+
+// NewIndexWorkerPool creates a pool of workers for h.
+func NewIndexWorkerPool(h *Handlers, workers, maxAttempts int) *IndexWorkerPool {
+	host, _ := os.Hostname()
+	suffix, err := randomTokenID("W", 6)
+	if err != nil {
+		suffix = fmt.Sprintf("W-%d", time.Now().UnixNano())
+	}
+	return &IndexWorkerPool{
+		h:           h,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		owner:       fmt.Sprintf("%s/%d/%s", host, os.Getpid(), suffix),
+		// Heartbeats run every lease/6, which bounds how long a
+		// cancellation takes to reach a running build.
+		lease: time.Minute,
+		poll:  10 * time.Second,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes an idle worker, e.g. right after a job is enqueued. Safe to
+// call on a nil pool.
+func (p *IndexWorkerPool) Notify() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers and blocks until ctx is cancelled and they have
+// stopped.
+func (p *IndexWorkerPool) Run(ctx context.Context) {
+	log.Printf("IndexWorkerPool: starting %d workers as %s", p.workers, p.owner)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *IndexWorkerPool) loop(ctx context.Context) {
+	ticker := time.NewTicker(p.poll)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			job, err := p.h.DB.ClaimIndexJob(ctx, p.owner, p.lease)
+			if err != nil {
+				log.Printf("IndexWorkerPool: ClaimIndexJob error: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			p.runJob(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// runJob executes one claimed job, heartbeating its lease and watching for
+// cancellation until it finishes.
+func (p *IndexWorkerPool) runJob(ctx context.Context, job *IndexJob) {
+	log.Printf("IndexWorkerPool: running job %s study=%s attempt=%d", job.JobID, job.StudyID, job.Attempts)
+
+	if job.Attempts > p.maxAttempts {
+		err := fmt.Errorf("giving up after %d attempts: %s", job.Attempts-1, job.LastError)
+		p.finish(ctx, job, err, false)
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var cancelRequested atomic.Bool
+	go func() {
+		t := time.NewTicker(p.lease / 6)
+		defer t.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-t.C:
+				held, cancelReq, err := p.h.DB.RenewIndexJobLease(runCtx, job.JobID, p.owner, p.lease)
+				if err != nil {
+					log.Printf("IndexWorkerPool: heartbeat %s error: %v", job.JobID, err)
+					continue
+				}
+				if cancelReq {
+					log.Printf("IndexWorkerPool: job %s cancelled", job.JobID)
+					cancelRequested.Store(true)
+					cancel()
+					return
+				}
+				if !held {
+					log.Printf("IndexWorkerPool: lost lease on job %s, stopping", job.JobID)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := p.h.runIndexJob(runCtx, job)
+	if err != nil {
+		log.Printf("IndexWorkerPool: job %s attempt %d failed: %v", job.JobID, job.Attempts, err)
+	}
+	if cancelRequested.Load() {
+		p.finish(ctx, job, nil, true)
+		return
+	}
+	if runCtx.Err() != nil || errors.Is(err, errIndexSuperseded) {
+		// Shutting down or lease lost: leave the job to whoever resumes it.
+		return
+	}
+	p.finish(ctx, job, err, false)
+}
+
+// finish records the attempt's outcome on the job and the study status.
+func (p *IndexWorkerPool) finish(ctx context.Context, job *IndexJob, runErr error, cancelled bool) {
+	jobStatus, err := p.h.DB.FinishIndexJob(ctx, job, runErr, cancelled, p.maxAttempts)
+	if errors.Is(err, errIndexSuperseded) {
+		// Another worker or a new build owns the job and the study status.
+		log.Printf("IndexWorkerPool: job %s superseded before it finished", job.JobID)
+		return
+	}
+	if err != nil {
+		log.Printf("IndexWorkerPool: FinishIndexJob(%s) error: %v", job.JobID, err)
+		return
+	}
+	if jobStatus == IndexJobSucceeded {
+		// runIndexJob already marked the study indexed.
+		return
+	}
+	_, err = p.h.DB.UpdateLongitudinalIndexStatus(ctx, job.StudyID, job.PatientUserID, func(s *LongitudinalIndexStatus) {
+		lastError := ""
+		if runErr != nil {
+			lastError = runErr.Error()
+		}
+		switch jobStatus {
+		case IndexJobCancelled:
+			s.Status, s.LastError = "cancelled", ""
+		case IndexJobQueued:
+			s.Status, s.LastError = "queued", lastError
+		default:
+			s.Status, s.LastError = "error", lastError
+		}
+		if runErr != nil || cancelled {
+			s.FinishedAt = time.Now().UTC()
+			if !s.StartedAt.IsZero() {
+				s.DurationMS = s.FinishedAt.Sub(s.StartedAt).Milliseconds()
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("IndexWorkerPool: UpdateLongitudinalIndexStatus(%s) error: %v", job.StudyID, err)
+	}
+	if jobStatus == IndexJobQueued {
+		p.Notify()
+	}
+}
+
+// enqueueStudyIndex queues an index build for study, marks the study
+// "queued" and wakes the local workers. Counts and the index version of the
+// previous build are kept until the new one finishes.
+func (h *Handlers) enqueueStudyIndex(ctx context.Context, study *ImagingStudy) (*IndexJob, bool, error) {
+	job, enqueued, err := h.DB.EnqueueIndexJob(ctx, study)
+	if err != nil {
+		return nil, false, err
+	}
+	if !enqueued {
+		return job, false, nil
+	}
+	if _, err := h.DB.UpdateLongitudinalIndexStatus(ctx, study.StudyID, study.UserID, func(s *LongitudinalIndexStatus) {
+		s.Status, s.LastError = "queued", ""
+		s.JobID, s.Attempts = job.JobID, 0
+		s.InstancesProcessed, s.InstancesTotal = 0, 0
+	}); err != nil {
+		return nil, false, err
+	}
+	h.Indexer.Notify()
+	return job, true, nil
+}
+
+// indexProgressInterval throttles progress writes to the status document.
+const indexProgressInterval = 2 * time.Second
+
+// runIndexJob rebuilds a study's slice index, reporting instance progress on
+// its imaging_longitudinal_status document. The new slices are written as the
+// next index version, which readers switch to when the status is marked
+// indexed.
+func (h *Handlers) runIndexJob(ctx context.Context, job *IndexJob) error {
+	study, err := h.DB.GetImagingStudy(ctx, job.StudyID)
+	if err != nil {
+		return err
+	}
+	if study == nil {
+		return permanentIngestError("study_not_found", fmt.Errorf("study %s not found", job.StudyID))
+	}
+
+	started := time.Now().UTC()
+	st, err := h.DB.UpdateLongitudinalIndexStatus(ctx, study.StudyID, study.UserID, func(s *LongitudinalIndexStatus) {
+		s.Status, s.LastError = "indexing", ""
+		s.JobID, s.Attempts = job.JobID, job.Attempts
+		s.InstancesProcessed, s.InstancesTotal = 0, 0
+		s.StartedAt, s.FinishedAt, s.DurationMS = started, time.Time{}, 0
+	})
+	if err != nil {
+		return err
+	}
+	version := st.IndexVersion + 1
+
+	var lastWrite time.Time
+	progress := func(processed, total int) {
+		if processed < total && time.Since(lastWrite) < indexProgressInterval {
+			return
+		}
+		lastWrite = time.Now()
+		if _, err := h.DB.UpdateLongitudinalIndexStatus(ctx, study.StudyID, study.UserID, func(s *LongitudinalIndexStatus) {
+			s.InstancesProcessed, s.InstancesTotal = processed, total
+		}); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("runIndexJob progress(%s) error: %v", study.StudyID, err)
+		}
+	}
+
+	slices, err := h.buildIndexedSlicesForStudy(ctx, study, progress)
+	if err != nil {
+		return fmt.Errorf("buildIndexedSlicesForStudy(%s): %w", study.StudyID, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := h.DB.SaveIndexedSlicesForStudy(ctx, study.StudyID, version, slices); err != nil {
+		return fmt.Errorf("SaveIndexedSlicesForStudy(%s): %w", study.StudyID, err)
+	}
+
+	// Publish the new version, unless another build got there first.
+	if err := h.DB.PublishLongitudinalIndexVersion(ctx, job, version, func(s *LongitudinalIndexStatus) {
+		s.Status, s.LastError = "indexed", ""
+		s.SlicesIndexed = len(slices)
+		s.IndexVersion = version
+		s.FinishedAt = time.Now().UTC()
+		s.DurationMS = s.FinishedAt.Sub(started).Milliseconds()
+	}); err != nil {
+		return err
+	}
+	// Leftovers only cost storage and are pruned by the next build, so
+	// this does not fail the job.
+	if err := h.DB.PruneIndexedSlicesForStudy(ctx, study.StudyID, version); err != nil {
+		log.Printf("runIndexJob PruneIndexedSlicesForStudy(%s) error: %v", study.StudyID, err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIndexJobClaimable(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		job  IndexJob
+		want bool
+	}{
+		{"queued due", IndexJob{Status: IndexJobQueued, AvailableAt: now.Add(-time.Second)}, true},
+		{"queued backing off", IndexJob{Status: IndexJobQueued, AvailableAt: now.Add(time.Minute)}, false},
+		{"running leased", IndexJob{Status: IndexJobRunning, LeaseExpiresAt: now.Add(time.Minute)}, false},
+		{"running lease expired", IndexJob{Status: IndexJobRunning, LeaseExpiresAt: now.Add(-time.Minute)}, true},
+		{"cancelling lease expired", IndexJob{Status: IndexJobRunning, CancelRequested: true, LeaseExpiresAt: now.Add(-time.Minute)}, false},
+		{"succeeded", IndexJob{Status: IndexJobSucceeded}, false},
+		{"failed", IndexJob{Status: IndexJobFailed}, false},
+		{"cancelled", IndexJob{Status: IndexJobCancelled}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.job.claimable(now); got != tc.want {
+			t.Errorf("%s: claimable = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIndexJobReplaceable(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		job  IndexJob
+		want bool
+	}{
+		{"queued", IndexJob{Status: IndexJobQueued}, false},
+		{"running", IndexJob{Status: IndexJobRunning, LeaseExpiresAt: now.Add(-time.Minute)}, false},
+		{"cancelling leased", IndexJob{Status: IndexJobRunning, CancelRequested: true, LeaseExpiresAt: now.Add(time.Minute)}, false},
+		{"cancelling lease expired", IndexJob{Status: IndexJobRunning, CancelRequested: true, LeaseExpiresAt: now.Add(-time.Minute)}, true},
+		{"succeeded", IndexJob{Status: IndexJobSucceeded}, true},
+		{"failed", IndexJob{Status: IndexJobFailed}, true},
+		{"cancelled", IndexJob{Status: IndexJobCancelled}, true},
+	}
+	for _, tc := range tests {
+		if got := tc.job.replaceable(now); got != tc.want {
+			t.Errorf("%s: replaceable = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIndexJobFinishStatus(t *testing.T) {
+	transient := errors.New("dicomweb: 503")
+	permanent := permanentIngestError("study_not_found", errors.New("gone"))
+	tests := []struct {
+		name      string
+		job       IndexJob
+		runErr    error
+		cancelled bool
+		want      string
+		wantRerun bool
+	}{
+		{"succeeded", IndexJob{Attempts: 1}, nil, false, IndexJobSucceeded, false},
+		{"retry", IndexJob{Attempts: 1}, transient, false, IndexJobQueued, false},
+		{"out of attempts", IndexJob{Attempts: 3}, transient, false, IndexJobFailed, false},
+		{"permanent", IndexJob{Attempts: 1}, permanent, false, IndexJobFailed, false},
+		{"cancelled", IndexJob{Attempts: 1}, nil, true, IndexJobCancelled, false},
+		{"rerun after success", IndexJob{Attempts: 1, RerunRequested: true}, nil, false, IndexJobQueued, true},
+		{"rerun after failure", IndexJob{Attempts: 3, RerunRequested: true}, permanent, false, IndexJobQueued, true},
+		{"cancel beats rerun", IndexJob{Attempts: 1, RerunRequested: true}, nil, true, IndexJobCancelled, false},
+	}
+	for _, tc := range tests {
+		got, rerun := tc.job.finishStatus(tc.runErr, tc.cancelled, 3)
+		if got != tc.want || rerun != tc.wantRerun {
+			t.Errorf("%s: finishStatus = %s, %v; want %s, %v", tc.name, got, rerun, tc.want, tc.wantRerun)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/googleapi"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IngestFailure is an ingest error that has already been classified.
+// Permanent failures are dead-lettered immediately instead of retried.
+type IngestFailure struct {
+	Permanent bool
+	Reason    string // short machine-readable cause, e.g. "no_valid_dicom"
+	Err       error
+}
+
+func (e *IngestFailure) Error() string { return e.Err.Error() }
+func (e *IngestFailure) Unwrap() error { return e.Err }
+
+// permanentIngestError marks err as not worth retrying.
+func permanentIngestError(reason string, err error) error {
+	return &IngestFailure{Permanent: true, Reason: reason, Err: err}
+}
+
+// classifyImportFailure classifies a failed Healthcare import from the LRO
+// status code (google.rpc.Code) and the per-file details split out by
+// summarizeStatusDetails.
+func classifyImportFailure(result *ImportOperationResult, err error) error {
+	if result == nil {
+		return err
+	}
+	switch codes.Code(result.Code) {
+	case codes.InvalidArgument, codes.NotFound, codes.PermissionDenied,
+		codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented:
+		return permanentIngestError(fmt.Sprintf("import_code_%d", result.Code), err)
+	case codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.Internal, codes.Unavailable:
+		return &IngestFailure{Reason: fmt.Sprintf("import_code_%d", result.Code), Err: err}
+	}
+	// Other codes (UNKNOWN, ...): if the store named specific files it
+	// rejected, importing the same files again will fail the same way.
+	if len(result.ErrorMessages) > 0 {
+		return permanentIngestError("import_rejected_files", err)
+	}
+	return &IngestFailure{Reason: fmt.Sprintf("import_code_%d", result.Code), Err: err}
+}
+
+// classifyIngestError decides whether an ingest error is permanent and gives
+// a short reason for it. Unclassified errors are treated as retryable.
+func classifyIngestError(err error) (bool, string) {
+	var f *IngestFailure
+	if errors.As(err, &f) {
+		return f.Permanent, f.Reason
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, "timeout"
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500:
+			return false, fmt.Sprintf("http_%d", gerr.Code)
+		case gerr.Code >= 400:
+			return true, fmt.Sprintf("http_%d", gerr.Code)
+		}
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.InvalidArgument, codes.NotFound, codes.PermissionDenied,
+			codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented:
+			return true, "rpc_" + strings.ToLower(st.Code().String())
+		case codes.OK, codes.Unknown:
+		default:
+			return false, "rpc_" + strings.ToLower(st.Code().String())
+		}
+	}
+	return false, "unknown"
+}
+
+// Dead-letter statuses.
+const (
+	DeadLetterOpen     = "open"
+	DeadLetterRequeued = "requeued"
+)
+
+// IngestDeadLetter records an ingest job that failed permanently or ran out
+// of attempts, stored in ingest_dead_letters keyed by job ID.
+type IngestDeadLetter struct {
+	JobID           string `firestore:"job_id" json:"job_id"`
+	SessionID       string `firestore:"session_id" json:"session_id"`
+	GCSPrefix       string `firestore:"gcs_prefix" json:"gcs_prefix"`
+	MessageID       string `firestore:"message_id" json:"message_id"`
+	Step            string `firestore:"step" json:"step"` // last completed step
+	ImportOperation string `firestore:"import_operation" json:"import_operation"`
+	Attempts        int    `firestore:"attempts" json:"attempts"`
+
+	Permanent bool   `firestore:"permanent" json:"permanent"`
+	Reason    string `firestore:"reason" json:"reason"`
+	LastError string `firestore:"last_error" json:"last_error"`
+
+	Status         string    `firestore:"status" json:"status"` // open|requeued
+	Requeues       int       `firestore:"requeues" json:"requeues"`
+	RequeuedBy     string    `firestore:"requeued_by" json:"requeued_by"`
+	RequeuedAt     time.Time `firestore:"requeued_at" json:"requeued_at"`
+	DeadLetteredAt time.Time `firestore:"dead_lettered_at" json:"dead_lettered_at"`
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: ingest_dead_letters
+//
+// FinishIngestJob releases the lease and records the outcome of an attempt.
+// Retryable failures are re-queued with backoff; permanent failures, and
+// jobs that reach maxAttempts, are marked failed and dead-lettered. Once the
+// job is done either way, the session's pending quota bytes are released.
+// It returns the job status.
+func (db *FirestoreDB) FinishIngestJob(ctx context.Context, job *IngestJob, runErr error, maxAttempts int) (string, error) {
+	now := time.Now().UTC()
+	jobRef := db.client.Collection("ingest_jobs").Doc(job.JobID)
+	updates := map[string]interface{}{
+		"lease_owner":      "",
+		"lease_expires_at": time.Time{},
+		"updated_at":       now,
+	}
+
+	if runErr == nil {
+		updates["status"] = IngestJobSucceeded
+		updates["last_error"] = ""
+		updates["failure_reason"] = ""
+		if _, err := jobRef.Set(ctx, updates, firestore.MergeAll); err != nil {
+			return "", fmt.Errorf("finish ingest job (%s): %w", job.JobID, err)
+		}
+		return IngestJobSucceeded, db.ReleasePendingBytes(ctx, job.SessionID)
+	}
+
+	permanent, reason := classifyIngestError(runErr)
+	updates["last_error"] = runErr.Error()
+	updates["failure_reason"] = reason
+
+	if !permanent && job.Attempts < maxAttempts {
+		updates["status"] = IngestJobQueued
+		updates["available_at"] = now.Add(ingestRetryBackoff(job.Attempts))
+		if _, err := jobRef.Set(ctx, updates, firestore.MergeAll); err != nil {
+			return "", fmt.Errorf("finish ingest job (%s): %w", job.JobID, err)
+		}
+		return IngestJobQueued, nil
+	}
+
+	updates["status"] = IngestJobFailed
+	dlRef := db.client.Collection("ingest_dead_letters").Doc(job.JobID)
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Keep the requeue history if this job was dead-lettered before.
+		dl := IngestDeadLetter{}
+		if snap, err := tx.Get(dlRef); err == nil {
+			if err := snap.DataTo(&dl); err != nil {
+				return err
+			}
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		dl.JobID = job.JobID
+		dl.SessionID = job.SessionID
+		dl.GCSPrefix = job.GCSPrefix
+		dl.MessageID = job.MessageID
+		dl.Step = job.Step
+		dl.ImportOperation = job.ImportOperation
+		dl.Attempts = job.Attempts
+		dl.Permanent = permanent
+		dl.Reason = reason
+		dl.LastError = runErr.Error()
+		dl.Status = DeadLetterOpen
+		dl.DeadLetteredAt = now
+
+		if err := tx.Set(jobRef, updates, firestore.MergeAll); err != nil {
+			return err
+		}
+		return tx.Set(dlRef, &dl)
+	})
+	if err != nil {
+		return "", fmt.Errorf("dead-letter ingest job (%s): %w", job.JobID, err)
+	}
+	log.Printf("FinishIngestJob: job %s dead-lettered (permanent=%v reason=%s attempts=%d): %v", job.JobID, permanent, reason, job.Attempts, runErr)
+	return IngestJobFailed, db.ReleasePendingBytes(ctx, job.SessionID)
+}
+
+// ListIngestDeadLetters returns dead letters, newest first, optionally
+// filtered by status.
+func (db *FirestoreDB) ListIngestDeadLetters(ctx context.Context, statusFilter string, limit int) ([]*IngestDeadLetter, error) {
+	q := db.client.Collection("ingest_dead_letters").Query
+	if statusFilter != "" {
+		q = q.Where("status", "==", statusFilter)
+	}
+	docs, err := q.OrderBy("dead_lettered_at", firestore.Desc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("list ingest dead letters: %w", err)
+	}
+	res := make([]*IngestDeadLetter, 0, len(docs))
+	for _, d := range docs {
+		var dl IngestDeadLetter
+		if err := d.DataTo(&dl); err != nil {
+			return nil, fmt.Errorf("decode ingest dead letter (%s): %w", d.Ref.ID, err)
+		}
+		res = append(res, &dl)
+	}
+	return res, nil
+}
+
+// GetIngestDeadLetter fetches a dead letter by job ID, or nil if none.
+func (db *FirestoreDB) GetIngestDeadLetter(ctx context.Context, jobID string) (*IngestDeadLetter, error) {
+	snap, err := db.client.Collection("ingest_dead_letters").Doc(jobID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get ingest dead letter (%s): %w", jobID, err)
+	}
+	var dl IngestDeadLetter
+	if err := snap.DataTo(&dl); err != nil {
+		return nil, fmt.Errorf("decode ingest dead letter (%s): %w", jobID, err)
+	}
+	return &dl, nil
+}
+
+// RequeueIngestJob puts a dead-lettered job back on the queue with a fresh
+// attempt budget. With restart the job starts over from validation;
+// otherwise it resumes after its last completed step.
+func (db *FirestoreDB) RequeueIngestJob(ctx context.Context, jobID, requeuedBy string, restart bool) error {
+	jobRef := db.client.Collection("ingest_jobs").Doc(jobID)
+	dlRef := db.client.Collection("ingest_dead_letters").Doc(jobID)
+	return db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(dlRef)
+		if err != nil {
+			return err
+		}
+		var dl IngestDeadLetter
+		if err := snap.DataTo(&dl); err != nil {
+			return err
+		}
+		if dl.Status != DeadLetterOpen {
+			return fmt.Errorf("dead letter %s is %s, not %s", jobID, dl.Status, DeadLetterOpen)
+		}
+
+		now := time.Now().UTC()
+		jobUpdates := map[string]interface{}{
+			"status":       IngestJobQueued,
+			"attempts":     0,
+			"available_at": now,
+			"updated_at":   now,
+		}
+		if restart {
+			jobUpdates["step"] = ""
+			jobUpdates["import_operation"] = ""
+		}
+		if err := tx.Set(jobRef, jobUpdates, firestore.MergeAll); err != nil {
+			return err
+		}
+		return tx.Set(dlRef, map[string]interface{}{
+			"status":      DeadLetterRequeued,
+			"requeues":    dl.Requeues + 1,
+			"requeued_by": requeuedBy,
+			"requeued_at": now,
+		}, firestore.MergeAll)
+	})
+}
+
+// ////////////////////////////////////////////////////////////////
+//
+//	Admin endpoints for failed ingests
+//
+// requireAdmin returns the caller's user ID if they may use admin endpoints
+// (listed in Config.AdminUserIDs, or using the dev bearer token), writing an
+// error response and returning false otherwise. The ID must come from a
+// verified Firebase ID token; X-User-Id is only honored with the dev bearer.
+func (h *Handlers) requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if h.devAuthOK(r) {
+		if userID := strings.TrimSpace(r.Header.Get("X-User-Id")); userID != "" {
+			return userID, true
+		}
+		return "dev", true
+	}
+	userID, err := h.verifiedUserIDFromRequest(r.Context(), r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthorized",
+		})
+		return "", false
+	}
+	for _, id := range h.Cfg.AdminUserIDs {
+		if id == userID {
+			return userID, true
+		}
+	}
+	writeJSON(w, http.StatusForbidden, map[string]interface{}{
+		"error": "forbidden",
+	})
+	return "", false
+}
+
+// AdminIngestDeadLettersHandler implements:
+//   - GET  /api/admin/ingest/dead-letters[?status=open|requeued]
+//   - GET  /api/admin/ingest/dead-letters/<job_id>
+//   - POST /api/admin/ingest/dead-letters/<job_id>/requeue  {"restart": false}
+func (h *Handlers) AdminIngestDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	const prefix = "/api/admin/ingest/dead-letters"
+	suffix := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	parts := strings.Split(suffix, "/")
+	ctx := r.Context()
+
+	switch {
+	case suffix == "" && r.Method == http.MethodGet:
+		statusFilter := strings.TrimSpace(r.URL.Query().Get("status"))
+		dls, err := h.DB.ListIngestDeadLetters(ctx, statusFilter, 100)
+		if err != nil {
+			log.Printf("AdminIngestDeadLetters ListIngestDeadLetters error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"error": "server_error",
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok":           true,
+			"dead_letters": dls,
+		})
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		h.handleAdminDeadLetterDetail(w, r, parts[0])
+
+	case len(parts) == 2 && parts[1] == "requeue" && r.Method == http.MethodPost:
+		var body struct {
+			Restart bool `json:"restart"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body) // optional body
+
+		dl, err := h.DB.GetIngestDeadLetter(ctx, parts[0])
+		if err != nil {
+			log.Printf("AdminIngestDeadLetters GetIngestDeadLetter error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"error": "server_error",
+			})
+			return
+		}
+		if dl == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "dead_letter_not_found"})
+			return
+		}
+		if dl.Status != DeadLetterOpen {
+			writeJSON(w, http.StatusConflict, map[string]interface{}{"error": "already_requeued"})
+			return
+		}
+		if err := h.DB.RequeueIngestJob(ctx, dl.JobID, adminID, body.Restart); err != nil {
+			log.Printf("AdminIngestDeadLetters RequeueIngestJob error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"error": "server_error",
+			})
+			return
+		}
+		if err := h.updateUploadSession(ctx, dl.SessionID, map[string]interface{}{
+			"status":        "uploaded",
+			"error_message": "",
+		}); err != nil {
+			log.Printf("AdminIngestDeadLetters updateUploadSession error: %v", err)
+		}
+		h.Ingest.Notify()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok":      true,
+			"job_id":  dl.JobID,
+			"restart": body.Restart,
+		})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// handleAdminDeadLetterDetail returns a dead letter with the job, the upload
+// session and the files that did not import, for diagnosis.
+func (h *Handlers) handleAdminDeadLetterDetail(w http.ResponseWriter, r *http.Request, jobID string) {
+	ctx := r.Context()
+	dl, err := h.DB.GetIngestDeadLetter(ctx, jobID)
+	if err != nil {
+		log.Printf("AdminIngestDeadLetters GetIngestDeadLetter error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	if dl == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "dead_letter_not_found"})
+		return
+	}
+
+	job, err := h.DB.GetIngestJob(ctx, jobID)
+	if err != nil {
+		log.Printf("AdminIngestDeadLetters GetIngestJob error: %v", err)
+	}
+	sess, err := h.DB.GetUploadSession(ctx, dl.SessionID)
+	if err != nil {
+		log.Printf("AdminIngestDeadLetters GetUploadSession error: %v", err)
+	}
+	files, err := h.DB.ListUploadFiles(ctx, dl.SessionID)
+	if err != nil {
+		log.Printf("AdminIngestDeadLetters ListUploadFiles error: %v", err)
+	}
+	failed := []*UploadFile{}
+	for _, f := range files {
+		if f.Outcome != UploadFileImported && f.Outcome != UploadFileDuplicate {
+			failed = append(failed, f)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":           true,
+		"dead_letter":  dl,
+		"job":          job,
+		"session":      sess,
+		"failed_files": failed,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyIngestError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantPermanent bool
+		wantReason    string
+	}{
+		{"permanent failure", permanentIngestError("no_valid_dicom", errors.New("x")), true, "no_valid_dicom"},
+		{"wrapped permanent failure", fmt.Errorf("ingest: %w", permanentIngestError("bad_message", errors.New("x"))), true, "bad_message"},
+		{"deadline", fmt.Errorf("wait: %w", context.DeadlineExceeded), false, "timeout"},
+		{"http 404", fmt.Errorf("get: %w", &googleapi.Error{Code: http.StatusNotFound}), true, "http_404"},
+		{"http 429", &googleapi.Error{Code: http.StatusTooManyRequests}, false, "http_429"},
+		{"http 503", &googleapi.Error{Code: http.StatusServiceUnavailable}, false, "http_503"},
+		{"rpc permission denied", status.Error(codes.PermissionDenied, "no"), true, "rpc_permissiondenied"},
+		{"rpc unavailable", fmt.Errorf("firestore: %w", status.Error(codes.Unavailable, "down")), false, "rpc_unavailable"},
+		{"plain error", errors.New("boom"), false, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			permanent, reason := classifyIngestError(tt.err)
+			if permanent != tt.wantPermanent || reason != tt.wantReason {
+				t.Errorf("classifyIngestError = (%v, %q), want (%v, %q)", permanent, reason, tt.wantPermanent, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestClassifyImportFailure(t *testing.T) {
+	importErr := errors.New("dicom import failed")
+	tests := []struct {
+		name          string
+		result        *ImportOperationResult
+		wantPermanent bool
+		wantReason    string
+	}{
+		{"no result", nil, false, "unknown"},
+		{"invalid argument", &ImportOperationResult{Code: 3}, true, "import_code_3"},
+		{"unavailable", &ImportOperationResult{Code: 14}, false, "import_code_14"},
+		{"unknown with rejected files", &ImportOperationResult{Code: 2, ErrorMessages: []string{"gs://b/x.dcm: bad"}}, true, "import_rejected_files"},
+		{"unknown without details", &ImportOperationResult{Code: 2}, false, "import_code_2"},
+		{"internal with rejected files", &ImportOperationResult{Code: 13, ErrorMessages: []string{"gs://b/x.dcm: bad"}}, false, "import_code_13"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyImportFailure(tt.result, importErr)
+			if !errors.Is(err, importErr) {
+				t.Fatalf("classified error %v does not wrap the import error", err)
+			}
+			permanent, reason := classifyIngestError(err)
+			if permanent != tt.wantPermanent || reason != tt.wantReason {
+				t.Errorf("classification = (%v, %q), want (%v, %q)", permanent, reason, tt.wantPermanent, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestRequireAdminIgnoresUserIDHeader(t *testing.T) {
+	h := &Handlers{Cfg: Config{AdminUserIDs: []string{"admin-1"}, DevBearer: "dev-secret"}}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/ingest/dead-letters", nil)
+	req.Header.Set("X-User-Id", "admin-1")
+	rec := httptest.NewRecorder()
+	if _, ok := h.requireAdmin(rec, req); ok {
+		t.Fatal("bare X-User-Id header was accepted as admin")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer dev-secret")
+	rec = httptest.NewRecorder()
+	if id, ok := h.requireAdmin(rec, req); !ok || id != "admin-1" {
+		t.Fatalf("dev bearer: id = %q, ok = %v", id, ok)
+	}
+}
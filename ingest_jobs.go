@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ingest job statuses.
+const (
+	IngestJobQueued    = "queued"
+	IngestJobRunning   = "running"
+	IngestJobSucceeded = "succeeded"
+	IngestJobFailed    = "failed"
+)
+
+// Ingest steps, in execution order. A job records the last step it
+// completed so a new attempt can skip ahead.
+const (
+	IngestStepValidated      = "validated"
+	IngestStepDeidentified   = "deidentified"
+	IngestStepImportStarted  = "import_started"
+	IngestStepImported       = "imported"
+	IngestStepStudiesCreated = "studies_created"
+)
+
+var ingestStepOrder = map[string]int{
+	"":                       0,
+	IngestStepValidated:      1,
+	IngestStepDeidentified:   2,
+	IngestStepImportStarted:  3,
+	IngestStepImported:       4,
+	IngestStepStudiesCreated: 5,
+}
+
+// IngestJob is the durable record of one ingest run, stored in the
+// ingest_jobs collection.
+type IngestJob struct {
+	JobID     string `firestore:"job_id" json:"job_id"`
+	SessionID string `firestore:"session_id" json:"session_id"`
+	GCSPrefix string `firestore:"gcs_prefix" json:"gcs_prefix"`
+	MessageID string `firestore:"message_id" json:"message_id"` // Pub/Sub message ID the job came from
+
+	Status   string `firestore:"status" json:"status"` // queued|running|succeeded|failed
+	Step     string `firestore:"step" json:"step"`     // last completed step
+	Attempts int    `firestore:"attempts" json:"attempts"`
+
+	// ImportOperation is the Healthcare LRO name, kept so a resumed attempt
+	// waits on the running import instead of starting another one.
+	ImportOperation string `firestore:"import_operation" json:"import_operation"`
+
+	LeaseOwner     string    `firestore:"lease_owner" json:"lease_owner"`
+	LeaseExpiresAt time.Time `firestore:"lease_expires_at" json:"lease_expires_at"`
+	HeartbeatAt    time.Time `firestore:"heartbeat_at" json:"heartbeat_at"`
+	AvailableAt    time.Time `firestore:"available_at" json:"available_at"` // earliest time a queued job may run
+
+	LastError string    `firestore:"last_error" json:"last_error"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// completed reports whether the job already finished step. A nil job (ingest
+// run without a job record) has completed nothing.
+func (j *IngestJob) completed(step string) bool {
+	if j == nil {
+		return false
+	}
+	return ingestStepOrder[j.Step] >= ingestStepOrder[step]
+}
+
+// claimable reports whether a worker may take the job at now: it is queued
+// and due, or running under a lease that has expired.
+func (j *IngestJob) claimable(now time.Time) bool {
+	switch j.Status {
+	case IngestJobQueued:
+		return !j.AvailableAt.After(now)
+	case IngestJobRunning:
+		return j.LeaseExpiresAt.Before(now)
+	}
+	return false
+}
+
+// message rebuilds the ingest message the job was created from.
+func (j *IngestJob) message() IngestMessage {
+	return IngestMessage{SessionID: j.SessionID, GCSPrefix: j.GCSPrefix}
+}
+
+// ingestRetryBackoff returns how long to wait before the next attempt.
+func ingestRetryBackoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < 30*time.Minute; i++ {
+		d *= 2
+	}
+	if d > 30*time.Minute {
+		d = 30 * time.Minute
+	}
+	return d
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: ingest_jobs
+//
+// EnqueueIngestJob records a queued job for msg. Jobs are keyed by session
+// and Pub/Sub message ID, so a redelivered message finds the existing job
+// instead of creating another; created is false in that case.
+func (db *FirestoreDB) EnqueueIngestJob(ctx context.Context, msg IngestMessage, messageID string) (job *IngestJob, created bool, err error) {
+	var jobID string
+	if messageID != "" {
+		jobID = deterministicTokenID("JOB", msg.SessionID, messageID)
+	} else {
+		if jobID, err = randomTokenID("JOB", 10); err != nil {
+			return nil, false, fmt.Errorf("randomTokenID for ingest job: %w", err)
+		}
+	}
+	now := time.Now().UTC()
+	job = &IngestJob{
+		JobID:       jobID,
+		SessionID:   msg.SessionID,
+		GCSPrefix:   msg.GCSPrefix,
+		MessageID:   messageID,
+		Status:      IngestJobQueued,
+		AvailableAt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := db.client.Collection("ingest_jobs").Doc(jobID).Create(ctx, job); err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.AlreadyExists {
+			existing, gerr := db.GetIngestJob(ctx, jobID)
+			if gerr != nil {
+				return nil, false, gerr
+			}
+			if existing != nil {
+				return existing, false, nil
+			}
+		}
+		return nil, false, fmt.Errorf("create ingest job (%s): %w", jobID, err)
+	}
+	return job, true, nil
+}
+
+// GetIngestJob fetches a job by ID, or nil if it does not exist.
+func (db *FirestoreDB) GetIngestJob(ctx context.Context, jobID string) (*IngestJob, error) {
+	snap, err := db.client.Collection("ingest_jobs").Doc(jobID).Get(ctx)
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get ingest job (%s): %w", jobID, err)
+	}
+	var job IngestJob
+	if err := snap.DataTo(&job); err != nil {
+		return nil, fmt.Errorf("decode ingest job (%s): %w", jobID, err)
+	}
+	return &job, nil
+}
+
+// ClaimIngestJob takes the oldest claimable job under a lease for owner.
+// It returns nil when nothing is due.
+//
+// Requires composite indexes on (status, available_at) and
+// (status, lease_expires_at).
+func (db *FirestoreDB) ClaimIngestJob(ctx context.Context, owner string, lease time.Duration) (*IngestJob, error) {
+	col := db.client.Collection("ingest_jobs")
+	now := time.Now().UTC()
+
+	queued, err := col.Where("status", "==", IngestJobQueued).
+		Where("available_at", "<=", now).
+		OrderBy("available_at", firestore.Asc).
+		Limit(10).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query queued ingest jobs: %w", err)
+	}
+	expired, err := col.Where("status", "==", IngestJobRunning).
+		Where("lease_expires_at", "<", now).
+		Limit(10).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query expired ingest jobs: %w", err)
+	}
+
+	// Jobs abandoned by a crashed worker go first; they have waited longest.
+	for _, cand := range append(expired, queued...) {
+		var claimed *IngestJob
+		err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			claimed = nil
+			snap, err := tx.Get(cand.Ref)
+			if err != nil {
+				return err
+			}
+			var job IngestJob
+			if err := snap.DataTo(&job); err != nil {
+				return err
+			}
+			now := time.Now().UTC()
+			if !job.claimable(now) {
+				return nil
+			}
+			job.Status = IngestJobRunning
+			job.Attempts++
+			job.LeaseOwner = owner
+			job.LeaseExpiresAt = now.Add(lease)
+			job.HeartbeatAt = now
+			job.UpdatedAt = now
+			claimed = &job
+			return tx.Set(cand.Ref, &job)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("claim ingest job (%s): %w", cand.Ref.ID, err)
+		}
+		if claimed != nil {
+			return claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+// RenewIngestJobLease extends the lease while owner still holds it. It
+// returns false if another worker has taken the job over.
+func (db *FirestoreDB) RenewIngestJobLease(ctx context.Context, jobID, owner string, lease time.Duration) (bool, error) {
+	ref := db.client.Collection("ingest_jobs").Doc(jobID)
+	held := false
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		held = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var job IngestJob
+		if err := snap.DataTo(&job); err != nil {
+			return err
+		}
+		if job.Status != IngestJobRunning || job.LeaseOwner != owner {
+			return nil
+		}
+		held = true
+		now := time.Now().UTC()
+		return tx.Update(ref, []firestore.Update{
+			{Path: "lease_expires_at", Value: now.Add(lease)},
+			{Path: "heartbeat_at", Value: now},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return false, fmt.Errorf("renew ingest job lease (%s): %w", jobID, err)
+	}
+	return held, nil
+}
+
+// CheckpointIngestJob records that job completed step, along with any extra
+// fields. A nil job is a no-op so the ingest flow can run without a job.
+func (db *FirestoreDB) CheckpointIngestJob(ctx context.Context, job *IngestJob, step string, extra map[string]interface{}) error {
+	if job == nil {
+		return nil
+	}
+	updates := map[string]interface{}{
+		"step":       step,
+		"updated_at": time.Now().UTC(),
+	}
+	for k, v := range extra {
+		updates[k] = v
+	}
+	if _, err := db.client.Collection("ingest_jobs").Doc(job.JobID).Set(ctx, updates, firestore.MergeAll); err != nil {
+		return fmt.Errorf("checkpoint ingest job (%s, %s): %w", job.JobID, step, err)
+	}
+	job.Step = step
+	if op, ok := extra["import_operation"].(string); ok {
+		job.ImportOperation = op
+	}
+	return nil
+}
+
+// ////////////////////////////////////////////////////////////////
+//
+//	Ingest worker pool
+//
+// IngestWorkerPool runs queued ingest jobs in this process. Several
+// instances (or processes) can share the same ingest_jobs collection; leases
+// make sure each job runs on one worker at a time.
+type IngestWorkerPool struct {
+	h           *Handlers
+	workers     int
+	maxAttempts int
+	owner       string
+	lease       time.Duration
+	poll        time.Duration
+	wake        chan struct{}
+}
+
+// NewIngestWorkerPool creates a pool of workers for h.
+func NewIngestWorkerPool(h *Handlers, workers, maxAttempts int) *IngestWorkerPool {
+	host, _ := os.Hostname()
+	suffix, err := randomTokenID("W", 6)
+	if err != nil {
+		suffix = fmt.Sprintf("W-%d", time.Now().UnixNano())
+	}
+	return &IngestWorkerPool{
+		h:           h,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		owner:       fmt.Sprintf("%s/%d/%s", host, os.Getpid(), suffix),
+		lease:       2 * time.Minute,
+		poll:        10 * time.Second,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes an idle worker, e.g. right after a job is enqueued. Safe to
+// call on a nil pool.
+func (p *IngestWorkerPool) Notify() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers and blocks until ctx is cancelled and they have
+// stopped.
+func (p *IngestWorkerPool) Run(ctx context.Context) {
+	log.Printf("IngestWorkerPool: starting %d workers as %s", p.workers, p.owner)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *IngestWorkerPool) loop(ctx context.Context) {
+	ticker := time.NewTicker(p.poll)
+	defer ticker.Stop()
+	for {
+		// Drain everything that is due before sleeping again.
+		for ctx.Err() == nil {
+			job, err := p.h.DB.ClaimIngestJob(ctx, p.owner, p.lease)
+			if err != nil {
+				log.Printf("IngestWorkerPool: ClaimIngestJob error: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			p.runJob(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// runJob executes one claimed job, heartbeating its lease until it finishes.
+func (p *IngestWorkerPool) runJob(ctx context.Context, job *IngestJob) {
+	log.Printf("IngestWorkerPool: running job %s session=%s attempt=%d step=%q", job.JobID, job.SessionID, job.Attempts, job.Step)
+
+	if job.Attempts > p.maxAttempts {
+		// A worker died while holding the job on its final attempt.
+		err := fmt.Errorf("giving up after %d attempts: %s", job.Attempts-1, job.LastError)
+		p.finish(ctx, job, err)
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		t := time.NewTicker(p.lease / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-t.C:
+				held, err := p.h.DB.RenewIngestJobLease(runCtx, job.JobID, p.owner, p.lease)
+				if err != nil {
+					log.Printf("IngestWorkerPool: heartbeat %s error: %v", job.JobID, err)
+					continue
+				}
+				if !held {
+					log.Printf("IngestWorkerPool: lost lease on job %s, stopping", job.JobID)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := p.h.handleIngestMessage(runCtx, job.message(), job)
+	if err != nil {
+		log.Printf("IngestWorkerPool: job %s attempt %d failed: %v", job.JobID, job.Attempts, err)
+	}
+	if runCtx.Err() != nil {
+		// Shutting down or lease lost: leave the job to whoever resumes it.
+		return
+	}
+	p.finish(ctx, job, err)
+}
+
+// finish records the attempt's outcome on the job and, for a failed attempt,
+// on the session: "retrying" while the job is re-queued, and "error" only
+// once it has been dead-lettered, since clients treat "error" as final.
+func (p *IngestWorkerPool) finish(ctx context.Context, job *IngestJob, runErr error) {
+	jobStatus, err := p.h.DB.FinishIngestJob(ctx, job, runErr, p.maxAttempts)
+	if err != nil {
+		log.Printf("IngestWorkerPool: FinishIngestJob(%s) error: %v", job.JobID, err)
+	}
+	if runErr == nil || jobStatus == "" {
+		return
+	}
+	sessStatus := "retrying"
+	if jobStatus == IngestJobFailed {
+		sessStatus = "error"
+	}
+	if err := p.h.updateUploadSession(ctx, job.SessionID, map[string]interface{}{
+		"status":        sessStatus,
+		"error_message": runErr.Error(),
+	}); err != nil {
+		log.Printf("IngestWorkerPool: updateUploadSession(%s, %s) error: %v", job.SessionID, sessStatus, err)
+	}
+}
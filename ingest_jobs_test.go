@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIngestJobCompleted(t *testing.T) {
+	var nilJob *IngestJob
+	if nilJob.completed(IngestStepValidated) {
+		t.Fatal("nil job should have completed nothing")
+	}
+
+	job := &IngestJob{Step: IngestStepImportStarted}
+	for step, want := range map[string]bool{
+		IngestStepValidated:      true,
+		IngestStepImportStarted:  true,
+		IngestStepImported:       false,
+		IngestStepStudiesCreated: false,
+	} {
+		if got := job.completed(step); got != want {
+			t.Errorf("completed(%q) = %v, want %v", step, got, want)
+		}
+	}
+}
+
+func TestIngestJobClaimable(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		job  IngestJob
+		want bool
+	}{
+		{"queued due", IngestJob{Status: IngestJobQueued, AvailableAt: now.Add(-time.Second)}, true},
+		{"queued backing off", IngestJob{Status: IngestJobQueued, AvailableAt: now.Add(time.Minute)}, false},
+		{"running leased", IngestJob{Status: IngestJobRunning, LeaseExpiresAt: now.Add(time.Minute)}, false},
+		{"running lease expired", IngestJob{Status: IngestJobRunning, LeaseExpiresAt: now.Add(-time.Minute)}, true},
+		{"succeeded", IngestJob{Status: IngestJobSucceeded}, false},
+		{"failed", IngestJob{Status: IngestJobFailed}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.job.claimable(now); got != tc.want {
+			t.Errorf("%s: claimable = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIngestRetryBackoff(t *testing.T) {
+	if got := ingestRetryBackoff(1); got != 30*time.Second {
+		t.Errorf("backoff(1) = %v", got)
+	}
+	if got := ingestRetryBackoff(3); got != 2*time.Minute {
+		t.Errorf("backoff(3) = %v", got)
+	}
+	if got := ingestRetryBackoff(20); got != 30*time.Minute {
+		t.Errorf("backoff(20) = %v", got)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// LandmarkPair is one anatomical point clicked in both studies, in each
+// study's patient coordinates (mm).
+type LandmarkPair struct {
+	Source [3]float64 `firestore:"source" json:"source"`
+	Target [3]float64 `firestore:"target" json:"target"`
+}
+
+// RegistrationResidual summarizes how well a transform maps the source
+// landmarks onto the target ones.
+type RegistrationResidual struct {
+	RMS       float64   `firestore:"rms" json:"rms"`
+	Max       float64   `firestore:"max" json:"max"`
+	PerPoint  []float64 `firestore:"per_point" json:"per_point"`
+	NumPoints int       `firestore:"num_points" json:"num_points"`
+}
+
+// Minimum landmark counts: a rigid fit has 6 degrees of freedom, an affine
+// fit 12, so it needs a fourth, non-coplanar point.
+const (
+	minRigidLandmarks  = 3
+	minAffineLandmarks = 4
+)
+
+// registerLandmarks fits a transform of the given kind mapping source
+// landmarks onto target landmarks in the least-squares sense.
+func registerLandmarks(kind string, pairs []LandmarkPair) (mat4, *RegistrationResidual, error) {
+	var m mat4
+	var err error
+	switch kind {
+	case FrameTransformRigid:
+		if len(pairs) < minRigidLandmarks {
+			return m, nil, fmt.Errorf("rigid registration needs at least %d landmarks", minRigidLandmarks)
+		}
+		m, err = fitRigid(pairs)
+	case FrameTransformAffine:
+		if len(pairs) < minAffineLandmarks {
+			return m, nil, fmt.Errorf("affine registration needs at least %d landmarks", minAffineLandmarks)
+		}
+		m, err = fitAffine(pairs)
+	default:
+		return m, nil, fmt.Errorf("kind must be %q or %q", FrameTransformRigid, FrameTransformAffine)
+	}
+	if err != nil {
+		return m, nil, err
+	}
+	return m, landmarkResidual(m, pairs), nil
+}
+
+func landmarkResidual(m mat4, pairs []LandmarkPair) *RegistrationResidual {
+	res := &RegistrationResidual{PerPoint: make([]float64, len(pairs)), NumPoints: len(pairs)}
+	var sum float64
+	for i, p := range pairs {
+		x, y, z := m.apply(p.Source[0], p.Source[1], p.Source[2])
+		d := math.Sqrt(sq(x-p.Target[0]) + sq(y-p.Target[1]) + sq(z-p.Target[2]))
+		res.PerPoint[i] = d
+		sum += d * d
+		if d > res.Max {
+			res.Max = d
+		}
+	}
+	if len(pairs) > 0 {
+		res.RMS = math.Sqrt(sum / float64(len(pairs)))
+	}
+	return res
+}
+
+func sq(v float64) float64 { return v * v }
+
+// centroids returns the mean source and target landmark.
+func centroids(pairs []LandmarkPair) (cs, ct [3]float64) {
+	for _, p := range pairs {
+		for k := 0; k < 3; k++ {
+			cs[k] += p.Source[k]
+			ct[k] += p.Target[k]
+		}
+	}
+	n := float64(len(pairs))
+	for k := 0; k < 3; k++ {
+		cs[k] /= n
+		ct[k] /= n
+	}
+	return cs, ct
+}
+
+// fitRigid solves the Kabsch problem with Horn's closed-form quaternion
+// method: the optimal rotation is the eigenvector of the largest eigenvalue
+// of a symmetric 4x4 built from the cross-covariance, which is always a
+// proper rotation (no reflection fix-up needed).
+func fitRigid(pairs []LandmarkPair) (mat4, error) {
+	if collinear(pairs) {
+		return mat4{}, fmt.Errorf("landmarks are collinear; rotation is undetermined")
+	}
+	cs, ct := centroids(pairs)
+
+	// S[i][j] = Σ (s-cs)_i (t-ct)_j
+	var s [3][3]float64
+	for _, p := range pairs {
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				s[i][j] += (p.Source[i] - cs[i]) * (p.Target[j] - ct[j])
+			}
+		}
+	}
+	sxx, sxy, sxz := s[0][0], s[0][1], s[0][2]
+	syx, syy, syz := s[1][0], s[1][1], s[1][2]
+	szx, szy, szz := s[2][0], s[2][1], s[2][2]
+	n := [4][4]float64{
+		{sxx + syy + szz, syz - szy, szx - sxz, sxy - syx},
+		{syz - szy, sxx - syy - szz, sxy + syx, szx + sxz},
+		{szx - sxz, sxy + syx, -sxx + syy - szz, syz + szy},
+		{sxy - syx, szx + sxz, syz + szy, -sxx - syy + szz},
+	}
+	vals, vecs := symEigen4(n)
+	best := 0
+	for i := 1; i < 4; i++ {
+		if vals[i] > vals[best] {
+			best = i
+		}
+	}
+	w, x, y, z := vecs[0][best], vecs[1][best], vecs[2][best], vecs[3][best]
+
+	r := [3][3]float64{
+		{w*w + x*x - y*y - z*z, 2 * (x*y - w*z), 2 * (x*z + w*y)},
+		{2 * (x*y + w*z), w*w - x*x + y*y - z*z, 2 * (y*z - w*x)},
+		{2 * (x*z - w*y), 2 * (y*z + w*x), w*w - x*x - y*y + z*z},
+	}
+	m := identityMat4()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i*4+j] = r[i][j]
+		}
+		m[i*4+3] = ct[i] - (r[i][0]*cs[0] + r[i][1]*cs[1] + r[i][2]*cs[2])
+	}
+	return m, nil
+}
+
+// collinear reports whether all source (or all target) landmarks lie on a
+// line, within 1 mm.
+func collinear(pairs []LandmarkPair) bool {
+	check := func(pt func(LandmarkPair) [3]float64) bool {
+		a := pt(pairs[0])
+		var dir [3]float64
+		var found bool
+		for _, p := range pairs[1:] {
+			b := pt(p)
+			d := [3]float64{b[0] - a[0], b[1] - a[1], b[2] - a[2]}
+			if l := math.Sqrt(sq(d[0]) + sq(d[1]) + sq(d[2])); l > 1 {
+				dir = [3]float64{d[0] / l, d[1] / l, d[2] / l}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true
+		}
+		for _, p := range pairs {
+			b := pt(p)
+			v := [3]float64{b[0] - a[0], b[1] - a[1], b[2] - a[2]}
+			c := [3]float64{
+				v[1]*dir[2] - v[2]*dir[1],
+				v[2]*dir[0] - v[0]*dir[2],
+				v[0]*dir[1] - v[1]*dir[0],
+			}
+			if math.Sqrt(sq(c[0])+sq(c[1])+sq(c[2])) > 1 {
+				return false
+			}
+		}
+		return true
+	}
+	return check(func(p LandmarkPair) [3]float64 { return p.Source }) ||
+		check(func(p LandmarkPair) [3]float64 { return p.Target })
+}
+
+// fitAffine solves the normal equations for each output coordinate: with
+// rows [x y z 1] of the source landmarks, (AᵀA)·p = Aᵀb.
+func fitAffine(pairs []LandmarkPair) (mat4, error) {
+	var ata [4][4]float64
+	var atb [3][4]float64
+	for _, p := range pairs {
+		row := [4]float64{p.Source[0], p.Source[1], p.Source[2], 1}
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				ata[i][j] += row[i] * row[j]
+			}
+			for k := 0; k < 3; k++ {
+				atb[k][i] += row[i] * p.Target[k]
+			}
+		}
+	}
+	m := identityMat4()
+	for k := 0; k < 3; k++ {
+		sol, ok := solve4(ata, atb[k])
+		if !ok {
+			return mat4{}, fmt.Errorf("landmarks are coplanar; affine transform is undetermined")
+		}
+		copy(m[k*4:k*4+4], sol[:])
+	}
+	return m, nil
+}
+
+// solve4 solves a 4x4 linear system by Gaussian elimination with partial
+// pivoting. Pivots are compared relative to the matrix scale so millimetre
+// coordinates do not trip a fixed threshold.
+func solve4(a [4][4]float64, b [4]float64) ([4]float64, bool) {
+	var scale float64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			scale = math.Max(scale, math.Abs(a[i][j]))
+		}
+	}
+	for col := 0; col < 4; col++ {
+		piv := col
+		for r := col + 1; r < 4; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[piv][col]) {
+				piv = r
+			}
+		}
+		if math.Abs(a[piv][col]) <= 1e-10*scale {
+			return [4]float64{}, false
+		}
+		a[col], a[piv] = a[piv], a[col]
+		b[col], b[piv] = b[piv], b[col]
+		for r := col + 1; r < 4; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c < 4; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	var x [4]float64
+	for r := 3; r >= 0; r-- {
+		s := b[r]
+		for c := r + 1; c < 4; c++ {
+			s -= a[r][c] * x[c]
+		}
+		x[r] = s / a[r][r]
+	}
+	return x, true
+}
+
+// symEigen4 diagonalizes a symmetric 4x4 matrix with cyclic Jacobi
+// rotations. Column i of vecs is the eigenvector of vals[i].
+func symEigen4(a [4][4]float64) (vals [4]float64, vecs [4][4]float64) {
+	for i := 0; i < 4; i++ {
+		vecs[i][i] = 1
+	}
+	for sweep := 0; sweep < 50; sweep++ {
+		var off float64
+		for p := 0; p < 4; p++ {
+			for q := p + 1; q < 4; q++ {
+				off += a[p][q] * a[p][q]
+			}
+		}
+		if off < 1e-22 {
+			break
+		}
+		for p := 0; p < 4; p++ {
+			for q := p + 1; q < 4; q++ {
+				if math.Abs(a[p][q]) < 1e-300 {
+					continue
+				}
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < 4; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p] = c*akp - s*akq
+					a[k][q] = s*akp + c*akq
+				}
+				for k := 0; k < 4; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k] = c*apk - s*aqk
+					a[q][k] = s*apk + c*aqk
+				}
+				for k := 0; k < 4; k++ {
+					vkp, vkq := vecs[k][p], vecs[k][q]
+					vecs[k][p] = c*vkp - s*vkq
+					vecs[k][q] = s*vkp + c*vkq
+				}
+			}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		vals[i] = a[i][i]
+	}
+	return vals, vecs
+}
+
+// dominantFrameOfReference returns the FrameOfReferenceUID shared by most of
+// a study's cataloged instances.
+func dominantFrameOfReference(instances []*ImagingInstance) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, in := range instances {
+		if in.FrameOfReferenceUID == "" {
+			continue
+		}
+		counts[in.FrameOfReferenceUID]++
+		n := counts[in.FrameOfReferenceUID]
+		if n > counts[best] || (n == counts[best] && in.FrameOfReferenceUID < best) {
+			best = in.FrameOfReferenceUID
+		}
+	}
+	return best
+}
+
+// ////////////////////////////////////////////////////
+//
+//	ENDPOINT: /api/imaging/longitudinal/register
+//
+// LongitudinalRegisterHandler implements POST /api/imaging/longitudinal/register.
+// Body:
+//
+//	{
+//	  "sourceStudyId": "STUDY-A",
+//	  "targetStudyId": "STUDY-B",
+//	  "kind": "rigid",                       // or "affine"
+//	  "sourceFrameOfReferenceUid": "1.2.3",  // optional, defaults to the study's main frame
+//	  "targetFrameOfReferenceUid": "1.2.4",  // optional
+//	  "landmarks": [{"source": [x,y,z], "target": [x,y,z]}, ...]
+//	}
+//
+// The fitted transform maps source patient coordinates to target ones and is
+// stored in frame_transforms, where resolve-point picks it up.
+func (h *Handlers) LongitudinalRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	callerID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("LongitudinalRegisterHandler getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+		return
+	}
+
+	var body struct {
+		SourceStudyID string         `json:"sourceStudyId"`
+		TargetStudyID string         `json:"targetStudyId"`
+		Kind          string         `json:"kind"`
+		SourceFoRUID  string         `json:"sourceFrameOfReferenceUid"`
+		TargetFoRUID  string         `json:"targetFrameOfReferenceUid"`
+		Landmarks     []LandmarkPair `json:"landmarks"`
+		Description   string         `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_json"})
+		return
+	}
+	if body.Kind == "" {
+		body.Kind = FrameTransformRigid
+	}
+	if strings.TrimSpace(body.SourceStudyID) == "" || strings.TrimSpace(body.TargetStudyID) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "sourceStudyId and targetStudyId required"})
+		return
+	}
+
+	// Source and target may be the same study (e.g. two series in different
+	// frames), so each side resolves into its own variable.
+	var sourceFoR, targetFoR string
+	for _, side := range []struct {
+		studyID, forUID string
+		out             *string
+	}{
+		{body.SourceStudyID, body.SourceFoRUID, &sourceFoR},
+		{body.TargetStudyID, body.TargetFoRUID, &targetFoR},
+	} {
+		study, err := h.DB.GetImagingStudy(ctx, side.studyID)
+		if err != nil {
+			log.Printf("LongitudinalRegisterHandler GetImagingStudy(%s) error: %v", side.studyID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+			return
+		}
+		if study == nil || study.UserID != callerID {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "study_not_found", "study_id": side.studyID})
+			return
+		}
+		forUID := strings.TrimSpace(side.forUID)
+		if forUID == "" {
+			instances, err := h.studyImagingInstances(ctx, study)
+			if err != nil {
+				log.Printf("LongitudinalRegisterHandler studyImagingInstances(%s) error: %v", study.StudyID, err)
+				writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+				return
+			}
+			forUID = dominantFrameOfReference(instances)
+		}
+		if forUID == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "frame_of_reference_unknown", "study_id": side.studyID})
+			return
+		}
+		*side.out = forUID
+	}
+
+	m, residual, err := registerLandmarks(body.Kind, body.Landmarks)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "registration_failed", "details": err.Error()})
+		return
+	}
+
+	t := &FrameTransform{
+		PatientUserID: callerID,
+		SourceFoRUID:  sourceFoR,
+		TargetFoRUID:  targetFoR,
+		Kind:          body.Kind,
+		Matrix:        m[:],
+		Description:   body.Description,
+		CreatedBy:     callerID,
+		Method:        FrameTransformMethodLandmarks,
+		SourceStudyID: body.SourceStudyID,
+		TargetStudyID: body.TargetStudyID,
+		Landmarks:     body.Landmarks,
+		Residual:      residual,
+	}
+	if err := validateFrameTransform(t); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_transform", "details": err.Error()})
+		return
+	}
+	if err := h.DB.CreateFrameTransform(ctx, t); err != nil {
+		log.Printf("LongitudinalRegisterHandler CreateFrameTransform error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"ok":        true,
+		"transform": t,
+		"residual":  residual,
+	})
+}
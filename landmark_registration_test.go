@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// applyToPairs builds landmark pairs whose targets are m applied to sources.
+func applyToPairs(m mat4, sources [][3]float64) []LandmarkPair {
+	pairs := make([]LandmarkPair, len(sources))
+	for i, s := range sources {
+		x, y, z := m.apply(s[0], s[1], s[2])
+		pairs[i] = LandmarkPair{Source: s, Target: [3]float64{x, y, z}}
+	}
+	return pairs
+}
+
+var testLandmarks = [][3]float64{
+	{0, 0, 0}, {100, 0, 0}, {0, 80, 0}, {0, 0, 60}, {40, 30, 20},
+}
+
+func TestRegisterLandmarksRigid(t *testing.T) {
+	// 25° about an oblique axis plus a translation.
+	rot, _ := mat4FromSlice(rigidZ(25, 12, -7, 30))
+	tilt, _ := mat4FromSlice([]float64{1, 0, 0, 0, 0, math.Cos(0.3), -math.Sin(0.3), 0, 0, math.Sin(0.3), math.Cos(0.3), 0, 0, 0, 0, 1})
+	want := tilt.mul(rot)
+
+	m, res, err := registerLandmarks(FrameTransformRigid, applyToPairs(want, testLandmarks[:3]))
+	if err != nil {
+		t.Fatalf("registerLandmarks: %v", err)
+	}
+	for i := range m {
+		if math.Abs(m[i]-want[i]) > 1e-6 {
+			t.Fatalf("matrix = %v, want %v", m, want)
+		}
+	}
+	if res.RMS > 1e-6 || res.NumPoints != 3 {
+		t.Errorf("residual = %+v, want ~0 over 3 points", res)
+	}
+	if err := validateFrameTransform(&FrameTransform{SourceFoRUID: "A", TargetFoRUID: "B", Kind: FrameTransformRigid, Matrix: m[:]}); err != nil {
+		t.Errorf("fitted rigid transform fails validation: %v", err)
+	}
+}
+
+func TestRegisterLandmarksRigidNoisyResidual(t *testing.T) {
+	want, _ := mat4FromSlice(rigidZ(10, 5, 5, 5))
+	pairs := applyToPairs(want, testLandmarks)
+	pairs[4].Target[0] += 2 // one misplaced click
+
+	_, res, err := registerLandmarks(FrameTransformRigid, pairs)
+	if err != nil {
+		t.Fatalf("registerLandmarks: %v", err)
+	}
+	if res.RMS <= 0 || res.Max < res.RMS || len(res.PerPoint) != 5 {
+		t.Errorf("residual = %+v", res)
+	}
+	if res.Max > 2 {
+		t.Errorf("max residual %g exceeds the injected error", res.Max)
+	}
+}
+
+func TestRegisterLandmarksAffine(t *testing.T) {
+	want, _ := mat4FromSlice([]float64{1.1, 0.05, 0, 3, -0.02, 0.95, 0.1, -4, 0, 0, 1.2, 8, 0, 0, 0, 1})
+	m, res, err := registerLandmarks(FrameTransformAffine, applyToPairs(want, testLandmarks))
+	if err != nil {
+		t.Fatalf("registerLandmarks: %v", err)
+	}
+	for i := range m {
+		if math.Abs(m[i]-want[i]) > 1e-6 {
+			t.Fatalf("matrix = %v, want %v", m, want)
+		}
+	}
+	if res.RMS > 1e-6 {
+		t.Errorf("residual RMS = %g", res.RMS)
+	}
+}
+
+func TestRegisterLandmarksRejectsDegenerate(t *testing.T) {
+	id := identityMat4()
+	cases := map[string]struct {
+		kind    string
+		sources [][3]float64
+	}{
+		"too few rigid":   {FrameTransformRigid, testLandmarks[:2]},
+		"too few affine":  {FrameTransformAffine, testLandmarks[:3]},
+		"collinear":       {FrameTransformRigid, [][3]float64{{0, 0, 0}, {10, 0, 0}, {20, 0, 0}}},
+		"coplanar affine": {FrameTransformAffine, [][3]float64{{0, 0, 0}, {10, 0, 0}, {0, 10, 0}, {10, 10, 0}}},
+		"unknown kind":    {"elastic", testLandmarks},
+	}
+	for name, c := range cases {
+		if _, _, err := registerLandmarks(c.kind, applyToPairs(id, c.sources)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestDominantFrameOfReference(t *testing.T) {
+	instances := []*ImagingInstance{
+		{FrameOfReferenceUID: "1.2"}, {FrameOfReferenceUID: "1.3"}, {FrameOfReferenceUID: "1.3"}, {},
+	}
+	if got := dominantFrameOfReference(instances); got != "1.3" {
+		t.Errorf("dominantFrameOfReference = %q, want 1.3", got)
+	}
+	if got := dominantFrameOfReference(nil); got != "" {
+		t.Errorf("dominantFrameOfReference(nil) = %q", got)
+	}
+}
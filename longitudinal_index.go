@@ -2,20 +2,24 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"math"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"cloud.google.com/go/firestore"
+
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 // Collection name: e.g. imaging_slice_index.
 //
-// Key strategy: let Firestore auto‑ID; query by study_id / frame_of_reference_uid later.
+// Key strategy: one document per study, SOP instance and frame (see
+// indexedSliceDocID); query by study_id / frame_of_reference_uid.
 type IndexedSlice struct {
 	// Ownership / grouping
 	StudyID           string `firestore:"study_id" json:"study_id"`               // ImagingStudy.StudyID
@@ -24,31 +28,194 @@ type IndexedSlice struct {
 	SeriesInstanceUID string `firestore:"series_instance_uid" json:"series_instance_uid"`
 	SOPInstanceUID    string `firestore:"sop_instance_uid" json:"sop_instance_uid"`
 	InstanceNumber    int    `firestore:"instance_number" json:"instance_number"`
+	FrameNumber       int    `firestore:"frame_number" json:"frame_number"` // 1-based
 
 	FrameOfReferenceUID string `firestore:"frame_of_reference_uid" json:"frame_of_reference_uid"`
 
-	// Geometry
-	IPPX, IPPY, IPPZ          float64 `firestore:"ipp_x" json:"ipp_x"`
-	RowDirX, RowDirY, RowDirZ float64 `firestore:"row_dir_x" json:"row_dir_x"`
-	ColDirX, ColDirY, ColDirZ float64 `firestore:"col_dir_x" json:"col_dir_x"`
-	RowSpacing, ColSpacing    float64 `firestore:"row_spacing" json:"row_spacing"`
+	// Geometry. Each component needs its own tag: a tag on a multi-name
+	// field applies to every name, which Firestore rejects as duplicates.
+	IPPX       float64 `firestore:"ipp_x" json:"ipp_x"`
+	IPPY       float64 `firestore:"ipp_y" json:"ipp_y"`
+	IPPZ       float64 `firestore:"ipp_z" json:"ipp_z"`
+	RowDirX    float64 `firestore:"row_dir_x" json:"row_dir_x"`
+	RowDirY    float64 `firestore:"row_dir_y" json:"row_dir_y"`
+	RowDirZ    float64 `firestore:"row_dir_z" json:"row_dir_z"`
+	ColDirX    float64 `firestore:"col_dir_x" json:"col_dir_x"`
+	ColDirY    float64 `firestore:"col_dir_y" json:"col_dir_y"`
+	ColDirZ    float64 `firestore:"col_dir_z" json:"col_dir_z"`
+	RowSpacing float64 `firestore:"row_spacing" json:"row_spacing"`
+	ColSpacing float64 `firestore:"col_spacing" json:"col_spacing"`
+
+	// Series details, for per-series results and filters in resolve-point.
+	Modality          string `firestore:"modality" json:"modality"`
+	SeriesNumber      int    `firestore:"series_number" json:"series_number"`
+	SeriesDescription string `firestore:"series_description" json:"series_description"`
+
+	// Image extent, for bounds checks in resolve-point. Zero on slices
+	// indexed before these were recorded.
+	Rows           int     `firestore:"rows" json:"rows"`
+	Columns        int     `firestore:"columns" json:"columns"`
+	SliceThickness float64 `firestore:"slice_thickness" json:"slice_thickness"`
 
 	// Precomputed plane: normal · x = d
-	NormalX, NormalY, NormalZ float64 `firestore:"normal_x" json:"normal_x"`
-	PlaneD                    float64 `firestore:"plane_d" json:"plane_d"`
+	NormalX float64 `firestore:"normal_x" json:"normal_x"`
+	NormalY float64 `firestore:"normal_y" json:"normal_y"`
+	NormalZ float64 `firestore:"normal_z" json:"normal_z"`
+	PlaneD  float64 `firestore:"plane_d" json:"plane_d"`
 
 	StudyDate       string    `firestore:"study_date" json:"study_date"`
 	AcquisitionTime string    `firestore:"acquisition_time" json:"acquisition_time"`
 	CreatedAt       time.Time `firestore:"created_at" json:"created_at"`
+
+	// Index versioning, see SaveIndexedSlicesForStudy: the version that
+	// wrote the slice, the version that dropped it (0 while live) and, while
+	// a rewrite is unpublished, the content older readers still see.
+	IndexVersion   int64         `firestore:"index_version" json:"index_version"`
+	RetiredVersion int64         `firestore:"retired_version" json:"-"`
+	Previous       *IndexedSlice `firestore:"previous,omitempty" json:"-"`
 }
 
 // collection logitudinal_index_status
 type LongitudinalIndexStatus struct {
 	StudyID       string    `firestore:"study_id" json:"study_id"`
 	PatientUserID string    `firestore:"patient_user_id" json:"patient_user_id"`
-	Status        string    `firestore:"status" json:"status"` // "not_indexed" | "indexing" | "indexed" | "error"
+	Status        string    `firestore:"status" json:"status"` // "not_indexed" | "queued" | "indexing" | "indexed" | "error" | "cancelled"
 	LastError     string    `firestore:"last_error" json:"last_error"`
 	UpdatedAt     time.Time `firestore:"updated_at" json:"updated_at"`
+
+	// Progress of the current (or last) index job.
+	JobID              string    `firestore:"job_id" json:"job_id"`
+	Attempts           int       `firestore:"attempts" json:"attempts"`
+	InstancesProcessed int       `firestore:"instances_processed" json:"instances_processed"`
+	InstancesTotal     int       `firestore:"instances_total" json:"instances_total"`
+	StartedAt          time.Time `firestore:"started_at" json:"started_at"`
+	FinishedAt         time.Time `firestore:"finished_at" json:"finished_at"`
+	DurationMS         int64     `firestore:"duration_ms" json:"duration_ms"`
+
+	// The index currently served: slice count and a version bumped by every
+	// successful rebuild.
+	SlicesIndexed int   `firestore:"slices_indexed" json:"slices_indexed"`
+	IndexVersion  int64 `firestore:"index_version" json:"index_version"`
+}
+
+// sliceFrameNumber returns the 1-based frame of the instance a slice shows;
+// slices indexed before frames were recorded are single-frame.
+func sliceFrameNumber(s *IndexedSlice) int {
+	if s.FrameNumber < 1 {
+		return 1
+	}
+	return s.FrameNumber
+}
+
+// sliceFramesURL returns the frames endpoint that renders a slice.
+func sliceFramesURL(studyID string, s *IndexedSlice) string {
+	return fmt.Sprintf("/api/imaging/studies/%s/dicom/series/%s/instances/%s/frames/%d",
+		url.PathEscape(studyID), url.PathEscape(s.SeriesInstanceUID), url.PathEscape(s.SOPInstanceUID), sliceFrameNumber(s))
+}
+
+// indexedSliceDocID keys a slice document by study, SOP instance and frame,
+// so rebuilding an unchanged instance rewrites the same document.
+func indexedSliceDocID(s *IndexedSlice) string {
+	return deterministicTokenID("SLICE", s.StudyID, s.SOPInstanceUID, strconv.Itoa(s.FrameNumber))
+}
+
+// visibleAt returns the content of a slice document that readers of index
+// version v see, or nil if the slice is not part of that version.
+func (s *IndexedSlice) visibleAt(v int64) *IndexedSlice {
+	if s.RetiredVersion != 0 && s.RetiredVersion <= v {
+		return nil
+	}
+	if s.IndexVersion <= v {
+		return s
+	}
+	if s.Previous != nil && s.Previous.IndexVersion <= v {
+		return s.Previous
+	}
+	return nil
+}
+
+// clean reports whether the document carries nothing but its live content.
+func (s *IndexedSlice) clean() bool {
+	return s.RetiredVersion == 0 && s.Previous == nil
+}
+
+// sameSliceContent compares two slices ignoring version stamps.
+func sameSliceContent(a, b *IndexedSlice) bool {
+	x, y := *a, *b
+	x.IndexVersion, x.RetiredVersion, x.Previous, x.CreatedAt = 0, 0, nil, time.Time{}
+	y.IndexVersion, y.RetiredVersion, y.Previous, y.CreatedAt = 0, 0, nil, time.Time{}
+	return x == y
+}
+
+// planSliceIndexWrite diffs a rebuilt index against a study's existing slice
+// documents (by document ID) and returns the documents to write and delete
+// so that version next can be published while readers of served still see
+// their own index:
+//
+//   - unchanged slices are left alone;
+//   - new and changed slices are stamped next, and changed ones keep the
+//     served content in Previous;
+//   - dropped slices are retired at next rather than deleted;
+//   - documents served cannot see (left by a failed build) are deleted.
+func planSliceIndexWrite(existing map[string]*IndexedSlice, slices []*IndexedSlice, served, next int64) (map[string]*IndexedSlice, []string) {
+	sets := make(map[string]*IndexedSlice)
+	fresh := make(map[string]bool, len(slices))
+	for _, s := range slices {
+		id := indexedSliceDocID(s)
+		fresh[id] = true
+		var visible *IndexedSlice
+		if old := existing[id]; old != nil {
+			visible = old.visibleAt(served)
+			if visible == old && old.clean() && sameSliceContent(old, s) {
+				continue
+			}
+		}
+		doc := *s
+		doc.IndexVersion, doc.RetiredVersion, doc.Previous = next, 0, nil
+		if visible != nil {
+			prev := *visible
+			prev.RetiredVersion, prev.Previous = 0, nil
+			doc.Previous = &prev
+		}
+		sets[id] = &doc
+	}
+
+	var deletes []string
+	for id, old := range existing {
+		if fresh[id] {
+			continue
+		}
+		visible := old.visibleAt(served)
+		if visible == nil {
+			deletes = append(deletes, id)
+			continue
+		}
+		if visible == old && old.RetiredVersion == next && old.Previous == nil {
+			continue
+		}
+		doc := *visible
+		doc.RetiredVersion, doc.Previous = next, nil
+		sets[id] = &doc
+	}
+	sort.Strings(deletes)
+	return sets, deletes
+}
+
+// planSliceIndexPrune returns, once version v is published, the retired
+// documents to delete and the documents whose Previous content no reader
+// needs any more.
+func planSliceIndexPrune(existing map[string]*IndexedSlice, v int64) (clear, deletes []string) {
+	for id, s := range existing {
+		switch {
+		case s.RetiredVersion != 0 && s.RetiredVersion <= v:
+			deletes = append(deletes, id)
+		case s.Previous != nil && s.IndexVersion <= v:
+			clear = append(clear, id)
+		}
+	}
+	sort.Strings(clear)
+	sort.Strings(deletes)
+	return clear, deletes
 }
 
 // ////////////////////////////////////
@@ -56,54 +223,197 @@ type LongitudinalIndexStatus struct {
 //	Extending FirestoreDB
 //
 //	 Save indexed slices - table: imaging_slice_index
+//
+// SaveIndexedSlicesForStudy writes a rebuilt index for a study as index
+// version, which must be one above the version currently served (see
+// LongitudinalIndexStatus.IndexVersion). Only the difference to the stored
+// documents is written, and nothing becomes visible to readers until the
+// status is moved to version; PruneIndexedSlicesForStudy then removes what
+// the old version needed.
 func (db *FirestoreDB) SaveIndexedSlicesForStudy(
 	ctx context.Context,
 	studyID string,
+	version int64,
 	slices []*IndexedSlice,
 ) error {
 	if studyID == "" {
 		return fmt.Errorf("empty studyID")
 	}
-	// For simplicity, delete existing index for this study then write new docs.
-	// You can optimize later.
-	col := db.client.Collection("imaging_slice_index")
-	// Delete old docs
-	q := col.Where("study_id", "==", studyID)
-	docs, err := q.Documents(ctx).GetAll()
+	existing, err := db.indexedSliceDocs(ctx, studyID)
 	if err != nil {
-		return fmt.Errorf("query existing index: %w", err)
+		return err
 	}
-	batch := db.client.Batch()
-	for _, d := range docs {
-		batch.Delete(d.Ref)
+	sets, deletes := planSliceIndexWrite(existing, slices, version-1, version)
+
+	ids := make([]string, 0, len(sets))
+	for id := range sets {
+		ids = append(ids, id)
 	}
-	if _, err := batch.Commit(ctx); err != nil {
-		return fmt.Errorf("delete old index: %w", err)
+	sort.Strings(ids)
+
+	col := db.client.Collection("imaging_slice_index")
+	const batchSize = 400
+	for i := 0; i < len(ids); i += batchSize {
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		b := db.client.Batch()
+		for _, id := range ids[i:end] {
+			b.Set(col.Doc(id), sets[id])
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("write index batch: %w", err)
+		}
 	}
+	for i := 0; i < len(deletes); i += batchSize {
+		end := i + batchSize
+		if end > len(deletes) {
+			end = len(deletes)
+		}
+		b := db.client.Batch()
+		for _, id := range deletes[i:end] {
+			b.Delete(col.Doc(id))
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("delete stale index batch: %w", err)
+		}
+	}
+	return nil
+}
 
-	if len(slices) == 0 {
-		return nil
+// PruneIndexedSlicesForStudy is called once version is published: it drops
+// the cached index and removes slices retired by version along with the
+// Previous content kept for readers of the version before.
+func (db *FirestoreDB) PruneIndexedSlicesForStudy(ctx context.Context, studyID string, version int64) error {
+	db.sliceIndex.invalidate(studyID)
+
+	existing, err := db.indexedSliceDocs(ctx, studyID)
+	if err != nil {
+		return err
 	}
+	clear, deletes := planSliceIndexPrune(existing, version)
 
-	// Write new docs in batches of ~400‑500 to avoid Firestore limits.
+	col := db.client.Collection("imaging_slice_index")
 	const batchSize = 400
-	for i := 0; i < len(slices); i += batchSize {
+	for i := 0; i < len(clear); i += batchSize {
 		end := i + batchSize
-		if end > len(slices) {
-			end = len(slices)
+		if end > len(clear) {
+			end = len(clear)
 		}
 		b := db.client.Batch()
-		for _, s := range slices[i:end] {
-			ref := col.NewDoc()
-			b.Set(ref, s)
+		for _, id := range clear[i:end] {
+			b.Update(col.Doc(id), []firestore.Update{{Path: "previous", Value: firestore.Delete}})
 		}
 		if _, err := b.Commit(ctx); err != nil {
-			return fmt.Errorf("write index batch: %w", err)
+			return fmt.Errorf("prune index batch: %w", err)
+		}
+	}
+	for i := 0; i < len(deletes); i += batchSize {
+		end := i + batchSize
+		if end > len(deletes) {
+			end = len(deletes)
+		}
+		b := db.client.Batch()
+		for _, id := range deletes[i:end] {
+			b.Delete(col.Doc(id))
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("delete retired index batch: %w", err)
 		}
 	}
 	return nil
 }
 
+// indexedSliceDocs returns every slice document of a study, whatever its
+// version, by document ID.
+func (db *FirestoreDB) indexedSliceDocs(ctx context.Context, studyID string) (map[string]*IndexedSlice, error) {
+	docs, err := db.client.Collection("imaging_slice_index").
+		Where("study_id", "==", studyID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query existing index: %w", err)
+	}
+	res := make(map[string]*IndexedSlice, len(docs))
+	for _, d := range docs {
+		var s IndexedSlice
+		if err := d.DataTo(&s); err != nil {
+			return nil, fmt.Errorf("decode indexed slice (%s): %w", d.Ref.ID, err)
+		}
+		res[d.Ref.ID] = &s
+	}
+	return res, nil
+}
+
+// LongitudinalIndexVersion returns the index version served for a study,
+// 0 if it has no status yet.
+func (db *FirestoreDB) LongitudinalIndexVersion(ctx context.Context, studyID string) (int64, error) {
+	snap, err := db.client.Collection("imaging_longitudinal_status").Doc(studyID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("get index version (%s): %w", studyID, err)
+	}
+	var s LongitudinalIndexStatus
+	if err := snap.DataTo(&s); err != nil {
+		return 0, fmt.Errorf("decode index status (%s): %w", studyID, err)
+	}
+	return s.IndexVersion, nil
+}
+
+// listServedSlices runs q over a study's slice documents and returns the
+// slices of the served index version. The version is read before and after
+// the query; if a new version was published in between (and may have been
+// pruned) the read is retried.
+func (db *FirestoreDB) listServedSlices(ctx context.Context, studyID string, q firestore.Query) ([]*IndexedSlice, error) {
+	const maxReads = 3
+	for read := 1; ; read++ {
+		version, err := db.LongitudinalIndexVersion(ctx, studyID)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := q.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, fmt.Errorf("query indexed slices for study %s: %w", studyID, err)
+		}
+		after, err := db.LongitudinalIndexVersion(ctx, studyID)
+		if err != nil {
+			return nil, err
+		}
+		if after != version {
+			if read == maxReads {
+				return nil, fmt.Errorf("index of study %s changed while reading", studyID)
+			}
+			continue
+		}
+
+		res := make([]*IndexedSlice, 0, len(docs))
+		for _, d := range docs {
+			var s IndexedSlice
+			if err := d.DataTo(&s); err != nil {
+				return nil, fmt.Errorf("decode indexed slice (%s): %w", d.Ref.ID, err)
+			}
+			if v := s.visibleAt(version); v != nil {
+				v.Previous = nil
+				res = append(res, v)
+			}
+		}
+		return res, nil
+	}
+}
+
+// ListIndexedSlicesForStudy returns all indexed slices of a study across
+// frames of reference, for resolve-point to pick the frame it can reach.
+func (db *FirestoreDB) ListIndexedSlicesForStudy(ctx context.Context, studyID string) ([]*IndexedSlice, error) {
+	studyID = strings.TrimSpace(studyID)
+	if studyID == "" {
+		return nil, fmt.Errorf("studyID is required")
+	}
+	q := db.client.Collection("imaging_slice_index").Where("study_id", "==", studyID)
+	return db.listServedSlices(ctx, studyID, q)
+}
+
 // ListIndexedSlicesForStudyAndFoR returns all indexed slices for a given
 // study_id and FrameOfReferenceUID. This is used by the resolve-point
 // endpoint to find candidate slices per study.
@@ -122,21 +432,7 @@ func (db *FirestoreDB) ListIndexedSlicesForStudyAndFoR(
 	q := col.
 		Where("study_id", "==", studyID).
 		Where("frame_of_reference_uid", "==", frameOfRefUID)
-
-	docs, err := q.Documents(ctx).GetAll()
-	if err != nil {
-		return nil, fmt.Errorf("query indexed slices for study %s: %w", studyID, err)
-	}
-
-	res := make([]*IndexedSlice, 0, len(docs))
-	for _, d := range docs {
-		var s IndexedSlice
-		if err := d.DataTo(&s); err != nil {
-			return nil, fmt.Errorf("decode indexed slice (%s): %w", d.Ref.ID, err)
-		}
-		res = append(res, &s)
-	}
-	return res, nil
+	return db.listServedSlices(ctx, studyID, q)
 }
 
 // ////////////////////////////////////
@@ -160,6 +456,40 @@ func (db *FirestoreDB) SetLongitudinalIndexStatus(
 	return nil
 }
 
+// UpdateLongitudinalIndexStatus applies fn to a study's status document in a
+// transaction, starting from an empty status if there is none, so fields fn
+// does not touch (index version, counts) are preserved.
+func (db *FirestoreDB) UpdateLongitudinalIndexStatus(
+	ctx context.Context,
+	studyID, patientUserID string,
+	fn func(s *LongitudinalIndexStatus),
+) (*LongitudinalIndexStatus, error) {
+	if strings.TrimSpace(studyID) == "" {
+		return nil, fmt.Errorf("invalid status")
+	}
+	ref := db.client.Collection("imaging_longitudinal_status").Doc(studyID)
+	var res *LongitudinalIndexStatus
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		s := LongitudinalIndexStatus{StudyID: studyID, PatientUserID: patientUserID, Status: "not_indexed"}
+		snap, err := tx.Get(ref)
+		if err == nil {
+			if err := snap.DataTo(&s); err != nil {
+				return err
+			}
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		fn(&s)
+		s.UpdatedAt = time.Now().UTC()
+		res = &s
+		return tx.Set(ref, &s)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("update longitudinal index status: %w", err)
+	}
+	return res, nil
+}
+
 // ////////////////////////////////////
 //
 //	Extending FirestoreDB - table: imaging_longitudinal_status
@@ -241,6 +571,94 @@ func parseDICOMFloatSlice(ds map[string]interface{}, tag string, expected int) (
 	return res, true
 }
 
+// dicomwebSequenceItem returns item i of sequence tag in a DICOM JSON
+// dataset, or nil if there is no such item.
+func dicomwebSequenceItem(ds map[string]interface{}, tag string, i int) map[string]interface{} {
+	m, ok := ds[tag].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	items, ok := m["Value"].([]interface{})
+	if !ok || i < 0 || i >= len(items) {
+		return nil
+	}
+	item, _ := items[i].(map[string]interface{})
+	return item
+}
+
+// dicomwebSequenceLen returns the number of items of sequence tag.
+func dicomwebSequenceLen(ds map[string]interface{}, tag string) int {
+	m, ok := ds[tag].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	items, _ := m["Value"].([]interface{})
+	return len(items)
+}
+
+// frameGeometry is the image plane of one frame of an instance.
+type frameGeometry struct {
+	frame     int       // 1-based frame number
+	ipp       []float64 // ImagePositionPatient
+	iop       []float64 // ImageOrientationPatient
+	spacing   []float64 // PixelSpacing
+	thickness float64   // SliceThickness, 0 if unknown
+}
+
+// frameGeometries returns the plane of every frame of an instance.
+//
+// Enhanced multi-frame objects (enhanced CT/MR/PET and the like) carry the
+// geometry in the Per-Frame Functional Groups Sequence (5200,9230), one item
+// per frame, with macros common to all frames in the Shared Functional
+// Groups Sequence (5200,9229):
+//
+//	Plane Position Sequence    (0020,9113) → ImagePositionPatient
+//	Plane Orientation Sequence (0020,9116) → ImageOrientationPatient
+//	Pixel Measures Sequence    (0028,9110) → PixelSpacing, SliceThickness
+//
+// Each attribute is taken from the frame's item, then the shared item, then
+// the top level. Other instances have a single plane at the top level, reported
+// as frame 1. Frames without a complete geometry are left out.
+func frameGeometries(ds map[string]interface{}) []frameGeometry {
+	nFrames := dicomwebSequenceLen(ds, "52009230")
+	if nFrames == 0 {
+		nFrames = 1
+	}
+	shared := dicomwebSequenceItem(ds, "52009229", 0)
+
+	out := make([]frameGeometry, 0, nFrames)
+	for i := 0; i < nFrames; i++ {
+		perFrame := dicomwebSequenceItem(ds, "52009230", i)
+		lookup := func(seqTag, tag string, n int) ([]float64, bool) {
+			for _, group := range []map[string]interface{}{perFrame, shared} {
+				if v, ok := parseDICOMFloatSlice(dicomwebSequenceItem(group, seqTag, 0), tag, n); ok {
+					return v, true
+				}
+			}
+			return parseDICOMFloatSlice(ds, tag, n)
+		}
+
+		ipp, ok := lookup("00209113", "00200032", 3) // ImagePositionPatient
+		if !ok {
+			continue
+		}
+		iop, ok := lookup("00209116", "00200037", 6) // ImageOrientationPatient
+		if !ok {
+			continue
+		}
+		spacing, ok := lookup("00289110", "00280030", 2) // PixelSpacing
+		if !ok {
+			continue
+		}
+		g := frameGeometry{frame: i + 1, ipp: ipp, iop: iop, spacing: spacing}
+		if v, ok := lookup("00289110", "00180050", 1); ok { // SliceThickness
+			g.thickness = v[0]
+		}
+		out = append(out, g)
+	}
+	return out
+}
+
 // ////////////////////////////////////////////////////////////
 //
 //	     Calculator function: IndexedSlices →  Calculate // Row/col direction vectors
@@ -248,92 +666,110 @@ func parseDICOMFloatSlice(ds map[string]interface{}, tag string, expected int) (
 //													    	// PlaneD = normal · IPP
 //
 //	     This is the VALUE CALCULATOR
+//
+// progress, if set, is called with the number of instances processed so far
+// and the total once the study metadata is in.
 func (h *Handlers) buildIndexedSlicesForStudy(
 	ctx context.Context,
 	study *ImagingStudy,
+	progress func(processed, total int),
 ) ([]*IndexedSlice, error) {
-	if h.Dicom == nil {
-		return nil, fmt.Errorf("dicom client not configured")
-	}
-	bytes, err := h.Dicom.StudyMetadataJSON(ctx, study.StudyInstanceUID)
+	datasets, err := h.studyInstanceDatasets(ctx, study, true)
 	if err != nil {
-		return nil, fmt.Errorf("StudyMetadataJSON: %w", err)
-	}
-
-	var datasets []map[string]interface{}
-	if err := json.Unmarshal(bytes, &datasets); err != nil {
-		return nil, fmt.Errorf("unmarshal study metadata: %w", err)
+		return nil, err
 	}
 
 	slices := make([]*IndexedSlice, 0, len(datasets))
 	now := time.Now().UTC()
 
-	for _, ds := range datasets {
+	for i, ds := range datasets {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(i, len(datasets))
+		}
 		seriesUID := dicomwebTagString(ds, "0020000E") // SeriesInstanceUID
 		sopUID := dicomwebTagString(ds, "00080018")    // SOPInstanceUID
 		if seriesUID == "" || sopUID == "" {
 			continue
 		}
 
-		ipp, ok := parseDICOMFloatSlice(ds, "00200032", 3) // ImagePositionPatient
-		if !ok {
-			continue
-		}
-		iop, ok := parseDICOMFloatSlice(ds, "00200037", 6) // ImageOrientationPatient
-		if !ok {
-			continue
-		}
-		spacing, ok := parseDICOMFloatSlice(ds, "00280030", 2) // PixelSpacing
-		if !ok {
+		frames := frameGeometries(ds)
+		if len(frames) == 0 {
 			continue
 		}
 
 		// FrameOfReferenceUID
 		forUID := dicomwebTagString(ds, "00200052")
 
-		// Row/col direction vectors
-		rowDir := [3]float64{iop[0], iop[1], iop[2]}
-		colDir := [3]float64{iop[3], iop[4], iop[5]}
+		// Series details (optional)
+		modality := dicomwebTagString(ds, "00080060")
+		seriesDesc := dicomwebTagString(ds, "0008103E")
+		seriesNum := 0
+		if v, ok := parseDICOMFloatSlice(ds, "00200011", 1); ok { // SeriesNumber
+			seriesNum = int(v[0])
+		}
 
-		// Normal = rowDir × colDir
-		normal := [3]float64{
-			rowDir[1]*colDir[2] - rowDir[2]*colDir[1],
-			rowDir[2]*colDir[0] - rowDir[0]*colDir[2],
-			rowDir[0]*colDir[1] - rowDir[1]*colDir[0],
+		// Image size (optional)
+		var rows, cols int
+		if v, ok := parseDICOMFloatSlice(ds, "00280010", 1); ok { // Rows
+			rows = int(v[0])
+		}
+		if v, ok := parseDICOMFloatSlice(ds, "00280011", 1); ok { // Columns
+			cols = int(v[0])
 		}
-		// PlaneD = normal · IPP
-		planeD := normal[0]*ipp[0] + normal[1]*ipp[1] + normal[2]*ipp[2]
 
 		// Instance number (optional)
-		instNumStr := dicomwebTagString(ds, "00200013")
 		instNum := 0
-		if instNumStr != "" {
-			if n, err := strconv.Atoi(strings.TrimSpace(instNumStr)); err == nil {
-				instNum = n
-			}
+		if v, ok := parseDICOMFloatSlice(ds, "00200013", 1); ok { // InstanceNumber
+			instNum = int(v[0])
 		}
 
-		s := &IndexedSlice{
-			StudyID:             study.StudyID,
-			PatientUserID:       study.UserID,
-			StudyInstanceUID:    study.StudyInstanceUID,
-			SeriesInstanceUID:   seriesUID,
-			SOPInstanceUID:      sopUID,
-			InstanceNumber:      instNum,
-			FrameOfReferenceUID: forUID,
+		for _, g := range frames {
+			// Row/col direction vectors
+			rowDir := [3]float64{g.iop[0], g.iop[1], g.iop[2]}
+			colDir := [3]float64{g.iop[3], g.iop[4], g.iop[5]}
 
-			IPPX: ipp[0], IPPY: ipp[1], IPPZ: ipp[2],
-			RowDirX: rowDir[0], RowDirY: rowDir[1], RowDirZ: rowDir[2],
-			ColDirX: colDir[0], ColDirY: colDir[1], ColDirZ: colDir[2],
-			RowSpacing: spacing[0], ColSpacing: spacing[1],
-			NormalX: normal[0], NormalY: normal[1], NormalZ: normal[2],
-			PlaneD: planeD,
-
-			StudyDate:       study.StudyDate,
-			AcquisitionTime: "", // you can extract 0008,0032 if needed
-			CreatedAt:       now,
+			// Normal = rowDir × colDir
+			normal := [3]float64{
+				rowDir[1]*colDir[2] - rowDir[2]*colDir[1],
+				rowDir[2]*colDir[0] - rowDir[0]*colDir[2],
+				rowDir[0]*colDir[1] - rowDir[1]*colDir[0],
+			}
+			// PlaneD = normal · IPP
+			planeD := normal[0]*g.ipp[0] + normal[1]*g.ipp[1] + normal[2]*g.ipp[2]
+
+			s := &IndexedSlice{
+				StudyID:             study.StudyID,
+				PatientUserID:       study.UserID,
+				StudyInstanceUID:    study.StudyInstanceUID,
+				SeriesInstanceUID:   seriesUID,
+				SOPInstanceUID:      sopUID,
+				InstanceNumber:      instNum,
+				FrameNumber:         g.frame,
+				FrameOfReferenceUID: forUID,
+				Modality:            modality,
+				SeriesNumber:        seriesNum,
+				SeriesDescription:   seriesDesc,
+
+				IPPX: g.ipp[0], IPPY: g.ipp[1], IPPZ: g.ipp[2],
+				RowDirX: rowDir[0], RowDirY: rowDir[1], RowDirZ: rowDir[2],
+				ColDirX: colDir[0], ColDirY: colDir[1], ColDirZ: colDir[2],
+				RowSpacing: g.spacing[0], ColSpacing: g.spacing[1],
+				Rows: rows, Columns: cols, SliceThickness: g.thickness,
+				NormalX: normal[0], NormalY: normal[1], NormalZ: normal[2],
+				PlaneD: planeD,
+
+				StudyDate:       study.StudyDate,
+				AcquisitionTime: "", // you can extract 0008,0032 if needed
+				CreatedAt:       now,
+			}
+			slices = append(slices, s)
 		}
-		slices = append(slices, s)
+	}
+	if progress != nil {
+		progress(len(datasets), len(datasets))
 	}
 	return slices, nil
 }
@@ -352,21 +788,170 @@ func distanceToSlicePlane(slice *IndexedSlice, x, y, z float64) float64 {
 }
 
 // projectPointToSlice computes approximate pixel coordinates (row, col) of a
-// world-space point on a given slice, using the stored geometry. We do not
-// clamp to image bounds here; the viewer can handle clamping.
+// world-space point on a given slice, using the stored geometry. Rows run
+// along the column direction cosines and are PixelSpacing[0] apart; columns
+// run along the row direction cosines, PixelSpacing[1] apart. The result is
+// not clamped; see sliceContains.
 func projectPointToSlice(slice *IndexedSlice, x, y, z float64) (row, col float64) {
 	vx := x - slice.IPPX
 	vy := y - slice.IPPY
 	vz := z - slice.IPPZ
 
-	rowNumerator := vx*slice.RowDirX + vy*slice.RowDirY + vz*slice.RowDirZ
-	colNumerator := vx*slice.ColDirX + vy*slice.ColDirY + vz*slice.ColDirZ
+	alongRow := vx*slice.RowDirX + vy*slice.RowDirY + vz*slice.RowDirZ
+	alongCol := vx*slice.ColDirX + vy*slice.ColDirY + vz*slice.ColDirZ
 
 	if slice.RowSpacing != 0 {
-		row = rowNumerator / slice.RowSpacing
+		row = alongCol / slice.RowSpacing
 	}
 	if slice.ColSpacing != 0 {
-		col = colNumerator / slice.ColSpacing
+		col = alongRow / slice.ColSpacing
 	}
 	return row, col
 }
+
+// defaultSliceToleranceMM is the plane distance accepted for slices whose
+// thickness is unknown.
+const defaultSliceToleranceMM = 2.5
+
+// sliceTolerance is how far from a slice's plane a point may lie and still
+// be considered on the slice: half the slice thickness.
+func sliceTolerance(slice *IndexedSlice) float64 {
+	if slice.SliceThickness > 0 {
+		return slice.SliceThickness / 2
+	}
+	return defaultSliceToleranceMM
+}
+
+// sliceContains reports whether a projected (row, col) falls on the image,
+// with pixel centers at integer indices. Unknown dimensions always pass.
+func sliceContains(slice *IndexedSlice, row, col float64) (rowIn, colIn bool) {
+	rowIn = slice.Rows <= 0 || (row >= -0.5 && row <= float64(slice.Rows)-0.5)
+	colIn = slice.Columns <= 0 || (col >= -0.5 && col <= float64(slice.Columns)-0.5)
+	return rowIn, colIn
+}
+
+// sliceResolution is where a point lands on one indexed slice.
+type sliceResolution struct {
+	Slice       *IndexedSlice
+	Row, Col    float64
+	Distance    float64 // mm from the slice plane
+	Tolerance   float64 // mm accepted for this slice
+	RowInBounds bool
+	ColInBounds bool
+	Confidence  float64 // 1 on the plane, falling to 0 at the tolerance
+}
+
+func resolveOnSlice(slice *IndexedSlice, distance, tolerance, x, y, z float64) *sliceResolution {
+	r := &sliceResolution{Slice: slice, Distance: distance, Tolerance: tolerance}
+	r.Row, r.Col = projectPointToSlice(slice, x, y, z)
+	r.RowInBounds, r.ColInBounds = sliceContains(slice, r.Row, r.Col)
+	if r.RowInBounds && r.ColInBounds && tolerance > 0 && distance <= tolerance {
+		r.Confidence = 1 - distance/tolerance
+	}
+	return r
+}
+
+// onSlice reports whether the point lies on the resolved slice, not just
+// near it.
+func (r *sliceResolution) onSlice() bool {
+	return r.RowInBounds && r.ColInBounds && r.Distance <= r.Tolerance
+}
+
+// betterThan prefers a point on the slice, then the closer plane.
+func (r *sliceResolution) betterThan(o *sliceResolution) bool {
+	if r.onSlice() != o.onSlice() {
+		return r.onSlice()
+	}
+	return r.Distance < o.Distance
+}
+
+// seriesFilter restricts resolve-point to some series; empty fields match
+// everything.
+type seriesFilter struct {
+	Modality    string
+	Orientation string
+	SeriesUIDs  map[string]bool
+}
+
+func (f seriesFilter) matches(s *IndexedSlice) bool {
+	if f.Modality != "" && !strings.EqualFold(f.Modality, s.Modality) {
+		return false
+	}
+	if f.Orientation != "" && f.Orientation != sliceOrientation(s) {
+		return false
+	}
+	if len(f.SeriesUIDs) > 0 && !f.SeriesUIDs[s.SeriesInstanceUID] {
+		return false
+	}
+	return true
+}
+
+// sliceOrientation classifies a slice like its series (axial, sagittal, ...).
+func sliceOrientation(s *IndexedSlice) string {
+	return orientationClass([]float64{s.RowDirX, s.RowDirY, s.RowDirZ, s.ColDirX, s.ColDirY, s.ColDirZ})
+}
+
+// resolveOnStack returns the closest slice of one stack that the point lies
+// on: within the plane tolerance (toleranceMM, or each slice's own when
+// zero) and inside the image. With includeOutOfBounds, a point on no slice
+// resolves to the nearest plane with zero confidence instead.
+func resolveOnStack(st *sliceStack, x, y, z, toleranceMM, maxTolerance float64, includeOutOfBounds bool) *sliceResolution {
+	tolerance := func(s *IndexedSlice) float64 {
+		if toleranceMM > 0 {
+			return toleranceMM
+		}
+		return sliceTolerance(s)
+	}
+	radius := toleranceMM
+	if radius <= 0 {
+		radius = maxTolerance
+	}
+	cands := st.within(x, y, z, radius, nil)
+	sort.SliceStable(cands, func(a, b int) bool { return cands[a].distance < cands[b].distance })
+	for _, c := range cands {
+		if r := resolveOnSlice(c.slice, c.distance, tolerance(c.slice), x, y, z); r.onSlice() {
+			return r
+		}
+	}
+	if !includeOutOfBounds {
+		return nil
+	}
+	best, dist := st.nearest(x, y, z)
+	if best == nil {
+		return nil
+	}
+	r := resolveOnSlice(best, dist, tolerance(best), x, y, z)
+	r.Confidence = 0
+	return r
+}
+
+// resolvePointPerSeries resolves the point on every series of frame forUID
+// that passes the filter, keeping the best slice per series. Results are
+// ordered by series number.
+func resolvePointPerSeries(idx *studySliceIndex, forUID string, x, y, z, toleranceMM float64, includeOutOfBounds bool, filter seriesFilter) []*sliceResolution {
+	bySeries := make(map[string]*sliceResolution)
+	for _, st := range idx.stacks[forUID] {
+		if len(st.slices) == 0 || !filter.matches(st.slices[0]) {
+			continue
+		}
+		r := resolveOnStack(st, x, y, z, toleranceMM, idx.maxTolerance, includeOutOfBounds)
+		if r == nil {
+			continue
+		}
+		if cur, ok := bySeries[st.seriesUID]; !ok || r.betterThan(cur) {
+			bySeries[st.seriesUID] = r
+		}
+	}
+	res := make([]*sliceResolution, 0, len(bySeries))
+	for _, r := range bySeries {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(a, b int) bool {
+		sa, sb := res[a].Slice, res[b].Slice
+		if sa.SeriesNumber != sb.SeriesNumber {
+			return sa.SeriesNumber < sb.SeriesNumber
+		}
+		return sa.SeriesInstanceUID < sb.SeriesInstanceUID
+	})
+	return res
+}
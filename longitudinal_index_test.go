@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+)
+
+// axialSlice is a 400x200 axial image at height z whose columns run along
+// +x 1 mm apart and rows along +y 0.5 mm apart, starting at (-100, -100).
+func axialSlice(sop string, z, thickness float64) *IndexedSlice {
+	return &IndexedSlice{
+		SeriesInstanceUID:   "S1",
+		SOPInstanceUID:      sop,
+		FrameOfReferenceUID: "F",
+		IPPX:                -100, IPPY: -100, IPPZ: z,
+		RowDirX: 1, ColDirY: 1,
+		RowSpacing: 0.5, ColSpacing: 1,
+		Rows: 400, Columns: 200, SliceThickness: thickness,
+		NormalZ: 1, PlaneD: z,
+	}
+}
+
+func TestProjectPointToSliceAxes(t *testing.T) {
+	row, col := projectPointToSlice(axialSlice("a", 0, 2), 10, -50, 0)
+	if row != 100 || col != 110 {
+		t.Fatalf("row, col = %v, %v; want 100, 110", row, col)
+	}
+	if rowIn, colIn := sliceContains(axialSlice("a", 0, 2), 399.4, 200); !rowIn || colIn {
+		t.Fatalf("bounds = %v %v; want row in, col out", rowIn, colIn)
+	}
+	if rowIn, colIn := sliceContains(&IndexedSlice{}, -5, 1e6); !rowIn || !colIn {
+		t.Fatal("unknown dimensions should pass")
+	}
+}
+
+// resolveOne resolves a point on a single-series index.
+func resolveOne(t *testing.T, idx *studySliceIndex, x, y, z, tol float64, includeOutOfBounds bool) *sliceResolution {
+	t.Helper()
+	res := resolvePointPerSeries(idx, "F", x, y, z, tol, includeOutOfBounds, seriesFilter{})
+	if len(res) > 1 {
+		t.Fatalf("%d results for one series", len(res))
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res[0]
+}
+
+func TestResolvePointOnSeries(t *testing.T) {
+	idx := buildStudySliceIndex([]*IndexedSlice{
+		axialSlice("z0", 0, 2),
+		axialSlice("z5", 5, 2),
+		axialSlice("z10", 10, 2),
+	})
+
+	r := resolveOne(t, idx, 0, 0, 5.5, 0, false)
+	if r == nil || r.Slice.SOPInstanceUID != "z5" {
+		t.Fatalf("resolved %+v, want z5", r)
+	}
+	if math.Abs(r.Distance-0.5) > 1e-9 || r.Tolerance != 1 || math.Abs(r.Confidence-0.5) > 1e-9 {
+		t.Fatalf("distance %v tolerance %v confidence %v", r.Distance, r.Tolerance, r.Confidence)
+	}
+
+	// Between slices, beyond half the thickness of either.
+	if r := resolveOne(t, idx, 0, 0, 2.5, 0, false); r != nil {
+		t.Fatalf("gap resolved to %s", r.Slice.SOPInstanceUID)
+	}
+	// A wider explicit tolerance accepts it.
+	if r := resolveOne(t, idx, 0, 0, 2.4, 3, false); r == nil || r.Slice.SOPInstanceUID != "z0" {
+		t.Fatalf("explicit tolerance resolved %+v", r)
+	}
+	// On the plane but outside the image.
+	if r := resolveOne(t, idx, 150, 0, 5, 0, false); r != nil {
+		t.Fatalf("outside point resolved to %s", r.Slice.SOPInstanceUID)
+	}
+	r = resolveOne(t, idx, 150, 0, 5, 0, true)
+	if r == nil || r.Slice.SOPInstanceUID != "z5" || r.ColInBounds || !r.RowInBounds || r.Confidence != 0 {
+		t.Fatalf("includeOutOfBounds resolved %+v", r)
+	}
+}
+
+func TestResolvePointPerSeries(t *testing.T) {
+	// Axial series 2 has a small field of view that misses the point; the
+	// sagittal localizer (series 1) and axial series 3 contain it.
+	small := axialSlice("small", 5, 2)
+	small.SeriesInstanceUID, small.SeriesNumber, small.Modality = "S2", 2, "MR"
+	small.Rows, small.Columns = 20, 20
+	large := axialSlice("large", 5.6, 2)
+	large.SeriesInstanceUID, large.SeriesNumber, large.Modality = "S3", 3, "MR"
+	loc := &IndexedSlice{
+		SeriesInstanceUID: "S1", SeriesNumber: 1, Modality: "MR", SOPInstanceUID: "loc",
+		FrameOfReferenceUID: "F",
+		IPPX:                50, IPPY: -100, IPPZ: 100,
+		RowDirY: 1, ColDirZ: -1,
+		RowSpacing: 1, ColSpacing: 1, Rows: 256, Columns: 256, SliceThickness: 4,
+		NormalX: -1, PlaneD: -50,
+	}
+	idx := buildStudySliceIndex([]*IndexedSlice{small, large, loc})
+
+	res := resolvePointPerSeries(idx, "F", 50, 50, 5, 0, false, seriesFilter{})
+	var got []string
+	for _, r := range res {
+		got = append(got, r.Slice.SOPInstanceUID)
+	}
+	if fmt.Sprint(got) != "[loc large]" {
+		t.Fatalf("matches = %v, want [loc large]", got)
+	}
+	if o := sliceOrientation(res[0].Slice); o != OrientationSagittal {
+		t.Fatalf("localizer orientation = %s", o)
+	}
+
+	res = resolvePointPerSeries(idx, "F", 50, 50, 5, 0, false, seriesFilter{Orientation: OrientationAxial})
+	if len(res) != 1 || res[0].Slice.SOPInstanceUID != "large" {
+		t.Fatalf("axial filter matched %d results", len(res))
+	}
+	res = resolvePointPerSeries(idx, "F", 50, 50, 5, 0, true, seriesFilter{SeriesUIDs: map[string]bool{"S2": true}})
+	if len(res) != 1 || res[0].Slice.SOPInstanceUID != "small" || res[0].Confidence != 0 {
+		t.Fatalf("series filter with includeOutOfBounds = %+v", res)
+	}
+	if res := resolvePointPerSeries(idx, "F", 50, 50, 5, 0, false, seriesFilter{Modality: "ct"}); len(res) != 0 {
+		t.Fatalf("modality filter matched %d results", len(res))
+	}
+}
+
+// servedSlices lists "sop@z" for the slices of store visible at version v.
+func servedSlices(store map[string]*IndexedSlice, v int64) string {
+	var out []string
+	for _, doc := range store {
+		if s := doc.visibleAt(v); s != nil {
+			out = append(out, fmt.Sprintf("%s@%g", s.SOPInstanceUID, s.PlaneD))
+		}
+	}
+	sort.Strings(out)
+	return fmt.Sprint(out)
+}
+
+func applySliceWrites(store, sets map[string]*IndexedSlice, deletes []string) {
+	for id, doc := range sets {
+		store[id] = doc
+	}
+	for _, id := range deletes {
+		delete(store, id)
+	}
+}
+
+func TestSliceIndexVersionedRewrite(t *testing.T) {
+	build := func(zs map[string]float64) []*IndexedSlice {
+		var out []*IndexedSlice
+		for sop, z := range zs {
+			s := axialSlice(sop, z, 2)
+			s.StudyID, s.FrameNumber = "ST", 1
+			out = append(out, s)
+		}
+		return out
+	}
+
+	store := make(map[string]*IndexedSlice)
+	sets, deletes := planSliceIndexWrite(store, build(map[string]float64{"a": 0, "b": 1, "c": 2}), 0, 1)
+	applySliceWrites(store, sets, deletes)
+	if got := servedSlices(store, 0); got != "[]" {
+		t.Fatalf("version 0 sees %s before publish", got)
+	}
+	clear, deletes := planSliceIndexPrune(store, 1)
+	if len(clear) != 0 || len(deletes) != 0 {
+		t.Fatalf("first build left %v to clear, %v to delete", clear, deletes)
+	}
+
+	// Rebuild: a unchanged, b moved, c dropped, d added.
+	sets, deletes = planSliceIndexWrite(store, build(map[string]float64{"a": 0, "b": 5, "d": 3}), 1, 2)
+	if len(sets) != 3 || len(deletes) != 0 {
+		t.Fatalf("rebuild writes %d docs, deletes %v; want 3 writes (b, c, d)", len(sets), deletes)
+	}
+	applySliceWrites(store, sets, deletes)
+	if got, want := servedSlices(store, 1), "[a@0 b@1 c@2]"; got != want {
+		t.Fatalf("version 1 during rewrite sees %s, want %s", got, want)
+	}
+	if got, want := servedSlices(store, 2), "[a@0 b@5 d@3]"; got != want {
+		t.Fatalf("version 2 sees %s, want %s", got, want)
+	}
+
+	clear, deletes = planSliceIndexPrune(store, 2)
+	if len(clear) != 1 || len(deletes) != 1 {
+		t.Fatalf("prune clears %v, deletes %v; want b cleared and c deleted", clear, deletes)
+	}
+	for _, id := range clear {
+		store[id].Previous = nil
+	}
+	applySliceWrites(store, nil, deletes)
+	if got, want := servedSlices(store, 2), "[a@0 b@5 d@3]"; got != want {
+		t.Fatalf("version 2 after prune sees %s, want %s", got, want)
+	}
+	for id, doc := range store {
+		if !doc.clean() {
+			t.Fatalf("doc %s not clean after prune: %+v", id, doc)
+		}
+	}
+}
+
+func TestSliceIndexFailedBuildDiscarded(t *testing.T) {
+	s := axialSlice("a", 0, 2)
+	s.StudyID, s.FrameNumber, s.IndexVersion = "ST", 1, 1
+	// A build of version 2 moved a and added e, then failed before publish.
+	moved := *s
+	moved.PlaneD, moved.IndexVersion = 7, 2
+	prev := *s
+	moved.Previous = &prev
+	added := axialSlice("e", 4, 2)
+	added.StudyID, added.FrameNumber, added.IndexVersion = "ST", 1, 2
+	store := map[string]*IndexedSlice{
+		indexedSliceDocID(s):     &moved,
+		indexedSliceDocID(added): added,
+	}
+	if got := servedSlices(store, 1); got != "[a@0]" {
+		t.Fatalf("version 1 sees %s", got)
+	}
+
+	// The retry rebuilds just a, unchanged.
+	sets, deletes := planSliceIndexWrite(store, []*IndexedSlice{s}, 1, 2)
+	applySliceWrites(store, sets, deletes)
+	if len(deletes) != 1 || deletes[0] != indexedSliceDocID(added) {
+		t.Fatalf("deletes = %v, want the unpublished e", deletes)
+	}
+	if got := servedSlices(store, 2); got != "[a@0]" {
+		t.Fatalf("version 2 sees %s", got)
+	}
+}
+
+// dicomJSON decodes a DICOM JSON dataset literal.
+func dicomJSON(t *testing.T, src string) map[string]interface{} {
+	t.Helper()
+	var ds map[string]interface{}
+	if err := json.Unmarshal([]byte(src), &ds); err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestFrameGeometriesEnhancedMultiFrame(t *testing.T) {
+	ds := dicomJSON(t, `{
+	  "00280008": {"vr": "IS", "Value": [3]},
+	  "52009229": {"vr": "SQ", "Value": [{
+	    "00209116": {"vr": "SQ", "Value": [{"00200037": {"vr": "DS", "Value": [1, 0, 0, 0, 1, 0]}}]},
+	    "00289110": {"vr": "SQ", "Value": [{
+	      "00280030": {"vr": "DS", "Value": [0.5, 0.5]},
+	      "00180050": {"vr": "DS", "Value": [1.5]}
+	    }]}
+	  }]},
+	  "52009230": {"vr": "SQ", "Value": [
+	    {"00209113": {"vr": "SQ", "Value": [{"00200032": {"vr": "DS", "Value": [-100, -100, 10]}}]}},
+	    {"00209113": {"vr": "SQ", "Value": [{"00200032": {"vr": "DS", "Value": [-100, -100, 11.5]}}]},
+	     "00289110": {"vr": "SQ", "Value": [{"00280030": {"vr": "DS", "Value": [0.8, 0.8]}}]}},
+	    {"00209113": {"vr": "SQ", "Value": []}}
+	  ]}
+	}`)
+
+	frames := frameGeometries(ds)
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2 (frame 3 has no position)", len(frames))
+	}
+	if f := frames[0]; f.frame != 1 || f.ipp[2] != 10 || f.iop[4] != 1 || f.spacing[0] != 0.5 || f.thickness != 1.5 {
+		t.Fatalf("frame 1 = %+v", f)
+	}
+	// Frame 2 overrides the shared spacing; thickness still comes from the
+	// shared item.
+	if f := frames[1]; f.frame != 2 || f.ipp[2] != 11.5 || f.spacing[0] != 0.8 || f.thickness != 1.5 {
+		t.Fatalf("frame 2 = %+v", f)
+	}
+}
+
+func TestFrameGeometriesSingleFrame(t *testing.T) {
+	ds := dicomJSON(t, `{
+	  "00200032": {"vr": "DS", "Value": ["0", "0", "4"]},
+	  "00200037": {"vr": "DS", "Value": ["1", "0", "0", "0", "1", "0"]},
+	  "00280030": {"vr": "DS", "Value": ["1", "1"]},
+	  "00180050": {"vr": "DS", "Value": ["3"]}
+	}`)
+	frames := frameGeometries(ds)
+	if len(frames) != 1 || frames[0].frame != 1 || frames[0].ipp[2] != 4 || frames[0].thickness != 3 {
+		t.Fatalf("frames = %+v", frames)
+	}
+	if got := frameGeometries(dicomJSON(t, `{"00200032": {"vr": "DS", "Value": [0, 0, 4]}}`)); len(got) != 0 {
+		t.Fatalf("instance without orientation gave %+v", got)
+	}
+}
+
+func TestSliceFramesURL(t *testing.T) {
+	s := axialSlice("1.2.3", 0, 2)
+	if got, want := sliceFramesURL("ST-1", s), "/api/imaging/studies/ST-1/dicom/series/S1/instances/1.2.3/frames/1"; got != want {
+		t.Fatalf("legacy slice url = %s, want %s", got, want)
+	}
+	s.FrameNumber = 7
+	if got := sliceFrameNumber(s); got != 7 {
+		t.Fatalf("frame = %d", got)
+	}
+}
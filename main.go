@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -18,10 +19,24 @@ type Handlers struct {
 	Cfg     Config
 	DB      *FirestoreDB
 	Storage *storage.Client
+	Blobs   BlobStore // overrides Storage for ingest reads; nil means GCS
 	Dicom   *dicomweb.Client
+	Events  *UploadEventBus   // live upload/ingest progress for SSE subscribers
+	Ingest  *IngestWorkerPool // nil when ingest workers run elsewhere
+	Indexer *IndexWorkerPool  // nil when index workers run elsewhere
+
+	Registrar *RegistrationWorkerPool // nil when registration workers run elsewhere
+
+	PushVerifier PushTokenVerifier // verifies Pub/Sub push OIDC tokens
+
+	Stow dicomweb.InstanceStorer // per-instance ingest target when IngestMode is "stow"
 }
 
 func main() {
+	backfillIndex := flag.Bool("backfill-longitudinal-index", false,
+		"enqueue longitudinal indexing for every study without an index status, then exit")
+	flag.Parse()
+
 	cfg := LoadConfig()
 
 	ctx := context.Background()
@@ -62,6 +77,74 @@ func main() {
 		DB:      fsdb,
 		Storage: st,
 		Dicom:   dw,
+		Events:  NewUploadEventBus(),
+	}
+
+	if cfg.IngestMode == IngestModeStow {
+		if cfg.StowURL != "" {
+			h.Stow = dicomweb.NewHTTPStowClient(cfg.StowURL, cfg.StowBearer, nil)
+		} else {
+			h.Stow = dw
+		}
+	}
+
+	if *backfillIndex {
+		// Index workers of the running service pick the jobs up.
+		scanned, enqueued, err := h.backfillLongitudinalIndex(ctx)
+		if err != nil {
+			log.Fatalf("longitudinal index backfill failed after %d studies (%d enqueued): %v", scanned, enqueued, err)
+		}
+		log.Printf("longitudinal index backfill: %d studies scanned, %d enqueued", scanned, enqueued)
+		return
+	}
+
+	// The service refuses to start with unauthenticated push endpoints
+	// unless that is asked for explicitly.
+	if err := cfg.validatePubSubPush(); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	if !cfg.PubSubPushInsecure {
+		h.PushVerifier, err = NewGooglePushVerifier(ctx)
+		if err != nil {
+			log.Fatalf("failed to init Pub/Sub push verifier: %v", err)
+		}
+	}
+
+	// Ingest workers pick up jobs queued by the Pub/Sub push endpoint.
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	workersDone := make(chan struct{})
+	if cfg.IngestWorkers > 0 {
+		h.Ingest = NewIngestWorkerPool(h, cfg.IngestWorkers, cfg.IngestMaxAttempts)
+		go func() {
+			defer close(workersDone)
+			h.Ingest.Run(workerCtx)
+		}()
+	} else {
+		close(workersDone)
+	}
+	// Index workers build longitudinal slice indexes queued by
+	// /api/imaging/longitudinal/index.
+	indexersDone := make(chan struct{})
+	if cfg.IndexWorkers > 0 {
+		h.Indexer = NewIndexWorkerPool(h, cfg.IndexWorkers, cfg.IndexMaxAttempts)
+		go func() {
+			defer close(indexersDone)
+			h.Indexer.Run(workerCtx)
+		}()
+	} else {
+		close(indexersDone)
+	}
+	// Registration workers run jobs queued by
+	// /api/imaging/longitudinal/auto-register.
+	registrarsDone := make(chan struct{})
+	if cfg.RegistrationWorkers > 0 {
+		h.Registrar = NewRegistrationWorkerPool(h, cfg.RegistrationWorkers, cfg.RegistrationMaxAttempts)
+		go func() {
+			defer close(registrarsDone)
+			h.Registrar.Run(workerCtx)
+		}()
+	} else {
+		close(registrarsDone)
 	}
 
 	mux := http.NewServeMux()
@@ -83,16 +166,30 @@ func main() {
 	mux.HandleFunc("/api/imaging/studies", h.ListImagingStudiesHandler)
 	mux.HandleFunc("/api/imaging/studies/", h.ImagingStudyByIDHandler)
 
+	// Storage usage and quotas for the patient dashboard
+	mux.HandleFunc("/api/imaging/usage", h.ImagingUsageHandler)
+
 	// Longitudinal (scan-over-time) endpoints
 	mux.HandleFunc("/api/imaging/longitudinal/index", h.LongitudinalIndexHandler)
+	mux.HandleFunc("/api/imaging/longitudinal/index/cancel", h.LongitudinalIndexCancelHandler)
 	mux.HandleFunc("/api/imaging/longitudinal/index-status", h.LongitudinalIndexStatusHandler)
 	mux.HandleFunc("/api/imaging/longitudinal/resolve-point", h.LongitudinalResolvePointHandler)
+	mux.HandleFunc("/api/imaging/longitudinal/register", h.LongitudinalRegisterHandler)
+	mux.HandleFunc("/api/imaging/longitudinal/auto-register", h.LongitudinalAutoRegisterHandler)
+	mux.HandleFunc("/api/imaging/longitudinal/auto-register/", h.LongitudinalAutoRegisterHandler)
+	mux.HandleFunc("/api/imaging/frame-transforms", h.FrameTransformsHandler)
+	mux.HandleFunc("/api/imaging/frame-transforms/", h.FrameTransformsHandler)
 
 	// Minimal DICOMweb-style proxy for OHIF / other viewers
 	mux.HandleFunc("/api/dicomweb/studies/", h.DicomWebStudiesHandler)
 
-	// Internal Pub/Sub endpoint for DICOM ingest worker
-	mux.HandleFunc("/internal/pubsub/dicom-ingest", h.PubSubDicomIngestHandler)
+	// Internal Pub/Sub endpoint for DICOM ingest worker, on the public mux
+	// unless a separate internal listener is configured.
+	internalMux := mux
+	if cfg.InternalAddr != "" {
+		internalMux = http.NewServeMux()
+	}
+	internalMux.HandleFunc("/internal/pubsub/dicom-ingest", h.requirePubSubPush(h.PubSubDicomIngestHandler))
 	// Get upload session object
 	mux.HandleFunc("/api/imaging/provider/upload-sessions/", h.ProviderGetUploadSessionHandler)
 
@@ -103,6 +200,13 @@ func main() {
 
 	mux.HandleFunc("/api/imaging/user/upload-sessions", h.UserCreateUploadSessionHandler)
 
+	// Live upload/ingest progress (Server-Sent Events)
+	mux.HandleFunc("/api/imaging/upload-sessions/", h.UploadSessionEventsHandler)
+
+	// Admin: list, inspect and re-queue dead-lettered ingests
+	mux.HandleFunc("/api/admin/ingest/dead-letters", h.AdminIngestDeadLettersHandler)
+	mux.HandleFunc("/api/admin/ingest/dead-letters/", h.AdminIngestDeadLettersHandler)
+
 	//// Indexing for point-over-time
 	//mux.HandleFunc("/api/imaging/longitudinal/index", h.LongitudinalIndexHandler)
 	//mux.HandleFunc("/api/imaging/longitudinal/index-status", h.LongitudinalIndexStatusHandler)
@@ -123,6 +227,20 @@ func main() {
 		}
 	}()
 
+	var internalServer *http.Server
+	if cfg.InternalAddr != "" {
+		internalServer = &http.Server{
+			Addr:    cfg.InternalAddr,
+			Handler: internalMux,
+		}
+		go func() {
+			log.Printf("VisitVizor internal server listening on %s", cfg.InternalAddr)
+			if err := internalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("internal server failed: %v", err)
+			}
+		}()
+	}
+
 	// Graceful shutdown on SIGINT/SIGTERM
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
@@ -132,4 +250,13 @@ func main() {
 	if err := server.Shutdown(context.Background()); err != nil {
 		log.Printf("server shutdown error: %v", err)
 	}
+	if internalServer != nil {
+		if err := internalServer.Shutdown(context.Background()); err != nil {
+			log.Printf("internal server shutdown error: %v", err)
+		}
+	}
+	stopWorkers()
+	<-workersDone
+	<-indexersDone
+	<-registrarsDone
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// volume is a scalar image on a regular voxel grid. Voxel (i, j, k) is column
+// i, row j of slice k; toPatient maps voxel indices to patient coordinates
+// (mm) and toIndex is its inverse.
+type volume struct {
+	nx, ny, nz int
+	data       []float32 // i fastest, then j, then k
+	toPatient  mat4
+	toIndex    mat4
+}
+
+func newVolume(nx, ny, nz int, toPatient mat4) (*volume, error) {
+	if nx < 1 || ny < 1 || nz < 1 {
+		return nil, errors.New("empty volume")
+	}
+	inv, ok := toPatient.inverse()
+	if !ok {
+		return nil, errors.New("singular voxel-to-patient matrix")
+	}
+	return &volume{
+		nx: nx, ny: ny, nz: nz,
+		data:      make([]float32, nx*ny*nz),
+		toPatient: toPatient,
+		toIndex:   inv,
+	}, nil
+}
+
+func (v *volume) index(i, j, k int) int { return (k*v.ny+j)*v.nx + i }
+
+func (v *volume) at(i, j, k int) float32 { return v.data[v.index(i, j, k)] }
+
+// cellOf splits a continuous grid coordinate into the two neighbouring
+// samples and the weight of the upper one.
+func cellOf(f float64, n int) (int, int, float64) {
+	i0 := int(f)
+	if i0 >= n-1 {
+		return n - 1, n - 1, 0
+	}
+	return i0, i0 + 1, f - float64(i0)
+}
+
+// sample trilinearly interpolates the volume at a patient coordinate; ok is
+// false outside the grid.
+func (v *volume) sample(x, y, z float64) (float64, bool) {
+	fi, fj, fk := v.toIndex.apply(x, y, z)
+	if fi < 0 || fj < 0 || fk < 0 || fi > float64(v.nx-1) || fj > float64(v.ny-1) || fk > float64(v.nz-1) {
+		return 0, false
+	}
+	i0, i1, di := cellOf(fi, v.nx)
+	j0, j1, dj := cellOf(fj, v.ny)
+	k0, k1, dk := cellOf(fk, v.nz)
+
+	lerp := func(a, b float32, t float64) float64 { return float64(a) + (float64(b)-float64(a))*t }
+	c00 := lerp(v.at(i0, j0, k0), v.at(i1, j0, k0), di)
+	c10 := lerp(v.at(i0, j1, k0), v.at(i1, j1, k0), di)
+	c01 := lerp(v.at(i0, j0, k1), v.at(i1, j0, k1), di)
+	c11 := lerp(v.at(i0, j1, k1), v.at(i1, j1, k1), di)
+	c0 := c00 + (c10-c00)*dj
+	c1 := c01 + (c11-c01)*dj
+	return c0 + (c1-c0)*dk, true
+}
+
+// center returns the patient coordinate of the middle of the grid.
+func (v *volume) center() [3]float64 {
+	x, y, z := v.toPatient.apply(float64(v.nx-1)/2, float64(v.ny-1)/2, float64(v.nz-1)/2)
+	return [3]float64{x, y, z}
+}
+
+// normalize rescales intensities to [0, 1] between the 1st and 99th
+// percentiles, so histograms of different scanners and protocols line up
+// and a few extreme voxels do not squeeze everything into one bin.
+func (v *volume) normalize() error {
+	sorted := append([]float32(nil), v.data...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	lo := float64(sorted[len(sorted)/100])
+	hi := float64(sorted[len(sorted)-1-len(sorted)/100])
+	if hi-lo < 1e-6 {
+		return errors.New("volume has no contrast")
+	}
+	for i, val := range v.data {
+		t := (float64(val) - lo) / (hi - lo)
+		v.data[i] = float32(math.Max(0, math.Min(1, t)))
+	}
+	return nil
+}
+
+// centroid returns the intensity-weighted center in patient coordinates,
+// falling back to the grid center for an empty image.
+func (v *volume) centroid() [3]float64 {
+	var sum, sx, sy, sz float64
+	for k := 0; k < v.nz; k++ {
+		for j := 0; j < v.ny; j++ {
+			for i := 0; i < v.nx; i++ {
+				w := float64(v.at(i, j, k))
+				if w <= 0 {
+					continue
+				}
+				x, y, z := v.toPatient.apply(float64(i), float64(j), float64(k))
+				sum += w
+				sx, sy, sz = sx+w*x, sy+w*y, sz+w*z
+			}
+		}
+	}
+	if sum == 0 {
+		return v.center()
+	}
+	return [3]float64{sx / sum, sy / sum, sz / sum}
+}
+
+// RegistrationQuality describes how well an intensity-based registration
+// aligned the two volumes.
+type RegistrationQuality struct {
+	MutualInformation   float64 `firestore:"mutual_information" json:"mutual_information"`
+	NormalizedMI        float64 `firestore:"normalized_mutual_information" json:"normalized_mutual_information"`
+	InitialNormalizedMI float64 `firestore:"initial_normalized_mutual_information" json:"initial_normalized_mutual_information"`
+	Overlap             float64 `firestore:"overlap" json:"overlap"` // fraction of target samples inside the source volume
+	Evaluations         int     `firestore:"evaluations" json:"evaluations"`
+	GridSpacing         float64 `firestore:"grid_spacing_mm" json:"grid_spacing_mm"`
+}
+
+// Mutual information settings. Below minMIOverlap of the target samples
+// inside the source, the score is forced to zero so the optimizer cannot
+// improve the metric by sliding the volumes apart.
+const (
+	miBins       = 32
+	miMaxSamples = 20000
+	minMIOverlap = 0.25
+)
+
+// miMetric scores a source→target transform by the mutual information of
+// the target intensities and the source intensities at the mapped points.
+type miMetric struct {
+	moving    *volume
+	points    [][3]float64
+	fixedBins []int
+}
+
+func miBin(v float64) int {
+	b := int(v*(miBins-1) + 0.5)
+	if b < 0 {
+		return 0
+	}
+	if b >= miBins {
+		return miBins - 1
+	}
+	return b
+}
+
+// newMIMetric samples up to miMaxSamples target voxels. The sample set is
+// drawn with a fixed seed, so a registration is reproducible.
+func newMIMetric(fixed, moving *volume) *miMetric {
+	total := len(fixed.data)
+	idx := make([]int, 0, total)
+	for i := range fixed.data {
+		idx = append(idx, i)
+	}
+	if total > miMaxSamples {
+		rng := rand.New(rand.NewSource(1))
+		rng.Shuffle(total, func(a, b int) { idx[a], idx[b] = idx[b], idx[a] })
+		idx = idx[:miMaxSamples]
+		sort.Ints(idx)
+	}
+
+	m := &miMetric{moving: moving, points: make([][3]float64, len(idx)), fixedBins: make([]int, len(idx))}
+	for n, id := range idx {
+		i := id % fixed.nx
+		j := (id / fixed.nx) % fixed.ny
+		k := id / (fixed.nx * fixed.ny)
+		x, y, z := fixed.toPatient.apply(float64(i), float64(j), float64(k))
+		m.points[n] = [3]float64{x, y, z}
+		m.fixedBins[n] = miBin(float64(fixed.data[id]))
+	}
+	return m
+}
+
+type miScore struct {
+	MI      float64
+	NMI     float64
+	Overlap float64
+}
+
+// evaluate computes the joint histogram for t (source → target).
+func (m *miMetric) evaluate(t mat4) miScore {
+	inv, ok := t.inverse()
+	if !ok || len(m.points) == 0 {
+		return miScore{}
+	}
+	var joint [miBins * miBins]float64
+	n := 0
+	for i, p := range m.points {
+		x, y, z := inv.apply(p[0], p[1], p[2])
+		v, ok := m.moving.sample(x, y, z)
+		if !ok {
+			continue
+		}
+		joint[m.fixedBins[i]*miBins+miBin(v)]++
+		n++
+	}
+	score := miScore{Overlap: float64(n) / float64(len(m.points))}
+	if n == 0 || score.Overlap < minMIOverlap {
+		return score
+	}
+
+	var pa, pb [miBins]float64
+	var hab float64
+	for a := 0; a < miBins; a++ {
+		for b := 0; b < miBins; b++ {
+			c := joint[a*miBins+b]
+			if c == 0 {
+				continue
+			}
+			p := c / float64(n)
+			pa[a] += p
+			pb[b] += p
+			hab -= p * math.Log(p)
+		}
+	}
+	entropy := func(ps []float64) float64 {
+		h := 0.0
+		for _, p := range ps {
+			if p > 0 {
+				h -= p * math.Log(p)
+			}
+		}
+		return h
+	}
+	ha, hb := entropy(pa[:]), entropy(pb[:])
+	score.MI = ha + hb - hab
+	if hab > 0 {
+		score.NMI = (ha + hb) / hab
+	}
+	return score
+}
+
+// rigidParams are rotations about x, y, z (radians) and a translation (mm).
+type rigidParams [6]float64
+
+// rigidMatrix builds x' = R(x - c) + c + t with R = Rz·Ry·Rx, rotating
+// about the source center c so rotation and translation steps stay
+// decoupled during the search.
+func rigidMatrix(p rigidParams, c [3]float64) mat4 {
+	sx, cx := math.Sincos(p[0])
+	sy, cy := math.Sincos(p[1])
+	sz, cz := math.Sincos(p[2])
+	r := [3][3]float64{
+		{cz * cy, cz*sy*sx - sz*cx, cz*sy*cx + sz*sx},
+		{sz * cy, sz*sy*sx + cz*cx, sz*sy*cx - cz*sx},
+		{-sy, cy * sx, cy * cx},
+	}
+	m := identityMat4()
+	for i := 0; i < 3; i++ {
+		rc := r[i][0]*c[0] + r[i][1]*c[1] + r[i][2]*c[2]
+		m[i*4+0], m[i*4+1], m[i*4+2] = r[i][0], r[i][1], r[i][2]
+		m[i*4+3] = c[i] + p[3+i] - rc
+	}
+	return m
+}
+
+// miOptions bound the compass search: steps start at the initial sizes and
+// are halved whenever no single-parameter move improves the score.
+type miOptions struct {
+	MaxEvaluations     int
+	InitialRotation    float64 // radians
+	InitialTranslation float64 // mm
+	MinRotation        float64
+	MinTranslation     float64
+}
+
+func defaultMIOptions() miOptions {
+	return miOptions{
+		MaxEvaluations:     3000,
+		InitialRotation:    0.1,
+		InitialTranslation: 8,
+		MinRotation:        0.002,
+		MinTranslation:     0.1,
+	}
+}
+
+// registerMutualInformation finds the rigid transform mapping source patient
+// coordinates onto target ones that maximizes normalized mutual information.
+// Both volumes must be normalized. The search starts from aligned intensity
+// centroids.
+func registerMutualInformation(source, target *volume, opts miOptions) (mat4, *RegistrationQuality, error) {
+	metric := newMIMetric(target, source)
+	center := source.center()
+
+	var p rigidParams
+	cs, ct := source.centroid(), target.centroid()
+	for i := 0; i < 3; i++ {
+		p[3+i] = ct[i] - cs[i]
+	}
+
+	evals := 0
+	score := func(p rigidParams) miScore {
+		evals++
+		return metric.evaluate(rigidMatrix(p, center))
+	}
+	best := score(p)
+	initial := best
+
+	steps := [6]float64{
+		opts.InitialRotation, opts.InitialRotation, opts.InitialRotation,
+		opts.InitialTranslation, opts.InitialTranslation, opts.InitialTranslation,
+	}
+	for evals < opts.MaxEvaluations {
+		improved := false
+		for d := 0; d < 6 && evals < opts.MaxEvaluations; d++ {
+			for _, sign := range []float64{1, -1} {
+				q := p
+				q[d] += sign * steps[d]
+				if s := score(q); s.NMI > best.NMI {
+					p, best, improved = q, s, true
+					break
+				}
+			}
+		}
+		if improved {
+			continue
+		}
+		if steps[0] <= opts.MinRotation && steps[3] <= opts.MinTranslation {
+			break
+		}
+		for d := range steps {
+			steps[d] /= 2
+		}
+	}
+
+	if best.NMI == 0 {
+		return mat4{}, nil, errors.New("volumes do not overlap")
+	}
+	return rigidMatrix(p, center), &RegistrationQuality{
+		MutualInformation:   best.MI,
+		NormalizedMI:        best.NMI,
+		InitialNormalizedMI: initial.NMI,
+		Overlap:             best.Overlap,
+		Evaluations:         evals,
+	}, nil
+}
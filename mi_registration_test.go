@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// phantom is a smooth, asymmetric test object: a few Gaussian blobs of
+// different sizes and intensities, in patient coordinates.
+func phantom(x, y, z float64) float32 {
+	blobs := []struct{ cx, cy, cz, sigma, amp float64 }{
+		{0, 0, 0, 25, 1.0},
+		{18, -10, 6, 8, 1.5},
+		{-15, 14, -8, 6, 2.0},
+		{5, 20, 12, 5, -0.8},
+	}
+	v := 0.0
+	for _, b := range blobs {
+		d2 := (x-b.cx)*(x-b.cx) + (y-b.cy)*(y-b.cy) + (z-b.cz)*(z-b.cz)
+		v += b.amp * math.Exp(-d2/(2*b.sigma*b.sigma))
+	}
+	return float32(v)
+}
+
+// sampledVolume fills an axis-aligned grid with phantom values seen through
+// world, which maps grid patient coordinates into phantom coordinates.
+func sampledVolume(t *testing.T, n int, spacing float64, origin [3]float64, world mat4) *volume {
+	t.Helper()
+	m := identityMat4()
+	m[0], m[5], m[10] = spacing, spacing, spacing
+	m[3], m[7], m[11] = origin[0], origin[1], origin[2]
+	v, err := newVolume(n, n, n, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < n; k++ {
+		for j := 0; j < n; j++ {
+			for i := 0; i < n; i++ {
+				x, y, z := m.apply(float64(i), float64(j), float64(k))
+				x, y, z = world.apply(x, y, z)
+				v.data[v.index(i, j, k)] = phantom(x, y, z)
+			}
+		}
+	}
+	if err := v.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVolumeSampleTrilinear(t *testing.T) {
+	m := identityMat4()
+	m[0], m[5], m[10] = 2, 2, 2
+	v, err := newVolume(2, 2, 2, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range v.data {
+		v.data[i] = float32(i)
+	}
+	got, ok := v.sample(1, 1, 1)
+	if !ok || math.Abs(got-3.5) > 1e-9 {
+		t.Fatalf("center sample = %v, %v; want 3.5", got, ok)
+	}
+	if got, ok := v.sample(2, 2, 2); !ok || got != 7 {
+		t.Fatalf("corner sample = %v, %v; want 7", got, ok)
+	}
+	if _, ok := v.sample(2.1, 0, 0); ok {
+		t.Fatal("sample outside the grid should fail")
+	}
+}
+
+func TestMIMetricPeaksAtAlignment(t *testing.T) {
+	v := sampledVolume(t, 24, 3, [3]float64{-36, -36, -36}, identityMat4())
+	metric := newMIMetric(v, v)
+	aligned := metric.evaluate(identityMat4())
+	shifted := metric.evaluate(rigidMatrix(rigidParams{0, 0, 0, 6, 0, 0}, [3]float64{}))
+	if aligned.Overlap != 1 {
+		t.Fatalf("aligned overlap = %v", aligned.Overlap)
+	}
+	if aligned.NMI <= shifted.NMI || aligned.MI <= shifted.MI {
+		t.Fatalf("aligned %+v should score above shifted %+v", aligned, shifted)
+	}
+}
+
+func TestRegisterMutualInformationRecoversRigidMotion(t *testing.T) {
+	want := rigidMatrix(rigidParams{0.05, -0.04, 0.08, 6, -4, 3}, [3]float64{})
+	inv, _ := want.inverse()
+
+	source := sampledVolume(t, 36, 3, [3]float64{-54, -54, -54}, identityMat4())
+	// The target sees the phantom moved by want: its intensity at p is the
+	// source intensity at want⁻¹(p).
+	target := sampledVolume(t, 32, 3.2, [3]float64{-48, -50, -47}, inv)
+
+	got, q, err := registerMutualInformation(source, target, defaultMIOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.NormalizedMI <= q.InitialNormalizedMI {
+		t.Fatalf("quality did not improve: %+v", q)
+	}
+
+	maxErr := 0.0
+	for _, p := range [][3]float64{{0, 0, 0}, {30, 0, 0}, {0, 30, 0}, {0, 0, 30}, {-25, 20, -15}} {
+		gx, gy, gz := got.apply(p[0], p[1], p[2])
+		wx, wy, wz := want.apply(p[0], p[1], p[2])
+		maxErr = math.Max(maxErr, math.Sqrt(sq(gx-wx)+sq(gy-wy)+sq(gz-wz)))
+	}
+	if maxErr > 1.5 {
+		t.Fatalf("max point error = %.2f mm (quality %+v)", maxErr, q)
+	}
+}
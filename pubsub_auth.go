@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// PushTokenClaims are the OIDC token claims checked on Pub/Sub push requests.
+type PushTokenClaims struct {
+	Issuer        string
+	Audience      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Expires       time.Time
+}
+
+// PushTokenVerifier checks the signature, expiry and audience of the OIDC
+// token Pub/Sub attaches to push requests. Production uses Google's public
+// keys; tests can plug in a verifier backed by locally generated keys.
+type PushTokenVerifier interface {
+	Verify(ctx context.Context, token, audience string) (*PushTokenClaims, error)
+}
+
+// googlePushVerifier verifies Google-signed ID tokens.
+type googlePushVerifier struct {
+	v *idtoken.Validator
+}
+
+// NewGooglePushVerifier returns a verifier for Google-signed OIDC tokens.
+func NewGooglePushVerifier(ctx context.Context) (PushTokenVerifier, error) {
+	v, err := idtoken.NewValidator(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("idtoken.NewValidator: %w", err)
+	}
+	return &googlePushVerifier{v: v}, nil
+}
+
+func (g *googlePushVerifier) Verify(ctx context.Context, token, audience string) (*PushTokenClaims, error) {
+	p, err := g.v.Validate(ctx, token, audience)
+	if err != nil {
+		return nil, err
+	}
+	claims := &PushTokenClaims{
+		Issuer:   p.Issuer,
+		Audience: p.Audience,
+		Subject:  p.Subject,
+		Expires:  time.Unix(p.Expires, 0).UTC(),
+	}
+	claims.Email, _ = p.Claims["email"].(string)
+	claims.EmailVerified, _ = p.Claims["email_verified"].(bool)
+	return claims, nil
+}
+
+// rsaPushVerifier verifies RS256 tokens against a fixed set of public keys
+// keyed by "kid", e.g. keys generated for tests or a local emulator.
+type rsaPushVerifier struct {
+	keys map[string]*rsa.PublicKey
+	now  func() time.Time
+}
+
+// NewRSAPushVerifier returns a verifier that trusts the given RSA keys.
+func NewRSAPushVerifier(keys map[string]*rsa.PublicKey) PushTokenVerifier {
+	return &rsaPushVerifier{keys: keys, now: time.Now}
+}
+
+func (v *rsaPushVerifier) Verify(ctx context.Context, token, audience string) (*PushTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unexpected signing algorithm %q", header.Alg)
+	}
+	key, ok := v.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token signature: %w", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+
+	var payload struct {
+		Iss           string `json:"iss"`
+		Aud           string `json:"aud"`
+		Sub           string `json:"sub"`
+		Exp           int64  `json:"exp"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := decodeJWTSegment(parts[1], &payload); err != nil {
+		return nil, fmt.Errorf("token payload: %w", err)
+	}
+	if audience != "" && payload.Aud != audience {
+		return nil, fmt.Errorf("audience %q does not match", payload.Aud)
+	}
+	if v.now().Unix() > payload.Exp {
+		return nil, fmt.Errorf("token expired")
+	}
+	return &PushTokenClaims{
+		Issuer:        payload.Iss,
+		Audience:      payload.Aud,
+		Subject:       payload.Sub,
+		Email:         payload.Email,
+		EmailVerified: payload.EmailVerified,
+		Expires:       time.Unix(payload.Exp, 0).UTC(),
+	}, nil
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// checkPushClaims enforces the issuer and the push service account on
+// verified token claims.
+func checkPushClaims(claims *PushTokenClaims, serviceAccountEmail string) error {
+	if claims.Issuer != "accounts.google.com" && claims.Issuer != "https://accounts.google.com" {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if serviceAccountEmail == "" {
+		return fmt.Errorf("no push service account configured")
+	}
+	if !claims.EmailVerified {
+		return fmt.Errorf("email %q not verified", claims.Email)
+	}
+	if !strings.EqualFold(claims.Email, serviceAccountEmail) {
+		return fmt.Errorf("unexpected service account %q", claims.Email)
+	}
+	return nil
+}
+
+// requirePubSubPush wraps a Pub/Sub push handler with OIDC verification.
+// Verification is skipped only when PubSubPushInsecure is set (local dev);
+// without an audience and service account every push is rejected.
+func (h *Handlers) requirePubSubPush(next http.HandlerFunc) http.HandlerFunc {
+	if h.Cfg.PubSubPushInsecure {
+		log.Printf("requirePubSubPush: VISIT_VIZOR_PUBSUB_PUSH_INSECURE set; push requests are NOT authenticated")
+		return next
+	}
+	if err := h.Cfg.validatePubSubPush(); err != nil {
+		log.Printf("requirePubSubPush: %v; rejecting all push requests", err)
+		return func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "unauthorized",
+			})
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		authz := r.Header.Get("Authorization")
+		token := strings.TrimSpace(strings.TrimPrefix(authz, "Bearer "))
+		if !strings.HasPrefix(authz, "Bearer ") || token == "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "unauthorized",
+			})
+			return
+		}
+		if h.PushVerifier == nil {
+			log.Printf("requirePubSubPush: no verifier configured")
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"error": "server_error",
+			})
+			return
+		}
+
+		claims, err := h.PushVerifier.Verify(r.Context(), token, h.Cfg.PubSubPushAudience)
+		if err == nil {
+			err = checkPushClaims(claims, h.Cfg.PubSubPushServiceAccount)
+		}
+		if err != nil {
+			log.Printf("requirePubSubPush: rejected push request: %v", err)
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "unauthorized",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
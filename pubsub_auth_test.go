@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signTestToken builds an RS256 JWT with the given claims.
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestRequirePubSubPush(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		audience = "https://api.example.com/internal/pubsub/dicom-ingest"
+		pushSA   = "pubsub-push@example.iam.gserviceaccount.com"
+	)
+	h := &Handlers{
+		Cfg:          Config{PubSubPushAudience: audience, PubSubPushServiceAccount: pushSA},
+		PushVerifier: NewRSAPushVerifier(map[string]*rsa.PublicKey{"k1": &key.PublicKey}),
+	}
+	handler := h.requirePubSubPush(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            audience,
+			"sub":            "1234",
+			"email":          pushSA,
+			"email_verified": true,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(k string, v interface{}) map[string]interface{} {
+		c := valid()
+		c[k] = v
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", signTestToken(t, key, "k1", valid()), http.StatusOK},
+		{"missing token", "", http.StatusUnauthorized},
+		{"wrong audience", signTestToken(t, key, "k1", with("aud", "https://other")), http.StatusUnauthorized},
+		{"expired", signTestToken(t, key, "k1", with("exp", time.Now().Add(-time.Minute).Unix())), http.StatusUnauthorized},
+		{"wrong service account", signTestToken(t, key, "k1", with("email", "someone@example.com")), http.StatusUnauthorized},
+		{"unverified email", signTestToken(t, key, "k1", with("email_verified", false)), http.StatusUnauthorized},
+		{"wrong issuer", signTestToken(t, key, "k1", with("iss", "https://evil.example.com")), http.StatusUnauthorized},
+		{"unknown key", signTestToken(t, key, "k2", valid()), http.StatusUnauthorized},
+		{"bad signature", signTestToken(t, otherKey, "k1", valid()), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/internal/pubsub/dicom-ingest", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequirePubSubPushConfig(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const audience = "https://api.example.com/internal/pubsub/dicom-ingest"
+	// Any service account can mint a Google-signed token for the audience.
+	token := signTestToken(t, key, "k1", map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            audience,
+		"sub":            "1234",
+		"email":          "anyone@other-project.iam.gserviceaccount.com",
+		"email_verified": true,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	})
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want int
+	}{
+		{"no audience", Config{}, http.StatusUnauthorized},
+		{"no service account", Config{PubSubPushAudience: audience}, http.StatusUnauthorized},
+		{"insecure dev mode", Config{PubSubPushInsecure: true}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handlers{
+				Cfg:          tt.cfg,
+				PushVerifier: NewRSAPushVerifier(map[string]*rsa.PublicKey{"k1": &key.PublicKey}),
+			}
+			handler := h.requirePubSubPush(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/internal/pubsub/dicom-ingest", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if gotErr := tt.cfg.validatePubSubPush() != nil; gotErr != (tt.want != http.StatusOK) {
+				t.Errorf("validatePubSubPush error = %v", gotErr)
+			}
+		})
+	}
+}
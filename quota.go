@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Usage scopes. Every upload is charged to the owning account and, for
+// provider uploads, to the provider organization as well.
+const (
+	QuotaScopeAccount     = "account"
+	QuotaScopeProviderOrg = "provider_org"
+)
+
+// QuotaLimits caps usage for one scope. Zero means unlimited.
+type QuotaLimits struct {
+	MaxBytes          int64 `firestore:"max_bytes" json:"max_bytes"`
+	MaxStudies        int64 `firestore:"max_studies" json:"max_studies"`
+	MaxSessionsPerDay int64 `firestore:"max_sessions_per_day" json:"max_sessions_per_day"`
+}
+
+// UsageRecord is the usage document for one scope in the imaging_usage
+// collection. Limits, when set, override the configured defaults field by
+// field.
+type UsageRecord struct {
+	ScopeType string `firestore:"scope_type" json:"scope_type"`
+	ScopeID   string `firestore:"scope_id" json:"scope_id"`
+
+	BytesStored int64 `firestore:"bytes_stored" json:"bytes_stored"`
+	// PendingBytes sums the bytes declared by upload sessions that have not
+	// finished ingest yet; it counts against MaxBytes alongside BytesStored.
+	PendingBytes int64 `firestore:"pending_bytes" json:"pending_bytes"`
+	Studies      int64 `firestore:"studies" json:"studies"`
+
+	SessionsDay   string `firestore:"sessions_day" json:"sessions_day"` // YYYY-MM-DD (UTC) SessionsToday refers to
+	SessionsToday int64  `firestore:"sessions_today" json:"sessions_today"`
+
+	Limits *QuotaLimits `firestore:"limits,omitempty" json:"limits,omitempty"`
+
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// quotaScope identifies one usage document.
+type quotaScope struct {
+	Type string
+	ID   string
+}
+
+func (s quotaScope) docID() string {
+	return s.Type + ":" + s.ID
+}
+
+// QuotaViolation describes the first limit an operation would exceed.
+type QuotaViolation struct {
+	ScopeType string `json:"scope_type"`
+	ScopeID   string `json:"scope_id"`
+	Limit     string `json:"limit"` // bytes|studies|sessions_per_day
+	Max       int64  `json:"max"`
+	Used      int64  `json:"used"`
+}
+
+func (v *QuotaViolation) Error() string {
+	return fmt.Sprintf("%s %s quota exceeded for %s (used=%d max=%d)", v.ScopeType, v.Limit, v.ScopeID, v.Used, v.Max)
+}
+
+// quotaScopesForSession returns the scopes an upload session is charged to.
+func quotaScopesForSession(userID, providerOrgID string) []quotaScope {
+	scopes := []quotaScope{{Type: QuotaScopeAccount, ID: userID}}
+	if providerOrgID != "" {
+		scopes = append(scopes, quotaScope{Type: QuotaScopeProviderOrg, ID: providerOrgID})
+	}
+	return scopes
+}
+
+// effectiveLimits merges per-scope overrides on rec over the configured
+// defaults for the scope type.
+func (h *Handlers) effectiveLimits(scopeType string, rec *UsageRecord) QuotaLimits {
+	limits := h.Cfg.AccountQuota
+	if scopeType == QuotaScopeProviderOrg {
+		limits = h.Cfg.ProviderOrgQuota
+	}
+	if rec != nil && rec.Limits != nil {
+		if rec.Limits.MaxBytes > 0 {
+			limits.MaxBytes = rec.Limits.MaxBytes
+		}
+		if rec.Limits.MaxStudies > 0 {
+			limits.MaxStudies = rec.Limits.MaxStudies
+		}
+		if rec.Limits.MaxSessionsPerDay > 0 {
+			limits.MaxSessionsPerDay = rec.Limits.MaxSessionsPerDay
+		}
+	}
+	return limits
+}
+
+// checkQuota reports whether adding addBytes of storage and addSessions new
+// sessions on day would exceed limits. Studies are only counted once ingest
+// completes, so an account already at its study limit cannot start or add to
+// an upload.
+func checkQuota(scope quotaScope, rec *UsageRecord, limits QuotaLimits, addBytes, addSessions int64, day string) *QuotaViolation {
+	if rec == nil {
+		rec = &UsageRecord{}
+	}
+	violation := func(limit string, max, used int64) *QuotaViolation {
+		return &QuotaViolation{ScopeType: scope.Type, ScopeID: scope.ID, Limit: limit, Max: max, Used: used}
+	}
+
+	if limits.MaxStudies > 0 && rec.Studies >= limits.MaxStudies {
+		return violation("studies", limits.MaxStudies, rec.Studies)
+	}
+	if limits.MaxBytes > 0 && rec.BytesStored+rec.PendingBytes+addBytes > limits.MaxBytes {
+		return violation("bytes", limits.MaxBytes, rec.BytesStored+rec.PendingBytes)
+	}
+	if addSessions > 0 && limits.MaxSessionsPerDay > 0 {
+		today := int64(0)
+		if rec.SessionsDay == day {
+			today = rec.SessionsToday
+		}
+		if today+addSessions > limits.MaxSessionsPerDay {
+			return violation("sessions_per_day", limits.MaxSessionsPerDay, today)
+		}
+	}
+	return nil
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: imaging_usage
+//
+// GetUsage returns the usage document for a scope, or nil if none exists yet.
+func (db *FirestoreDB) GetUsage(ctx context.Context, scopeType, scopeID string) (*UsageRecord, error) {
+	scope := quotaScope{Type: scopeType, ID: scopeID}
+	snap, err := db.client.Collection("imaging_usage").Doc(scope.docID()).Get(ctx)
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get usage (%s): %w", scope.docID(), err)
+	}
+	var rec UsageRecord
+	if err := snap.DataTo(&rec); err != nil {
+		return nil, fmt.Errorf("decode usage (%s): %w", scope.docID(), err)
+	}
+	return &rec, nil
+}
+
+// ReserveUploadSession atomically checks every scope's quota and, if none is
+// exceeded, counts one new upload session for today against each of them.
+func (db *FirestoreDB) ReserveUploadSession(
+	ctx context.Context,
+	scopes []quotaScope,
+	limitsFor func(scopeType string, rec *UsageRecord) QuotaLimits,
+	now time.Time,
+) (*QuotaViolation, error) {
+	day := now.UTC().Format("2006-01-02")
+	col := db.client.Collection("imaging_usage")
+
+	var violation *QuotaViolation
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		violation = nil
+		recs := make([]*UsageRecord, len(scopes))
+		for i, scope := range scopes {
+			snap, err := tx.Get(col.Doc(scope.docID()))
+			if err != nil {
+				if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+					continue
+				}
+				return err
+			}
+			var rec UsageRecord
+			if err := snap.DataTo(&rec); err != nil {
+				return fmt.Errorf("decode usage (%s): %w", scope.docID(), err)
+			}
+			recs[i] = &rec
+		}
+
+		for i, scope := range scopes {
+			if v := checkQuota(scope, recs[i], limitsFor(scope.Type, recs[i]), 0, 1, day); v != nil {
+				violation = v
+				return nil
+			}
+		}
+
+		for i, scope := range scopes {
+			sessionsToday := int64(1)
+			if recs[i] != nil && recs[i].SessionsDay == day {
+				sessionsToday = recs[i].SessionsToday + 1
+			}
+			if err := tx.Set(col.Doc(scope.docID()), map[string]interface{}{
+				"scope_type":     scope.Type,
+				"scope_id":       scope.ID,
+				"sessions_day":   day,
+				"sessions_today": sessionsToday,
+				"updated_at":     now.UTC(),
+			}, firestore.MergeAll); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reserve upload session: %w", err)
+	}
+	return violation, nil
+}
+
+// ReserveUploadBytes atomically checks every scope's byte and study quotas
+// against addBytes and, if none is exceeded, adds addBytes to each scope's
+// pending_bytes and to the session's declared_bytes and pending_bytes.
+// Pending bytes are not stored yet but will be once the session is
+// ingested, so concurrent URL requests and sessions cannot together slip
+// past the byte quota. ReleasePendingBytes gives them back.
+func (db *FirestoreDB) ReserveUploadBytes(
+	ctx context.Context,
+	sessionID string,
+	scopes []quotaScope,
+	limitsFor func(scopeType string, rec *UsageRecord) QuotaLimits,
+	addBytes int64,
+) (*QuotaViolation, error) {
+	col := db.client.Collection("imaging_usage")
+	sessRef := db.client.Collection("upload_sessions").Doc(sessionID)
+
+	var violation *QuotaViolation
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		violation = nil
+		if _, err := tx.Get(sessRef); err != nil {
+			return err
+		}
+		recs := make([]*UsageRecord, len(scopes))
+		for i, scope := range scopes {
+			snap, err := tx.Get(col.Doc(scope.docID()))
+			if err != nil {
+				if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+					continue
+				}
+				return err
+			}
+			var rec UsageRecord
+			if err := snap.DataTo(&rec); err != nil {
+				return fmt.Errorf("decode usage (%s): %w", scope.docID(), err)
+			}
+			recs[i] = &rec
+		}
+
+		for i, scope := range scopes {
+			if v := checkQuota(scope, recs[i], limitsFor(scope.Type, recs[i]), addBytes, 0, ""); v != nil {
+				violation = v
+				return nil
+			}
+		}
+		if addBytes == 0 {
+			return nil
+		}
+		now := time.Now().UTC()
+		for _, scope := range scopes {
+			if err := tx.Set(col.Doc(scope.docID()), map[string]interface{}{
+				"scope_type":    scope.Type,
+				"scope_id":      scope.ID,
+				"pending_bytes": firestore.Increment(addBytes),
+				"updated_at":    now,
+			}, firestore.MergeAll); err != nil {
+				return err
+			}
+		}
+		return tx.Update(sessRef, []firestore.Update{
+			{Path: "declared_bytes", Value: firestore.Increment(addBytes)},
+			{Path: "pending_bytes", Value: firestore.Increment(addBytes)},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reserve upload bytes (%s): %w", sessionID, err)
+	}
+	return violation, nil
+}
+
+// ReleasePendingBytes returns the session's pending bytes to every scope it
+// was charged to and zeroes them on the session. It runs when ingest ends,
+// successfully or not; imported bytes are charged by AddUsage instead.
+// Releasing twice is a no-op.
+func (db *FirestoreDB) ReleasePendingBytes(ctx context.Context, sessionID string) error {
+	col := db.client.Collection("imaging_usage")
+	sessRef := db.client.Collection("upload_sessions").Doc(sessionID)
+
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(sessRef)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+		var sess UploadSession
+		if err := snap.DataTo(&sess); err != nil {
+			return fmt.Errorf("decode upload session (%s): %w", sessionID, err)
+		}
+		if sess.PendingBytes == 0 {
+			return nil
+		}
+		now := time.Now().UTC()
+		for _, scope := range quotaScopesForSession(sess.UserID, sess.ProviderOrgID) {
+			if err := tx.Set(col.Doc(scope.docID()), map[string]interface{}{
+				"scope_type":    scope.Type,
+				"scope_id":      scope.ID,
+				"pending_bytes": firestore.Increment(-sess.PendingBytes),
+				"updated_at":    now,
+			}, firestore.MergeAll); err != nil {
+				return err
+			}
+		}
+		return tx.Update(sessRef, []firestore.Update{
+			{Path: "pending_bytes", Value: 0},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("release pending bytes (%s): %w", sessionID, err)
+	}
+	return nil
+}
+
+// AddUsage adjusts stored bytes and study counts for each scope. Negative
+// deltas release usage, e.g. when a study is deleted.
+func (db *FirestoreDB) AddUsage(ctx context.Context, scopes []quotaScope, deltaBytes, deltaStudies int64) error {
+	col := db.client.Collection("imaging_usage")
+	for _, scope := range scopes {
+		_, err := col.Doc(scope.docID()).Set(ctx, map[string]interface{}{
+			"scope_type":   scope.Type,
+			"scope_id":     scope.ID,
+			"bytes_stored": firestore.Increment(deltaBytes),
+			"studies":      firestore.Increment(deltaStudies),
+			"updated_at":   time.Now().UTC(),
+		}, firestore.MergeAll)
+		if err != nil {
+			return fmt.Errorf("add usage (%s): %w", scope.docID(), err)
+		}
+	}
+	return nil
+}
+
+// reserveUploadSession enforces session quotas for a new upload session.
+func (h *Handlers) reserveUploadSession(ctx context.Context, userID, providerOrgID string) (*QuotaViolation, error) {
+	return h.DB.ReserveUploadSession(ctx, quotaScopesForSession(userID, providerOrgID), h.effectiveLimits, time.Now())
+}
+
+// reserveUploadBytes enforces the byte and study quotas before issuing an
+// upload URL for addBytes more data in sess, and counts the bytes against
+// the session if they fit.
+func (h *Handlers) reserveUploadBytes(ctx context.Context, sess *UploadSession, addBytes int64) (*QuotaViolation, error) {
+	scopes := quotaScopesForSession(sess.UserID, sess.ProviderOrgID)
+	return h.DB.ReserveUploadBytes(ctx, sess.SessionID, scopes, h.effectiveLimits, addBytes)
+}
+
+// writeQuotaExceeded writes the standard 429 response for a quota violation.
+func writeQuotaExceeded(w http.ResponseWriter, v *QuotaViolation) {
+	writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"error": "quota_exceeded",
+		"quota": v,
+	})
+}
+
+// ImagingUsageHandler implements GET /api/imaging/usage.
+// It returns the authenticated user's storage usage and quota limits for the
+// patient dashboard.
+func (h *Handlers) ImagingUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("ImagingUsageHandler getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthorized",
+		})
+		return
+	}
+
+	rec, err := h.DB.GetUsage(ctx, QuotaScopeAccount, userID)
+	if err != nil {
+		log.Printf("ImagingUsageHandler GetUsage error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	limits := h.effectiveLimits(QuotaScopeAccount, rec)
+	if rec == nil {
+		rec = &UsageRecord{ScopeType: QuotaScopeAccount, ScopeID: userID}
+	}
+	sessionsToday := int64(0)
+	if rec.SessionsDay == time.Now().UTC().Format("2006-01-02") {
+		sessionsToday = rec.SessionsToday
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok": true,
+		"usage": map[string]interface{}{
+			"bytes_stored":   rec.BytesStored,
+			"studies":        rec.Studies,
+			"sessions_today": sessionsToday,
+		},
+		"limits": limits,
+	})
+}
+
+// releaseStudyUsage returns a deleted study's bytes and study slot to its
+// owner and provider organization.
+func (h *Handlers) releaseStudyUsage(ctx context.Context, study *ImagingStudy) {
+	scopes := quotaScopesForSession(study.UserID, strings.TrimSpace(study.ProviderOrgID))
+	if err := h.DB.AddUsage(ctx, scopes, -study.SizeBytes, -1); err != nil {
+		log.Printf("releaseStudyUsage: study %s: %v", study.StudyID, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckQuota(t *testing.T) {
+	scope := quotaScope{Type: QuotaScopeAccount, ID: "user-1"}
+	limits := QuotaLimits{MaxBytes: 1000, MaxStudies: 3, MaxSessionsPerDay: 2}
+	const day = "2026-10-18"
+
+	tests := []struct {
+		name        string
+		rec         *UsageRecord
+		addBytes    int64
+		addSessions int64
+		wantLimit   string
+	}{
+		{"no usage yet", nil, 500, 1, ""},
+		{"bytes exceeded", &UsageRecord{BytesStored: 900}, 200, 0, "bytes"},
+		{"bytes at limit", &UsageRecord{BytesStored: 800}, 200, 0, ""},
+		{"pending bytes count", &UsageRecord{BytesStored: 500, PendingBytes: 400}, 200, 0, "bytes"},
+		{"studies full", &UsageRecord{Studies: 3}, 0, 1, "studies"},
+		{"sessions today full", &UsageRecord{SessionsDay: day, SessionsToday: 2}, 0, 1, "sessions_per_day"},
+		{"sessions from yesterday", &UsageRecord{SessionsDay: "2026-10-17", SessionsToday: 2}, 0, 1, ""},
+		{"sessions ignored for url", &UsageRecord{SessionsDay: day, SessionsToday: 2}, 10, 0, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := checkQuota(scope, tc.rec, limits, tc.addBytes, tc.addSessions, day)
+			got := ""
+			if v != nil {
+				got = v.Limit
+			}
+			if got != tc.wantLimit {
+				t.Fatalf("checkQuota limit = %q, want %q (%+v)", got, tc.wantLimit, v)
+			}
+		})
+	}
+
+	if v := checkQuota(scope, &UsageRecord{BytesStored: 1 << 40, Studies: 1 << 20}, QuotaLimits{}, 1, 1, day); v != nil {
+		t.Fatalf("zero limits should be unlimited, got %+v", v)
+	}
+}
+
+func TestEffectiveLimits(t *testing.T) {
+	h := &Handlers{Cfg: Config{
+		AccountQuota:     QuotaLimits{MaxBytes: 100, MaxStudies: 10, MaxSessionsPerDay: 5},
+		ProviderOrgQuota: QuotaLimits{MaxSessionsPerDay: 50},
+	}}
+
+	got := h.effectiveLimits(QuotaScopeAccount, &UsageRecord{Limits: &QuotaLimits{MaxBytes: 500}})
+	want := QuotaLimits{MaxBytes: 500, MaxStudies: 10, MaxSessionsPerDay: 5}
+	if got != want {
+		t.Fatalf("account limits = %+v, want %+v", got, want)
+	}
+	if got := h.effectiveLimits(QuotaScopeProviderOrg, nil); got != h.Cfg.ProviderOrgQuota {
+		t.Fatalf("provider limits = %+v, want %+v", got, h.Cfg.ProviderOrgQuota)
+	}
+}
@@ -0,0 +1,1035 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Registration volumes are resampled to roughly registrationGridMM voxels
+// and at most registrationMaxDim voxels per axis, which keeps a job to a
+// few seconds of CPU and a few MB of memory whatever the acquisition size.
+const (
+	registrationGridMM       = 3.0
+	registrationMaxDim       = 96
+	registrationFetchWorkers = 8
+	registrationJobTimeout   = 20 * time.Minute
+
+	// Instances are fetched transcoded so the pixel data is always native.
+	explicitVRLittleEndianUID = "1.2.840.10008.1.2.1"
+)
+
+// Registration job statuses. "done" and "error" predate the job queue and
+// are what API clients already poll for.
+const (
+	RegistrationJobQueued    = "queued"
+	RegistrationJobRunning   = "running"
+	RegistrationJobDone      = "done"
+	RegistrationJobFailed    = "error"
+	RegistrationJobCancelled = "cancelled"
+)
+
+// RegistrationJob is a background intensity-based registration of two
+// studies, stored in registration_jobs and run by RegistrationWorkerPool
+// under a lease. On success TransformID names the frame transform it
+// created.
+type RegistrationJob struct {
+	JobID           string `firestore:"job_id" json:"job_id"`
+	PatientUserID   string `firestore:"patient_user_id" json:"patient_user_id"`
+	SourceStudyID   string `firestore:"source_study_id" json:"source_study_id"`
+	TargetStudyID   string `firestore:"target_study_id" json:"target_study_id"`
+	SourceSeriesUID string `firestore:"source_series_uid" json:"source_series_uid"`
+	TargetSeriesUID string `firestore:"target_series_uid" json:"target_series_uid"`
+	Description     string `firestore:"description" json:"description"`
+
+	Status          string `firestore:"status" json:"status"` // "queued" | "running" | "done" | "error" | "cancelled"
+	Stage           string `firestore:"stage" json:"stage"`   // "loading_source" | "loading_target" | "registering" | "saving"
+	LastError       string `firestore:"last_error" json:"last_error"`
+	Attempts        int    `firestore:"attempts" json:"attempts"`
+	CancelRequested bool   `firestore:"cancel_requested" json:"cancel_requested"`
+
+	LeaseOwner     string    `firestore:"lease_owner" json:"lease_owner"`
+	LeaseExpiresAt time.Time `firestore:"lease_expires_at" json:"lease_expires_at"`
+	HeartbeatAt    time.Time `firestore:"heartbeat_at" json:"heartbeat_at"`
+	AvailableAt    time.Time `firestore:"available_at" json:"available_at"`
+
+	TransformID string               `firestore:"transform_id" json:"transform_id"`
+	Quality     *RegistrationQuality `firestore:"quality" json:"quality"`
+
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// claimable reports whether a worker may take the job at now: it is queued
+// and due, or running under a lease that has expired. A job whose worker
+// died after a cancel request is not resumed.
+func (j *RegistrationJob) claimable(now time.Time) bool {
+	switch j.Status {
+	case RegistrationJobQueued:
+		return !j.AvailableAt.After(now)
+	case RegistrationJobRunning:
+		return !j.CancelRequested && j.LeaseExpiresAt.Before(now)
+	}
+	return false
+}
+
+// volumeSlice is one decoded image, block-averaged in plane, with the
+// geometry of its downsampled pixel grid.
+type volumeSlice struct {
+	position   [3]float64 // center of the first downsampled pixel
+	rowDir     [3]float64 // direction of increasing column index
+	colDir     [3]float64 // direction of increasing row index
+	rowSpacing float64    // mm between downsampled rows
+	colSpacing float64    // mm between downsampled columns
+	rows, cols int
+	pixels     []float32
+}
+
+// decodeVolumeSlice reads the first frame of a grayscale image, applies the
+// modality rescale and block-averages it down to about gridMM pixels.
+func decodeVolumeSlice(ds *dicom.Dataset, gridMM float64) (*volumeSlice, error) {
+	ipp := getFloatsByTagN(ds, tag.ImagePositionPatient, 3)
+	iop := getFloatsByTagN(ds, tag.ImageOrientationPatient, 6)
+	ps := getFloatsByTagN(ds, tag.PixelSpacing, 2)
+	if ipp == nil || iop == nil || ps == nil || ps[0] <= 0 || ps[1] <= 0 {
+		return nil, errors.New("image has no patient geometry")
+	}
+
+	el, err := ds.FindElementByTag(tag.PixelData)
+	if err != nil {
+		return nil, errors.New("image has no pixel data")
+	}
+	info, ok := el.Value.GetValue().(dicom.PixelDataInfo)
+	if !ok || info.IntentionallySkipped || len(info.Frames) == 0 {
+		return nil, errors.New("image has no pixel data")
+	}
+	if info.Frames[0].IsEncapsulated() {
+		return nil, errors.New("compressed pixel data")
+	}
+	nf, err := info.Frames[0].GetNativeFrame()
+	if err != nil {
+		return nil, err
+	}
+	if nf.SamplesPerPixel() != 1 {
+		return nil, errors.New("only grayscale images can be registered")
+	}
+
+	slope := firstFloat(getFloatsByTag(ds, tag.RescaleSlope))
+	if slope == 0 {
+		slope = 1
+	}
+	intercept := firstFloat(getFloatsByTag(ds, tag.RescaleIntercept))
+	signed := intTag(ds, tag.PixelRepresentation) == 1
+	rows, cols := nf.Rows(), nf.Cols()
+	var sample func(i int) int
+	switch raw := nf.RawDataSlice().(type) {
+	case []uint8:
+		sample = func(i int) int { return int(raw[i]) }
+		if signed {
+			sample = func(i int) int { return int(int8(raw[i])) }
+		}
+	case []uint16:
+		sample = func(i int) int { return int(raw[i]) }
+		if signed {
+			sample = func(i int) int { return int(int16(raw[i])) }
+		}
+	case []uint32:
+		sample = func(i int) int { return int(raw[i]) }
+		if signed {
+			sample = func(i int) int { return int(int32(raw[i])) }
+		}
+	case []int:
+		sample = func(i int) int { return raw[i] }
+	default:
+		return nil, fmt.Errorf("unsupported pixel data type %T", raw)
+	}
+	value := func(x, y int) float64 {
+		return float64(sample(y*cols+x))*slope + intercept
+	}
+
+	f := int(gridMM / math.Min(ps[0], ps[1]))
+	if f < 1 {
+		f = 1
+	}
+	for (cols+f-1)/f > registrationMaxDim || (rows+f-1)/f > registrationMaxDim {
+		f++
+	}
+	s := &volumeSlice{
+		rowDir:     [3]float64{iop[0], iop[1], iop[2]},
+		colDir:     [3]float64{iop[3], iop[4], iop[5]},
+		rowSpacing: ps[0] * float64(f),
+		colSpacing: ps[1] * float64(f),
+		rows:       rows / f,
+		cols:       cols / f,
+	}
+	if s.rows == 0 || s.cols == 0 {
+		return nil, errors.New("image is too small")
+	}
+	half := float64(f-1) / 2
+	for i := 0; i < 3; i++ {
+		s.position[i] = ipp[i] + s.rowDir[i]*ps[1]*half + s.colDir[i]*ps[0]*half
+	}
+	s.pixels = make([]float32, s.rows*s.cols)
+	for y := 0; y < s.rows; y++ {
+		for x := 0; x < s.cols; x++ {
+			sum := 0.0
+			for dy := 0; dy < f; dy++ {
+				for dx := 0; dx < f; dx++ {
+					sum += value(x*f+dx, y*f+dy)
+				}
+			}
+			s.pixels[y*s.cols+x] = float32(sum / float64(f*f))
+		}
+	}
+	return s, nil
+}
+
+// assembleVolume stacks slices along their normal. Slices are assumed to be
+// evenly spaced; the slice step is taken from the first and last positions.
+func assembleVolume(slices []*volumeSlice) (*volume, error) {
+	if len(slices) < 3 {
+		return nil, errors.New("series has too few slices for volume registration")
+	}
+	first := slices[0]
+	n := sliceNormal([]float64{first.rowDir[0], first.rowDir[1], first.rowDir[2], first.colDir[0], first.colDir[1], first.colDir[2]})
+	if n == nil {
+		return nil, errors.New("degenerate image orientation")
+	}
+	proj := func(s *volumeSlice) float64 { return s.position[0]*n[0] + s.position[1]*n[1] + s.position[2]*n[2] }
+	sort.SliceStable(slices, func(a, b int) bool { return proj(slices[a]) < proj(slices[b]) })
+	for _, s := range slices {
+		if s.rows != first.rows || s.cols != first.cols {
+			return nil, errors.New("slices differ in size")
+		}
+	}
+
+	first, last := slices[0], slices[len(slices)-1]
+	var step [3]float64
+	for i := range step {
+		step[i] = (last.position[i] - first.position[i]) / float64(len(slices)-1)
+	}
+	if math.Sqrt(sq(step[0])+sq(step[1])+sq(step[2])) < 1e-3 {
+		return nil, errors.New("slices share one position")
+	}
+
+	m := identityMat4()
+	for i := 0; i < 3; i++ {
+		m[i*4+0] = first.rowDir[i] * first.colSpacing
+		m[i*4+1] = first.colDir[i] * first.rowSpacing
+		m[i*4+2] = step[i]
+		m[i*4+3] = first.position[i]
+	}
+	v, err := newVolume(first.cols, first.rows, len(slices), m)
+	if err != nil {
+		return nil, err
+	}
+	for k, s := range slices {
+		copy(v.data[k*first.rows*first.cols:], s.pixels)
+	}
+	return v, nil
+}
+
+// registrationSlices picks the instances of one series to load: those in
+// the dominant orientation, one per slice position, thinned to about
+// registrationGridMM apart and at most registrationMaxDim slices.
+func registrationSlices(instances []*ImagingInstance) []*ImagingInstance {
+	counts := make(map[string]int)
+	var iop []float64
+	best := 0
+	for _, in := range instances {
+		if len(in.ImageOrientationPatient) != 6 || len(in.ImagePositionPatient) != 3 {
+			continue
+		}
+		key := fmt.Sprintf("%.3f", in.ImageOrientationPatient)
+		counts[key]++
+		if counts[key] > best {
+			best, iop = counts[key], in.ImageOrientationPatient
+		}
+	}
+	n := sliceNormal(iop)
+	if n == nil {
+		return nil
+	}
+	key := fmt.Sprintf("%.3f", iop)
+
+	type positioned struct {
+		in  *ImagingInstance
+		pos float64
+	}
+	var list []positioned
+	for _, in := range instances {
+		if len(in.ImagePositionPatient) != 3 || fmt.Sprintf("%.3f", in.ImageOrientationPatient) != key {
+			continue
+		}
+		p := in.ImagePositionPatient
+		list = append(list, positioned{in, p[0]*n[0] + p[1]*n[1] + p[2]*n[2]})
+	}
+	sort.SliceStable(list, func(a, b int) bool { return list[a].pos < list[b].pos })
+
+	var unique []*ImagingInstance
+	last := math.Inf(-1)
+	for _, p := range list {
+		if p.pos-last < 1e-3 {
+			continue
+		}
+		unique = append(unique, p.in)
+		last = p.pos
+	}
+
+	stride := 1
+	if spacing := sliceSpacing(n, unique); spacing > 0 {
+		stride = int(math.Round(registrationGridMM / spacing))
+		if stride < 1 {
+			stride = 1
+		}
+	}
+	for (len(unique)+stride-1)/stride > registrationMaxDim {
+		stride++
+	}
+	var picked []*ImagingInstance
+	for i := 0; i < len(unique); i += stride {
+		picked = append(picked, unique[i])
+	}
+	return picked
+}
+
+// registrationSeries returns the instances of the requested series, or of
+// the study's largest series when seriesUID is empty.
+func registrationSeries(instances []*ImagingInstance, seriesUID string) []*ImagingInstance {
+	bySeries := make(map[string][]*ImagingInstance)
+	for _, in := range instances {
+		bySeries[in.SeriesInstanceUID] = append(bySeries[in.SeriesInstanceUID], in)
+	}
+	if seriesUID != "" {
+		return bySeries[seriesUID]
+	}
+	var best []*ImagingInstance
+	for uid, insts := range bySeries {
+		if uid == "" {
+			continue
+		}
+		if len(insts) > len(best) || (len(insts) == len(best) && uid < best[0].SeriesInstanceUID) {
+			best = insts
+		}
+	}
+	return best
+}
+
+// fetchDataset retrieves one instance, transcoded to native pixel data, and
+// parses it.
+func (h *Handlers) fetchDataset(ctx context.Context, in *ImagingInstance) (*dicom.Dataset, error) {
+	resp, err := h.Dicom.RetrieveInstanceTranscoded(ctx, in.StudyInstanceUID, in.SeriesInstanceUID, in.SOPInstanceUID, explicitVRLittleEndianUID)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("retrieve %s: upstream status %d", in.SOPInstanceUID, resp.StatusCode)
+	}
+	raw, err := readRetrievedInstance(resp)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := dicom.Parse(bytes.NewReader(raw), int64(len(raw)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", in.SOPInstanceUID, err)
+	}
+	return &ds, nil
+}
+
+// loadRegistrationVolume fetches and decodes the picked slices of a series
+// into a normalized coarse volume.
+func loadRegistrationVolume(
+	ctx context.Context,
+	instances []*ImagingInstance,
+	fetch func(context.Context, *ImagingInstance) (*dicom.Dataset, error),
+) (*volume, error) {
+	picked := registrationSlices(instances)
+	if len(picked) == 0 {
+		return nil, errors.New("series has no positioned slices")
+	}
+
+	slices := make([]*volumeSlice, len(picked))
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, registrationFetchWorkers)
+	)
+	for i, in := range picked {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, in *ImagingInstance) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ds, err := fetch(ctx, in)
+			if err == nil {
+				slices[i], err = decodeVolumeSlice(ds, registrationGridMM)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("instance %s: %w", in.SOPInstanceUID, err)
+				}
+				mu.Unlock()
+			}
+		}(i, in)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	v, err := assembleVolume(slices)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.normalize(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// voxelSize returns the largest voxel edge of a volume in mm.
+func voxelSize(v *volume) float64 {
+	size := 0.0
+	for c := 0; c < 3; c++ {
+		size = math.Max(size, math.Sqrt(sq(v.toPatient[c])+sq(v.toPatient[4+c])+sq(v.toPatient[8+c])))
+	}
+	return size
+}
+
+// runRegistrationJob loads both series, registers them and stores the
+// result as a frame transform, recording progress on the job document.
+// Errors that retrying cannot fix are marked permanent.
+func (h *Handlers) runRegistrationJob(ctx context.Context, job *RegistrationJob) error {
+	if job.TransformID != "" {
+		// An earlier attempt saved its transform but did not get to
+		// finish the job.
+		return nil
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, registrationJobTimeout)
+	defer cancel()
+
+	stage := func(s string) {
+		job.Stage = s
+		if err := h.DB.UpdateRegistrationJobProgress(ctx, job); err != nil {
+			log.Printf("runRegistrationJob UpdateRegistrationJobProgress(%s) error: %v", job.JobID, err)
+		}
+	}
+	// fail turns a timeout of this attempt into a permanent error: a job
+	// that ran out of time once would only do so again.
+	fail := func(err error) error {
+		if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+			return permanentIngestError("timeout", err)
+		}
+		return err
+	}
+
+	load := func(studyID string, seriesUID *string) (*volume, string, error) {
+		study, err := h.DB.GetImagingStudy(ctx, studyID)
+		if err != nil {
+			return nil, "", err
+		}
+		if study == nil {
+			return nil, "", permanentIngestError("study_not_found", fmt.Errorf("study %s not found", studyID))
+		}
+		instances, err := h.studyImagingInstances(ctx, study)
+		if err != nil {
+			return nil, "", err
+		}
+		series := registrationSeries(instances, *seriesUID)
+		if len(series) == 0 {
+			return nil, "", permanentIngestError("series_not_found", fmt.Errorf("study %s has no matching series", studyID))
+		}
+		*seriesUID = series[0].SeriesInstanceUID
+		forUID := dominantFrameOfReference(series)
+		if forUID == "" {
+			return nil, "", permanentIngestError("frame_of_reference_unknown", fmt.Errorf("study %s: frame of reference unknown", studyID))
+		}
+		v, err := loadRegistrationVolume(ctx, series, h.fetchDataset)
+		if err != nil {
+			return nil, "", fmt.Errorf("study %s: %w", studyID, err)
+		}
+		return v, forUID, nil
+	}
+
+	stage("loading_source")
+	source, sourceFoR, err := load(job.SourceStudyID, &job.SourceSeriesUID)
+	if err != nil {
+		return fail(err)
+	}
+	stage("loading_target")
+	target, targetFoR, err := load(job.TargetStudyID, &job.TargetSeriesUID)
+	if err != nil {
+		return fail(err)
+	}
+
+	stage("registering")
+	m, quality, err := registerMutualInformation(source, target, defaultMIOptions())
+	if err != nil {
+		return permanentIngestError("registration_failed", err)
+	}
+	quality.GridSpacing = voxelSize(target)
+
+	stage("saving")
+	t := &FrameTransform{
+		PatientUserID: job.PatientUserID,
+		SourceFoRUID:  sourceFoR,
+		TargetFoRUID:  targetFoR,
+		Kind:          FrameTransformRigid,
+		Matrix:        m[:],
+		Description:   job.Description,
+		CreatedBy:     job.PatientUserID,
+		Method:        FrameTransformMethodMutualInformation,
+		SourceStudyID: job.SourceStudyID,
+		TargetStudyID: job.TargetStudyID,
+		Quality:       quality,
+	}
+	if err := validateFrameTransform(t); err != nil {
+		return permanentIngestError("invalid_transform", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	if err := h.DB.CreateFrameTransform(ctx, t); err != nil {
+		return fail(err)
+	}
+	job.TransformID, job.Quality = t.TransformID, quality
+	if err := h.DB.UpdateRegistrationJobProgress(ctx, job); err != nil {
+		// The transform exists; a retry would create a second one.
+		log.Printf("runRegistrationJob UpdateRegistrationJobProgress(%s) error: %v", job.JobID, err)
+	}
+	return nil
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: registration_jobs
+//
+// CreateRegistrationJob stores a new queued job with a generated ID.
+func (db *FirestoreDB) CreateRegistrationJob(ctx context.Context, job *RegistrationJob) error {
+	id, err := randomTokenID("RGJ", 10)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	job.JobID = id
+	job.Status = RegistrationJobQueued
+	job.AvailableAt = now
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	if _, err := db.client.Collection("registration_jobs").Doc(id).Create(ctx, job); err != nil {
+		return fmt.Errorf("create registration job: %w", err)
+	}
+	return nil
+}
+
+// UpdateRegistrationJobProgress writes the progress fields of a running job
+// (stage, resolved series and the created transform) without touching its
+// status or lease.
+func (db *FirestoreDB) UpdateRegistrationJobProgress(ctx context.Context, job *RegistrationJob) error {
+	if job == nil || strings.TrimSpace(job.JobID) == "" {
+		return fmt.Errorf("invalid job")
+	}
+	job.UpdatedAt = time.Now().UTC()
+	_, err := db.client.Collection("registration_jobs").Doc(job.JobID).Update(ctx, []firestore.Update{
+		{Path: "stage", Value: job.Stage},
+		{Path: "source_series_uid", Value: job.SourceSeriesUID},
+		{Path: "target_series_uid", Value: job.TargetSeriesUID},
+		{Path: "transform_id", Value: job.TransformID},
+		{Path: "quality", Value: job.Quality},
+		{Path: "updated_at", Value: job.UpdatedAt},
+	})
+	if err != nil {
+		return fmt.Errorf("update registration job (%s): %w", job.JobID, err)
+	}
+	return nil
+}
+
+// GetRegistrationJob returns a job, or nil if it does not exist.
+func (db *FirestoreDB) GetRegistrationJob(ctx context.Context, jobID string) (*RegistrationJob, error) {
+	doc, err := db.client.Collection("registration_jobs").Doc(jobID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get registration job: %w", err)
+	}
+	var job RegistrationJob
+	if err := doc.DataTo(&job); err != nil {
+		return nil, fmt.Errorf("decode registration job: %w", err)
+	}
+	return &job, nil
+}
+
+// ClaimRegistrationJob takes the oldest claimable job under a lease for
+// owner. It returns nil when nothing is due.
+//
+// Requires composite indexes on (status, available_at) and
+// (status, lease_expires_at).
+func (db *FirestoreDB) ClaimRegistrationJob(ctx context.Context, owner string, lease time.Duration) (*RegistrationJob, error) {
+	col := db.client.Collection("registration_jobs")
+	now := time.Now().UTC()
+
+	queued, err := col.Where("status", "==", RegistrationJobQueued).
+		Where("available_at", "<=", now).
+		OrderBy("available_at", firestore.Asc).
+		Limit(10).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query queued registration jobs: %w", err)
+	}
+	expired, err := col.Where("status", "==", RegistrationJobRunning).
+		Where("lease_expires_at", "<", now).
+		Limit(10).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("query expired registration jobs: %w", err)
+	}
+
+	for _, cand := range append(expired, queued...) {
+		var claimed *RegistrationJob
+		err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			claimed = nil
+			snap, err := tx.Get(cand.Ref)
+			if err != nil {
+				return err
+			}
+			var job RegistrationJob
+			if err := snap.DataTo(&job); err != nil {
+				return err
+			}
+			now := time.Now().UTC()
+			if !job.claimable(now) {
+				return nil
+			}
+			job.Status = RegistrationJobRunning
+			job.Attempts++
+			job.LeaseOwner = owner
+			job.LeaseExpiresAt = now.Add(lease)
+			job.HeartbeatAt = now
+			job.UpdatedAt = now
+			claimed = &job
+			return tx.Set(cand.Ref, &job)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("claim registration job (%s): %w", cand.Ref.ID, err)
+		}
+		if claimed != nil {
+			return claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+// RenewRegistrationJobLease extends the lease while owner still holds it.
+// held is false if another worker has taken the job over; cancelRequested
+// reports a pending cancellation.
+func (db *FirestoreDB) RenewRegistrationJobLease(ctx context.Context, jobID, owner string, lease time.Duration) (held, cancelRequested bool, err error) {
+	ref := db.client.Collection("registration_jobs").Doc(jobID)
+	err = db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		held, cancelRequested = false, false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var job RegistrationJob
+		if err := snap.DataTo(&job); err != nil {
+			return err
+		}
+		if job.Status != RegistrationJobRunning || job.LeaseOwner != owner {
+			return nil
+		}
+		held, cancelRequested = true, job.CancelRequested
+		now := time.Now().UTC()
+		return tx.Update(ref, []firestore.Update{
+			{Path: "lease_expires_at", Value: now.Add(lease)},
+			{Path: "heartbeat_at", Value: now},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return false, false, fmt.Errorf("renew registration job lease (%s): %w", jobID, err)
+	}
+	return held, cancelRequested, nil
+}
+
+// FinishRegistrationJob releases the lease and records the outcome of an
+// attempt: cancelled, done, re-queued with backoff, or failed once the
+// error is permanent or the job has used maxAttempts. It returns the job
+// status.
+func (db *FirestoreDB) FinishRegistrationJob(ctx context.Context, job *RegistrationJob, runErr error, cancelled bool, maxAttempts int) (string, error) {
+	now := time.Now().UTC()
+	updates := map[string]interface{}{
+		"lease_owner":      "",
+		"lease_expires_at": time.Time{},
+		"cancel_requested": false,
+		"updated_at":       now,
+		"last_error":       "",
+	}
+	switch {
+	case cancelled:
+		updates["status"] = RegistrationJobCancelled
+	case runErr == nil:
+		updates["status"] = RegistrationJobDone
+		updates["stage"] = ""
+	default:
+		updates["last_error"] = runErr.Error()
+		if permanent, _ := classifyIngestError(runErr); !permanent && job.Attempts < maxAttempts {
+			updates["status"] = RegistrationJobQueued
+			updates["available_at"] = now.Add(ingestRetryBackoff(job.Attempts))
+		} else {
+			updates["status"] = RegistrationJobFailed
+		}
+	}
+	if _, err := db.client.Collection("registration_jobs").Doc(job.JobID).Set(ctx, updates, firestore.MergeAll); err != nil {
+		return "", fmt.Errorf("finish registration job (%s): %w", job.JobID, err)
+	}
+	return updates["status"].(string), nil
+}
+
+// CancelRegistrationJob cancels a job: a queued job is cancelled at once, a
+// running one is flagged and stopped by its worker at the next heartbeat.
+// It returns the job (nil if it does not exist) and whether anything was
+// cancelled.
+func (db *FirestoreDB) CancelRegistrationJob(ctx context.Context, jobID string) (*RegistrationJob, bool, error) {
+	ref := db.client.Collection("registration_jobs").Doc(jobID)
+	var (
+		job       *RegistrationJob
+		cancelled bool
+	)
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		job, cancelled = nil, false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+		var j RegistrationJob
+		if err := snap.DataTo(&j); err != nil {
+			return err
+		}
+		job = &j
+		switch j.Status {
+		case RegistrationJobQueued:
+			j.Status = RegistrationJobCancelled
+		case RegistrationJobRunning:
+			j.CancelRequested = true
+		default:
+			return nil
+		}
+		j.UpdatedAt = time.Now().UTC()
+		cancelled = true
+		return tx.Set(ref, &j)
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("cancel registration job (%s): %w", jobID, err)
+	}
+	return job, cancelled, nil
+}
+
+// ////////////////////////////////////////////////////////////////
+//
+//	Registration worker pool
+//
+// RegistrationWorkerPool runs queued registration jobs with a fixed number
+// of workers. Like the index pool it can run in several processes over the
+// same registration_jobs collection.
+type RegistrationWorkerPool struct {
+	h           *Handlers
+	workers     int
+	maxAttempts int
+	owner       string
+	lease       time.Duration
+	poll        time.Duration
+	wake        chan struct{}
+}
+
+// NewRegistrationWorkerPool creates a pool of workers for h.
+func NewRegistrationWorkerPool(h *Handlers, workers, maxAttempts int) *RegistrationWorkerPool {
+	host, _ := os.Hostname()
+	suffix, err := randomTokenID("W", 6)
+	if err != nil {
+		suffix = fmt.Sprintf("W-%d", time.Now().UnixNano())
+	}
+	return &RegistrationWorkerPool{
+		h:           h,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		owner:       fmt.Sprintf("%s/%d/%s", host, os.Getpid(), suffix),
+		lease:       time.Minute,
+		poll:        10 * time.Second,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes an idle worker, e.g. right after a job is created. Safe to
+// call on a nil pool.
+func (p *RegistrationWorkerPool) Notify() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers and blocks until ctx is cancelled and they have
+// stopped.
+func (p *RegistrationWorkerPool) Run(ctx context.Context) {
+	log.Printf("RegistrationWorkerPool: starting %d workers as %s", p.workers, p.owner)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *RegistrationWorkerPool) loop(ctx context.Context) {
+	ticker := time.NewTicker(p.poll)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			job, err := p.h.DB.ClaimRegistrationJob(ctx, p.owner, p.lease)
+			if err != nil {
+				log.Printf("RegistrationWorkerPool: ClaimRegistrationJob error: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			p.runJob(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// runJob executes one claimed job, heartbeating its lease and watching for
+// cancellation until it finishes.
+func (p *RegistrationWorkerPool) runJob(ctx context.Context, job *RegistrationJob) {
+	log.Printf("RegistrationWorkerPool: running job %s attempt=%d", job.JobID, job.Attempts)
+
+	if job.Attempts > p.maxAttempts {
+		err := fmt.Errorf("giving up after %d attempts: %s", job.Attempts-1, job.LastError)
+		p.finish(ctx, job, err, false)
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var cancelRequested atomic.Bool
+	go func() {
+		t := time.NewTicker(p.lease / 6)
+		defer t.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-t.C:
+				held, cancelReq, err := p.h.DB.RenewRegistrationJobLease(runCtx, job.JobID, p.owner, p.lease)
+				if err != nil {
+					log.Printf("RegistrationWorkerPool: heartbeat %s error: %v", job.JobID, err)
+					continue
+				}
+				if cancelReq {
+					log.Printf("RegistrationWorkerPool: job %s cancelled", job.JobID)
+					cancelRequested.Store(true)
+					cancel()
+					return
+				}
+				if !held {
+					log.Printf("RegistrationWorkerPool: lost lease on job %s, stopping", job.JobID)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := p.h.runRegistrationJob(runCtx, job)
+	if err != nil {
+		log.Printf("RegistrationWorkerPool: job %s attempt %d failed: %v", job.JobID, job.Attempts, err)
+	}
+	if cancelRequested.Load() {
+		p.finish(ctx, job, nil, true)
+		return
+	}
+	if runCtx.Err() != nil {
+		// Shutting down or lease lost: leave the job to whoever resumes it.
+		return
+	}
+	p.finish(ctx, job, err, false)
+}
+
+func (p *RegistrationWorkerPool) finish(ctx context.Context, job *RegistrationJob, runErr error, cancelled bool) {
+	if _, err := p.h.DB.FinishRegistrationJob(ctx, job, runErr, cancelled, p.maxAttempts); err != nil {
+		log.Printf("RegistrationWorkerPool: FinishRegistrationJob(%s) error: %v", job.JobID, err)
+	}
+}
+
+// ////////////////////////////////////////////////////
+//
+//	ENDPOINT: /api/imaging/longitudinal/auto-register[/{jobId}]
+//
+// LongitudinalAutoRegisterHandler starts and polls intensity-based rigid
+// registrations:
+//
+//	POST   /api/imaging/longitudinal/auto-register          queue a job
+//	GET    /api/imaging/longitudinal/auto-register/{jobId}  job status
+//	DELETE /api/imaging/longitudinal/auto-register/{jobId}  cancel a job
+//
+// POST body:
+//
+//	{
+//	  "sourceStudyId": "STUDY-A",
+//	  "targetStudyId": "STUDY-B",
+//	  "sourceSeriesUid": "1.2.3",  // optional, defaults to the largest series
+//	  "targetSeriesUid": "1.2.4",  // optional
+//	  "description": "..."
+//	}
+//
+// The job maximizes mutual information between coarse volumes of the two
+// series and, when done, stores the result in frame_transforms. Jobs run on
+// the registration worker pool and are retried on transient errors.
+func (h *Handlers) LongitudinalAutoRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	callerID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("LongitudinalAutoRegisterHandler getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+		return
+	}
+
+	const prefix = "/api/imaging/longitudinal/auto-register"
+	jobID := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	if jobID != "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		job, err := h.DB.GetRegistrationJob(ctx, jobID)
+		if err != nil {
+			log.Printf("LongitudinalAutoRegisterHandler GetRegistrationJob error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+			return
+		}
+		if job == nil || job.PatientUserID != callerID {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "job_not_found"})
+			return
+		}
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"job": job})
+			return
+		}
+		job, cancelled, err := h.DB.CancelRegistrationJob(ctx, jobID)
+		if err != nil {
+			log.Printf("LongitudinalAutoRegisterHandler CancelRegistrationJob error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "cancelled": cancelled, "job": job})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		SourceStudyID   string `json:"sourceStudyId"`
+		TargetStudyID   string `json:"targetStudyId"`
+		SourceSeriesUID string `json:"sourceSeriesUid"`
+		TargetSeriesUID string `json:"targetSeriesUid"`
+		Description     string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_json"})
+		return
+	}
+	body.SourceStudyID = strings.TrimSpace(body.SourceStudyID)
+	body.TargetStudyID = strings.TrimSpace(body.TargetStudyID)
+	if body.SourceStudyID == "" || body.TargetStudyID == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "sourceStudyId and targetStudyId required"})
+		return
+	}
+	if body.SourceStudyID == body.TargetStudyID && body.SourceSeriesUID == body.TargetSeriesUID {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "source and target must differ"})
+		return
+	}
+	if h.Dicom == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "dicom_client_not_configured"})
+		return
+	}
+
+	for _, studyID := range []string{body.SourceStudyID, body.TargetStudyID} {
+		study, err := h.DB.GetImagingStudy(ctx, studyID)
+		if err != nil {
+			log.Printf("LongitudinalAutoRegisterHandler GetImagingStudy(%s) error: %v", studyID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+			return
+		}
+		if study == nil || study.UserID != callerID {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "study_not_found", "study_id": studyID})
+			return
+		}
+	}
+
+	job := &RegistrationJob{
+		PatientUserID:   callerID,
+		SourceStudyID:   body.SourceStudyID,
+		TargetStudyID:   body.TargetStudyID,
+		SourceSeriesUID: strings.TrimSpace(body.SourceSeriesUID),
+		TargetSeriesUID: strings.TrimSpace(body.TargetSeriesUID),
+		Description:     body.Description,
+	}
+	if err := h.DB.CreateRegistrationJob(ctx, job); err != nil {
+		log.Printf("LongitudinalAutoRegisterHandler CreateRegistrationJob error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+		return
+	}
+
+	h.Registrar.Notify()
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"ok":  true,
+		"job": job,
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/frame"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// pixelDataset builds an axial 16-bit signed image at height z whose pixel
+// (x, y) holds x + 10*y - 20.
+func pixelDataset(t *testing.T, rows, cols int, z float64) *dicom.Dataset {
+	t.Helper()
+	nf := frame.NewNativeFrame[uint16](16, rows, cols, rows*cols, 1)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			nf.RawData[y*cols+x] = uint16(int16(x + 10*y - 20))
+		}
+	}
+	return &dicom.Dataset{Elements: []*dicom.Element{
+		mustElement(t, tag.ImagePositionPatient, []string{"-10", "-20", fmt.Sprint(z)}),
+		mustElement(t, tag.ImageOrientationPatient, []string{"1", "0", "0", "0", "1", "0"}),
+		mustElement(t, tag.PixelSpacing, []string{"1", "1"}),
+		mustElement(t, tag.PixelRepresentation, []int{1}),
+		mustElement(t, tag.RescaleSlope, []string{"2"}),
+		mustElement(t, tag.RescaleIntercept, []string{"5"}),
+		mustElement(t, tag.PixelData, dicom.PixelDataInfo{Frames: []*frame.Frame{{NativeData: nf}}}),
+	}}
+}
+
+func TestDecodeVolumeSliceDownsamples(t *testing.T) {
+	s, err := decodeVolumeSlice(pixelDataset(t, 8, 8, 4), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.rows != 4 || s.cols != 4 || s.rowSpacing != 2 || s.colSpacing != 2 {
+		t.Fatalf("grid = %dx%d @ %v,%v", s.rows, s.cols, s.rowSpacing, s.colSpacing)
+	}
+	if s.position != [3]float64{-9.5, -19.5, 4} {
+		t.Fatalf("position = %v", s.position)
+	}
+	// Block (0,0) averages x+10y-20 over x,y in {0,1}: -14.5, rescaled 2v+5.
+	if got := s.pixels[0]; got != -24 {
+		t.Fatalf("pixel[0] = %v, want -24", got)
+	}
+}
+
+func TestAssembleVolumeOrdersSlices(t *testing.T) {
+	var slices []*volumeSlice
+	for _, z := range []float64{6, 0, 3} {
+		s, err := decodeVolumeSlice(pixelDataset(t, 4, 4, z), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.pixels[0] = float32(z)
+		slices = append(slices, s)
+	}
+	v, err := assembleVolume(slices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.nx != 4 || v.ny != 4 || v.nz != 3 {
+		t.Fatalf("dims = %d %d %d", v.nx, v.ny, v.nz)
+	}
+	for k, z := range []float64{0, 3, 6} {
+		if v.at(0, 0, k) != float32(z) {
+			t.Fatalf("slice %d holds z=%v", k, v.at(0, 0, k))
+		}
+	}
+	x, y, z := v.toPatient.apply(2, 1, 2)
+	if x != -8 || y != -19 || z != 6 {
+		t.Fatalf("voxel (2,1,2) at %v %v %v", x, y, z)
+	}
+}
+
+func TestRegistrationSlicesThinsAndDropsLocalizers(t *testing.T) {
+	axial := []float64{1, 0, 0, 0, 1, 0}
+	var instances []*ImagingInstance
+	for i := 0; i < 10; i++ {
+		instances = append(instances, &ImagingInstance{
+			SOPInstanceUID:          fmt.Sprint(i),
+			ImagePositionPatient:    []float64{0, 0, float64(i)},
+			ImageOrientationPatient: axial,
+		})
+	}
+	instances = append(instances,
+		&ImagingInstance{SOPInstanceUID: "dup", ImagePositionPatient: []float64{0, 0, 0}, ImageOrientationPatient: axial},
+		&ImagingInstance{SOPInstanceUID: "loc", ImagePositionPatient: []float64{0, 0, 0}, ImageOrientationPatient: []float64{0, 1, 0, 0, 0, -1}},
+	)
+
+	got := registrationSlices(instances)
+	var uids []string
+	for _, in := range got {
+		uids = append(uids, in.SOPInstanceUID)
+	}
+	if fmt.Sprint(uids) != "[0 3 6 9]" {
+		t.Fatalf("picked %v", uids)
+	}
+}
+
+func TestLoadRegistrationVolume(t *testing.T) {
+	var instances []*ImagingInstance
+	datasets := make(map[string]*dicom.Dataset)
+	for i := 0; i < 4; i++ {
+		uid := fmt.Sprint(i)
+		z := float64(3 * i)
+		instances = append(instances, &ImagingInstance{
+			SOPInstanceUID:          uid,
+			ImagePositionPatient:    []float64{-10, -20, z},
+			ImageOrientationPatient: []float64{1, 0, 0, 0, 1, 0},
+		})
+		datasets[uid] = pixelDataset(t, 12, 12, z)
+	}
+	fetch := func(_ context.Context, in *ImagingInstance) (*dicom.Dataset, error) {
+		return datasets[in.SOPInstanceUID], nil
+	}
+
+	v, err := loadRegistrationVolume(context.Background(), instances, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.nx != 4 || v.ny != 4 || v.nz != 4 {
+		t.Fatalf("dims = %d %d %d", v.nx, v.ny, v.nz)
+	}
+	if got := voxelSize(v); math.Abs(got-3) > 1e-9 {
+		t.Fatalf("voxel size = %v", got)
+	}
+	for _, val := range v.data {
+		if val < 0 || val > 1 {
+			t.Fatalf("value %v not normalized", val)
+		}
+	}
+}
+
+func TestRegistrationJobClaimable(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		job  RegistrationJob
+		want bool
+	}{
+		{"queued due", RegistrationJob{Status: RegistrationJobQueued, AvailableAt: now.Add(-time.Second)}, true},
+		{"queued backing off", RegistrationJob{Status: RegistrationJobQueued, AvailableAt: now.Add(time.Minute)}, false},
+		{"running leased", RegistrationJob{Status: RegistrationJobRunning, LeaseExpiresAt: now.Add(time.Minute)}, false},
+		{"running lease expired", RegistrationJob{Status: RegistrationJobRunning, LeaseExpiresAt: now.Add(-time.Minute)}, true},
+		{"cancelling lease expired", RegistrationJob{Status: RegistrationJobRunning, CancelRequested: true, LeaseExpiresAt: now.Add(-time.Minute)}, false},
+		{"done", RegistrationJob{Status: RegistrationJobDone}, false},
+		{"failed", RegistrationJob{Status: RegistrationJobFailed}, false},
+		{"cancelled", RegistrationJob{Status: RegistrationJobCancelled}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.job.claimable(now); got != tc.want {
+			t.Errorf("%s: claimable = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sliceStack is a set of parallel slices of one series and frame of
+// reference, sorted by their plane offset along the shared normal.
+type sliceStack struct {
+	seriesUID string
+	normal    [3]float64
+	slices    []*IndexedSlice // ascending PlaneD
+}
+
+// nearest returns the slice whose plane is closest to the point by binary
+// search on PlaneD; only the two planes around n·p can be closest.
+func (st *sliceStack) nearest(x, y, z float64) (*IndexedSlice, float64) {
+	d := st.normal[0]*x + st.normal[1]*y + st.normal[2]*z
+	i := sort.Search(len(st.slices), func(i int) bool { return st.slices[i].PlaneD >= d })
+	var best *IndexedSlice
+	bestDist := math.Inf(1)
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(st.slices) {
+			continue
+		}
+		if dist := math.Abs(d - st.slices[j].PlaneD); dist < bestDist {
+			best, bestDist = st.slices[j], dist
+		}
+	}
+	return best, bestDist
+}
+
+type sliceCandidate struct {
+	slice    *IndexedSlice
+	distance float64
+}
+
+// within appends every slice whose plane lies within radius of the point,
+// binary searching for the start of the PlaneD range.
+func (st *sliceStack) within(x, y, z, radius float64, out []sliceCandidate) []sliceCandidate {
+	d := st.normal[0]*x + st.normal[1]*y + st.normal[2]*z
+	i := sort.Search(len(st.slices), func(i int) bool { return st.slices[i].PlaneD >= d-radius })
+	for ; i < len(st.slices) && st.slices[i].PlaneD <= d+radius; i++ {
+		out = append(out, sliceCandidate{st.slices[i], math.Abs(d - st.slices[i].PlaneD)})
+	}
+	return out
+}
+
+// studySliceIndex is the in-memory form of a study's imaging_slice_index
+// documents, grouped by frame of reference and orientation.
+type studySliceIndex struct {
+	slices []*IndexedSlice
+	frames []*IndexedSlice          // one slice per frame of reference, for pickSliceFrame
+	stacks map[string][]*sliceStack // by FrameOfReferenceUID
+
+	// maxTolerance is the largest sliceTolerance of any slice, the search
+	// radius when slices use their own tolerance.
+	maxTolerance float64
+}
+
+// sliceStackKey groups a series' slices whose normals agree to ~0.1°;
+// slices in one stack must share the normal for PlaneD ordering to be
+// meaningful.
+func sliceStackKey(s *IndexedSlice) string {
+	return fmt.Sprintf("%s|%s|%.3f|%.3f|%.3f", s.FrameOfReferenceUID, s.SeriesInstanceUID, s.NormalX, s.NormalY, s.NormalZ)
+}
+
+func buildStudySliceIndex(slices []*IndexedSlice) *studySliceIndex {
+	idx := &studySliceIndex{slices: slices, stacks: make(map[string][]*sliceStack)}
+	byKey := make(map[string]*sliceStack)
+	for _, s := range slices {
+		key := sliceStackKey(s)
+		st, ok := byKey[key]
+		if !ok {
+			st = &sliceStack{seriesUID: s.SeriesInstanceUID, normal: [3]float64{s.NormalX, s.NormalY, s.NormalZ}}
+			byKey[key] = st
+			if len(idx.stacks[s.FrameOfReferenceUID]) == 0 {
+				idx.frames = append(idx.frames, s)
+			}
+			idx.stacks[s.FrameOfReferenceUID] = append(idx.stacks[s.FrameOfReferenceUID], st)
+		}
+		st.slices = append(st.slices, s)
+		idx.maxTolerance = math.Max(idx.maxTolerance, sliceTolerance(s))
+	}
+	for _, stacks := range idx.stacks {
+		for _, st := range stacks {
+			sort.SliceStable(st.slices, func(a, b int) bool { return st.slices[a].PlaneD < st.slices[b].PlaneD })
+		}
+	}
+	return idx
+}
+
+// nearest returns the slice of frame forUID closest to the point, across
+// all orientations, or nil if the study has no slices in that frame.
+func (idx *studySliceIndex) nearest(forUID string, x, y, z float64) (*IndexedSlice, float64) {
+	var best *IndexedSlice
+	bestDist := math.Inf(1)
+	for _, st := range idx.stacks[forUID] {
+		if s, d := st.nearest(x, y, z); s != nil && d < bestDist {
+			best, bestDist = s, d
+		}
+	}
+	return best, bestDist
+}
+
+// Cached study indexes expire after sliceIndexTTL so instances that did not
+// see a rewrite themselves still pick it up, and at most sliceIndexMaxStudies
+// are kept.
+const (
+	sliceIndexTTL        = 5 * time.Minute
+	sliceIndexMaxStudies = 2000
+)
+
+type sliceIndexEntry struct {
+	index    *studySliceIndex
+	loadedAt time.Time
+}
+
+// sliceIndexCache holds study indexes in memory. Invalidation bumps a
+// generation counter so a load that raced with a rewrite is not cached.
+type sliceIndexCache struct {
+	mu         sync.Mutex
+	entries    map[string]*sliceIndexEntry
+	generation uint64
+	now        func() time.Time
+}
+
+func newSliceIndexCache() *sliceIndexCache {
+	return &sliceIndexCache{entries: make(map[string]*sliceIndexEntry), now: time.Now}
+}
+
+// get returns a fresh cached index and the generation to pass to put.
+func (c *sliceIndexCache) get(studyID string) (*studySliceIndex, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[studyID]; ok && c.now().Sub(e.loadedAt) < sliceIndexTTL {
+		return e.index, c.generation
+	}
+	return nil, c.generation
+}
+
+func (c *sliceIndexCache) put(studyID string, gen uint64, idx *studySliceIndex) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.generation {
+		return
+	}
+	if _, ok := c.entries[studyID]; !ok && len(c.entries) >= sliceIndexMaxStudies {
+		var oldestID string
+		var oldest time.Time
+		for id, e := range c.entries {
+			if oldestID == "" || e.loadedAt.Before(oldest) {
+				oldestID, oldest = id, e.loadedAt
+			}
+		}
+		delete(c.entries, oldestID)
+	}
+	c.entries[studyID] = &sliceIndexEntry{index: idx, loadedAt: c.now()}
+}
+
+func (c *sliceIndexCache) invalidate(studyID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.entries, studyID)
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: imaging_slice_index (cached)
+//
+// StudySliceIndex returns the in-memory index of a study's slices, loading
+// it from imaging_slice_index on a cache miss.
+func (db *FirestoreDB) StudySliceIndex(ctx context.Context, studyID string) (*studySliceIndex, error) {
+	idx, gen := db.sliceIndex.get(studyID)
+	if idx != nil {
+		return idx, nil
+	}
+	slices, err := db.ListIndexedSlicesForStudy(ctx, studyID)
+	if err != nil {
+		return nil, err
+	}
+	idx = buildStudySliceIndex(slices)
+	db.sliceIndex.put(studyID, gen, idx)
+	return idx, nil
+}
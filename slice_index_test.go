@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// stackSlices makes n parallel slices of frame forUID with unit normal
+// (nx, ny, nz), spaced 2.5 mm apart.
+func stackSlices(forUID string, n int, nx, ny, nz float64) []*IndexedSlice {
+	res := make([]*IndexedSlice, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, &IndexedSlice{
+			FrameOfReferenceUID: forUID,
+			SOPInstanceUID:      fmt.Sprintf("%s-%d", forUID, i),
+			InstanceNumber:      i,
+			NormalX:             nx, NormalY: ny, NormalZ: nz,
+			PlaneD: -100 + 2.5*float64(i),
+		})
+	}
+	return res
+}
+
+func TestStudySliceIndexMatchesLinearScan(t *testing.T) {
+	var slices []*IndexedSlice
+	slices = append(slices, stackSlices("A", 80, 0, 0, 1)...)
+	slices = append(slices, stackSlices("A", 30, 1, 0, 0)...)
+	slices = append(slices, stackSlices("B", 50, 0, 1, 0)...)
+	rand.New(rand.NewSource(3)).Shuffle(len(slices), func(i, j int) { slices[i], slices[j] = slices[j], slices[i] })
+	idx := buildStudySliceIndex(slices)
+
+	if len(idx.frames) != 2 {
+		t.Fatalf("frames = %d, want 2", len(idx.frames))
+	}
+
+	rng := rand.New(rand.NewSource(7))
+	for n := 0; n < 500; n++ {
+		x, y, z := rng.Float64()*300-150, rng.Float64()*300-150, rng.Float64()*300-150
+		for _, forUID := range []string{"A", "B"} {
+			_, got := idx.nearest(forUID, x, y, z)
+			want := math.Inf(1)
+			for _, s := range slices {
+				if s.FrameOfReferenceUID == forUID {
+					want = math.Min(want, distanceToSlicePlane(s, x, y, z))
+				}
+			}
+			if math.Abs(got-want) > 1e-9 {
+				t.Fatalf("nearest(%s, %v,%v,%v) distance %v, want %v", forUID, x, y, z, got, want)
+			}
+		}
+	}
+	if s, _ := idx.nearest("C", 0, 0, 0); s != nil {
+		t.Fatalf("unknown frame matched %+v", s)
+	}
+}
+
+func TestSliceIndexCacheInvalidation(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newSliceIndexCache()
+	c.now = func() time.Time { return now }
+	idx := buildStudySliceIndex(nil)
+
+	_, gen := c.get("S1")
+	c.put("S1", gen, idx)
+	if got, _ := c.get("S1"); got != idx {
+		t.Fatal("cached index not returned")
+	}
+
+	// A load that started before an invalidation must not be cached.
+	_, gen = c.get("S2")
+	c.invalidate("S1")
+	c.put("S2", gen, idx)
+	if got, _ := c.get("S2"); got != nil {
+		t.Fatal("stale load was cached")
+	}
+	if got, _ := c.get("S1"); got != nil {
+		t.Fatal("invalidated index still cached")
+	}
+
+	_, gen = c.get("S3")
+	c.put("S3", gen, idx)
+	now = now.Add(sliceIndexTTL)
+	if got, _ := c.get("S3"); got != nil {
+		t.Fatal("expired index still cached")
+	}
+}
+
+func BenchmarkStudySliceIndexNearest(b *testing.B) {
+	var slices []*IndexedSlice
+	slices = append(slices, stackSlices("A", 400, 0, 0, 1)...)
+	slices = append(slices, stackSlices("A", 200, 1, 0, 0)...)
+	slices = append(slices, stackSlices("A", 200, 0, 1, 0)...)
+	idx := buildStudySliceIndex(slices)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.nearest("A", 12.5, -40, float64(i%300)-150)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload event types emitted on the per-session event stream.
+const (
+	UploadEventStatus         = "status"          // session status transition
+	UploadEventFilesScanned   = "files_scanned"   // objects examined during validation
+	UploadEventImportProgress = "import_progress" // Healthcare import LRO counters
+	UploadEventStudyCreated   = "study_created"   // ImagingStudy document written
+	UploadEventStudyUpdated   = "study_updated"   // upload merged into an existing ImagingStudy
+)
+
+// ImportProgress mirrors the progress counters the Healthcare API reports in
+// the import operation metadata.
+type ImportProgress struct {
+	Success int64 `json:"success"`
+	Failure int64 `json:"failure"`
+	Pending int64 `json:"pending"`
+}
+
+// UploadEvent is a single progress event for an upload session.
+type UploadEvent struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+
+	Status       string `json:"status,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+
+	FilesScanned int `json:"files_scanned,omitempty"`
+
+	Import *ImportProgress `json:"import,omitempty"`
+
+	StudyID          string `json:"study_id,omitempty"`
+	StudyInstanceUID string `json:"study_instance_uid,omitempty"`
+
+	At time.Time `json:"at"`
+}
+
+// UploadEventBus fans out upload events to subscribers in this process.
+// Publishing never blocks: slow subscribers miss events rather than stall
+// the ingest worker. A nil bus is valid and drops everything.
+type UploadEventBus struct {
+	mu   sync.Mutex
+	subs map[string]map[chan UploadEvent]struct{}
+}
+
+// NewUploadEventBus creates an empty event bus.
+func NewUploadEventBus() *UploadEventBus {
+	return &UploadEventBus{subs: make(map[string]map[chan UploadEvent]struct{})}
+}
+
+// Subscribe registers for events of a session. The returned cancel func must
+// be called to release the subscription; it closes the channel.
+func (b *UploadEventBus) Subscribe(sessionID string) (<-chan UploadEvent, func()) {
+	ch := make(chan UploadEvent, 32)
+	if b == nil {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.mu.Lock()
+	if b.subs[sessionID] == nil {
+		b.subs[sessionID] = make(map[chan UploadEvent]struct{})
+	}
+	b.subs[sessionID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[sessionID], ch)
+			if len(b.subs[sessionID]) == 0 {
+				delete(b.subs, sessionID)
+			}
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish delivers ev to every current subscriber of ev.SessionID.
+func (b *UploadEventBus) Publish(ev UploadEvent) {
+	if b == nil || ev.SessionID == "" {
+		return
+	}
+	if ev.At.IsZero() {
+		ev.At = time.Now().UTC()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[ev.SessionID] {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("UploadEventBus: dropping %s event for session %s (subscriber full)", ev.Type, ev.SessionID)
+		}
+	}
+}
+
+// updateUploadSession persists session updates and, when the status changes,
+// publishes a status event for live subscribers.
+func (h *Handlers) updateUploadSession(ctx context.Context, sessionID string, updates map[string]interface{}) error {
+	if err := h.DB.UpdateUploadSessionStatus(ctx, sessionID, updates); err != nil {
+		return err
+	}
+	if st, ok := updates["status"].(string); ok {
+		ev := UploadEvent{Type: UploadEventStatus, SessionID: sessionID, Status: st}
+		if msg, ok := updates["error_message"].(string); ok {
+			ev.ErrorMessage = msg
+		}
+		h.Events.Publish(ev)
+	}
+	return nil
+}
+
+// isTerminalUploadStatus reports whether no further events are expected.
+func isTerminalUploadStatus(status string) bool {
+	return status == "ready" || status == "error"
+}
+
+// sseKeepAlive is how often a comment line is written to keep proxies from
+// closing an idle stream.
+const sseKeepAlive = 15 * time.Second
+
+// UploadSessionEventsHandler implements
+// GET /api/imaging/upload-sessions/<session_id>/events
+//
+//	Streams upload/ingest progress as Server-Sent Events to the session's
+//	owner. The current session status is sent first; the stream ends after a
+//	ready/error status.
+func (h *Handlers) UploadSessionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	const prefix = "/api/imaging/upload-sessions/"
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	sessionID := strings.TrimSuffix(rest, "/events")
+	if rest == r.URL.Path || sessionID == rest || sessionID == "" || strings.Contains(sessionID, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := h.GetUserIDFromRequest(ctx, r)
+	if err != nil {
+		log.Printf("UploadSessionEvents getUserIDFromRequest error: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthorized",
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "streaming_unsupported",
+		})
+		return
+	}
+
+	// Subscribe before reading the session so no transition is lost in between.
+	events, cancel := h.Events.Subscribe(sessionID)
+	defer cancel()
+
+	sess, err := h.DB.GetUploadSession(ctx, sessionID)
+	if err != nil {
+		log.Printf("UploadSessionEvents GetUploadSession error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "server_error",
+		})
+		return
+	}
+	// Sessions of other users are reported as missing rather than forbidden.
+	if sess == nil || sess.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "session_not_found"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	initial := UploadEvent{
+		Type:         UploadEventStatus,
+		SessionID:    sessionID,
+		Status:       sess.Status,
+		ErrorMessage: sess.ErrorMsg,
+		At:           sess.UpdatedAt,
+	}
+	if err := writeSSE(w, initial); err != nil {
+		return
+	}
+	flusher.Flush()
+	if isTerminalUploadStatus(sess.Status) {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+			if ev.Type == UploadEventStatus && isTerminalUploadStatus(ev.Status) {
+				return
+			}
+		}
+	}
+}
+
+// writeSSE writes ev as one SSE message using its type as the event name.
+func writeSSE(w http.ResponseWriter, ev UploadEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
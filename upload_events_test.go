@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUploadEventBus(t *testing.T) {
+	bus := NewUploadEventBus()
+
+	a, cancelA := bus.Subscribe("SESS-A")
+	b, cancelB := bus.Subscribe("SESS-B")
+	defer cancelB()
+
+	bus.Publish(UploadEvent{Type: UploadEventStatus, SessionID: "SESS-A", Status: "importing"})
+
+	select {
+	case ev := <-a:
+		if ev.Status != "importing" || ev.At.IsZero() {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	default:
+		t.Fatal("subscriber A did not receive its event")
+	}
+	select {
+	case ev := <-b:
+		t.Fatalf("subscriber B received event for another session: %+v", ev)
+	default:
+	}
+
+	cancelA()
+	cancelA() // idempotent
+	if _, ok := <-a; ok {
+		t.Fatal("channel not closed after cancel")
+	}
+	bus.Publish(UploadEvent{Type: UploadEventStatus, SessionID: "SESS-A", Status: "ready"})
+
+	var nilBus *UploadEventBus
+	nilBus.Publish(UploadEvent{SessionID: "SESS-A"})
+	ch, cancel := nilBus.Subscribe("SESS-A")
+	defer cancel()
+	if _, ok := <-ch; ok {
+		t.Fatal("nil bus subscription should be closed")
+	}
+}
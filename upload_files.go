@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Per-file ingest outcomes.
+const (
+	UploadFilePending   = "pending"   // validated, waiting for the import to finish
+	UploadFileImported  = "imported"  // accepted by the DICOM store
+	UploadFileDuplicate = "duplicate" // instance already existed in the DICOM store
+	UploadFileRejected  = "rejected"  // failed validation or rejected by the import
+	UploadFileUnknown   = "unknown"   // import failed and details did not mention this file
+)
+
+// UploadFile tracks a single uploaded object through ingest. Documents live in
+// the upload_files sub-collection of the owning upload session.
+type UploadFile struct {
+	ObjectName   string `firestore:"object_name" json:"object_name"`
+	SizeBytes    int64  `firestore:"size_bytes" json:"size_bytes"`
+	MD5          string `firestore:"md5" json:"md5"`       // hex, from GCS object attrs
+	CRC32C       string `firestore:"crc32c" json:"crc32c"` // hex, from GCS object attrs
+	DetectedType string `firestore:"detected_type" json:"detected_type"`
+
+	StudyInstanceUID  string `firestore:"study_instance_uid" json:"study_instance_uid"`
+	SeriesInstanceUID string `firestore:"series_instance_uid" json:"series_instance_uid"`
+	SOPInstanceUID    string `firestore:"sop_instance_uid" json:"sop_instance_uid"`
+
+	// DeidObjectName is the de-identified copy sent to the DICOM store when
+	// ingest-time de-identification is on; the UIDs above are then the
+	// remapped ones.
+	DeidObjectName string `firestore:"deid_object_name" json:"deid_object_name"`
+
+	Outcome       string    `firestore:"outcome" json:"outcome"` // pending|imported|duplicate|rejected|unknown
+	Reason        string    `firestore:"reason" json:"reason"`
+	QuarantinedTo string    `firestore:"quarantined_to" json:"quarantined_to"`
+	UpdatedAt     time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// newUploadFile builds a pending UploadFile from GCS object attributes.
+func newUploadFile(attrs *storage.ObjectAttrs) *UploadFile {
+	f := &UploadFile{
+		ObjectName: attrs.Name,
+		SizeBytes:  attrs.Size,
+		Outcome:    UploadFilePending,
+	}
+	if len(attrs.MD5) > 0 {
+		f.MD5 = hex.EncodeToString(attrs.MD5)
+	}
+	if attrs.CRC32C != 0 {
+		f.CRC32C = fmt.Sprintf("%08x", attrs.CRC32C)
+	}
+	return f
+}
+
+// uploadFileDocID derives a stable document ID from the object name. Object
+// names contain "/" which Firestore does not allow in document IDs.
+func uploadFileDocID(objectName string) string {
+	sum := sha1.Sum([]byte(objectName))
+	return hex.EncodeToString(sum[:])
+}
+
+// applyImportResult sets the final outcome of every pending file from the
+// import operation result. Files mentioned in duplicate details become
+// duplicates, files mentioned in other error details are rejected with that
+// message, and the rest are imported when the operation succeeded (or
+// unknown when it failed without naming them).
+func applyImportResult(files []*UploadFile, bucketName string, result *ImportOperationResult, importErr error) {
+	for _, f := range files {
+		if f.Outcome != UploadFilePending {
+			continue
+		}
+		if result != nil {
+			if msg, ok := findFileMention(f, bucketName, result.DuplicateMessages); ok {
+				f.Outcome = UploadFileDuplicate
+				f.Reason = msg
+				continue
+			}
+			if msg, ok := findFileMention(f, bucketName, result.ErrorMessages); ok {
+				f.Outcome = UploadFileRejected
+				f.Reason = msg
+				continue
+			}
+		}
+		if importErr != nil {
+			f.Outcome = UploadFileUnknown
+			f.Reason = importErr.Error()
+			continue
+		}
+		f.Outcome = UploadFileImported
+		f.Reason = ""
+	}
+}
+
+// storedObjectName is the object that is actually imported for f: the
+// de-identified copy if there is one, else the upload itself.
+func (f *UploadFile) storedObjectName() string {
+	if f.DeidObjectName != "" {
+		return f.DeidObjectName
+	}
+	return f.ObjectName
+}
+
+// importedBytesByStudy sums the sizes of imported files per StudyInstanceUID.
+// Duplicates are skipped since their instances were already stored.
+func importedBytesByStudy(files []*UploadFile) map[string]int64 {
+	res := make(map[string]int64)
+	for _, f := range files {
+		if f.Outcome == UploadFileImported && f.StudyInstanceUID != "" {
+			res[f.StudyInstanceUID] += f.SizeBytes
+		}
+	}
+	return res
+}
+
+// ingestedInstances returns the scanned instances whose files were imported
+// or found to be duplicates, one per SOPInstanceUID. Objects that were
+// rejected, or that were not part of this import, are left out.
+func ingestedInstances(instances []dicomInstanceInfo, files []*UploadFile) []dicomInstanceInfo {
+	ingested := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.Outcome == UploadFileImported || f.Outcome == UploadFileDuplicate {
+			ingested[f.storedObjectName()] = true
+		}
+	}
+	seen := make(map[string]bool, len(instances))
+	res := make([]dicomInstanceInfo, 0, len(instances))
+	for _, in := range instances {
+		if !ingested[in.ObjectName] || seen[in.SOPInstanceUID] {
+			continue
+		}
+		seen[in.SOPInstanceUID] = true
+		res = append(res, in)
+	}
+	return res
+}
+
+// findFileMention returns the first message that refers to f by gs:// path,
+// object name or SOPInstanceUID.
+func findFileMention(f *UploadFile, bucketName string, messages []string) (string, bool) {
+	name := f.storedObjectName()
+	gsPath := fmt.Sprintf("gs://%s/%s", bucketName, name)
+	for _, m := range messages {
+		if containsObjectName(m, gsPath) || containsObjectName(m, name) {
+			return m, true
+		}
+		if f.SOPInstanceUID != "" && containsUID(m, f.SOPInstanceUID) {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// containsUID reports whether uid occurs in s as a whole UID, i.e. not as
+// the prefix or suffix of a longer one such as uid+".1" or "1"+uid.
+func containsUID(s, uid string) bool {
+	isUIDChar := func(c byte) bool { return c == '.' || (c >= '0' && c <= '9') }
+	return containsWhole(s, uid, isUIDChar)
+}
+
+// containsObjectName reports whether name occurs in s as a whole object name
+// or path, i.e. not as part of a longer one such as name+".bak" or
+// "other/"+name.
+func containsObjectName(s, name string) bool {
+	isNameChar := func(c byte) bool {
+		return strings.IndexByte("._-/", c) >= 0 ||
+			(c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+	return containsWhole(s, name, isNameChar)
+}
+
+// containsWhole reports whether sub occurs in s with no isPart character
+// directly before or after it.
+func containsWhole(s, sub string, isPart func(c byte) bool) bool {
+	if sub == "" {
+		return false
+	}
+	for i := 0; ; {
+		j := strings.Index(s[i:], sub)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(sub)
+		if (start == 0 || !isPart(s[start-1])) && (end == len(s) || !isPart(s[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// ////////////////////////////////////
+//
+//	Extending FirestoreDB - table: upload_sessions/{id}/upload_files
+//
+// UpsertUploadFiles writes per-file records for a session in batches.
+func (db *FirestoreDB) UpsertUploadFiles(ctx context.Context, sessionID string, files []*UploadFile) error {
+	if strings.TrimSpace(sessionID) == "" {
+		return fmt.Errorf("empty sessionID")
+	}
+	col := db.client.Collection("upload_sessions").Doc(sessionID).Collection("upload_files")
+	now := time.Now().UTC()
+
+	const batchSize = 400
+	for i := 0; i < len(files); i += batchSize {
+		end := i + batchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		b := db.client.Batch()
+		for _, f := range files[i:end] {
+			f.UpdatedAt = now
+			b.Set(col.Doc(uploadFileDocID(f.ObjectName)), f)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return fmt.Errorf("write upload files batch (%s): %w", sessionID, err)
+		}
+	}
+	return nil
+}
+
+// ListUploadFiles returns all per-file records for a session ordered by
+// object name.
+func (db *FirestoreDB) ListUploadFiles(ctx context.Context, sessionID string) ([]*UploadFile, error) {
+	col := db.client.Collection("upload_sessions").Doc(sessionID).Collection("upload_files")
+	iter := col.Documents(ctx)
+	defer iter.Stop()
+
+	var res []*UploadFile
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list upload files (%s): %w", sessionID, err)
+		}
+		var f UploadFile
+		if err := doc.DataTo(&f); err != nil {
+			return nil, fmt.Errorf("decode upload file (%s): %w", doc.Ref.ID, err)
+		}
+		res = append(res, &f)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ObjectName < res[j].ObjectName })
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestApplyImportResult(t *testing.T) {
+	newFiles := func() []*UploadFile {
+		return []*UploadFile{
+			{ObjectName: "up/a.dcm", SOPInstanceUID: "1.2.3.1", Outcome: UploadFilePending},
+			{ObjectName: "up/b.dcm", SOPInstanceUID: "1.2.3.2", Outcome: UploadFilePending},
+			{ObjectName: "up/c.dcm", SOPInstanceUID: "1.2.3.3", Outcome: UploadFilePending},
+			{ObjectName: "up/d.pdf", Outcome: UploadFileRejected, Reason: "not_dicom:application/pdf"},
+		}
+	}
+
+	files := newFiles()
+	result := &ImportOperationResult{
+		DuplicateMessages: []string{"instance 1.2.3.1 already exists"},
+		ErrorMessages:     []string{"gs://bkt/up/b.dcm: invalid pixel data"},
+	}
+	applyImportResult(files, "bkt", result, errors.New("dicom import failed"))
+
+	want := []string{UploadFileDuplicate, UploadFileRejected, UploadFileUnknown, UploadFileRejected}
+	for i, f := range files {
+		if f.Outcome != want[i] {
+			t.Errorf("%s: outcome = %q, want %q", f.ObjectName, f.Outcome, want[i])
+		}
+	}
+	if files[1].Reason != "gs://bkt/up/b.dcm: invalid pixel data" {
+		t.Errorf("rejected reason = %q", files[1].Reason)
+	}
+	if files[3].Reason != "not_dicom:application/pdf" {
+		t.Errorf("validation reason overwritten: %q", files[3].Reason)
+	}
+
+	files = newFiles()
+	applyImportResult(files, "bkt", &ImportOperationResult{}, nil)
+	for _, f := range files[:3] {
+		if f.Outcome != UploadFileImported {
+			t.Errorf("%s: outcome = %q, want imported", f.ObjectName, f.Outcome)
+		}
+	}
+}
+
+func TestFindFileMentionMatchesWholeUID(t *testing.T) {
+	f := &UploadFile{ObjectName: "up/a.dcm", SOPInstanceUID: "1.2.3.1"}
+	for msg, want := range map[string]bool{
+		"instance 1.2.3.1 already exists":    true,
+		"instance 1.2.3.1: bad header":       true,
+		"uid=1.2.3.1":                        true,
+		"1.2.3.1":                            true,
+		"instance 1.2.3.10 already exists":   false,
+		"instance 1.2.3.1.5 already exists":  false,
+		"instance 11.2.3.1 already exists":   false,
+		"seen 1.2.3.12 and then 1.2.3.1 too": true,
+	} {
+		if _, got := findFileMention(f, "bkt", []string{msg}); got != want {
+			t.Errorf("findFileMention(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestFindFileMentionMatchesWholeObjectName(t *testing.T) {
+	f := &UploadFile{ObjectName: "up/a.dcm"}
+	for msg, want := range map[string]bool{
+		"gs://bkt/up/a.dcm: invalid pixel data":     true,
+		"file up/a.dcm rejected":                    true,
+		`"up/a.dcm"`:                                true,
+		"gs://bkt/up/a.dcm.bak: invalid pixel data": false,
+		"file up/a.dcm.bak rejected":                false,
+		"file up/a.dcm2 rejected":                   false,
+		"gs://bkt/backup/up/a.dcm: bad header":      false,
+		"gs://bkt2/up/a.dcm: bad header":            false,
+	} {
+		if _, got := findFileMention(f, "bkt", []string{msg}); got != want {
+			t.Errorf("findFileMention(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestIngestedInstances(t *testing.T) {
+	files := []*UploadFile{
+		{ObjectName: "up/a.dcm", Outcome: UploadFileImported},
+		{ObjectName: "up/b.dcm", Outcome: UploadFileDuplicate},
+		{ObjectName: "up/c.dcm", Outcome: UploadFileRejected},
+		{ObjectName: "up/d.dcm", DeidObjectName: "deid/d.dcm", Outcome: UploadFileImported},
+		{ObjectName: "up/e.dcm", Outcome: UploadFileImported},
+	}
+	instances := []dicomInstanceInfo{
+		{ObjectName: "up/a.dcm", SOPInstanceUID: "1.1"},
+		{ObjectName: "up/b.dcm", SOPInstanceUID: "1.2"},
+		{ObjectName: "up/c.dcm", SOPInstanceUID: "1.3"},
+		{ObjectName: "deid/d.dcm", SOPInstanceUID: "1.4"},
+		{ObjectName: "up/e.dcm", SOPInstanceUID: "1.1"}, // same instance sent twice
+		{ObjectName: "up/late.dcm", SOPInstanceUID: "1.5"},
+	}
+
+	got := ingestedInstances(instances, files)
+	var uids []string
+	for _, in := range got {
+		uids = append(uids, in.SOPInstanceUID)
+	}
+	if want := "1.1,1.2,1.4"; strings.Join(uids, ",") != want {
+		t.Fatalf("ingested SOP UIDs = %v, want %s", uids, want)
+	}
+}